@@ -0,0 +1,156 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+// ParamValue is a value of a parameter which can be any JSON value: string, number, boolean, array or object.
+// String and integer values are kept in IntOrString as before, and the others are kept in Raw.
+// +kubebuilder:validation:Type=""
+// +kubebuilder:validation:XPreserveUnknownFields
+type ParamValue struct {
+	intstr.IntOrString `json:"-"`
+	// Raw is the JSON encoding of a value which is neither a string nor a 32-bit integer
+	Raw []byte `json:"-"`
+	// Given is false if the value is missing or null, which is decoded to the zero value
+	Given bool `json:"-"`
+}
+
+// FromString creates a ParamValue of a string
+func FromString(val string) ParamValue {
+	return ParamValue{IntOrString: intstr.FromString(val), Given: true}
+}
+
+// FromInt creates a ParamValue of an integer
+func FromInt(val int) ParamValue {
+	return ParamValue{IntOrString: intstr.FromInt(val), Given: true}
+}
+
+// FromIntOrString creates a ParamValue of a string or an integer
+func FromIntOrString(val intstr.IntOrString) ParamValue {
+	return ParamValue{IntOrString: val, Given: true}
+}
+
+// FromValue creates a ParamValue of any value which can be encoded to JSON
+func FromValue(val interface{}) (ParamValue, error) {
+	raw, err := json.Marshal(val)
+	if err != nil {
+		return ParamValue{}, err
+	}
+	v := ParamValue{}
+	if err := v.UnmarshalJSON(raw); err != nil {
+		return ParamValue{}, err
+	}
+	return v, nil
+}
+
+// UnmarshalJSON implements the json.Unmarshaller interface.
+func (v *ParamValue) UnmarshalJSON(value []byte) error {
+	trimmed := bytes.TrimSpace(value)
+	*v = ParamValue{}
+	if len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) {
+		return nil
+	}
+	v.Given = true
+	if trimmed[0] == '"' {
+		return v.IntOrString.UnmarshalJSON(trimmed)
+	}
+	var intVal int32
+	if err := json.Unmarshal(trimmed, &intVal); err == nil {
+		v.IntOrString = intstr.FromInt(int(intVal))
+		return nil
+	}
+	if !json.Valid(trimmed) {
+		return fmt.Errorf("invalid parameter value: %s", trimmed)
+	}
+	v.Raw = append([]byte{}, trimmed...)
+	return nil
+}
+
+// MarshalJSON implements the json.Marshaller interface.
+func (v ParamValue) MarshalJSON() ([]byte, error) {
+	if v.Raw != nil {
+		return v.Raw, nil
+	}
+	if !v.IsSet() {
+		return []byte("null"), nil
+	}
+	return v.IntOrString.MarshalJSON()
+}
+
+// IsSet reports whether the value is given, so an integer 0 is told apart from a missing value
+func (v ParamValue) IsSet() bool {
+	return v.Given || v.Raw != nil || v.IntOrString != (intstr.IntOrString{})
+}
+
+// IsRaw reports whether the value is neither a string nor a 32-bit integer
+func (v ParamValue) IsRaw() bool {
+	return v.Raw != nil
+}
+
+// Interface returns the value as string, int32, int64, float64, bool, []interface{} or map[string]interface{}
+func (v ParamValue) Interface() interface{} {
+	if v.Raw == nil {
+		if v.Type == intstr.Int {
+			return v.IntVal
+		}
+		return v.StrVal
+	}
+	decoder := json.NewDecoder(bytes.NewReader(v.Raw))
+	decoder.UseNumber()
+	var out interface{}
+	if err := decoder.Decode(&out); err != nil {
+		return string(v.Raw)
+	}
+	return fromNumber(out)
+}
+
+// String returns the string of a string value, and the JSON encoding of the others.
+func (v ParamValue) String() string {
+	if v.Raw != nil {
+		return string(v.Raw)
+	}
+	return v.IntOrString.String()
+}
+
+// fromNumber converts json.Number in the decoded value to int64 or float64
+func fromNumber(val interface{}) interface{} {
+	switch typed := val.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(typed.String(), 10, 64); err == nil {
+			return i
+		}
+		f, _ := typed.Float64()
+		return f
+	case []interface{}:
+		for idx := range typed {
+			typed[idx] = fromNumber(typed[idx])
+		}
+	case map[string]interface{}:
+		for key := range typed {
+			typed[key] = fromNumber(typed[key])
+		}
+	}
+	return val
+}
@@ -17,6 +17,7 @@ limitations under the License.
 package v1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/util/intstr"
@@ -107,17 +108,90 @@ type ParamSpec struct {
 	Required bool `json:"required,omitempty"`
 	// A default value for the parameter which will be used if the user does not override the value when instantiating the template.
 	// Avoid using default values for things like passwords, instead use generated parameters in combination with Secrets.
-	Value intstr.IntOrString `json:"value,omitempty"`
+	// The value can be a string, number, boolean, array or object according to the value type.
+	Value ParamValue `json:"value,omitempty"`
+	// Source of the value of the parameter, read when the objects of the template instance are rendered.
+	// It can be used only in parameters of the template instance.
+	// +optional
+	ValueFrom *ParamValueSource `json:"valueFrom,omitempty"`
+	// Generate the value of the parameter when the template is instantiated.
+	// The value is generated once per template instance and stored in a secret owned by the instance, so it is not changed by updates.
+	// It is used unless the template instance gives a value.
+	// +optional
+	Generate *GenerateSpec `json:"generate,omitempty"`
+	// Sensitive parameters are redacted from logs and status of the template instance.
+	// Parameters whose values are taken from secrets or generated are always sensitive.
+	// +optional
+	Sensitive bool `json:"sensitive,omitempty"`
 	// Set the data type of the parameter.
-	// You can specify string and number for a string or integer type.
+	// You can specify string, number (integer or float), integer, boolean, array, object and secretRef.
+	// The value of secretRef is an object of a secret name and an optional key of the secret in the namespace of the template instance.
 	// If not specified, it defaults to string.
-	// +kubebuilder:validation:Enum:=string;number
+	// +kubebuilder:validation:Enum:=string;number;integer;boolean;array;object;secretRef
 	ValueType string `json:"valueType,omitempty"`
+	// JSON schema to validate the value with.
+	// Keywords type, enum, minimum, maximum, exclusiveMinimum, exclusiveMaximum, minLength, maxLength, pattern,
+	// items, minItems, maxItems, uniqueItems, properties, required and additionalProperties are supported.
+	// +optional
+	// +kubebuilder:validation:XPreserveUnknownFields
+	Schema *runtime.RawExtension `json:"schema,omitempty"`
 	// Set the "regex" value for the parameter value.
 	// Given "regex" is used to validate parameter value from template instance.
 	Regex string `json:"regex,omitempty"`
 }
 
+// ParamValueSource selects a key of a secret or a config map in the namespace of the template instance.
+// Only one of the fields must be set.
+type ParamValueSource struct {
+	// Selects a key of a secret
+	// +optional
+	SecretKeyRef *corev1.SecretKeySelector `json:"secretKeyRef,omitempty"`
+	// Selects a key of a config map
+	// +optional
+	ConfigMapKeyRef *corev1.ConfigMapKeySelector `json:"configMapKeyRef,omitempty"`
+}
+
+// GenerateSpec describes how the value of a parameter is generated
+type GenerateSpec struct {
+	// Type of the generated value.
+	// random generates a random string of the charset, and uuid generates a random UUID.
+	// +kubebuilder:validation:Enum:=random;uuid
+	Type string `json:"type"`
+	// Length of the random string, at most 256. If not specified, it defaults to 16.
+	// +optional
+	// +kubebuilder:validation:Minimum:=1
+	// +kubebuilder:validation:Maximum:=256
+	Length int `json:"length,omitempty"`
+	// Characters of the random string. If not specified, it defaults to alphanumeric characters.
+	// +optional
+	Charset string `json:"charset,omitempty"`
+}
+
+// OutputSpec declares a value taken from objects created by the template
+type OutputSpec struct {
+	// Name of the value
+	Name string `json:"name"`
+	// Object created by the template to take the value from.
+	// Parameters can be referenced in the name of the object. ex) ${NAME}-db
+	// +optional
+	ObjectRef *OutputObjectRef `json:"objectRef,omitempty"`
+	// JSONPath expression of the value in the object. ex) {.spec.clusterIP}
+	// Outputs of the instance cannot be taken from Secrets. Only credentials given to template bindings can read Secrets,
+	// and their data is decoded before evaluation, so {.data.password} is the plain value.
+	// +optional
+	JSONPath string `json:"jsonPath,omitempty"`
+	// Value with parameter references, used instead of objectRef. ex) ${USER}
+	// +optional
+	Value string `json:"value,omitempty"`
+}
+
+type OutputObjectRef struct {
+	// +optional
+	APIVersion string `json:"apiVersion,omitempty"`
+	Kind       string `json:"kind"`
+	Name       string `json:"name"`
+}
+
 type LabelSpec struct {
 	AdditionalProperties string `json:"additionalProperties,omitempty"`
 }
@@ -125,6 +199,11 @@ type LabelSpec struct {
 // TemplateSpec defines the desired state of Template
 // +kubebuilder:resource:shortName="tp"
 type TemplateSpec struct {
+	// Version of the template.
+	// A new revision is recorded whenever the version changes, and template instances can pin or upgrade to a version.
+	// Objects and parameters must not be changed without changing the version once the version is released.
+	// +optional
+	Version string `json:"version,omitempty"`
 	// Templates can include a set of labels.
 	// These labels will be added to each object created when the template is instantiated.
 	// Defining a label in this way makes it easy for users to find and manage all the objects created from a particular template.
@@ -173,9 +252,22 @@ type TemplateSpec struct {
 	// The object will be created exactly as defined here, with any parameter values substituted in prior to creation.
 	// The definition of these objects can reference parameters defined earlier.
 	Objects []runtime.RawExtension `json:"objects,omitempty"`
-	Object  []string               `json:"object,omitempty"`
+	// Object is a list of objects written in go template, rendered with parameters (e.g. {{ .NAME }}) when the template is instantiated.
+	// Metadata of the instance is given as .Instance (Name, Namespace, UID, Labels, Annotations),
+	// and functions such as default, required, quote, toYaml, toJson, b64enc and randAlphaNum can be used.
+	// Values of randAlphaNum, randAlpha and randNumeric are predictable, so secrets should be generated by the generate field of parameters.
+	// Rendered objects are created together with objects. The same object must not be defined in both fields.
+	Object []string `json:"object,omitempty"`
 	// Service plan information to be used in the service catalog.
 	Plans []PlanSpec `json:"plans,omitempty"`
+	// Credentials are given to template bindings of the instances of the template in a secret.
+	// The name of each credential is used as the key of the secret.
+	// +optional
+	Credentials []OutputSpec `json:"credentials,omitempty"`
+	// Outputs are resolved when objects of the instance are ready, and published in the status of the instance.
+	// They cannot be taken from Secrets, which are given to template bindings by credentials.
+	// +optional
+	Outputs []OutputSpec `json:"outputs,omitempty"`
 	// Parameters allow a value to be supplied by the user or generated when the template is instantiated.
 	// Then, that value is substituted wherever the parameter is referenced.
 	// References can be defined in any field in the objects list field.
@@ -191,6 +283,10 @@ type TemplateStatus struct {
 	Reason string `json:"reason,omitempty"`
 	// Status indicates the status of the template.
 	Status TemplateStatusType `json:"status,omitempty"`
+	// ObservedGeneration is the generation of the template which the status is updated with
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// LatestRevision is the name of the revision created from the current template
+	LatestRevision string `json:"latestRevision,omitempty"`
 }
 
 // +kubebuilder:object:root=true
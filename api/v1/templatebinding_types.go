@@ -0,0 +1,81 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type BindingStatusType string
+
+const (
+	BindingReady   BindingStatusType = "Ready"
+	BindingWaiting BindingStatusType = "Waiting"
+	BindingError   BindingStatusType = "Error"
+)
+
+// TemplateBindingSpec defines the desired state of TemplateBinding
+type TemplateBindingSpec struct {
+	// Name of the template instance to bind in the same namespace
+	TemplateInstance string `json:"templateInstance"`
+	// Name of the secret which credentials of the instance are stored in.
+	// If not specified, it defaults to the name of the binding.
+	// +optional
+	SecretName string `json:"secretName,omitempty"`
+}
+
+// TemplateBindingStatus defines the observed state of TemplateBinding
+type TemplateBindingStatus struct {
+	// Status indicates whether the secret is ready
+	// +kubebuilder:validation:Enum:=Ready;Waiting;Error
+	Status BindingStatusType `json:"status,omitempty"`
+	// Message describes the status of the binding
+	Message string `json:"message,omitempty"`
+	// SecretName is the name of the secret populated with credentials
+	SecretName string `json:"secretName,omitempty"`
+	// LastTransitionTime is the last time the status changed
+	LastTransitionTime *metav1.Time `json:"lastTransitionTime,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:path=templatebindings,scope=Namespaced,shortName="tb"
+// +kubebuilder:printcolumn:name="INSTANCE",type="string",JSONPath=".spec.templateInstance"
+// +kubebuilder:printcolumn:name="SECRET",type="string",JSONPath=".status.secretName"
+// +kubebuilder:printcolumn:name="STATUS",type="string",JSONPath=".status.status"
+
+// TemplateBinding is the Schema for the templatebindings API
+type TemplateBinding struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   TemplateBindingSpec   `json:"spec,omitempty"`
+	Status TemplateBindingStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// TemplateBindingList contains a list of TemplateBinding
+type TemplateBindingList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TemplateBinding `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&TemplateBinding{}, &TemplateBindingList{})
+}
@@ -24,36 +24,232 @@ import (
 // EDIT THIS FILE!  THIS IS SCAFFOLDING FOR YOU TO OWN!
 // NOTE: json tags are required.  Any new fields you add must have json tags for the fields to be serialized.
 
+type SyncPolicyType string
+
+const (
+	// Drift of created objects is only reported in status
+	SyncPolicyManual SyncPolicyType = "Manual"
+	// Drifted or deleted objects are re-applied with the rendered state
+	SyncPolicyAutoHeal SyncPolicyType = "AutoHeal"
+)
+
+type GitopsStrategyType string
+
+const (
+	// Commits are pushed to the branch of the gitops repo
+	GitopsStrategyDirect GitopsStrategyType = "Direct"
+	// Each commit is pushed to a new branch created from the branch of the gitops repo
+	GitopsStrategyBranchPerChange GitopsStrategyType = "BranchPerChange"
+)
+
+type HealthStatusType string
+
+const (
+	HealthHealthy     HealthStatusType = "Healthy"
+	HealthProgressing HealthStatusType = "Progressing"
+	HealthDegraded    HealthStatusType = "Degraded"
+	HealthMissing     HealthStatusType = "Missing"
+)
+
+const (
+	// ConditionTypeSynced indicates whether created objects match the rendered template
+	ConditionTypeSynced = "Synced"
+	// ConditionTypeReady indicates whether every created object is healthy
+	ConditionTypeReady = "Ready"
+	// ConditionTypeOutputsResolved indicates whether every output of the template is resolved
+	ConditionTypeOutputsResolved = "OutputsResolved"
+	// ConditionTypeHooksSucceeded indicates whether the hooks of the last phase have succeeded
+	ConditionTypeHooksSucceeded = "HooksSucceeded"
+	// ConditionTypeRolledBack indicates whether the objects were restored because applying them failed
+	ConditionTypeRolledBack = "RolledBack"
+	// ConditionTypeConflicted indicates whether applying objects conflicts with the fields managed by others
+	ConditionTypeConflicted = "Conflicted"
+	// ConditionTypePushed indicates whether the rendered objects of the generation are pushed to the gitops repo
+	ConditionTypePushed = "Pushed"
+)
+
+type HookPhaseType string
+
+const (
+	// Hooks run before the objects are created
+	HookPreInstall HookPhaseType = "pre-install"
+	// Hooks run after the created objects are ready
+	HookPostInstall HookPhaseType = "post-install"
+	// Hooks run before the objects are updated with the changed spec
+	HookPreUpgrade HookPhaseType = "pre-upgrade"
+	// Hooks run before the objects are deleted with the instance
+	HookPreDelete HookPhaseType = "pre-delete"
+)
+
+type HookStatusType string
+
+const (
+	HookRunning   HookStatusType = "Running"
+	HookSucceeded HookStatusType = "Succeeded"
+	HookFailed    HookStatusType = "Failed"
+)
+
 type MetadataSpec struct {
 	Name string `json:"name,omitempty"`
 }
 
 type ObjectInfo struct {
-	Metadata   MetadataSpec           `json:"metadata,omitempty"`
+	Metadata MetadataSpec `json:"metadata,omitempty"`
+	// Version of the template.
+	// In spec, the instance is pinned or upgraded to the revision of the version.
+	// In status, it is the version of the template deployed by the instance.
+	Version string `json:"version,omitempty"`
+	// Name of the plan of the template.
+	// In spec, values of the plan are used as defaults of the parameters, and can be overridden by parameters of the instance.
+	// The plan can be changed only if the active plan is updateable.
+	// In status, it is the active plan of the instance.
+	Plan       string                 `json:"plan,omitempty"`
 	Objects    []runtime.RawExtension `json:"objects,omitempty"`
 	Object     []string               `json:"object,omitempty"`
 	Parameters []ParamSpec            `json:"parameters,omitempty"`
+	// Plans of the template deployed by the instance.
+	// Populated by the system in status.
+	Plans []PlanSpec `json:"plans,omitempty"`
+	// Credentials of the template deployed by the instance.
+	// Populated by the system in status.
+	Credentials []OutputSpec `json:"credentials,omitempty"`
+	// Outputs of the template deployed by the instance.
+	// Populated by the system in status.
+	Outputs []OutputSpec `json:"outputs,omitempty"`
 }
 
 // +kubebuilder:resource:shortName="ti"
 // TemplateInstanceSpec defines the desired state of TemplateInstance
-// Important: Use only one of the fields Template and ClusterTemplate. Fill in only metadata.name and parameters inside this field.
+// Important: Use only one of the fields Template and ClusterTemplate. Fill in only metadata.name, version, plan and parameters inside this field.
 type TemplateInstanceSpec struct {
 	// +kubebuilder:validation:OneOf [TODO: 나중에 추가할것]
 	Template *ObjectInfo `json:"template,omitempty"`
 	// +kubebuilder:validation:OneOf [TODO: 나중에 추가할것]
 	ClusterTemplate *ObjectInfo `json:"clustertemplate,omitempty"`
-	// Spec for Application CR
+	// Gitops makes the instance commit the rendered objects to the git repo instead of creating them in the cluster
 	Gitops GitopsSpec `json:"gitops,omitempty"`
+	// SyncPolicy decides what to do when objects created by the instance drift from the rendered template.
+	// Manual only reports the drift and AutoHeal re-applies the rendered objects.
+	// If not specified, it defaults to Manual.
+	// +kubebuilder:validation:Enum:=Manual;AutoHeal
+	// +optional
+	SyncPolicy SyncPolicyType `json:"syncPolicy,omitempty"`
+	// ForceConflicts takes the ownership of the fields managed by others when the objects are applied.
+	// Otherwise applying the fields managed by others fails, and the conflict is reported in the Conflicted condition.
+	// +optional
+	ForceConflicts bool `json:"forceConflicts,omitempty"`
+	// RollbackTo is the revision in status.history to roll back to.
+	// The template version, plan and parameters of the revision are restored in spec and applied as a new revision,
+	// and the field is cleared.
+	// +optional
+	RollbackTo int64 `json:"rollbackTo,omitempty"`
+	// RevisionHistoryLimit is the number of revisions kept in status.history.
+	// If not specified, it defaults to 10.
+	// +kubebuilder:validation:Minimum:=0
+	// +optional
+	RevisionHistoryLimit *int32 `json:"revisionHistoryLimit,omitempty"`
 }
 
+// GitopsSpec is the git repo which the rendered objects are committed to.
+// The objects are written under {path}/{instance name} of the branch in a single commit per generation of the instance,
+// and the files are removed when the instance is deleted.
 type GitopsSpec struct {
-	// Git repo. ex)https://github.com/user/repo
+	// Git repo. ex)https://github.com/user/repo, git@github.com:user/repo.git
 	SourceGitRepo string `json:"sourcegitrepo,omitempty"`
 	// Git repo directory
 	Path string `json:"path,omitempty"`
-	// Secret name which contains user credentials
+	// Secret name which contains user credentials.
+	// kubernetes.io/basic-auth secrets are used for http(s) repos and kubernetes.io/ssh-auth secrets (with optional known_hosts key) for ssh repos.
+	// Opaque secrets may have username and token keys, or ssh-privatekey and known_hosts keys.
 	Secret string `json:"secret,omitempty"`
+	// Branch is the branch which the objects are committed to, or which change branches are created from.
+	// If not specified, it defaults to main.
+	// +optional
+	Branch string `json:"branch,omitempty"`
+	// Author of the commits. If not specified, the name is template-operator and the email is the username of the credentials.
+	// +optional
+	Author GitopsAuthorSpec `json:"author,omitempty"`
+	// CommitMessage is a go template of the commit message, rendered with .Action (Update or Remove), .Namespace, .Name and .Generation of the instance.
+	// If not specified, it defaults to "{{ .Action }} {{ .Namespace }}/{{ .Name }} (generation {{ .Generation }})".
+	// +optional
+	CommitMessage string `json:"commitMessage,omitempty"`
+	// Strategy decides where the commits are pushed. Direct pushes the commits to the branch,
+	// and BranchPerChange pushes each commit to a new branch created from the branch to be reviewed and merged.
+	// If not specified, it defaults to Direct.
+	// +kubebuilder:validation:Enum:=Direct;BranchPerChange
+	// +optional
+	Strategy GitopsStrategyType `json:"strategy,omitempty"`
+	// ChangeBranchPrefix is the prefix of the branches created by BranchPerChange strategy,
+	// which are named {prefix}/{namespace}/{name}-{generation}, or {prefix}/{namespace}/{name}-removed for removal of the files.
+	// If not specified, it defaults to template-operator.
+	// +optional
+	ChangeBranchPrefix string `json:"changeBranchPrefix,omitempty"`
+	// CABundle is a PEM encoded CA bundle used to verify the TLS certificate of the repo, in addition to the system certificates
+	// +optional
+	CABundle []byte `json:"caBundle,omitempty"`
+	// InsecureSkipTLSVerify skips verification of the TLS certificate of the repo
+	// +optional
+	InsecureSkipTLSVerify bool `json:"insecureSkipTLSVerify,omitempty"`
+	// Application is the Argo CD Application created to deploy the committed objects from the repo.
+	// Sync and health status of the Application are reflected in Synced and Ready conditions of the instance.
+	// The Application is not created if not specified.
+	// +optional
+	Application *GitopsApplicationSpec `json:"application,omitempty"`
+}
+
+type GitopsApplicationSpec struct {
+	// Name of the Application. If not specified, it defaults to {namespace}-{name} of the instance.
+	// +optional
+	Name string `json:"name,omitempty"`
+	// Namespace of the Application, which Argo CD watches Applications in. If not specified, it defaults to argocd.
+	// It can be changed only if the operator allows overriding Applications.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+	// Project of the Application. If not specified, it defaults to default.
+	// It can be changed only if the operator allows overriding Applications.
+	// +optional
+	Project string `json:"project,omitempty"`
+	// Destination is the cluster and namespace which the objects are deployed to.
+	// If not specified, the objects are deployed to the namespace of the instance in the cluster which Argo CD runs in.
+	// It can be changed only if the operator allows overriding Applications.
+	// +optional
+	Destination GitopsDestinationSpec `json:"destination,omitempty"`
+	// Automated syncs the Application whenever the objects are committed. The Application is synced manually if not specified.
+	// +optional
+	Automated *GitopsAutomatedSyncSpec `json:"automated,omitempty"`
+}
+
+type GitopsDestinationSpec struct {
+	// Server is the URL of the API server of the cluster. If neither server nor name is specified, it defaults to https://kubernetes.default.svc.
+	Server string `json:"server,omitempty"`
+	// Name is the name of the cluster registered in Argo CD, which is used instead of server
+	Name string `json:"name,omitempty"`
+	// Namespace which the objects without namespace are deployed to. If not specified, it defaults to the namespace of the instance.
+	Namespace string `json:"namespace,omitempty"`
+}
+
+type GitopsAutomatedSyncSpec struct {
+	// Prune deletes the objects which are not committed anymore
+	Prune bool `json:"prune,omitempty"`
+	// SelfHeal reverts the objects changed in the cluster to the committed state
+	SelfHeal bool `json:"selfHeal,omitempty"`
+}
+
+type GitopsAuthorSpec struct {
+	Name  string `json:"name,omitempty"`
+	Email string `json:"email,omitempty"`
+}
+
+// GitopsStatusSpec is the commit which the rendered objects were pushed with
+type GitopsStatusSpec struct {
+	// GitopsSpec is the repo which the objects were committed to, and the files are removed from it when the instance is deleted
+	GitopsSpec `json:",inline"`
+	// PushedBranch is the branch which the commit was pushed to
+	PushedBranch string `json:"pushedBranch,omitempty"`
+	// Commit is the SHA of the commit which contains the rendered objects
+	Commit string `json:"commit,omitempty"`
+	// CommittedTime is the time when the objects were committed
+	CommittedTime *metav1.Time `json:"committedTime,omitempty"`
 }
 
 type RefSpec struct {
@@ -66,8 +262,51 @@ type RefSpec struct {
 	Uid             string `json:"uid,omitempty"`
 }
 
+type HealthSpec struct {
+	// Status is the health of the object.
+	// +kubebuilder:validation:Enum:=Healthy;Progressing;Degraded;Missing
+	Status HealthStatusType `json:"status,omitempty"`
+	// Message describes why the object is not healthy
+	Message string `json:"message,omitempty"`
+}
+
 type StatusObjectSpec struct {
 	Ref RefSpec `json:"ref"`
+	// Health assessed from the live state of the object
+	Health HealthSpec `json:"health,omitempty"`
+}
+
+type HookStatusSpec struct {
+	// Phase of the instance lifecycle which the hook ran at
+	Phase HookPhaseType `json:"phase"`
+	Ref   RefSpec       `json:"ref"`
+	// Generation of the instance which the hook ran for
+	Generation int64 `json:"generation,omitempty"`
+	// +kubebuilder:validation:Enum:=Running;Succeeded;Failed
+	Status  HookStatusType `json:"status,omitempty"`
+	Message string         `json:"message,omitempty"`
+	// LastTransitionTime is the time when the status of the hook was changed
+	LastTransitionTime *metav1.Time `json:"lastTransitionTime,omitempty"`
+}
+
+// InstanceRevisionSpec is a render of the instance whose objects were applied successfully
+type InstanceRevisionSpec struct {
+	// Revision is the sequence number of the revision
+	Revision int64 `json:"revision"`
+	// Generation of the instance which the revision was applied with
+	Generation int64 `json:"generation,omitempty"`
+	// Version of the template which the revision was rendered from
+	Version string `json:"version,omitempty"`
+	// TemplateRevision is the name of the template revision which the revision was rendered from
+	TemplateRevision string `json:"templateRevision,omitempty"`
+	// Plan of the template which the revision was rendered with
+	Plan string `json:"plan,omitempty"`
+	// Parameters of the instance which the revision was rendered with
+	Parameters []ParamSpec `json:"parameters,omitempty"`
+	// Digest is the SHA-256 digest of the rendered objects
+	Digest string `json:"digest,omitempty"`
+	// DeployedTime is the time when the objects of the revision were applied
+	DeployedTime *metav1.Time `json:"deployedTime,omitempty"`
 }
 
 type ConditionSpec struct {
@@ -84,6 +323,20 @@ type TemplateInstanceStatus struct {
 	Objects         []StatusObjectSpec `json:"objects,omitempty"`
 	Template        *ObjectInfo        `json:"template,omitempty"`
 	ClusterTemplate *ObjectInfo        `json:"clustertemplate,omitempty"`
+	// ObservedGeneration is the generation of the spec which the created objects were applied with
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// DriftedObjects lists created objects which were modified or deleted after being applied
+	DriftedObjects []RefSpec `json:"driftedObjects,omitempty"`
+	// TemplateRevision is the name of the template revision deployed by the instance
+	TemplateRevision string `json:"templateRevision,omitempty"`
+	// Outputs are values of the outputs of the template, resolved after the objects are ready
+	Outputs map[string]string `json:"outputs,omitempty"`
+	// Hooks are the results of the hook objects of the template which have run
+	Hooks []HookStatusSpec `json:"hooks,omitempty"`
+	// History is the list of the latest revisions of the instance, in ascending order
+	History []InstanceRevisionSpec `json:"history,omitempty"`
+	// Gitops is the last commit of the rendered objects, if the instance is in gitops mode
+	Gitops *GitopsStatusSpec `json:"gitops,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -0,0 +1,62 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// TemplateRevisionSpec is an immutable snapshot of a template
+type TemplateRevisionSpec struct {
+	// Name of the template which the revision is created from
+	TemplateName string `json:"templateName"`
+	// Version of the template
+	Version string `json:"version,omitempty"`
+	// Revision number which is increased for every new revision of the template
+	Revision int64 `json:"revision"`
+	// Hash of objects and parameters of the template
+	Hash string `json:"hash,omitempty"`
+	// Template is the snapshot of the template spec
+	Template TemplateSpec `json:"template"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:path=templaterevisions,scope=Namespaced,shortName="tr"
+// +kubebuilder:printcolumn:name="TEMPLATE",type="string",JSONPath=".spec.templateName"
+// +kubebuilder:printcolumn:name="VERSION",type="string",JSONPath=".spec.version"
+// +kubebuilder:printcolumn:name="REVISION",type="integer",JSONPath=".spec.revision"
+
+// TemplateRevision is the Schema for the templaterevisions API
+type TemplateRevision struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec TemplateRevisionSpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// TemplateRevisionList contains a list of TemplateRevision
+type TemplateRevisionList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TemplateRevision `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&TemplateRevision{}, &TemplateRevisionList{})
+}
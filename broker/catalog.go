@@ -0,0 +1,234 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/internal"
+)
+
+const defaultPlanName = "default"
+
+// templateEntry is a template published as a service
+type templateEntry struct {
+	name string
+	uid  string
+	spec *tmplv1.TemplateSpec
+}
+
+func (s *Server) getCatalog(w http.ResponseWriter, req *http.Request, namespace string) {
+	entries, err := s.listTemplates(req.Context(), namespace)
+	if err != nil {
+		s.Log.Error(err, "cannot list templates")
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+
+	catalog := &Catalog{Services: []Service{}}
+	for _, entry := range entries {
+		catalog.Services = append(catalog.Services, entry.toService())
+	}
+	writeJSON(w, http.StatusOK, catalog)
+}
+
+// listTemplates lists successfully reconciled cluster templates, or templates of the namespace if given
+func (s *Server) listTemplates(ctx context.Context, namespace string) ([]templateEntry, error) {
+	entries := []templateEntry{}
+	if len(namespace) == 0 {
+		templates := &tmplv1.ClusterTemplateList{}
+		if err := s.Client.List(ctx, templates); err != nil {
+			return nil, err
+		}
+		for idx := range templates.Items {
+			template := &templates.Items[idx]
+			if template.Status.Status == tmplv1.TemplateSuccess {
+				entries = append(entries, templateEntry{template.Name, string(template.UID), &template.TemplateSpec})
+			}
+		}
+		return entries, nil
+	}
+
+	templates := &tmplv1.TemplateList{}
+	if err := s.Client.List(ctx, templates, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	for idx := range templates.Items {
+		template := &templates.Items[idx]
+		if template.Status.Status == tmplv1.TemplateSuccess {
+			entries = append(entries, templateEntry{template.Name, string(template.UID), &template.TemplateSpec})
+		}
+	}
+	return entries, nil
+}
+
+// findService finds the template published with the service id
+func (s *Server) findService(ctx context.Context, namespace, serviceID string) (*templateEntry, error) {
+	entries, err := s.listTemplates(ctx, namespace)
+	if err != nil {
+		return nil, err
+	}
+	for idx := range entries {
+		if entries[idx].uid == serviceID {
+			return &entries[idx], nil
+		}
+	}
+	return nil, nil
+}
+
+// plans returns plans of the template, or the default plan if the template has none
+func (e *templateEntry) plans() []tmplv1.PlanSpec {
+	if len(e.spec.Plans) != 0 {
+		return e.spec.Plans
+	}
+	return []tmplv1.PlanSpec{{Name: defaultPlanName, Description: "default plan of " + e.name}}
+}
+
+// instancePlan returns the plan name to be requested by the template instance.
+// The default plan is not a plan of the template, so no plan is requested for it.
+func (e *templateEntry) instancePlan(plan *tmplv1.PlanSpec) string {
+	if len(e.spec.Plans) == 0 {
+		return ""
+	}
+	return plan.Name
+}
+
+// planID returns the id of the plan, which is generated from the service id if not given
+func (e *templateEntry) planID(plan *tmplv1.PlanSpec) string {
+	if len(plan.Id) != 0 {
+		return plan.Id
+	}
+	return e.uid + "-" + plan.Name
+}
+
+func (e *templateEntry) findPlan(planID string) *tmplv1.PlanSpec {
+	plans := e.plans()
+	for idx := range plans {
+		if e.planID(&plans[idx]) == planID {
+			return &plans[idx]
+		}
+	}
+	return nil
+}
+
+func (e *templateEntry) toService() Service {
+	service := Service{
+		Name:        e.name,
+		ID:          e.uid,
+		Description: e.spec.ShortDescription,
+		Tags:        e.spec.Tags,
+		Metadata: map[string]interface{}{
+			"displayName":         e.name,
+			"imageUrl":            e.spec.ImageUrl,
+			"longDescription":     e.spec.LongDescription,
+			"providerDisplayName": e.spec.Provider,
+			"documentationUrl":    e.spec.UrlDescription,
+		},
+		Plans: []Plan{},
+	}
+	if len(service.Description) == 0 {
+		service.Description = e.name
+	}
+
+	for _, plan := range e.plans() {
+		p := Plan{
+			ID:                     e.planID(&plan),
+			Name:                   plan.Name,
+			Description:            plan.Description,
+			Free:                   plan.Free,
+			Bindable:               plan.Bindable,
+			PlanUpdateable:         plan.PlanUpdateable,
+			MaximumPollingDuration: plan.MaximumPollingDuration,
+		}
+		if len(p.Description) == 0 {
+			p.Description = plan.Name
+		}
+		if plan.Metadata.DisplayName != "" || len(plan.Metadata.Bullets) != 0 || plan.Metadata.Costs.Unit != "" {
+			p.Metadata = plan.Metadata.DeepCopy()
+		}
+		if len(plan.MaintenanceInfo.Version) != 0 {
+			p.MaintenanceInfo = plan.MaintenanceInfo.DeepCopy()
+		}
+		schema := parametersSchema(e.spec.Parameters, plan.Schemas.ServiceInstance.Create.Parameters)
+		p.Schemas = &Schemas{ServiceInstance: ServiceInstanceSchema{
+			Create: InputParametersSchema{Parameters: schema},
+			Update: InputParametersSchema{Parameters: schema},
+		}}
+
+		service.PlanUpdateable = service.PlanUpdateable || plan.PlanUpdateable
+		service.Plans = append(service.Plans, p)
+	}
+	return service
+}
+
+// parametersSchema builds the JSON schema of the parameters which can be given by users.
+// Parameters whose values are fixed by the plan are left out.
+func parametersSchema(params []tmplv1.ParamSpec, fixed map[string]intstr.IntOrString) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for _, param := range params {
+		if _, exist := fixed[param.Name]; exist {
+			continue
+		}
+
+		property := map[string]interface{}{}
+		if param.Schema != nil && len(param.Schema.Raw) != 0 {
+			_ = json.Unmarshal(param.Schema.Raw, &property)
+		}
+		switch param.ValueType {
+		case "", internal.StringType:
+			property["type"] = "string"
+		case internal.SecretRefType:
+			property["type"] = "object"
+			property["properties"] = map[string]interface{}{
+				"name": map[string]interface{}{"type": "string"},
+				"key":  map[string]interface{}{"type": "string"},
+			}
+			property["required"] = []string{"name"}
+		default:
+			property["type"] = param.ValueType
+		}
+		if len(param.Description) != 0 {
+			property["description"] = param.Description
+		}
+		if len(param.DisplayName) != 0 {
+			property["title"] = param.DisplayName
+		}
+		if len(param.Regex) != 0 && property["type"] == "string" {
+			property["pattern"] = param.Regex
+		}
+		if defaultValue := defaultParamValue(param); defaultValue != nil {
+			property["default"] = defaultValue
+		} else if param.Required && param.Generate == nil {
+			required = append(required, param.Name)
+		}
+		properties[param.Name] = property
+	}
+
+	schema := map[string]interface{}{
+		"$schema":              "http://json-schema.org/draft-04/schema#",
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) != 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// defaultParamValue returns the default value of the parameter converted to the value type, or nil if it has none
+func defaultParamValue(param tmplv1.ParamSpec) interface{} {
+	if internal.IsEmptyParamValue(param.Value) {
+		return nil
+	}
+	converted, err := internal.ConvertParamValue(param, param.Value)
+	if err != nil {
+		return nil
+	}
+	return converted.Interface()
+}
@@ -0,0 +1,371 @@
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/internal"
+)
+
+func (s *Server) provision(w http.ResponseWriter, req *http.Request, routeNamespace, instanceID string) {
+	if !acceptsIncomplete(w, req) {
+		return
+	}
+	if msg := validateInstanceID(instanceID); len(msg) != 0 {
+		writeError(w, http.StatusBadRequest, "", msg)
+		return
+	}
+	body := &ProvisionRequest{}
+	if err := json.NewDecoder(req.Body).Decode(body); err != nil {
+		writeError(w, http.StatusBadRequest, "", "cannot decode request: "+err.Error())
+		return
+	}
+	namespace, err := instanceNamespace(routeNamespace, body.Context)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "", err.Error())
+		return
+	}
+
+	entry, plan, msg, err := s.findServicePlan(req.Context(), routeNamespace, body.ServiceID, body.PlanID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	if len(msg) != 0 {
+		writeError(w, http.StatusBadRequest, "", msg)
+		return
+	}
+	params, err := buildParameters(entry, plan, nil, body.Parameters)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "", err.Error())
+		return
+	}
+
+	instance := &tmplv1.TemplateInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        instanceID,
+			Namespace:   namespace,
+			Labels:      map[string]string{internal.BrokerInstanceLabel: instanceID},
+			Annotations: map[string]string{internal.BrokerServiceAnnotation: body.ServiceID, internal.BrokerPlanAnnotation: body.PlanID},
+		},
+	}
+	info := &tmplv1.ObjectInfo{Metadata: tmplv1.MetadataSpec{Name: entry.name}, Plan: entry.instancePlan(plan), Parameters: params}
+	if len(routeNamespace) == 0 {
+		instance.Spec.ClusterTemplate = info
+	} else {
+		instance.Spec.Template = info
+	}
+
+	// the same request can be sent again until the platform gets the response
+	existing, err := s.findInstance(req.Context(), routeNamespace, instanceID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	if existing != nil {
+		if existing.Namespace != namespace || existing.Annotations[internal.BrokerServiceAnnotation] != body.ServiceID ||
+			existing.Annotations[internal.BrokerPlanAnnotation] != body.PlanID || !reflect.DeepEqual(existing.Spec, instance.Spec) {
+			writeError(w, http.StatusConflict, "", "service instance "+instanceID+" already exists with different attributes")
+			return
+		}
+		if state, _ := instanceState(existing); state == stateSucceeded {
+			writeJSON(w, http.StatusOK, &OperationResponse{})
+			return
+		}
+		writeJSON(w, http.StatusAccepted, &OperationResponse{Operation: operationProvision})
+		return
+	}
+
+	if err := s.Client.Create(req.Context(), instance); err != nil {
+		s.Log.Error(err, "cannot create template instance", "instance", instanceID)
+		code := http.StatusInternalServerError
+		if errors.IsAlreadyExists(err) {
+			code = http.StatusConflict
+		} else if errors.IsInvalid(err) || errors.IsBadRequest(err) || errors.IsForbidden(err) {
+			code = http.StatusBadRequest
+		}
+		writeError(w, code, "", err.Error())
+		return
+	}
+	s.Log.Info("provisioned service instance", "instance", instanceID, "namespace", namespace, "template", entry.name)
+	writeJSON(w, http.StatusAccepted, &OperationResponse{Operation: operationProvision})
+}
+
+func (s *Server) update(w http.ResponseWriter, req *http.Request, routeNamespace, instanceID string) {
+	if !acceptsIncomplete(w, req) {
+		return
+	}
+	if msg := validateInstanceID(instanceID); len(msg) != 0 {
+		writeError(w, http.StatusBadRequest, "", msg)
+		return
+	}
+	body := &UpdateRequest{}
+	if err := json.NewDecoder(req.Body).Decode(body); err != nil {
+		writeError(w, http.StatusBadRequest, "", "cannot decode request: "+err.Error())
+		return
+	}
+
+	instance, err := s.findInstance(req.Context(), routeNamespace, instanceID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	if instance == nil || instance.GetDeletionTimestamp() != nil {
+		writeError(w, http.StatusNotFound, "", "service instance "+instanceID+" is not found")
+		return
+	}
+	if body.ServiceID != instance.Annotations[internal.BrokerServiceAnnotation] {
+		writeError(w, http.StatusBadRequest, "", "service of the instance cannot be changed")
+		return
+	}
+
+	// cluster templates are served without namespace
+	serviceNamespace, info := instance.Namespace, instance.Spec.Template
+	if instance.Spec.ClusterTemplate != nil {
+		serviceNamespace, info = "", instance.Spec.ClusterTemplate
+	}
+	currentPlanID := instance.Annotations[internal.BrokerPlanAnnotation]
+	planID := body.PlanID
+	if len(planID) == 0 {
+		planID = currentPlanID
+	}
+	entry, plan, msg, err := s.findServicePlan(req.Context(), serviceNamespace, body.ServiceID, planID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	if len(msg) != 0 {
+		writeError(w, http.StatusBadRequest, "", msg)
+		return
+	}
+	current := entry.findPlan(currentPlanID)
+	if planID != currentPlanID && (current == nil || !current.PlanUpdateable) {
+		writeError(w, http.StatusBadRequest, "", "plan of the service instance cannot be changed")
+		return
+	}
+
+	params, err := buildParameters(entry, plan, info.Parameters, body.Parameters)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "", err.Error())
+		return
+	}
+
+	updated := instance.DeepCopy()
+	updated.Annotations[internal.BrokerPlanAnnotation] = planID
+	updatedInfo := updated.Spec.Template
+	if updated.Spec.ClusterTemplate != nil {
+		updatedInfo = updated.Spec.ClusterTemplate
+	}
+	updatedInfo.Plan = entry.instancePlan(plan)
+	updatedInfo.Parameters = params
+	if err := s.Client.Patch(req.Context(), updated, client.MergeFrom(instance)); err != nil {
+		s.Log.Error(err, "cannot update template instance", "instance", instanceID)
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	s.Log.Info("updated service instance", "instance", instanceID, "plan", planID)
+	writeJSON(w, http.StatusAccepted, &OperationResponse{Operation: operationUpdate})
+}
+
+func (s *Server) deprovision(w http.ResponseWriter, req *http.Request, routeNamespace, instanceID string) {
+	if !acceptsIncomplete(w, req) {
+		return
+	}
+	query := req.URL.Query()
+	if len(query.Get("service_id")) == 0 || len(query.Get("plan_id")) == 0 {
+		writeError(w, http.StatusBadRequest, "", "service_id and plan_id must be given")
+		return
+	}
+	if msg := validateInstanceID(instanceID); len(msg) != 0 {
+		writeError(w, http.StatusBadRequest, "", msg)
+		return
+	}
+
+	instance, err := s.findInstance(req.Context(), routeNamespace, instanceID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	if instance == nil {
+		writeJSON(w, http.StatusGone, &OperationResponse{})
+		return
+	}
+	if instance.GetDeletionTimestamp() == nil {
+		if err := s.Client.Delete(req.Context(), instance); err != nil && !errors.IsNotFound(err) {
+			s.Log.Error(err, "cannot delete template instance", "instance", instanceID)
+			writeError(w, http.StatusInternalServerError, "", err.Error())
+			return
+		}
+		s.Log.Info("deprovisioned service instance", "instance", instanceID)
+	}
+	writeJSON(w, http.StatusAccepted, &OperationResponse{Operation: operationDeprovision})
+}
+
+func (s *Server) lastOperation(w http.ResponseWriter, req *http.Request, routeNamespace, instanceID string) {
+	if msg := validateInstanceID(instanceID); len(msg) != 0 {
+		writeError(w, http.StatusBadRequest, "", msg)
+		return
+	}
+	instance, err := s.findInstance(req.Context(), routeNamespace, instanceID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "", err.Error())
+		return
+	}
+	// the instance is gone after deprovisioning
+	if instance == nil {
+		writeJSON(w, http.StatusGone, &LastOperationResponse{State: stateSucceeded})
+		return
+	}
+
+	state, description := instanceState(instance)
+	writeJSON(w, http.StatusOK, &LastOperationResponse{State: state, Description: description})
+}
+
+// instanceState returns the state of the last operation on the template instance.
+// The operation succeeds when the applied objects are ready, and fails when the instance has an error.
+func instanceState(instance *tmplv1.TemplateInstance) (string, string) {
+	if instance.GetDeletionTimestamp() != nil {
+		return stateInProgress, "deleting objects of the instance"
+	}
+
+	var created, ready *tmplv1.ConditionSpec
+	for idx := range instance.Status.Conditions {
+		switch instance.Status.Conditions[idx].Type {
+		case "":
+			created = &instance.Status.Conditions[idx]
+		case tmplv1.ConditionTypeReady:
+			ready = &instance.Status.Conditions[idx]
+		}
+	}
+	switch {
+	case created != nil && created.Status == "Error":
+		return stateFailed, created.Message
+	case created == nil || instance.Status.ObservedGeneration != instance.Generation:
+		return stateInProgress, "applying objects of the instance"
+	case ready != nil && ready.Status != "True":
+		return stateInProgress, ready.Message
+	}
+	return stateSucceeded, ""
+}
+
+// findServicePlan returns the service and the plan of the ids, or a message if they are not found
+func (s *Server) findServicePlan(ctx context.Context, namespace, serviceID, planID string) (*templateEntry, *tmplv1.PlanSpec, string, error) {
+	entry, err := s.findService(ctx, namespace, serviceID)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	if entry == nil {
+		return nil, nil, fmt.Sprintf("service %s is not found", serviceID), nil
+	}
+	plan := entry.findPlan(planID)
+	if plan == nil {
+		return nil, nil, fmt.Sprintf("plan %s of service %s is not found", planID, entry.name), nil
+	}
+	return entry, plan, "", nil
+}
+
+// findInstance finds the template instance provisioned for the service instance through the route.
+// Instances of templates are found in the route namespace, and instances of cluster templates in every namespace.
+func (s *Server) findInstance(ctx context.Context, routeNamespace, instanceID string) (*tmplv1.TemplateInstance, error) {
+	instances := &tmplv1.TemplateInstanceList{}
+	opts := []client.ListOption{client.MatchingLabels{internal.BrokerInstanceLabel: instanceID}}
+	if len(routeNamespace) != 0 {
+		opts = append(opts, client.InNamespace(routeNamespace))
+	}
+	if err := s.Client.List(ctx, instances, opts...); err != nil {
+		return nil, err
+	}
+	for idx := range instances.Items {
+		instance := &instances.Items[idx]
+		if (len(routeNamespace) == 0) == (instance.Spec.ClusterTemplate != nil) {
+			return instance, nil
+		}
+	}
+	return nil, nil
+}
+
+// buildParameters merges given parameters into the base parameters.
+// Parameters whose values are fixed by the plan cannot be given, and the values are set by the controller with the plan.
+func buildParameters(entry *templateEntry, plan *tmplv1.PlanSpec, base []tmplv1.ParamSpec, given map[string]json.RawMessage) ([]tmplv1.ParamSpec, error) {
+	fixed := plan.Schemas.ServiceInstance.Create.Parameters
+	values := map[string]tmplv1.ParamValue{}
+	for _, param := range base {
+		if _, exist := fixed[param.Name]; !exist {
+			values[param.Name] = param.Value
+		}
+	}
+	for name, raw := range given {
+		if _, exist := fixed[name]; exist {
+			return nil, fmt.Errorf("parameter %s is fixed by plan %s", name, plan.Name)
+		}
+		val := tmplv1.ParamValue{}
+		if err := json.Unmarshal(raw, &val); err != nil {
+			return nil, fmt.Errorf("parameter %s: %s", name, err.Error())
+		}
+		values[name] = val
+	}
+
+	names := []string{}
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	params := []tmplv1.ParamSpec{}
+	for _, name := range names {
+		params = append(params, tmplv1.ParamSpec{Name: name, Value: values[name]})
+	}
+
+	templateParams := internal.ApplyPlanParameters(entry.spec.Parameters, plan)
+	if errs := internal.ValidateInstanceParameters(templateParams, params, field.NewPath("parameters")); len(errs) != 0 {
+		return nil, errs.ToAggregate()
+	}
+	return params, nil
+}
+
+// instanceNamespace returns the namespace to provision the instance in.
+// Templates are instantiated in their own namespace, and cluster templates in the namespace of the platform context.
+func instanceNamespace(routeNamespace string, ctx map[string]interface{}) (string, error) {
+	namespace, _ := ctx["namespace"].(string)
+	if len(routeNamespace) != 0 {
+		if len(namespace) != 0 && namespace != routeNamespace {
+			return "", fmt.Errorf("namespace %s of the context doesn't match with the broker namespace %s", namespace, routeNamespace)
+		}
+		return routeNamespace, nil
+	}
+	if len(namespace) == 0 {
+		return "", fmt.Errorf("namespace must be given in the context")
+	}
+	return namespace, nil
+}
+
+// validateInstanceID checks the instance id can be used as the name and the label of the template instance
+func validateInstanceID(instanceID string) string {
+	if errs := validation.IsDNS1123Subdomain(instanceID); len(errs) != 0 {
+		return "invalid instance id: " + strings.Join(errs, ", ")
+	}
+	if errs := validation.IsValidLabelValue(instanceID); len(errs) != 0 {
+		return "invalid instance id: " + strings.Join(errs, ", ")
+	}
+	return ""
+}
+
+// acceptsIncomplete writes an error if the platform doesn't accept asynchronous operations
+func acceptsIncomplete(w http.ResponseWriter, req *http.Request) bool {
+	if req.URL.Query().Get("accepts_incomplete") != "true" {
+		writeError(w, http.StatusUnprocessableEntity, "AsyncRequired", "This service plan requires client support for asynchronous service operations.")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,133 @@
+package broker
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-logr/logr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Server serves the Open Service Broker API with templates and cluster templates.
+// Cluster templates are served on /v2, and templates of a namespace on /namespaces/{namespace}/v2.
+// Service instances are provisioned as template instances in the namespace of the platform context.
+type Server struct {
+	Client client.Client
+	Log    logr.Logger
+	// Address the broker listens on. ex) :8081
+	Addr string
+	// Basic auth credentials of the broker
+	Username string
+	Password string
+	// Insecure serves requests without authentication if Username is empty.
+	// Service instances are created with the privileges of the operator, so it must be enabled explicitly.
+	Insecure bool
+}
+
+const (
+	readTimeout  = 30 * time.Second
+	writeTimeout = 30 * time.Second
+	idleTimeout  = 120 * time.Second
+)
+
+// Start runs the broker until the stop channel is closed
+func (s *Server) Start(stop <-chan struct{}) error {
+	if len(s.Username) == 0 && !s.Insecure {
+		return fmt.Errorf("credentials of the service broker are not given")
+	}
+	srv := &http.Server{
+		Addr:              s.Addr,
+		Handler:           s,
+		ReadHeaderTimeout: readTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		s.Log.Info("starting service broker", "addr", s.Addr)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			errCh <- err
+		}
+		close(errCh)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-stop:
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		return srv.Shutdown(ctx)
+	}
+}
+
+// NeedLeaderElection returns false, so every replica serves the broker
+func (s *Server) NeedLeaderElection() bool {
+	return false
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if len(s.Username) != 0 || !s.Insecure {
+		user, password, ok := req.BasicAuth()
+		if !ok || len(s.Username) == 0 || subtle.ConstantTimeCompare([]byte(user), []byte(s.Username)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(password), []byte(s.Password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="template-service-broker"`)
+			writeError(w, http.StatusUnauthorized, "", "invalid credentials")
+			return
+		}
+	}
+	if !strings.HasPrefix(req.Header.Get(apiVersionHeader), "2.") {
+		writeError(w, http.StatusPreconditionFailed, "", apiVersionHeader+" header must be 2.x")
+		return
+	}
+
+	// /namespaces/{namespace}/v2/... is served with templates of the namespace
+	namespace := ""
+	path := strings.Trim(req.URL.Path, "/")
+	if strings.HasPrefix(path, "namespaces/") {
+		parts := strings.SplitN(path, "/", 3)
+		if len(parts) < 3 || len(parts[1]) == 0 {
+			writeError(w, http.StatusNotFound, "", "not found")
+			return
+		}
+		namespace = parts[1]
+		path = parts[2]
+	}
+
+	parts := strings.Split(path, "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "v2" && parts[1] == "catalog" && req.Method == http.MethodGet:
+		s.getCatalog(w, req, namespace)
+	case len(parts) == 3 && parts[0] == "v2" && parts[1] == "service_instances":
+		switch req.Method {
+		case http.MethodPut:
+			s.provision(w, req, namespace, parts[2])
+		case http.MethodPatch:
+			s.update(w, req, namespace, parts[2])
+		case http.MethodDelete:
+			s.deprovision(w, req, namespace, parts[2])
+		default:
+			writeError(w, http.StatusMethodNotAllowed, "", req.Method+" is not allowed")
+		}
+	case len(parts) == 4 && parts[0] == "v2" && parts[1] == "service_instances" && parts[3] == "last_operation" && req.Method == http.MethodGet:
+		s.lastOperation(w, req, namespace, parts[2])
+	default:
+		writeError(w, http.StatusNotFound, "", "not found")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, code int, errorCode, description string) {
+	writeJSON(w, code, &ErrorResponse{Error: errorCode, Description: description})
+}
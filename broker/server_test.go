@@ -0,0 +1,369 @@
+package broker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/controllers/templateinstance"
+	"github.com/tmax-cloud/template-operator/internal"
+)
+
+func TestServer(t *testing.T) {
+	var (
+		namespace  = "test-ns"
+		instanceID = "a1b2c3d4-0000-1111-2222-333344445555"
+	)
+
+	clusterTemplate := &tmplv1.ClusterTemplate{
+		ObjectMeta: metav1.ObjectMeta{Name: "redis", UID: "cluster-template-uid"},
+		TemplateSpec: tmplv1.TemplateSpec{
+			ShortDescription: "redis cache",
+			Plans: []tmplv1.PlanSpec{
+				{
+					Name:           "small",
+					PlanUpdateable: true,
+					Schemas: tmplv1.Schemas{ServiceInstance: tmplv1.ServiceInstanceSchema{
+						Create: tmplv1.SchemaParameters{Parameters: map[string]intstr.IntOrString{"MEMORY": intstr.FromString("1Gi")}},
+					}},
+				},
+				{
+					Id:   "large-plan",
+					Name: "large",
+					Schemas: tmplv1.Schemas{ServiceInstance: tmplv1.ServiceInstanceSchema{
+						Create: tmplv1.SchemaParameters{Parameters: map[string]intstr.IntOrString{"MEMORY": intstr.FromString("8Gi")}},
+					}},
+				},
+			},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "NAME", ValueType: "string", Required: true, Value: tmplv1.FromString("")},
+				{Name: "MEMORY", ValueType: "string", Value: tmplv1.FromString("")},
+				{Name: "REPLICAS", ValueType: "integer", Value: tmplv1.FromInt(1)},
+			},
+		},
+		Status: tmplv1.TemplateStatus{Status: tmplv1.TemplateSuccess},
+	}
+	brokenTemplate := &tmplv1.ClusterTemplate{
+		ObjectMeta: metav1.ObjectMeta{Name: "broken", UID: "broken-uid"},
+		Status:     tmplv1.TemplateStatus{Status: tmplv1.TemplateError},
+	}
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: namespace, UID: "template-uid"},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Parameters: []tmplv1.ParamSpec{{Name: "NAME", ValueType: "string", Value: tmplv1.FromString("")}},
+		},
+		Status: tmplv1.TemplateStatus{Status: tmplv1.TemplateSuccess},
+	}
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion,
+		&tmplv1.ClusterTemplate{}, &tmplv1.ClusterTemplateList{}, &tmplv1.Template{}, &tmplv1.TemplateList{},
+		&tmplv1.TemplateInstance{}, &tmplv1.TemplateInstanceList{})
+
+	server := &Server{
+		Client:   fake.NewFakeClientWithScheme(s, clusterTemplate, brokenTemplate, template),
+		Log:      logf.Log.WithName("test-logger"),
+		Username: "admin",
+		Password: "secret",
+	}
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		raw, err := json.Marshal(body)
+		require.NoError(t, err)
+		req := httptest.NewRequest(method, path, bytes.NewReader(raw))
+		req.Header.Set(apiVersionHeader, "2.16")
+		req.SetBasicAuth("admin", "secret")
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+	getInstance := func() *tmplv1.TemplateInstance {
+		instance := &tmplv1.TemplateInstance{}
+		require.NoError(t, server.Client.Get(context.TODO(), types.NamespacedName{Name: instanceID, Namespace: namespace}, instance))
+		return instance
+	}
+	instancePath := "/v2/service_instances/" + instanceID
+
+	// authentication and api version
+	req := httptest.NewRequest(http.MethodGet, "/v2/catalog", nil)
+	req.Header.Set(apiVersionHeader, "2.16")
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	req = httptest.NewRequest(http.MethodGet, "/v2/catalog", nil)
+	req.SetBasicAuth("admin", "secret")
+	rec = httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusPreconditionFailed, rec.Code)
+
+	// cluster templates are served on /v2
+	rec = do(http.MethodGet, "/v2/catalog", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	catalog := &Catalog{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), catalog))
+	require.Len(t, catalog.Services, 1)
+	service := catalog.Services[0]
+	assert.Equal(t, "redis", service.Name)
+	assert.Equal(t, "cluster-template-uid", service.ID)
+	assert.True(t, service.PlanUpdateable)
+	require.Len(t, service.Plans, 2)
+	assert.Equal(t, "cluster-template-uid-small", service.Plans[0].ID)
+	assert.Equal(t, "large-plan", service.Plans[1].ID)
+	schema := service.Plans[0].Schemas.ServiceInstance.Create.Parameters
+	assert.NotContains(t, schema["properties"], "MEMORY", "parameter fixed by the plan is in the schema")
+	assert.Contains(t, schema["properties"], "REPLICAS")
+	assert.Equal(t, []interface{}{"NAME"}, schema["required"])
+
+	// templates are served on /namespaces/{namespace}/v2
+	rec = do(http.MethodGet, "/namespaces/"+namespace+"/v2/catalog", nil)
+	require.Equal(t, http.StatusOK, rec.Code)
+	catalog = &Catalog{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), catalog))
+	require.Len(t, catalog.Services, 1)
+	assert.Equal(t, "nginx", catalog.Services[0].Name)
+	assert.Equal(t, "template-uid-default", catalog.Services[0].Plans[0].ID)
+
+	provision := &ProvisionRequest{
+		ServiceID:  "cluster-template-uid",
+		PlanID:     "cluster-template-uid-small",
+		Context:    map[string]interface{}{"platform": "kubernetes", "namespace": namespace},
+		Parameters: map[string]json.RawMessage{"NAME": json.RawMessage(`"cache"`)},
+	}
+
+	// invalid requests
+	rec = do(http.MethodPut, instancePath, provision)
+	assert.Equal(t, http.StatusUnprocessableEntity, rec.Code)
+	rec = do(http.MethodPut, instancePath+"?accepts_incomplete=true", &ProvisionRequest{ServiceID: provision.ServiceID, PlanID: provision.PlanID})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "namespace must be given")
+	rec = do(http.MethodPut, instancePath+"?accepts_incomplete=true", &ProvisionRequest{
+		ServiceID: provision.ServiceID, PlanID: provision.PlanID, Context: provision.Context,
+		Parameters: map[string]json.RawMessage{"NAME": json.RawMessage(`"cache"`), "MEMORY": json.RawMessage(`"64Gi"`)},
+	})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "parameter MEMORY is fixed by plan small")
+	rec = do(http.MethodPut, instancePath+"?accepts_incomplete=true", &ProvisionRequest{
+		ServiceID: provision.ServiceID, PlanID: provision.PlanID, Context: provision.Context,
+		Parameters: map[string]json.RawMessage{"REPLICAS": json.RawMessage(`"many"`)},
+	})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "parameter NAME must have a value")
+	assert.Contains(t, rec.Body.String(), "value must be a number")
+	rec = do(http.MethodPut, instancePath+"?accepts_incomplete=true", &ProvisionRequest{ServiceID: "broken-uid", PlanID: "broken-uid-default", Context: provision.Context})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	// provision
+	rec = do(http.MethodPut, instancePath+"?accepts_incomplete=true", provision)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	assert.JSONEq(t, `{"operation": "provision"}`, rec.Body.String())
+
+	instance := getInstance()
+	assert.Equal(t, instanceID, instance.Labels[internal.BrokerInstanceLabel])
+	assert.Equal(t, "cluster-template-uid-small", instance.Annotations[internal.BrokerPlanAnnotation])
+	require.NotNil(t, instance.Spec.ClusterTemplate)
+	assert.Equal(t, "redis", instance.Spec.ClusterTemplate.Metadata.Name)
+	assert.Equal(t, "small", instance.Spec.ClusterTemplate.Plan)
+	assert.Equal(t, []tmplv1.ParamSpec{
+		{Name: "NAME", Value: tmplv1.FromString("cache")},
+	}, instance.Spec.ClusterTemplate.Parameters)
+
+	// the same request is accepted again, but different one conflicts
+	rec = do(http.MethodPut, instancePath+"?accepts_incomplete=true", provision)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	rec = do(http.MethodPut, instancePath+"?accepts_incomplete=true", &ProvisionRequest{
+		ServiceID: provision.ServiceID, PlanID: "large-plan", Context: provision.Context, Parameters: provision.Parameters,
+	})
+	assert.Equal(t, http.StatusConflict, rec.Code)
+
+	// last operation follows the status of the instance
+	lastOperation := func() *LastOperationResponse {
+		rec := do(http.MethodGet, instancePath+"/last_operation?operation=provision", nil)
+		require.Equal(t, http.StatusOK, rec.Code)
+		res := &LastOperationResponse{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), res))
+		return res
+	}
+	assert.Equal(t, stateInProgress, lastOperation().State)
+
+	r := &templateinstance.TemplateInstanceReconciler{
+		Client: server.Client,
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+	reconcileInstance := func() error {
+		_, err := r.Reconcile(reconcile.Request{NamespacedName: types.NamespacedName{Name: instanceID, Namespace: namespace}})
+		return err
+	}
+
+	// the instance fails while the template is missing, and succeeds after the error is resolved
+	require.NoError(t, server.Client.Delete(context.TODO(), clusterTemplate.DeepCopy()))
+	require.Error(t, reconcileInstance())
+	res := lastOperation()
+	assert.Equal(t, stateFailed, res.State)
+	assert.Contains(t, res.Description, "not found")
+
+	clusterTemplate.ResourceVersion = ""
+	require.NoError(t, server.Client.Create(context.TODO(), clusterTemplate.DeepCopy()))
+	require.NoError(t, reconcileInstance())
+	assert.Equal(t, &LastOperationResponse{State: stateSucceeded}, lastOperation())
+	rec = do(http.MethodPut, instancePath+"?accepts_incomplete=true", provision)
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// update
+	rec = do(http.MethodPatch, instancePath+"?accepts_incomplete=true", &UpdateRequest{
+		ServiceID:  provision.ServiceID,
+		PlanID:     "large-plan",
+		Parameters: map[string]json.RawMessage{"REPLICAS": json.RawMessage(`3`)},
+	})
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	instance = getInstance()
+	assert.Equal(t, "large-plan", instance.Annotations[internal.BrokerPlanAnnotation])
+	assert.Equal(t, "large", instance.Spec.ClusterTemplate.Plan)
+	assert.Equal(t, []tmplv1.ParamSpec{
+		{Name: "NAME", Value: tmplv1.FromString("cache")},
+		{Name: "REPLICAS", Value: tmplv1.FromInt(3)},
+	}, instance.Spec.ClusterTemplate.Parameters)
+
+	// large plan is not updateable
+	rec = do(http.MethodPatch, instancePath+"?accepts_incomplete=true", &UpdateRequest{ServiceID: provision.ServiceID, PlanID: "cluster-template-uid-small"})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "plan of the service instance cannot be changed")
+
+	// deprovision
+	rec = do(http.MethodDelete, instancePath+"?accepts_incomplete=true", nil)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	rec = do(http.MethodDelete, instancePath+"?accepts_incomplete=true&service_id=cluster-template-uid&plan_id=large-plan", nil)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	rec = do(http.MethodGet, instancePath+"/last_operation?operation=deprovision", nil)
+	assert.Equal(t, http.StatusGone, rec.Code)
+	rec = do(http.MethodDelete, instancePath+"?accepts_incomplete=true&service_id=cluster-template-uid&plan_id=large-plan", nil)
+	assert.Equal(t, http.StatusGone, rec.Code)
+
+	// templates are instantiated in their own namespace
+	rec = do(http.MethodPut, "/namespaces/"+namespace+"/v2/service_instances/"+instanceID+"?accepts_incomplete=true", &ProvisionRequest{
+		ServiceID: "template-uid",
+		PlanID:    "template-uid-default",
+		Context:   map[string]interface{}{"platform": "kubernetes"},
+	})
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	instance = getInstance()
+	require.NotNil(t, instance.Spec.Template)
+	assert.Equal(t, "nginx", instance.Spec.Template.Metadata.Name)
+
+	// instances are not found through the routes of other namespaces or cluster templates
+	for _, path := range []string{"/namespaces/other-ns" + instancePath, instancePath} {
+		rec = do(http.MethodGet, path+"/last_operation?operation=provision", nil)
+		assert.Equal(t, http.StatusGone, rec.Code)
+		rec = do(http.MethodPatch, path+"?accepts_incomplete=true", &UpdateRequest{ServiceID: "template-uid"})
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+		rec = do(http.MethodDelete, path+"?accepts_incomplete=true&service_id=template-uid&plan_id=template-uid-default", nil)
+		assert.Equal(t, http.StatusGone, rec.Code)
+	}
+	assert.Nil(t, getInstance().GetDeletionTimestamp())
+}
+
+func TestServerCredentials(t *testing.T) {
+	// the broker doesn't start without credentials unless it is insecure
+	server := &Server{Log: logf.Log.WithName("test-logger"), Addr: "127.0.0.1:0"}
+	stop := make(chan struct{})
+	close(stop)
+	assert.Error(t, server.Start(stop))
+
+	req := httptest.NewRequest(http.MethodGet, "/v2/catalog", nil)
+	req.Header.Set(apiVersionHeader, "2.16")
+	rec := httptest.NewRecorder()
+	server.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	server.Insecure = true
+	assert.NoError(t, server.Start(stop))
+}
+
+func TestServerTemplateWithoutPlans(t *testing.T) {
+	var (
+		namespace  = "test-ns"
+		instanceID = "b1b2c3d4-0000-1111-2222-333344445555"
+	)
+
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{Name: "nginx", Namespace: namespace, UID: "template-uid"},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Parameters: []tmplv1.ParamSpec{{Name: "NAME", ValueType: "string", Value: tmplv1.FromString("")}},
+		},
+		Status: tmplv1.TemplateStatus{Status: tmplv1.TemplateSuccess},
+	}
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion,
+		&tmplv1.ClusterTemplate{}, &tmplv1.ClusterTemplateList{}, &tmplv1.Template{}, &tmplv1.TemplateList{},
+		&tmplv1.TemplateInstance{}, &tmplv1.TemplateInstanceList{})
+
+	server := &Server{
+		Client:   fake.NewFakeClientWithScheme(s, template),
+		Log:      logf.Log.WithName("test-logger"),
+		Username: "admin",
+		Password: "secret",
+	}
+	do := func(method, path string, body interface{}) *httptest.ResponseRecorder {
+		raw, err := json.Marshal(body)
+		require.NoError(t, err)
+		req := httptest.NewRequest(method, path, bytes.NewReader(raw))
+		req.Header.Set(apiVersionHeader, "2.16")
+		req.SetBasicAuth("admin", "secret")
+		rec := httptest.NewRecorder()
+		server.ServeHTTP(rec, req)
+		return rec
+	}
+	instancePath := "/namespaces/" + namespace + "/v2/service_instances/" + instanceID
+	key := types.NamespacedName{Name: instanceID, Namespace: namespace}
+	r := &templateinstance.TemplateInstanceReconciler{
+		Client: server.Client,
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+
+	// the default plan of the catalog is not requested by the instance
+	rec := do(http.MethodPut, instancePath+"?accepts_incomplete=true", &ProvisionRequest{
+		ServiceID:  "template-uid",
+		PlanID:     "template-uid-default",
+		Parameters: map[string]json.RawMessage{"NAME": json.RawMessage(`"web"`)},
+	})
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	instance := &tmplv1.TemplateInstance{}
+	require.NoError(t, server.Client.Get(context.TODO(), key, instance))
+	assert.Empty(t, instance.Spec.Template.Plan)
+
+	_, err := r.Reconcile(reconcile.Request{NamespacedName: key})
+	require.NoError(t, err)
+	require.NoError(t, server.Client.Get(context.TODO(), key, instance))
+	state, description := instanceState(instance)
+	assert.NotEqual(t, stateFailed, state, description)
+
+	rec = do(http.MethodPatch, instancePath+"?accepts_incomplete=true", &UpdateRequest{
+		ServiceID:  "template-uid",
+		Parameters: map[string]json.RawMessage{"NAME": json.RawMessage(`"api"`)},
+	})
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	require.NoError(t, server.Client.Get(context.TODO(), key, instance))
+	assert.Empty(t, instance.Spec.Template.Plan)
+
+	_, err = r.Reconcile(reconcile.Request{NamespacedName: key})
+	require.NoError(t, err)
+	require.NoError(t, server.Client.Get(context.TODO(), key, instance))
+	state, description = instanceState(instance)
+	assert.NotEqual(t, stateFailed, state, description)
+}
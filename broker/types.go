@@ -0,0 +1,102 @@
+package broker
+
+import (
+	"encoding/json"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+)
+
+// Types of the Open Service Broker API v2
+// https://github.com/openservicebrokerapi/servicebroker/blob/v2.16/spec.md
+
+const (
+	apiVersionHeader = "X-Broker-API-Version"
+
+	stateInProgress = "in progress"
+	stateSucceeded  = "succeeded"
+	stateFailed     = "failed"
+
+	operationProvision   = "provision"
+	operationUpdate      = "update"
+	operationDeprovision = "deprovision"
+)
+
+type Catalog struct {
+	Services []Service `json:"services"`
+}
+
+type Service struct {
+	Name                 string                 `json:"name"`
+	ID                   string                 `json:"id"`
+	Description          string                 `json:"description"`
+	Tags                 []string               `json:"tags,omitempty"`
+	Bindable             bool                   `json:"bindable"`
+	InstancesRetrievable bool                   `json:"instances_retrievable,omitempty"`
+	PlanUpdateable       bool                   `json:"plan_updateable,omitempty"`
+	Metadata             map[string]interface{} `json:"metadata,omitempty"`
+	Plans                []Plan                 `json:"plans"`
+}
+
+type Plan struct {
+	ID                     string                  `json:"id"`
+	Name                   string                  `json:"name"`
+	Description            string                  `json:"description"`
+	Metadata               *tmplv1.PlanMetadata    `json:"metadata,omitempty"`
+	Free                   bool                    `json:"free,omitempty"`
+	Bindable               bool                    `json:"bindable,omitempty"`
+	PlanUpdateable         bool                    `json:"plan_updateable,omitempty"`
+	Schemas                *Schemas                `json:"schemas,omitempty"`
+	MaximumPollingDuration int                     `json:"maximum_polling_duration,omitempty"`
+	MaintenanceInfo        *tmplv1.MaintenanceInfo `json:"maintenance_info,omitempty"`
+}
+
+type Schemas struct {
+	ServiceInstance ServiceInstanceSchema `json:"service_instance"`
+}
+
+type ServiceInstanceSchema struct {
+	Create InputParametersSchema `json:"create"`
+	Update InputParametersSchema `json:"update"`
+}
+
+type InputParametersSchema struct {
+	// JSON schema of the parameters
+	Parameters map[string]interface{} `json:"parameters,omitempty"`
+}
+
+type ProvisionRequest struct {
+	ServiceID        string                     `json:"service_id"`
+	PlanID           string                     `json:"plan_id"`
+	Context          map[string]interface{}     `json:"context,omitempty"`
+	OrganizationGUID string                     `json:"organization_guid,omitempty"`
+	SpaceGUID        string                     `json:"space_guid,omitempty"`
+	Parameters       map[string]json.RawMessage `json:"parameters,omitempty"`
+}
+
+type UpdateRequest struct {
+	ServiceID      string                     `json:"service_id"`
+	PlanID         string                     `json:"plan_id,omitempty"`
+	Context        map[string]interface{}     `json:"context,omitempty"`
+	Parameters     map[string]json.RawMessage `json:"parameters,omitempty"`
+	PreviousValues *PreviousValues            `json:"previous_values,omitempty"`
+}
+
+type PreviousValues struct {
+	ServiceID string `json:"service_id,omitempty"`
+	PlanID    string `json:"plan_id,omitempty"`
+}
+
+type OperationResponse struct {
+	DashboardURL string `json:"dashboard_url,omitempty"`
+	Operation    string `json:"operation,omitempty"`
+}
+
+type LastOperationResponse struct {
+	State       string `json:"state"`
+	Description string `json:"description,omitempty"`
+}
+
+type ErrorResponse struct {
+	Error       string `json:"error,omitempty"`
+	Description string `json:"description,omitempty"`
+}
@@ -44,6 +44,8 @@ type ClusterTemplateReconciler struct {
 
 // +kubebuilder:rbac:groups=tmax.io,resources=clustertemplates,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=tmax.io,resources=clustertemplates/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=tmax.io,resources=clustertemplaterevisions,verbs=get;list;watch;create;delete
+// +kubebuilder:rbac:groups=tmax.io,resources=templateinstances,verbs=get;list;watch
 
 func (r *ClusterTemplateReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	reqLogger := r.Log.WithValues("Request.Namespace", req.Namespace, "Request.Name", req.Name)
@@ -76,8 +78,8 @@ func (r *ClusterTemplateReconciler) Reconcile(req ctrl.Request) (ctrl.Result, er
 		return ctrl.Result{}, nil
 	}
 
-	// if status field is not nil, end reconcile
-	if len(template.Status.Status) != 0 {
+	// if status field is not nil and the template is not changed, end reconcile
+	if len(template.Status.Status) != 0 && template.Status.ObservedGeneration == template.Generation {
 		reqLogger.Info("already handled template")
 		return ctrl.Result{}, nil
 	}
@@ -91,8 +93,10 @@ func (r *ClusterTemplateReconciler) Reconcile(req ctrl.Request) (ctrl.Result, er
 	if err := templateResolver.SetObjectKinds(); err != nil {
 		reqLogger.Error(err, "cannot decode object")
 		templateStatus := &tmplv1.TemplateStatus{
-			Message: "cannot decode object",
-			Status:  tmplv1.TemplateError,
+			Message:            "cannot decode object",
+			Status:             tmplv1.TemplateError,
+			ObservedGeneration: template.Generation,
+			LatestRevision:     template.Status.LatestRevision,
 		}
 		return r.updateClusterTemplateStatus(template, templateStatus)
 	}
@@ -105,16 +109,34 @@ func (r *ClusterTemplateReconciler) Reconcile(req ctrl.Request) (ctrl.Result, er
 	if err = r.Client.Patch(context.TODO(), updateTemplate, client.MergeFrom(template)); err != nil {
 		reqLogger.Error(err, "cannot update clustertemplate")
 		templateStatus := &tmplv1.TemplateStatus{
-			Message: "cannot update clustertemplate",
-			Status:  tmplv1.TemplateError,
+			Message:            "cannot update clustertemplate",
+			Status:             tmplv1.TemplateError,
+			ObservedGeneration: template.Generation,
+			LatestRevision:     template.Status.LatestRevision,
+		}
+		return r.updateClusterTemplateStatus(template, templateStatus)
+	}
+
+	// record the template as a revision which template instances can be pinned to
+	revision, err := r.ensureRevision(updateTemplate)
+	if err != nil {
+		reqLogger.Error(err, "cannot create revision")
+		templateStatus := &tmplv1.TemplateStatus{
+			Message:            err.Error(),
+			Reason:             "cannot create revision",
+			Status:             tmplv1.TemplateError,
+			ObservedGeneration: updateTemplate.Generation,
+			LatestRevision:     template.Status.LatestRevision,
 		}
 		return r.updateClusterTemplateStatus(template, templateStatus)
 	}
 
 	// update status when succeed
 	templateStatus := &tmplv1.TemplateStatus{
-		Message: "update success",
-		Status:  tmplv1.TemplateSuccess,
+		Message:            "update success",
+		Status:             tmplv1.TemplateSuccess,
+		ObservedGeneration: updateTemplate.Generation,
+		LatestRevision:     revision,
 	}
 	return r.updateClusterTemplateStatus(template, templateStatus)
 }
@@ -0,0 +1,93 @@
+package clustertemplate
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/internal"
+)
+
+// ensureRevision records the current template as an immutable revision and returns the name of the revision.
+// It fails when objects or parameters of an already released version are changed.
+func (r *ClusterTemplateReconciler) ensureRevision(template *tmplv1.ClusterTemplate) (string, error) {
+	hash, err := internal.TemplateHash(&template.TemplateSpec)
+	if err != nil {
+		return "", err
+	}
+	name := internal.RevisionName(template.Name, template.Version, hash)
+
+	revision := &tmplv1.ClusterTemplateRevision{}
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: name}, revision)
+	if err == nil {
+		if revision.Spec.Hash != hash {
+			return "", fmt.Errorf("version %s is already released with different objects or parameters, change the version", template.Version)
+		}
+		return name, nil
+	}
+	if !errors.IsNotFound(err) {
+		return "", err
+	}
+
+	revisions := &tmplv1.ClusterTemplateRevisionList{}
+	if err := r.Client.List(context.TODO(), revisions, client.MatchingLabels{internal.RevisionTemplateLabel: template.Name}); err != nil {
+		return "", err
+	}
+	var last int64
+	for _, rev := range revisions.Items {
+		if rev.Spec.Revision > last {
+			last = rev.Spec.Revision
+		}
+	}
+
+	revision = &tmplv1.ClusterTemplateRevision{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   name,
+			Labels: map[string]string{internal.RevisionTemplateLabel: template.Name},
+		},
+		Spec: tmplv1.TemplateRevisionSpec{
+			TemplateName: template.Name,
+			Version:      template.Version,
+			Revision:     last + 1,
+			Hash:         hash,
+			Template:     *template.TemplateSpec.DeepCopy(),
+		},
+	}
+	revision.Spec.Template.ObjectKinds = nil
+	if err := controllerutil.SetOwnerReference(template, revision, r.Scheme); err != nil {
+		return "", err
+	}
+	if err := r.Client.Create(context.TODO(), revision); err != nil {
+		return "", err
+	}
+	if err := r.pruneRevisions(template, name, revisions.Items); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// pruneRevisions deletes revisions without version which are neither the latest one nor deployed by instances.
+// Revisions without version are created whenever the template is changed, so they are not kept forever.
+func (r *ClusterTemplateReconciler) pruneRevisions(template *tmplv1.ClusterTemplate, latest string, revisions []tmplv1.ClusterTemplateRevision) error {
+	instances := &tmplv1.TemplateInstanceList{}
+	if err := r.Client.List(context.TODO(), instances); err != nil {
+		return err
+	}
+	deployed := internal.DeployedRevisions(instances.Items, true)
+	for idx := range revisions {
+		rev := &revisions[idx]
+		if rev.Name == latest || len(rev.Spec.Version) != 0 || deployed[rev.Name] {
+			continue
+		}
+		if err := r.Client.Delete(context.TODO(), rev); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+	}
+	return nil
+}
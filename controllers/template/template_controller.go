@@ -39,6 +39,8 @@ type TemplateReconciler struct {
 
 // +kubebuilder:rbac:groups=tmax.io,resources=templates,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=tmax.io,resources=templates/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=tmax.io,resources=templaterevisions,verbs=get;list;watch;create;delete
+// +kubebuilder:rbac:groups=tmax.io,resources=templateinstances,verbs=get;list;watch
 
 func (r *TemplateReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	reqLogger := r.Log.WithValues("Request.Namespace", req.Namespace, "Request.Name", req.Name)
@@ -58,8 +60,8 @@ func (r *TemplateReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 		return ctrl.Result{}, err
 	}
 
-	// if status field is not nil, end reconcile
-	if len(template.Status.Status) != 0 {
+	// if status field is not nil and the template is not changed, end reconcile
+	if len(template.Status.Status) != 0 && template.Status.ObservedGeneration == template.Generation {
 		reqLogger.Info("already handled template")
 		return ctrl.Result{}, nil
 	}
@@ -73,8 +75,10 @@ func (r *TemplateReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	if err := templateResolver.SetObjectKinds(); err != nil {
 		reqLogger.Error(err, "cannot decode object")
 		templateStatus := &tmplv1.TemplateStatus{
-			Message: "cannot decode object",
-			Status:  tmplv1.TemplateError,
+			Message:            "cannot decode object",
+			Status:             tmplv1.TemplateError,
+			ObservedGeneration: template.Generation,
+			LatestRevision:     template.Status.LatestRevision,
 		}
 		return r.updateTemplateStatus(template, templateStatus)
 	}
@@ -87,16 +91,34 @@ func (r *TemplateReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	if err = r.Client.Patch(context.TODO(), updateTemplate, client.MergeFrom(template)); err != nil {
 		reqLogger.Error(err, "cannot update template")
 		templateStatus := &tmplv1.TemplateStatus{
-			Message: "cannot update template",
-			Status:  tmplv1.TemplateError,
+			Message:            "cannot update template",
+			Status:             tmplv1.TemplateError,
+			ObservedGeneration: template.Generation,
+			LatestRevision:     template.Status.LatestRevision,
+		}
+		return r.updateTemplateStatus(template, templateStatus)
+	}
+
+	// record the template as a revision which template instances can be pinned to
+	revision, err := r.ensureRevision(updateTemplate)
+	if err != nil {
+		reqLogger.Error(err, "cannot create revision")
+		templateStatus := &tmplv1.TemplateStatus{
+			Message:            err.Error(),
+			Reason:             "cannot create revision",
+			Status:             tmplv1.TemplateError,
+			ObservedGeneration: updateTemplate.Generation,
+			LatestRevision:     template.Status.LatestRevision,
 		}
 		return r.updateTemplateStatus(template, templateStatus)
 	}
 
 	// update status when succeed
 	templateStatus := &tmplv1.TemplateStatus{
-		Message: "update success",
-		Status:  tmplv1.TemplateSuccess,
+		Message:            "update success",
+		Status:             tmplv1.TemplateSuccess,
+		ObservedGeneration: updateTemplate.Generation,
+		LatestRevision:     revision,
 	}
 	return r.updateTemplateStatus(template, templateStatus)
 }
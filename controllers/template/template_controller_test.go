@@ -29,6 +29,7 @@ func TestTemplateController(t *testing.T) {
 			Namespace: namespace,
 		},
 		TemplateSpec: tmplv1.TemplateSpec{
+			Version: "1.0",
 			Objects: []runtime.RawExtension{
 				{Raw: []byte(`{"kind": "Deployment"}`)},
 				{Raw: []byte(`{"kind": "Service"}`)},
@@ -40,7 +41,8 @@ func TestTemplateController(t *testing.T) {
 	objs := []runtime.Object{template}
 
 	s := scheme.Scheme
-	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template)
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template, &tmplv1.TemplateRevision{}, &tmplv1.TemplateRevisionList{},
+		&tmplv1.TemplateInstance{}, &tmplv1.TemplateInstanceList{})
 
 	cl := fake.NewFakeClient(objs...)
 
@@ -71,4 +73,90 @@ func TestTemplateController(t *testing.T) {
 	assert.Equal(t, "Deployment", ok[0], "ObjectKinds have unexpected value")
 	assert.Equal(t, "Service", ok[1], "ObjectKinds have unexpected value")
 	assert.Equal(t, "Secret", ok[2], "ObjectKinds have unexpected value")
+
+	// Check if the template is recorded as a revision
+	require.Equal(t, tmplv1.TemplateSuccess, tp.Status.Status, tp.Status.Message)
+	assert.Equal(t, "test-1.0-d0ff59", tp.Status.LatestRevision)
+
+	rev := &tmplv1.TemplateRevision{}
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: tp.Status.LatestRevision}, rev)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), rev.Spec.Revision)
+	assert.Equal(t, "1.0", rev.Spec.Version)
+	assert.Len(t, rev.Spec.Template.Objects, 3)
+
+	// objects of the released version cannot be changed
+	tp.Objects = tp.Objects[:2]
+	tp.Generation = tp.Status.ObservedGeneration + 1
+	require.NoError(t, r.Client.Update(context.TODO(), tp))
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, tp))
+	assert.Equal(t, tmplv1.TemplateError, tp.Status.Status)
+	assert.Equal(t, "test-1.0-d0ff59", tp.Status.LatestRevision)
+
+	// new version is recorded as the next revision
+	tp.Version = "1.1"
+	tp.Generation = tp.Status.ObservedGeneration + 1
+	require.NoError(t, r.Client.Update(context.TODO(), tp))
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, tp))
+	require.Equal(t, tmplv1.TemplateSuccess, tp.Status.Status, tp.Status.Message)
+	assert.Equal(t, "test-1.1-b05e24", tp.Status.LatestRevision)
+
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: "test-1.1-b05e24"}, rev)
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), rev.Spec.Revision)
+	assert.Len(t, rev.Spec.Template.Objects, 2)
+
+	// versions sanitized to the same name are recorded as different revisions
+	tp.Version = "1-0"
+	tp.Generation = tp.Status.ObservedGeneration + 1
+	require.NoError(t, r.Client.Update(context.TODO(), tp))
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, tp))
+	require.Equal(t, tmplv1.TemplateSuccess, tp.Status.Status, tp.Status.Message)
+	assert.Equal(t, "test-1-0-a302da", tp.Status.LatestRevision)
+
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: "test-1-0-a302da"}, rev)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), rev.Spec.Revision)
+	assert.Equal(t, "1-0", rev.Spec.Version)
+
+	// revisions without version are pruned unless they are deployed by instances
+	edit := func(mutate func(tp *tmplv1.Template)) string {
+		require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, tp))
+		mutate(tp)
+		tp.Generation = tp.Status.ObservedGeneration + 1
+		require.NoError(t, r.Client.Update(context.TODO(), tp))
+		_, err := r.Reconcile(req)
+		require.NoError(t, err)
+		require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, tp))
+		require.Equal(t, tmplv1.TemplateSuccess, tp.Status.Status, tp.Status.Message)
+		return tp.Status.LatestRevision
+	}
+	deployed := edit(func(tp *tmplv1.Template) { tp.Version = "" })
+	require.NoError(t, r.Client.Create(context.TODO(), &tmplv1.TemplateInstance{
+		ObjectMeta: metav1.ObjectMeta{Name: "instance", Namespace: namespace},
+		Spec:       tmplv1.TemplateInstanceSpec{Template: &tmplv1.ObjectInfo{Metadata: tmplv1.MetadataSpec{Name: name}}},
+		Status: tmplv1.TemplateInstanceStatus{
+			History: []tmplv1.InstanceRevisionSpec{{Revision: 1, TemplateRevision: deployed}},
+		},
+	}))
+	unused := edit(func(tp *tmplv1.Template) { tp.Objects = tp.Objects[:1] })
+	latest := edit(func(tp *tmplv1.Template) { tp.Objects = append(tp.Objects, runtime.RawExtension{Raw: []byte(`{"kind": "ConfigMap"}`)}) })
+	assert.NotEqual(t, unused, latest)
+
+	revisions := &tmplv1.TemplateRevisionList{}
+	require.NoError(t, r.Client.List(context.TODO(), revisions))
+	names := []string{}
+	for _, rev := range revisions.Items {
+		names = append(names, rev.Name)
+	}
+	assert.ElementsMatch(t, []string{"test-1.0-d0ff59", "test-1.1-b05e24", "test-1-0-a302da", deployed, latest}, names)
 }
@@ -0,0 +1,257 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package templatebinding
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/controllers/templateinstance"
+	"github.com/tmax-cloud/template-operator/internal"
+)
+
+// TemplateBindingReconciler reconciles a TemplateBinding object
+type TemplateBindingReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+}
+
+// +kubebuilder:rbac:groups=tmax.io,resources=templatebindings,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=tmax.io,resources=templatebindings/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+
+func (r *TemplateBindingReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
+	reqLogger := r.Log.WithValues("Request.Namespace", req.Namespace, "Request.Name", req.Name)
+	reqLogger.Info("Reconciling TemplateBinding")
+
+	binding := &tmplv1.TemplateBinding{}
+	if err := r.Client.Get(context.TODO(), req.NamespacedName, binding); err != nil {
+		if errors.IsNotFound(err) {
+			// the secret is garbage collected with the binding
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+
+	instance := &tmplv1.TemplateInstance{}
+	if err := r.Client.Get(context.TODO(), types.NamespacedName{Namespace: binding.Namespace, Name: binding.Spec.TemplateInstance}, instance); err != nil {
+		if errors.IsNotFound(err) {
+			return r.updateBindingStatus(binding, tmplv1.BindingWaiting, fmt.Sprintf("template instance %s is not found", binding.Spec.TemplateInstance), binding.Status.SecretName, nil)
+		}
+		return ctrl.Result{}, err
+	}
+	// credentials are taken after the instance is ready
+	if ready, msg := instanceReady(instance); !ready {
+		reqLogger.Info(msg)
+		return r.updateBindingStatus(binding, tmplv1.BindingWaiting, msg, binding.Status.SecretName, nil)
+	}
+
+	data, err := r.getCredentials(instance)
+	if err != nil {
+		reqLogger.Error(err, "cannot get credentials")
+		return r.updateBindingStatus(binding, tmplv1.BindingError, err.Error(), binding.Status.SecretName, err)
+	}
+
+	secretName := binding.Spec.SecretName
+	if len(secretName) == 0 {
+		secretName = binding.Name
+	}
+	// secrets which are not created by the binding are not overwritten
+	if err := r.checkSecretOwner(binding, secretName); err != nil {
+		reqLogger.Error(err, "cannot use secret")
+		return r.updateBindingStatus(binding, tmplv1.BindingError, err.Error(), binding.Status.SecretName, err)
+	}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: secretName, Namespace: binding.Namespace}}
+	if _, err := controllerutil.CreateOrUpdate(context.TODO(), r.Client, secret, func() error {
+		if secret.Labels == nil {
+			secret.Labels = map[string]string{}
+		}
+		secret.Labels[internal.BindingLabel] = binding.Name
+		secret.Data = data
+		return controllerutil.SetControllerReference(binding, secret, r.Scheme)
+	}); err != nil {
+		reqLogger.Error(err, "cannot create secret")
+		return r.updateBindingStatus(binding, tmplv1.BindingError, err.Error(), binding.Status.SecretName, err)
+	}
+
+	// the previous secret is removed when the secret name is changed
+	if prev := binding.Status.SecretName; len(prev) != 0 && prev != secretName {
+		if err := r.deleteSecret(binding, prev); err != nil {
+			reqLogger.Error(err, "cannot delete previous secret")
+			return ctrl.Result{}, err
+		}
+	}
+
+	return r.updateBindingStatus(binding, tmplv1.BindingReady, "credentials are stored in secret "+secretName, secretName, nil)
+}
+
+// instanceReady reports whether objects of the template instance are created and ready
+func instanceReady(instance *tmplv1.TemplateInstance) (bool, string) {
+	if instance.Status.Template == nil && instance.Status.ClusterTemplate == nil {
+		return false, fmt.Sprintf("template instance %s is not instantiated yet", instance.Name)
+	}
+	for _, cond := range instance.Status.Conditions {
+		if cond.Type == "" && cond.Status == "Error" {
+			return false, fmt.Sprintf("template instance %s has an error: %s", instance.Name, cond.Message)
+		}
+		if cond.Type == tmplv1.ConditionTypeReady && cond.Status != "True" {
+			return false, fmt.Sprintf("objects of template instance %s are not ready", instance.Name)
+		}
+	}
+	if instance.Status.ObservedGeneration != instance.Generation {
+		return false, fmt.Sprintf("template instance %s is being updated", instance.Name)
+	}
+	return true, ""
+}
+
+// getCredentials resolves credentials declared in the template which the instance is deployed with.
+// Values of service binding parameters of the active plan are added as well.
+func (r *TemplateBindingReconciler) getCredentials(instance *tmplv1.TemplateInstance) (map[string][]byte, error) {
+	snapshot, specInfo := instance.Status.Template, instance.Spec.Template
+	if instance.Status.ClusterTemplate != nil {
+		snapshot, specInfo = instance.Status.ClusterTemplate, instance.Spec.ClusterTemplate
+	}
+	if specInfo == nil {
+		return nil, fmt.Errorf("template instance %s has no template", instance.Name)
+	}
+
+	plan, err := internal.SelectPlan(snapshot.Plans, snapshot.Plan, "")
+	if err != nil {
+		return nil, err
+	}
+	if plan != nil && !plan.Bindable {
+		return nil, fmt.Errorf("plan %s of template %s is not bindable", plan.Name, snapshot.Metadata.Name)
+	}
+	if len(snapshot.Credentials) == 0 && (plan == nil || len(plan.Schemas.ServiceBinding.Create.Parameters) == 0) {
+		return nil, fmt.Errorf("template %s has no credentials", snapshot.Metadata.Name)
+	}
+
+	instanceParams, err := internal.ResolveValueFrom(r.Client, instance.Namespace, specInfo.Parameters)
+	if err != nil {
+		return nil, err
+	}
+	generated, err := internal.GetGeneratedValues(r.Client, instance)
+	if err != nil {
+		return nil, err
+	}
+	instanceParams = internal.WithGeneratedValues(snapshot.Parameters, instanceParams, generated)
+	params, err := templateinstance.ResolveParameters(snapshot, instanceParams)
+	if err != nil {
+		return nil, err
+	}
+
+	data := map[string][]byte{}
+	if plan != nil {
+		for key, val := range plan.Schemas.ServiceBinding.Create.Parameters {
+			data[key] = []byte(internal.ReplaceParamRefs(val.String(), params))
+		}
+	}
+	for _, cred := range snapshot.Credentials {
+		val, err := internal.ResolveOutput(r.Client, instance, cred, params)
+		if err != nil {
+			return nil, fmt.Errorf("credential %s: %s", cred.Name, err.Error())
+		}
+		data[cred.Name] = []byte(val)
+	}
+	return data, nil
+}
+
+func (r *TemplateBindingReconciler) checkSecretOwner(binding *tmplv1.TemplateBinding, name string) error {
+	secret := &corev1.Secret{}
+	if err := r.Client.Get(context.TODO(), types.NamespacedName{Namespace: binding.Namespace, Name: name}, secret); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !metav1.IsControlledBy(secret, binding) {
+		return fmt.Errorf("secret %s already exists and is not owned by the binding", name)
+	}
+	return nil
+}
+
+func (r *TemplateBindingReconciler) deleteSecret(binding *tmplv1.TemplateBinding, name string) error {
+	secret := &corev1.Secret{}
+	if err := r.Client.Get(context.TODO(), types.NamespacedName{Namespace: binding.Namespace, Name: name}, secret); err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	if !metav1.IsControlledBy(secret, binding) {
+		return nil
+	}
+	return client.IgnoreNotFound(r.Client.Delete(context.TODO(), secret))
+}
+
+func (r *TemplateBindingReconciler) updateBindingStatus(
+	binding *tmplv1.TemplateBinding, status tmplv1.BindingStatusType, message, secretName string, err error) (ctrl.Result, error) {
+	reqLogger := r.Log.WithName("update template binding status")
+
+	updated := binding.DeepCopy()
+	if updated.Status.Status != status || updated.Status.LastTransitionTime == nil {
+		now := metav1.Now()
+		updated.Status.LastTransitionTime = &now
+	}
+	updated.Status.Status = status
+	updated.Status.Message = message
+	updated.Status.SecretName = secretName
+
+	if errUp := r.Client.Status().Patch(context.TODO(), updated, client.MergeFrom(binding)); errUp != nil {
+		reqLogger.Error(errUp, "could not update TemplateBinding status")
+		return ctrl.Result{}, errUp
+	}
+	return ctrl.Result{}, err
+}
+
+func (r *TemplateBindingReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&tmplv1.TemplateBinding{}).
+		Owns(&corev1.Secret{}).
+		// bindings are reconciled again when the instance is ready or updated
+		Watches(&source.Kind{Type: &tmplv1.TemplateInstance{}}, &handler.EnqueueRequestsFromMapFunc{
+			ToRequests: handler.ToRequestsFunc(r.bindingsOfInstance),
+		}).
+		Complete(r)
+}
+
+func (r *TemplateBindingReconciler) bindingsOfInstance(obj handler.MapObject) []reconcile.Request {
+	bindings := &tmplv1.TemplateBindingList{}
+	if err := r.Client.List(context.TODO(), bindings, client.InNamespace(obj.Meta.GetNamespace())); err != nil {
+		r.Log.Error(err, "cannot list template bindings")
+		return nil
+	}
+	requests := []reconcile.Request{}
+	for _, binding := range bindings.Items {
+		if binding.Spec.TemplateInstance == obj.Meta.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Namespace: binding.Namespace, Name: binding.Name}})
+		}
+	}
+	return requests
+}
@@ -0,0 +1,166 @@
+package templatebinding
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/internal"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	runtime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+)
+
+func TestTemplateBindingController(t *testing.T) {
+	var (
+		instanceName = "test-instance"
+		bindingName  = "test-binding"
+		objectName   = "test-object"
+		namespace    = "test-ns"
+	)
+
+	snapshot := &tmplv1.ObjectInfo{
+		Metadata: tmplv1.MetadataSpec{Name: "test-template"},
+		Plan:     "standard",
+		Plans: []tmplv1.PlanSpec{
+			{Name: "standard", Bindable: true, Schemas: tmplv1.Schemas{ServiceBinding: tmplv1.ServiceBindingSchema{
+				Create: tmplv1.SchemaParameters{Parameters: map[string]intstr.IntOrString{
+					"database": intstr.FromString("${NAME}-db"),
+				}},
+			}}},
+			{Name: "private"},
+		},
+		Credentials: []tmplv1.OutputSpec{
+			{Name: "host", Value: "${NAME}.${NAMESPACE}.svc"},
+			{Name: "port", ObjectRef: &tmplv1.OutputObjectRef{Kind: "Service", Name: "${NAME}"}, JSONPath: ".spec.ports[0].port"},
+			{Name: "password", ObjectRef: &tmplv1.OutputObjectRef{APIVersion: "v1", Kind: "Secret", Name: "${NAME}"}, JSONPath: `{.data.password}`},
+		},
+		Parameters: []tmplv1.ParamSpec{
+			{Name: "NAME", ValueType: "string", Value: tmplv1.FromString("")},
+			{Name: "NAMESPACE", ValueType: "string", Value: tmplv1.FromString(namespace)},
+		},
+	}
+
+	instance := &tmplv1.TemplateInstance{
+		ObjectMeta: metav1.ObjectMeta{Name: instanceName, Namespace: namespace},
+		Spec: tmplv1.TemplateInstanceSpec{
+			Template: &tmplv1.ObjectInfo{
+				Metadata: tmplv1.MetadataSpec{Name: "test-template"},
+				Plan:     "standard",
+				Parameters: []tmplv1.ParamSpec{
+					{Name: "NAME", Value: tmplv1.FromString(objectName)},
+				},
+			},
+		},
+	}
+
+	binding := &tmplv1.TemplateBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: bindingName, Namespace: namespace},
+		Spec:       tmplv1.TemplateBindingSpec{TemplateInstance: instanceName},
+	}
+
+	service := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: objectName, Namespace: namespace},
+		Spec:       corev1.ServiceSpec{Ports: []corev1.ServicePort{{Port: 5432}}},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: objectName, Namespace: namespace},
+		Data:       map[string][]byte{"password": []byte("s3cr3t")},
+	}
+
+	objs := []runtime.Object{instance, binding, service, secret}
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, instance, binding, &tmplv1.TemplateBindingList{})
+
+	r := &TemplateBindingReconciler{
+		Client: fake.NewFakeClientWithScheme(s, objs...),
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Name: bindingName, Namespace: namespace}}
+
+	// the binding waits for the instance to be instantiated
+	_, err := r.Reconcile(req)
+	require.NoError(t, err)
+
+	tb := &tmplv1.TemplateBinding{}
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, tb))
+	assert.Equal(t, tmplv1.BindingWaiting, tb.Status.Status)
+	assert.NotNil(t, tb.Status.LastTransitionTime)
+
+	// objects of the instance become ready
+	ti := &tmplv1.TemplateInstance{}
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: instanceName, Namespace: namespace}, ti))
+	ti.Status.Template = snapshot
+	ti.Status.Objects = []tmplv1.StatusObjectSpec{
+		{Ref: tmplv1.RefSpec{ApiVersion: "v1", Kind: "Service", Name: objectName, Namespace: namespace}},
+		{Ref: tmplv1.RefSpec{ApiVersion: "v1", Kind: "Secret", Name: objectName, Namespace: namespace}},
+	}
+	ti.Status.Conditions = []tmplv1.ConditionSpec{
+		{Type: "", Status: "Succeeded"},
+		{Type: tmplv1.ConditionTypeReady, Status: "True"},
+	}
+	require.NoError(t, r.Client.Status().Update(context.TODO(), ti))
+
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, tb))
+	assert.Equal(t, tmplv1.BindingReady, tb.Status.Status)
+	assert.Equal(t, bindingName, tb.Status.SecretName)
+
+	credentials := &corev1.Secret{}
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: bindingName, Namespace: namespace}, credentials))
+	assert.Equal(t, map[string][]byte{
+		"host":     []byte(objectName + "." + namespace + ".svc"),
+		"port":     []byte("5432"),
+		"password": []byte("s3cr3t"),
+		"database": []byte(objectName + "-db"),
+	}, credentials.Data)
+	assert.Equal(t, bindingName, credentials.Labels[internal.BindingLabel])
+	assert.True(t, metav1.IsControlledBy(credentials, tb))
+
+	// the secret is moved when the secret name is changed
+	tb.Spec.SecretName = "renamed"
+	require.NoError(t, r.Client.Update(context.TODO(), tb))
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, tb))
+	assert.Equal(t, "renamed", tb.Status.SecretName)
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "renamed", Namespace: namespace}, &corev1.Secret{}))
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: bindingName, Namespace: namespace}, &corev1.Secret{})
+	assert.Error(t, err, "previous secret is not deleted")
+
+	// secrets not owned by the binding are not overwritten
+	tb.Spec.SecretName = objectName
+	require.NoError(t, r.Client.Update(context.TODO(), tb))
+	_, err = r.Reconcile(req)
+	require.Error(t, err)
+
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, tb))
+	assert.Equal(t, tmplv1.BindingError, tb.Status.Status)
+	assert.Contains(t, tb.Status.Message, "not owned by the binding")
+
+	// plans which are not bindable cannot be bound
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: instanceName, Namespace: namespace}, ti))
+	ti.Status.Template.Plan = "private"
+	require.NoError(t, r.Client.Status().Update(context.TODO(), ti))
+	_, err = r.Reconcile(req)
+	require.Error(t, err)
+
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, tb))
+	assert.Equal(t, tmplv1.BindingError, tb.Status.Status)
+	assert.Contains(t, tb.Status.Message, "not bindable")
+}
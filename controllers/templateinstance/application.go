@@ -0,0 +1,206 @@
+package templateinstance
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/internal"
+	"github.com/tmax-cloud/template-operator/schemas"
+)
+
+const (
+	defaultApplicationNamespace = "argocd"
+	defaultApplicationProject   = "default"
+	defaultDestinationServer    = "https://kubernetes.default.svc"
+	// Applications with the finalizer delete the deployed objects when they are deleted
+	applicationResourcesFinalizer = "resources-finalizer.argocd.argoproj.io"
+)
+
+// applicationKey returns the namespace and name of the Application of the gitops spec
+func applicationKey(instance *tmplv1.TemplateInstance, gitops tmplv1.GitopsSpec) types.NamespacedName {
+	key := types.NamespacedName{Namespace: gitops.Application.Namespace, Name: gitops.Application.Name}
+	if len(key.Namespace) == 0 {
+		key.Namespace = defaultApplicationNamespace
+	}
+	if len(key.Name) == 0 {
+		key.Name = instance.Namespace + "-" + instance.Name
+	}
+	return key
+}
+
+// checkApplication rejects Applications which deploy the objects out of the namespace of the instance,
+// unless the operator allows overriding the namespace, project and destination of Applications
+func (r *TemplateInstanceReconciler) checkApplication(instance *tmplv1.TemplateInstance) error {
+	spec := instance.Spec.Gitops.Application
+	if spec == nil || r.AllowApplicationOverrides {
+		return nil
+	}
+	if len(spec.Namespace) != 0 && spec.Namespace != defaultApplicationNamespace {
+		return fmt.Errorf("namespace of the application cannot be changed from %s", defaultApplicationNamespace)
+	}
+	if len(spec.Project) != 0 && spec.Project != defaultApplicationProject {
+		return fmt.Errorf("project of the application cannot be changed from %s", defaultApplicationProject)
+	}
+	dest := spec.Destination
+	if len(dest.Name) != 0 || (len(dest.Server) != 0 && dest.Server != defaultDestinationServer) {
+		return fmt.Errorf("destination of the application cannot be changed from %s", defaultDestinationServer)
+	}
+	if len(dest.Namespace) != 0 && dest.Namespace != instance.Namespace {
+		return fmt.Errorf("destination namespace of the application cannot be changed from %s", instance.Namespace)
+	}
+	return nil
+}
+
+// buildApplication returns the Application which deploys the files committed for the instance
+func buildApplication(instance *tmplv1.TemplateInstance, gitops tmplv1.GitopsSpec) (*unstructured.Unstructured, error) {
+	spec := gitops.Application
+	key := applicationKey(instance, gitops)
+
+	app := &schemas.Application{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      key.Name,
+			Namespace: key.Namespace,
+			// owner labels and annotation are used to find the instance when the status of the Application is changed
+			Labels:      ownerLabels(instance),
+			Annotations: map[string]string{internal.InstanceOwnerAnnotation: instance.Name},
+			Finalizers:  []string{applicationResourcesFinalizer},
+		},
+		Spec: schemas.ApplicationSpec{
+			Source: schemas.ApplicationSource{
+				RepoURL:        internal.MutateRepoURL(gitops.SourceGitRepo),
+				Path:           internal.InstanceDir(gitops, instance.Namespace, instance.Name),
+				TargetRevision: internal.GitopsBranch(gitops),
+			},
+			Destination: schemas.ApplicationDestination{
+				Server:    spec.Destination.Server,
+				Name:      spec.Destination.Name,
+				Namespace: spec.Destination.Namespace,
+			},
+			Project: spec.Project,
+		},
+	}
+	app.SetGroupVersionKind(schemas.ApplicationGroupVersionKind)
+	if len(app.Spec.Destination.Server) == 0 && len(app.Spec.Destination.Name) == 0 {
+		app.Spec.Destination.Server = defaultDestinationServer
+	}
+	if len(app.Spec.Destination.Namespace) == 0 {
+		app.Spec.Destination.Namespace = instance.Namespace
+	}
+	if len(app.Spec.Project) == 0 {
+		app.Spec.Project = defaultApplicationProject
+	}
+	if spec.Automated != nil {
+		app.Spec.SyncPolicy = &schemas.SyncPolicy{Automated: &schemas.SyncPolicyAutomated{
+			Prune:    spec.Automated.Prune,
+			SelfHeal: spec.Automated.SelfHeal,
+		}}
+	}
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(app)
+	if err != nil {
+		return nil, err
+	}
+	// status is owned by Argo CD
+	delete(content, "status")
+	return &unstructured.Unstructured{Object: content}, nil
+}
+
+// syncApplication applies the Application of the instance and reflects its sync and health status in Synced and Ready conditions.
+// It returns whether the Application is synced and healthy.
+func (r *TemplateInstanceReconciler) syncApplication(instance *tmplv1.TemplateInstance) (bool, error) {
+	gitops := instance.Spec.Gitops
+	if gitops.Application == nil {
+		return true, nil
+	}
+	desired, err := buildApplication(instance, gitops)
+	if err != nil {
+		return false, err
+	}
+
+	// Applications which are not created by the instance are not overwritten
+	live := &unstructured.Unstructured{}
+	live.SetGroupVersionKind(schemas.ApplicationGroupVersionKind)
+	if err := r.Client.Get(context.TODO(), applicationKey(instance, gitops), live); err == nil {
+		if !isOwnedBy(live, instance) {
+			return false, fmt.Errorf("application %s/%s already exists and is not owned by the instance", live.GetNamespace(), live.GetName())
+		}
+	} else if !errors.IsNotFound(err) {
+		return false, err
+	}
+	if err := r.applyObject(desired, instance.Spec.ForceConflicts); err != nil {
+		return false, err
+	}
+
+	// the applied object has the status of the Application
+	status := &schemas.ApplicationStatus{}
+	if content, exist, err := unstructured.NestedMap(desired.Object, "status"); err != nil {
+		return false, err
+	} else if exist {
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(content, status); err != nil {
+			return false, err
+		}
+	}
+	name := desired.GetNamespace() + "/" + desired.GetName()
+
+	sync := status.Sync
+	if len(sync.Status) == 0 {
+		sync.Status = schemas.SyncStatusCodeUnknown
+	}
+	synced := tmplv1.ConditionSpec{
+		Type:    tmplv1.ConditionTypeSynced,
+		Status:  "False",
+		Reason:  "Application" + string(sync.Status),
+		Message: fmt.Sprintf("application %s is %s", name, sync.Status),
+	}
+	if len(sync.Revision) != 0 {
+		synced.Message += " at revision " + sync.Revision
+	}
+	if sync.Status == schemas.SyncStatusCodeSynced {
+		synced.Status = "True"
+	}
+
+	health := status.Health
+	if len(health.Status) == 0 {
+		health.Status = schemas.HealthStatusUnknown
+	}
+	ready := tmplv1.ConditionSpec{
+		Type:    tmplv1.ConditionTypeReady,
+		Status:  "False",
+		Reason:  "Application" + string(health.Status),
+		Message: fmt.Sprintf("application %s is %s", name, health.Status),
+	}
+	if len(health.Message) != 0 {
+		ready.Message += ": " + health.Message
+	}
+	if health.Status == schemas.HealthStatusHealthy {
+		ready.Status = "True"
+	}
+
+	instance.Status.Conditions = setCondition(instance.Status.Conditions, synced)
+	instance.Status.Conditions = setCondition(instance.Status.Conditions, ready)
+	return synced.Status == "True" && ready.Status == "True", nil
+}
+
+// deleteApplication deletes the Application of the gitops spec, and the objects deployed by it are deleted by Argo CD
+func (r *TemplateInstanceReconciler) deleteApplication(instance *tmplv1.TemplateInstance, gitops tmplv1.GitopsSpec) error {
+	if gitops.Application == nil {
+		return nil
+	}
+	live := &unstructured.Unstructured{}
+	live.SetGroupVersionKind(schemas.ApplicationGroupVersionKind)
+	if err := r.Client.Get(context.TODO(), applicationKey(instance, gitops), live); err != nil {
+		return client.IgnoreNotFound(err)
+	}
+	if !isOwnedBy(live, instance) {
+		return nil
+	}
+	return client.IgnoreNotFound(r.Client.Delete(context.TODO(), live))
+}
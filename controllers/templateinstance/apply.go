@@ -0,0 +1,76 @@
+package templateinstance
+
+import (
+	"context"
+	goerrors "errors"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/internal"
+)
+
+// fieldManager owns the fields of objects applied by the template instance controller
+const fieldManager = "template-operator"
+
+// applyObject applies the rendered object with server-side apply.
+// Fields which are not declared in the template stay with their managers, and fields declared in the template
+// but managed by others make the apply fail with a conflict, unless force is set to take their ownership.
+func (r *TemplateInstanceReconciler) applyObject(unstr *unstructured.Unstructured, force bool) error {
+	unstr.SetResourceVersion("")
+	unstr.SetManagedFields(nil)
+
+	opts := []client.PatchOption{client.FieldOwner(fieldManager)}
+	if force {
+		opts = append(opts, client.ForceOwnership)
+	}
+	if err := r.Client.Patch(context.TODO(), unstr, client.Apply, opts...); err != nil {
+		return err
+	}
+	r.watchObject(unstr.GroupVersionKind())
+	return nil
+}
+
+// isApplyConflict reports whether the apply failed because fields of the object are managed by others
+func isApplyConflict(err error) bool {
+	var status errors.APIStatus
+	if !goerrors.As(err, &status) || status.Status().Reason != metav1.StatusReasonConflict || status.Status().Details == nil {
+		return false
+	}
+	for _, cause := range status.Status().Details.Causes {
+		if cause.Type == metav1.CauseTypeFieldManagerConflict {
+			return true
+		}
+	}
+	return false
+}
+
+// setConflictCondition records the conflict of the apply in the Conflicted condition of the instance,
+// and clears the condition when the objects are applied without conflicts
+func setConflictCondition(instance *tmplv1.TemplateInstance, err error, redactor *internal.Redactor) {
+	if err != nil && isApplyConflict(err) {
+		instance.Status.Conditions = setCondition(instance.Status.Conditions, tmplv1.ConditionSpec{
+			Type:    tmplv1.ConditionTypeConflicted,
+			Status:  "True",
+			Reason:  "FieldManagerConflict",
+			Message: redactor.Redact(err.Error()) + ", set spec.forceConflicts to take the fields",
+		})
+		return
+	}
+	if err != nil {
+		return
+	}
+	for _, cond := range instance.Status.Conditions {
+		if cond.Type == tmplv1.ConditionTypeConflicted && cond.Status == "True" {
+			instance.Status.Conditions = setCondition(instance.Status.Conditions, tmplv1.ConditionSpec{
+				Type:    tmplv1.ConditionTypeConflicted,
+				Status:  "False",
+				Reason:  "Applied",
+				Message: "objects are applied without conflicts",
+			})
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package templateinstance
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/internal"
+)
+
+// syncObjects compares rendered objects with the live objects and heals them when the sync policy is AutoHeal.
+// It is called when the reconcile is not caused by a spec change of the instance and records the result in the status of the instance.
+func (r *TemplateInstanceReconciler) syncObjects(instance *tmplv1.TemplateInstance, objs []runtime.RawExtension, redactor *internal.Redactor) error {
+	reqLogger := r.Log.WithName("sync objects")
+
+	drifted := []tmplv1.RefSpec{}
+	healed := []tmplv1.RefSpec{}
+	var conflict error
+	for idx := range objs {
+		desired, err := BytesToUnstructuredObject(&objs[idx])
+		if err != nil {
+			return err
+		}
+		if len(desired.GetNamespace()) == 0 {
+			desired.SetNamespace(instance.Namespace)
+		}
+		r.watchObject(desired.GroupVersionKind())
+
+		live := &unstructured.Unstructured{}
+		live.SetGroupVersionKind(desired.GroupVersionKind())
+		err = r.Client.Get(context.TODO(), types.NamespacedName{
+			Namespace: desired.GetNamespace(),
+			Name:      desired.GetName(),
+		}, live)
+		if err != nil && !errors.IsNotFound(err) {
+			return err
+		}
+
+		missing := errors.IsNotFound(err)
+		if !missing {
+			inSync, err := isSubset(desired.Object, live.Object)
+			if err != nil {
+				return err
+			}
+			if inSync {
+				continue
+			}
+		}
+
+		ref := objectRef(desired)
+		if instance.Spec.SyncPolicy != tmplv1.SyncPolicyAutoHeal {
+			reqLogger.Info(fmt.Sprintf("%s %s/%s drifted from the template", ref.Kind, ref.Namespace, ref.Name))
+			drifted = append(drifted, ref)
+			continue
+		}
+
+		if err = r.updateObject(&objs[idx], instance); err != nil {
+			reqLogger.Error(redactor.Error(err), fmt.Sprintf("failed to heal %s %s/%s", ref.Kind, ref.Namespace, ref.Name))
+			if isApplyConflict(err) {
+				conflict = &objectError{ref: ref, err: err}
+			}
+			drifted = append(drifted, ref)
+			continue
+		}
+		reqLogger.Info(fmt.Sprintf("%s %s/%s is healed", ref.Kind, ref.Namespace, ref.Name))
+		healed = append(healed, ref)
+	}
+
+	cond := tmplv1.ConditionSpec{
+		Type:    tmplv1.ConditionTypeSynced,
+		Status:  "True",
+		Reason:  "InSync",
+		Message: "all objects match the rendered template",
+	}
+	if len(drifted) != 0 {
+		cond.Status = "False"
+		cond.Reason = "Drifted"
+		cond.Message = "objects drifted from the rendered template: " + refsToString(drifted)
+	} else if len(healed) != 0 {
+		cond.Reason = "Healed"
+		cond.Message = "objects are re-applied with the rendered template: " + refsToString(healed)
+	}
+
+	instance.Status.DriftedObjects = nil
+	if len(drifted) != 0 {
+		instance.Status.DriftedObjects = drifted
+	}
+	instance.Status.Conditions = setCondition(instance.Status.Conditions, cond)
+	if conflict != nil || len(healed) != 0 {
+		setConflictCondition(instance, conflict, redactor)
+	}
+	return nil
+}
+
+// isSubset reports whether every field of desired has the same value in live.
+// Fields which are only in live (defaulted by api server or other controllers) are ignored.
+func isSubset(desired, live map[string]interface{}) (bool, error) {
+	d, err := normalize(desired)
+	if err != nil {
+		return false, err
+	}
+	l, err := normalize(live)
+	if err != nil {
+		return false, err
+	}
+	// status is owned by controllers of the object
+	delete(d.(map[string]interface{}), "status")
+	mergeStringData(d.(map[string]interface{}))
+	return subset(d, l), nil
+}
+
+// mergeStringData moves stringData of a Secret into data, because the api server only returns data
+func mergeStringData(obj map[string]interface{}) {
+	stringData, ok := obj["stringData"].(map[string]interface{})
+	if !ok || obj["kind"] != "Secret" || obj["apiVersion"] != "v1" {
+		return
+	}
+	data, ok := obj["data"].(map[string]interface{})
+	if !ok {
+		data = map[string]interface{}{}
+	}
+	for key, val := range stringData {
+		if str, ok := val.(string); ok {
+			data[key] = base64.StdEncoding.EncodeToString([]byte(str))
+		}
+	}
+	obj["data"] = data
+	delete(obj, "stringData")
+}
+
+// normalize makes numbers comparable by json round trip
+func normalize(obj map[string]interface{}) (interface{}, error) {
+	raw, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+	var out interface{}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func subset(desired, live interface{}) bool {
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return false
+		}
+		for key, val := range d {
+			if val == nil {
+				continue
+			}
+			if !subset(val, l[key]) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok || len(d) != len(l) {
+			return false
+		}
+		for idx := range d {
+			if !subset(d[idx], l[idx]) {
+				return false
+			}
+		}
+		return true
+	default:
+		return reflect.DeepEqual(desired, live) || equalScalar(desired, live)
+	}
+}
+
+// equalScalar compares numbers and strings by their string forms, and quantities by their canonical forms
+// (e.g. 1000m is returned as 1 by the api server)
+func equalScalar(desired, live interface{}) bool {
+	d, ok := scalarString(desired)
+	if !ok {
+		return false
+	}
+	l, ok := scalarString(live)
+	if !ok {
+		return false
+	}
+	if d == l {
+		return true
+	}
+	quantity, err := resource.ParseQuantity(d)
+	return err == nil && quantity.String() == l
+}
+
+func scalarString(val interface{}) (string, bool) {
+	switch v := val.(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	return "", false
+}
+
+func objectRef(unstr *unstructured.Unstructured) tmplv1.RefSpec {
+	return tmplv1.RefSpec{
+		ApiVersion: unstr.GetAPIVersion(),
+		Kind:       unstr.GetKind(),
+		Namespace:  unstr.GetNamespace(),
+		Name:       unstr.GetName(),
+	}
+}
+
+func refsToString(refs []tmplv1.RefSpec) string {
+	names := []string{}
+	for _, ref := range refs {
+		names = append(names, ref.Kind+" "+ref.Namespace+"/"+ref.Name)
+	}
+	return strings.Join(names, ", ")
+}
+
+// setCondition replaces the condition of the same type or appends a new one
+func setCondition(conditions []tmplv1.ConditionSpec, cond tmplv1.ConditionSpec) []tmplv1.ConditionSpec {
+	now := v1.NewTime(time.Now())
+	for idx, c := range conditions {
+		if c.Type != cond.Type {
+			continue
+		}
+		cond.LastTransitionTime = c.LastTransitionTime
+		if c.Status != cond.Status || cond.LastTransitionTime == nil {
+			cond.LastTransitionTime = &now
+		}
+		result := append([]tmplv1.ConditionSpec{}, conditions...)
+		result[idx] = cond
+		return result
+	}
+	cond.LastTransitionTime = &now
+	return append(append([]tmplv1.ConditionSpec{}, conditions...), cond)
+}
+
+// watchObject starts to watch the kind of objects created by template instances.
+// Each kind is watched only once.
+func (r *TemplateInstanceReconciler) watchObject(gvk schema.GroupVersionKind) {
+	if r.controller == nil {
+		return
+	}
+	r.watchLock.Lock()
+	defer r.watchLock.Unlock()
+	if _, exist := r.watchedKinds[gvk]; exist {
+		return
+	}
+
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(gvk)
+	if err := r.controller.Watch(
+		&source.Kind{Type: obj},
+		&handler.EnqueueRequestsFromMapFunc{ToRequests: handler.ToRequestsFunc(ownerInstanceRequests)},
+		objectChangedPredicate(),
+	); err != nil {
+		r.Log.Error(err, "failed to watch "+gvk.String())
+		return
+	}
+	r.watchedKinds[gvk] = struct{}{}
+}
+
+// ownerInstanceRequests maps an object to the template instance which created it
+func ownerInstanceRequests(a handler.MapObject) []reconcile.Request {
+	for _, ref := range a.Meta.GetOwnerReferences() {
+		if ref.Kind == "TemplateInstance" && strings.HasPrefix(ref.APIVersion, tmplv1.GroupVersion.Group+"/") {
+			return []reconcile.Request{{NamespacedName: types.NamespacedName{
+				Namespace: a.Meta.GetNamespace(),
+				Name:      ref.Name,
+			}}}
+		}
+	}
+
+	// objects created before the owner annotation only have the owner label
+	labels := a.Meta.GetLabels()
+	name := a.Meta.GetAnnotations()[internal.InstanceOwnerAnnotation]
+	if owner := labels[internal.InstanceOwnerLabel]; len(name) == 0 && strings.HasPrefix(owner, "TemplateInstance-") {
+		name = strings.TrimPrefix(owner, "TemplateInstance-")
+	}
+	if len(name) == 0 {
+		return nil
+	}
+	ns := labels[internal.InstanceNamespaceLabel]
+	if len(ns) == 0 {
+		ns = a.Meta.GetNamespace()
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{
+		Namespace: ns,
+		Name:      name,
+	}}}
+}
+
+// objectChangedPredicate ignores updates which only change the status of created objects
+func objectChangedPredicate() predicate.Predicate {
+	return predicate.Funcs{
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if e.MetaOld.GetGeneration() != e.MetaNew.GetGeneration() {
+				return true
+			}
+			if !reflect.DeepEqual(e.MetaOld.GetLabels(), e.MetaNew.GetLabels()) ||
+				!reflect.DeepEqual(e.MetaOld.GetAnnotations(), e.MetaNew.GetAnnotations()) {
+				return true
+			}
+			// kinds without generation (ConfigMap, Secret, ...) have no status to ignore
+			return e.MetaNew.GetGeneration() == 0 && e.MetaOld.GetResourceVersion() != e.MetaNew.GetResourceVersion()
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return false
+		},
+	}
+}
@@ -0,0 +1,65 @@
+package templateinstance
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/internal"
+)
+
+// generateParameters generates values of the parameters with generate option which are not generated yet.
+// Generated values are stored in a secret owned by the instance, so they are reused on every render.
+func (r *TemplateInstanceReconciler) generateParameters(instance *tmplv1.TemplateInstance, params []tmplv1.ParamSpec) (map[string][]byte, error) {
+	generate := false
+	for _, param := range params {
+		generate = generate || param.Generate != nil
+	}
+	if !generate {
+		return nil, nil
+	}
+
+	name := internal.GeneratedSecretName(instance)
+	// secrets which are not created by the instance are not overwritten
+	existing := &corev1.Secret{}
+	if err := r.Client.Get(context.TODO(), types.NamespacedName{Namespace: instance.Namespace, Name: name}, existing); err == nil {
+		if !metav1.IsControlledBy(existing, instance) {
+			return nil, fmt.Errorf("secret %s already exists and is not owned by the instance", name)
+		}
+	} else if !errors.IsNotFound(err) {
+		return nil, err
+	}
+
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: instance.Namespace}}
+	_, err := controllerutil.CreateOrUpdate(context.TODO(), r.Client, secret, func() error {
+		if secret.Labels == nil {
+			secret.Labels = map[string]string{}
+		}
+		secret.Labels[internal.GeneratedLabel] = instance.Name
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		// values generated before are never changed
+		for _, param := range params {
+			if _, exist := secret.Data[param.Name]; exist || param.Generate == nil {
+				continue
+			}
+			val, err := internal.GenerateValue(param.Generate)
+			if err != nil {
+				return fmt.Errorf("parameter %s: %s", param.Name, err.Error())
+			}
+			secret.Data[param.Name] = []byte(val)
+		}
+		return controllerutil.SetControllerReference(instance, secret, r.Scheme)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return secret.Data, nil
+}
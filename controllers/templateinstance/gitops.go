@@ -0,0 +1,199 @@
+package templateinstance
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/internal"
+)
+
+// gitopsEnabled reports whether the rendered objects are committed to a git repo instead of being created in the cluster
+func gitopsEnabled(instance *tmplv1.TemplateInstance) bool {
+	return len(instance.Spec.Gitops.SourceGitRepo) != 0
+}
+
+// checkGitopsMode rejects switching between gitops mode and creating objects in the cluster,
+// because the objects created in the previous mode would be left behind
+func checkGitopsMode(instance *tmplv1.TemplateInstance) error {
+	if gitopsEnabled(instance) && len(instance.Status.Objects) != 0 {
+		return fmt.Errorf("gitops cannot be enabled for the instance whose objects are created in the cluster")
+	}
+	if !gitopsEnabled(instance) && instance.Status.Gitops != nil {
+		return fmt.Errorf("gitops cannot be disabled for the instance whose objects are committed to %s", instance.Status.Gitops.SourceGitRepo)
+	}
+	return nil
+}
+
+// checkGitopsSecrets rejects committing secret values to the git repo in plain text.
+// Sensitive parameters, including generated values and values taken from secrets, and Secret objects are not allowed in gitops mode.
+func checkGitopsSecrets(objs []runtime.RawExtension, redactor *internal.Redactor) error {
+	if params := redactor.SensitiveParams(); len(params) != 0 {
+		return fmt.Errorf("sensitive parameters %s cannot be committed to the gitops repo in plain text", strings.Join(params, ", "))
+	}
+	for idx := range objs {
+		unstr, err := BytesToUnstructuredObject(&objs[idx])
+		if err != nil {
+			return err
+		}
+		if unstr.GetKind() == "Secret" && unstr.GetAPIVersion() == "v1" {
+			return fmt.Errorf("secret %s cannot be committed to the gitops repo in plain text", unstr.GetName())
+		}
+	}
+	return nil
+}
+
+// gitopsFiles renders the objects into yaml files named after their namespaces, kinds and names
+func gitopsFiles(instance *tmplv1.TemplateInstance, objs []runtime.RawExtension) (map[string][]byte, error) {
+	files := map[string][]byte{}
+	for idx := range objs {
+		unstr, err := BytesToUnstructuredObject(&objs[idx])
+		if err != nil {
+			return nil, err
+		}
+		if len(unstr.GetNamespace()) == 0 && !isClusterSetup(unstr) {
+			unstr.SetNamespace(instance.Namespace)
+		}
+		raw, err := unstr.MarshalJSON()
+		if err != nil {
+			return nil, err
+		}
+		data, err := yaml.JSONToYAML(raw)
+		if err != nil {
+			return nil, err
+		}
+
+		name := strings.ToLower(unstr.GetKind()) + "_" + unstr.GetName() + ".yaml"
+		if len(unstr.GetNamespace()) != 0 {
+			name = unstr.GetNamespace() + "_" + name
+		}
+		files[name] = data
+	}
+	return files, nil
+}
+
+// commitObjects commits the rendered objects to the git repo of the instance in a single commit, instead of creating them.
+// Objects are committed once per generation of the instance, and the SHA of the commit is recorded in the status.
+func (r *TemplateInstanceReconciler) commitObjects(instance, updateInstance *tmplv1.TemplateInstance, specInfo, objectInfo *tmplv1.ObjectInfo,
+	objs []runtime.RawExtension, redactor *internal.Redactor) (ctrl.Result, error) {
+	reqLogger := r.Log.WithName("commit k8s object")
+
+	if err := r.checkApplication(instance); err != nil {
+		reqLogger.Error(err, "error occurs while check application")
+		return r.updateTemplateInstanceStatus(instance, err)
+	}
+
+	prev := instance.Status.Gitops
+	if prev == nil || !reflect.DeepEqual(prev.GitopsSpec, instance.Spec.Gitops) || instance.Generation != instance.Status.ObservedGeneration {
+		// files are removed from the repo before the instance is deleted
+		if err := r.addInstanceFinalizer(updateInstance, internal.GitopsFinalizer); err != nil {
+			reqLogger.Error(err, "error occurs while update finalizer")
+			return r.updateTemplateInstanceStatus(instance, err)
+		}
+
+		if err := checkGitopsSecrets(objs, redactor); err != nil {
+			reqLogger.Error(err, "error occurs while check objects")
+			return r.updateTemplateInstanceStatus(instance, err)
+		}
+		files, err := gitopsFiles(instance, objs)
+		if err != nil {
+			reqLogger.Error(redactor.Error(err), "error occurs while render objects")
+			return r.updateTemplateInstanceStatus(instance, redactor.Error(err))
+		}
+		// files committed to the previous location are removed when the repo, path or branch is changed
+		if prev != nil && (prev.SourceGitRepo != instance.Spec.Gitops.SourceGitRepo ||
+			internal.MutateRepoPath(prev.Path) != internal.MutateRepoPath(instance.Spec.Gitops.Path) ||
+			internal.GitopsBranch(prev.GitopsSpec) != internal.GitopsBranch(instance.Spec.Gitops)) {
+			if err := r.removeCommittedFiles(instance, prev.GitopsSpec); err != nil {
+				reqLogger.Error(err, "error occurs while remove files from "+prev.SourceGitRepo)
+				return r.updateTemplateInstanceStatus(instance, err)
+			}
+		}
+
+		// the previous Application is deleted when it is renamed or removed from the spec
+		if prev != nil && prev.Application != nil &&
+			(instance.Spec.Gitops.Application == nil || applicationKey(instance, prev.GitopsSpec) != applicationKey(instance, instance.Spec.Gitops)) {
+			if err := r.deleteApplication(instance, prev.GitopsSpec); err != nil {
+				reqLogger.Error(err, "error occurs while delete application")
+				return r.updateTemplateInstanceStatus(instance, err)
+			}
+		}
+
+		branch, commit, err := internal.CommitFiles(r.Client, instance.Spec.Gitops, &internal.GitopsChange{
+			Action:     internal.GitopsActionUpdate,
+			Namespace:  instance.Namespace,
+			Name:       instance.Name,
+			Generation: instance.Generation,
+			Files:      files,
+		})
+		if err != nil {
+			reqLogger.Error(redactor.Error(err), "error occurs while commit objects to "+instance.Spec.Gitops.SourceGitRepo)
+			// the branch keeps being updated by others, so the push is tried again in the next reconcile
+			if conflict, ok := err.(*internal.PushConflictError); ok {
+				instance.Status.Conditions = setCondition(instance.Status.Conditions, tmplv1.ConditionSpec{
+					Type:    tmplv1.ConditionTypePushed,
+					Status:  "False",
+					Reason:  "RetriesExhausted",
+					Message: redactor.Redact(conflict.Error()),
+				})
+			}
+			return r.updateTemplateInstanceStatus(instance, redactor.Error(err))
+		}
+		reqLogger.Info(fmt.Sprintf("%d objects are committed to %s of %s in %s", len(files), branch, instance.Spec.Gitops.SourceGitRepo, commit))
+
+		now := v1.Now()
+		updateInstance.Status.Gitops = &tmplv1.GitopsStatusSpec{GitopsSpec: instance.Spec.Gitops, PushedBranch: branch, Commit: commit, CommittedTime: &now}
+		updateInstance.Status.ObservedGeneration = instance.Generation
+		updateInstance.Status.Conditions = setCondition(updateInstance.Status.Conditions, tmplv1.ConditionSpec{
+			Type:    tmplv1.ConditionTypePushed,
+			Status:  "True",
+			Reason:  "Pushed",
+			Message: fmt.Sprintf("objects of generation %d are pushed to %s in %s", instance.Generation, branch, commit),
+		})
+		recordRevision(updateInstance, specInfo, objectInfo, objs)
+	}
+
+	// the committed objects are deployed by the Argo CD Application
+	ready, err := r.syncApplication(updateInstance)
+	if err != nil {
+		reqLogger.Error(err, "error occurs while apply application")
+		return r.updateTemplateInstanceStatus(instance, err)
+	}
+
+	if err := r.Client.Status().Patch(context.TODO(), updateInstance, client.MergeFrom(instance)); err != nil {
+		reqLogger.Error(err, "could not update template instance status")
+		return ctrl.Result{}, err
+	}
+	if res, err := r.updateTemplateInstanceStatus(updateInstance, nil); err != nil || ready {
+		return res, err
+	}
+	// status changes of the Application are checked again later, in case they are not watched
+	return ctrl.Result{RequeueAfter: healthCheckInterval}, nil
+}
+
+// removeCommittedFiles commits removal of the files of the instance from the repo.
+// Files are left in the repo if the secret of the credentials is already deleted, not to block deletion of the namespace.
+func (r *TemplateInstanceReconciler) removeCommittedFiles(instance *tmplv1.TemplateInstance, gitops tmplv1.GitopsSpec) error {
+	if _, _, err := internal.CommitFiles(r.Client, gitops, &internal.GitopsChange{
+		Action:     internal.GitopsActionRemove,
+		Namespace:  instance.Namespace,
+		Name:       instance.Name,
+		Generation: instance.Generation,
+	}); err != nil {
+		if errors.IsNotFound(err) {
+			r.Log.Info("files of " + instance.Name + " are left in " + gitops.SourceGitRepo + ": " + err.Error())
+			return nil
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+package templateinstance
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+)
+
+// updateObjectStatus records references and health of the created objects in the status of the instance
+// and sets Ready condition. It returns whether every object is healthy.
+func (r *TemplateInstanceReconciler) updateObjectStatus(instance *tmplv1.TemplateInstance, objs []runtime.RawExtension) (bool, error) {
+	statusObjects := []tmplv1.StatusObjectSpec{}
+	notReady := []string{}
+
+	for idx := range objs {
+		desired, err := BytesToUnstructuredObject(&objs[idx])
+		if err != nil {
+			return false, err
+		}
+		if len(desired.GetNamespace()) == 0 {
+			desired.SetNamespace(instance.Namespace)
+		}
+
+		statusObject := tmplv1.StatusObjectSpec{Ref: objectRef(desired)}
+
+		live := &unstructured.Unstructured{}
+		live.SetGroupVersionKind(desired.GroupVersionKind())
+		if err := r.Client.Get(context.TODO(), types.NamespacedName{
+			Namespace: desired.GetNamespace(),
+			Name:      desired.GetName(),
+		}, live); err != nil {
+			if !errors.IsNotFound(err) {
+				return false, err
+			}
+			statusObject.Health = tmplv1.HealthSpec{Status: tmplv1.HealthMissing, Message: "object does not exist"}
+		} else {
+			statusObject.Ref.Uid = string(live.GetUID())
+			statusObject.Ref.ResourceVersion = live.GetResourceVersion()
+			if statusObject.Health, err = r.assessHealth(live); err != nil {
+				return false, err
+			}
+		}
+
+		if statusObject.Health.Status != tmplv1.HealthHealthy {
+			notReady = append(notReady, fmt.Sprintf("%s %s/%s is %s", desired.GetKind(), desired.GetNamespace(), desired.GetName(), statusObject.Health.Status))
+		}
+		statusObjects = append(statusObjects, statusObject)
+	}
+
+	cond := tmplv1.ConditionSpec{
+		Type:    tmplv1.ConditionTypeReady,
+		Status:  "True",
+		Reason:  "ObjectsHealthy",
+		Message: "all objects are healthy",
+	}
+	if len(notReady) != 0 {
+		cond.Status = "False"
+		cond.Reason = "ObjectsNotHealthy"
+		cond.Message = strings.Join(notReady, ", ")
+	}
+
+	instance.Status.Objects = statusObjects
+	instance.Status.Conditions = setCondition(instance.Status.Conditions, cond)
+	return len(notReady) == 0, nil
+}
+
+// assessHealth decides health of well-known kinds from their status.
+// Objects of other kinds are healthy when they exist.
+func (r *TemplateInstanceReconciler) assessHealth(obj *unstructured.Unstructured) (tmplv1.HealthSpec, error) {
+	gk := obj.GroupVersionKind().GroupKind()
+	switch gk.Group + "/" + gk.Kind {
+	case "apps/Deployment":
+		return deploymentHealth(obj), nil
+	case "apps/StatefulSet":
+		return replicasHealth(obj, "readyReplicas"), nil
+	case "apps/ReplicaSet":
+		return replicasHealth(obj, "availableReplicas"), nil
+	case "apps/DaemonSet":
+		return daemonSetHealth(obj), nil
+	case "/Service":
+		return r.serviceHealth(obj)
+	case "/PersistentVolumeClaim":
+		return pvcHealth(obj), nil
+	case "batch/Job":
+		return jobHealth(obj), nil
+	case "/Pod":
+		return podHealth(obj), nil
+	case "/Namespace":
+		return namespaceHealth(obj), nil
+	case "apiextensions.k8s.io/CustomResourceDefinition":
+		return crdHealth(obj), nil
+	}
+	return tmplv1.HealthSpec{Status: tmplv1.HealthHealthy}, nil
+}
+
+func deploymentHealth(obj *unstructured.Unstructured) tmplv1.HealthSpec {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		cond, ok := c.(map[string]interface{})
+		if ok && cond["type"] == "Progressing" && cond["reason"] == "ProgressDeadlineExceeded" {
+			return tmplv1.HealthSpec{Status: tmplv1.HealthDegraded, Message: fmt.Sprintf("%v", cond["message"])}
+		}
+	}
+	if observed, _, _ := unstructured.NestedInt64(obj.Object, "status", "observedGeneration"); observed < obj.GetGeneration() {
+		return tmplv1.HealthSpec{Status: tmplv1.HealthProgressing, Message: "waiting for rollout to be observed"}
+	}
+	return replicasHealth(obj, "availableReplicas")
+}
+
+func replicasHealth(obj *unstructured.Unstructured, readyField string) tmplv1.HealthSpec {
+	replicas, found, _ := unstructured.NestedInt64(obj.Object, "spec", "replicas")
+	if !found {
+		replicas = 1
+	}
+	ready, _, _ := unstructured.NestedInt64(obj.Object, "status", readyField)
+	if ready < replicas {
+		return tmplv1.HealthSpec{Status: tmplv1.HealthProgressing, Message: fmt.Sprintf("%d of %d replicas are ready", ready, replicas)}
+	}
+	return tmplv1.HealthSpec{Status: tmplv1.HealthHealthy}
+}
+
+func daemonSetHealth(obj *unstructured.Unstructured) tmplv1.HealthSpec {
+	desired, _, _ := unstructured.NestedInt64(obj.Object, "status", "desiredNumberScheduled")
+	available, _, _ := unstructured.NestedInt64(obj.Object, "status", "numberAvailable")
+	if available < desired {
+		return tmplv1.HealthSpec{Status: tmplv1.HealthProgressing, Message: fmt.Sprintf("%d of %d pods are available", available, desired)}
+	}
+	return tmplv1.HealthSpec{Status: tmplv1.HealthHealthy}
+}
+
+func (r *TemplateInstanceReconciler) serviceHealth(obj *unstructured.Unstructured) (tmplv1.HealthSpec, error) {
+	svcType, _, _ := unstructured.NestedString(obj.Object, "spec", "type")
+	if svcType == "ExternalName" {
+		return tmplv1.HealthSpec{Status: tmplv1.HealthHealthy}, nil
+	}
+	if svcType == "LoadBalancer" {
+		ingress, _, _ := unstructured.NestedSlice(obj.Object, "status", "loadBalancer", "ingress")
+		if len(ingress) == 0 {
+			return tmplv1.HealthSpec{Status: tmplv1.HealthProgressing, Message: "waiting for load balancer"}, nil
+		}
+	}
+	// endpoints of the service without selector are managed by user
+	if selector, _, _ := unstructured.NestedMap(obj.Object, "spec", "selector"); len(selector) == 0 {
+		return tmplv1.HealthSpec{Status: tmplv1.HealthHealthy}, nil
+	}
+
+	endpoints := &unstructured.Unstructured{}
+	endpoints.SetAPIVersion("v1")
+	endpoints.SetKind("Endpoints")
+	if err := r.Client.Get(context.TODO(), types.NamespacedName{
+		Namespace: obj.GetNamespace(),
+		Name:      obj.GetName(),
+	}, endpoints); err != nil {
+		if errors.IsNotFound(err) {
+			return tmplv1.HealthSpec{Status: tmplv1.HealthProgressing, Message: "no endpoints"}, nil
+		}
+		return tmplv1.HealthSpec{}, err
+	}
+	subsets, _, _ := unstructured.NestedSlice(endpoints.Object, "subsets")
+	for _, s := range subsets {
+		if subset, ok := s.(map[string]interface{}); ok {
+			if addresses, ok := subset["addresses"].([]interface{}); ok && len(addresses) != 0 {
+				return tmplv1.HealthSpec{Status: tmplv1.HealthHealthy}, nil
+			}
+		}
+	}
+	return tmplv1.HealthSpec{Status: tmplv1.HealthProgressing, Message: "no ready endpoints"}, nil
+}
+
+func pvcHealth(obj *unstructured.Unstructured) tmplv1.HealthSpec {
+	phase, _, _ := unstructured.NestedString(obj.Object, "status", "phase")
+	switch phase {
+	case "Bound":
+		return tmplv1.HealthSpec{Status: tmplv1.HealthHealthy}
+	case "Lost":
+		return tmplv1.HealthSpec{Status: tmplv1.HealthDegraded, Message: "persistent volume is lost"}
+	}
+	return tmplv1.HealthSpec{Status: tmplv1.HealthProgressing, Message: "waiting for volume to be bound"}
+}
+
+func jobHealth(obj *unstructured.Unstructured) tmplv1.HealthSpec {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		cond, ok := c.(map[string]interface{})
+		if !ok || cond["status"] != "True" {
+			continue
+		}
+		switch cond["type"] {
+		case "Complete":
+			return tmplv1.HealthSpec{Status: tmplv1.HealthHealthy}
+		case "Failed":
+			return tmplv1.HealthSpec{Status: tmplv1.HealthDegraded, Message: fmt.Sprintf("%v", cond["message"])}
+		}
+	}
+	return tmplv1.HealthSpec{Status: tmplv1.HealthProgressing, Message: "job is not completed"}
+}
+
+func podHealth(obj *unstructured.Unstructured) tmplv1.HealthSpec {
+	phase, _, _ := unstructured.NestedString(obj.Object, "status", "phase")
+	switch phase {
+	case "Succeeded":
+		return tmplv1.HealthSpec{Status: tmplv1.HealthHealthy}
+	case "Failed":
+		return tmplv1.HealthSpec{Status: tmplv1.HealthDegraded, Message: "pod is failed"}
+	case "Running":
+		conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+		for _, c := range conditions {
+			if cond, ok := c.(map[string]interface{}); ok && cond["type"] == "Ready" && cond["status"] == "True" {
+				return tmplv1.HealthSpec{Status: tmplv1.HealthHealthy}
+			}
+		}
+	}
+	return tmplv1.HealthSpec{Status: tmplv1.HealthProgressing, Message: "pod is not ready"}
+}
+
+func namespaceHealth(obj *unstructured.Unstructured) tmplv1.HealthSpec {
+	// phase of namespaces is not set until they are observed
+	if phase, found, _ := unstructured.NestedString(obj.Object, "status", "phase"); found && phase != "Active" {
+		return tmplv1.HealthSpec{Status: tmplv1.HealthDegraded, Message: "namespace is " + phase}
+	}
+	return tmplv1.HealthSpec{Status: tmplv1.HealthHealthy}
+}
+
+func crdHealth(obj *unstructured.Unstructured) tmplv1.HealthSpec {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		if cond, ok := c.(map[string]interface{}); ok && cond["type"] == "Established" && cond["status"] == "True" {
+			return tmplv1.HealthSpec{Status: tmplv1.HealthHealthy}
+		}
+	}
+	return tmplv1.HealthSpec{Status: tmplv1.HealthProgressing, Message: "waiting for the resource to be established"}
+}
@@ -0,0 +1,124 @@
+package templateinstance
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+)
+
+const defaultRevisionHistoryLimit = 10
+
+// recordRevision appends the render applied successfully to the revision history of the instance.
+// The oldest revisions are removed to keep the history within the limit.
+func recordRevision(instance *tmplv1.TemplateInstance, specInfo, objectInfo *tmplv1.ObjectInfo, objs []runtime.RawExtension) {
+	revision := int64(1)
+	if len(instance.Status.History) != 0 {
+		revision = instance.Status.History[len(instance.Status.History)-1].Revision + 1
+	}
+
+	now := v1.Now()
+	params := []tmplv1.ParamSpec{}
+	for _, param := range specInfo.Parameters {
+		params = append(params, *param.DeepCopy())
+	}
+	history := append(instance.Status.History, tmplv1.InstanceRevisionSpec{
+		Revision:         revision,
+		Generation:       instance.Generation,
+		Version:          objectInfo.Version,
+		TemplateRevision: instance.Status.TemplateRevision,
+		Plan:             objectInfo.Plan,
+		Parameters:       params,
+		Digest:           manifestDigest(objs),
+		DeployedTime:     &now,
+	})
+
+	limit := defaultRevisionHistoryLimit
+	if instance.Spec.RevisionHistoryLimit != nil {
+		limit = int(*instance.Spec.RevisionHistoryLimit)
+	}
+	if len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	instance.Status.History = history
+}
+
+// manifestDigest returns the SHA-256 digest of the rendered objects.
+// Objects are encoded again with sorted keys, so the digest doesn't depend on the format of the template.
+func manifestDigest(objs []runtime.RawExtension) string {
+	hash := sha256.New()
+	for idx := range objs {
+		raw := objs[idx].Raw
+		if unstr, err := BytesToUnstructuredObject(&objs[idx]); err == nil {
+			if encoded, err := json.Marshal(unstr.Object); err == nil {
+				raw = encoded
+			}
+		}
+		hash.Write(raw)
+		hash.Write([]byte("\n"))
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil))
+}
+
+// rollbackTo restores the template version, plan and parameters of the revision in spec of the instance.
+// The restored spec is applied as a new revision by the next reconcile.
+// The template is restored by its version, and the snapshot of templates without version is restored from the template revision.
+func (r *TemplateInstanceReconciler) rollbackTo(instance *tmplv1.TemplateInstance) (ctrl.Result, error) {
+	var rev *tmplv1.InstanceRevisionSpec
+	for idx := range instance.Status.History {
+		if instance.Status.History[idx].Revision == instance.Spec.RollbackTo {
+			rev = &instance.Status.History[idx]
+		}
+	}
+	if rev == nil {
+		return r.updateTemplateInstanceStatus(instance, fmt.Errorf("revision %d is not found in history", instance.Spec.RollbackTo))
+	}
+
+	rolledBack := instance.DeepCopy()
+	specInfo := rolledBack.Spec.Template
+	if specInfo == nil {
+		specInfo = rolledBack.Spec.ClusterTemplate
+	}
+	specInfo.Version = rev.Version
+	specInfo.Plan = rev.Plan
+	specInfo.Parameters = rev.DeepCopy().Parameters
+	rolledBack.Spec.RollbackTo = 0
+
+	// spec without version doesn't request an upgrade, so the snapshot is restored before spec
+	if len(rev.Version) == 0 && len(rev.TemplateRevision) != 0 {
+		namespace := instance.Namespace
+		if rolledBack.Spec.ClusterTemplate != nil {
+			namespace = ""
+		}
+		template, err := r.getTemplateRevision(namespace, rev.TemplateRevision)
+		if err != nil {
+			return r.updateTemplateInstanceStatus(instance, err)
+		}
+		snapshot := templateSnapshot(specInfo.Metadata.Name, template)
+		if rolledBack.Spec.ClusterTemplate != nil {
+			rolledBack.Status.ClusterTemplate = snapshot
+		} else {
+			rolledBack.Status.Template = snapshot
+		}
+		rolledBack.Status.TemplateRevision = rev.TemplateRevision
+		if err := r.Client.Status().Patch(context.TODO(), rolledBack, client.MergeFrom(instance)); err != nil {
+			r.Log.Error(err, "could not restore template snapshot")
+			return ctrl.Result{}, err
+		}
+	}
+
+	if err := r.Client.Patch(context.TODO(), rolledBack, client.MergeFrom(instance)); err != nil {
+		r.Log.Error(err, "could not roll back template instance")
+		return ctrl.Result{}, err
+	}
+	r.Log.Info(fmt.Sprintf("spec is rolled back to revision %d", rev.Revision))
+	return ctrl.Result{}, nil
+}
@@ -0,0 +1,326 @@
+package templateinstance
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/internal"
+)
+
+// splitHooks separates the hook objects from the other objects of the template
+func splitHooks(objs []runtime.RawExtension) (hooks, others []runtime.RawExtension, err error) {
+	for idx := range objs {
+		unstr, err := BytesToUnstructuredObject(&objs[idx])
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(hookPhases(unstr)) != 0 {
+			hooks = append(hooks, objs[idx])
+		} else {
+			others = append(others, objs[idx])
+		}
+	}
+	return hooks, others, nil
+}
+
+func hookPhases(unstr *unstructured.Unstructured) []tmplv1.HookPhaseType {
+	phases := []tmplv1.HookPhaseType{}
+	for _, phase := range strings.Split(unstr.GetAnnotations()[internal.HookAnnotation], ",") {
+		if phase = strings.TrimSpace(phase); len(phase) != 0 {
+			phases = append(phases, tmplv1.HookPhaseType(phase))
+		}
+	}
+	return phases
+}
+
+// hooksOf returns the hook objects which run at the phase
+func hooksOf(hooks []runtime.RawExtension, phase tmplv1.HookPhaseType) ([]*unstructured.Unstructured, error) {
+	result := []*unstructured.Unstructured{}
+	for idx := range hooks {
+		unstr, err := BytesToUnstructuredObject(&hooks[idx])
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range hookPhases(unstr) {
+			if p == phase {
+				result = append(result, unstr)
+				break
+			}
+		}
+	}
+	return result, nil
+}
+
+// runHooks runs the hooks of the phase one by one in the order of the template, once for each generation of the instance.
+// Results of the hooks are recorded in the status of the instance, and the hooks condition is set if the phase has hooks.
+// It returns Succeeded when every hook has succeeded, Running while a hook is running and Failed when a hook has failed.
+func (r *TemplateInstanceReconciler) runHooks(instance *tmplv1.TemplateInstance, hooks []runtime.RawExtension, phase tmplv1.HookPhaseType) (tmplv1.HookStatusType, string, error) {
+	objs, err := hooksOf(hooks, phase)
+	if err != nil || len(objs) == 0 {
+		return tmplv1.HookSucceeded, "", err
+	}
+
+	cond := tmplv1.ConditionSpec{
+		Type:    tmplv1.ConditionTypeHooksSucceeded,
+		Status:  "True",
+		Reason:  "HooksSucceeded",
+		Message: fmt.Sprintf("%s hooks have succeeded", phase),
+	}
+	for _, obj := range objs {
+		status, msg, err := r.runHook(instance, obj, phase)
+		if err != nil {
+			return "", "", err
+		}
+		switch status {
+		case tmplv1.HookRunning:
+			cond.Status, cond.Reason, cond.Message = "False", "HookRunning", msg
+		case tmplv1.HookFailed:
+			cond.Status, cond.Reason, cond.Message = "False", "HookFailed", msg
+		}
+		if status != tmplv1.HookSucceeded {
+			instance.Status.Conditions = setCondition(instance.Status.Conditions, cond)
+			return status, msg, nil
+		}
+	}
+	instance.Status.Conditions = setCondition(instance.Status.Conditions, cond)
+	return tmplv1.HookSucceeded, cond.Message, nil
+}
+
+// runHook creates the hook object for the generation of the instance, or checks the result of the created one.
+// Hook objects left by the previous runs are deleted before the hook runs again.
+func (r *TemplateInstanceReconciler) runHook(instance *tmplv1.TemplateInstance, unstr *unstructured.Unstructured, phase tmplv1.HookPhaseType) (tmplv1.HookStatusType, string, error) {
+	// hooks in other namespaces are deleted with the instance like the other objects.
+	// Finalizers cannot be added to the instance being deleted, so pre-delete hooks in other namespaces are left.
+	if finalizer := prepareObject(unstr, instance); len(finalizer) != 0 && instance.GetDeletionTimestamp() == nil {
+		if err := r.addInstanceFinalizer(instance, finalizer); err != nil {
+			return "", "", err
+		}
+	}
+	ref := objectRef(unstr)
+	name := fmt.Sprintf("%s hook %s %s/%s", phase, ref.Kind, ref.Namespace, ref.Name)
+
+	record := findHookStatus(instance.Status.Hooks, phase, ref)
+	if record != nil && record.Generation == instance.Generation && record.Status != tmplv1.HookRunning {
+		return record.Status, hookMessage(name, record), nil
+	}
+
+	live := &unstructured.Unstructured{}
+	live.SetGroupVersionKind(unstr.GroupVersionKind())
+	if err := r.Client.Get(context.TODO(), types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, live); err != nil {
+		if !errors.IsNotFound(err) {
+			return "", "", err
+		}
+		if err := r.applyObject(unstr, instance.Spec.ForceConflicts); err != nil {
+			return "", "", err
+		}
+		r.Log.Info(name + " is created")
+		live = unstr
+	} else if !isOwnedBy(live, instance) {
+		return "", "", fmt.Errorf("%s already exists and is not owned by the instance", name)
+	} else if record == nil || record.Generation != instance.Generation || record.Ref.Uid != string(live.GetUID()) {
+		// the object of the previous run must be deleted before the hook runs again
+		if live.GetDeletionTimestamp() == nil {
+			if err := r.Client.Delete(context.TODO(), live, client.PropagationPolicy(v1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+				return "", "", err
+			}
+		}
+		return tmplv1.HookRunning, fmt.Sprintf("%s is waiting for the previous run to be deleted", name), nil
+	}
+
+	status, msg, err := r.hookResult(live)
+	if err != nil {
+		return "", "", err
+	}
+	ref.Uid = string(live.GetUID())
+	setHookStatus(instance, tmplv1.HookStatusSpec{Phase: phase, Ref: ref, Generation: instance.Generation, Status: status, Message: msg})
+
+	policies := strings.Split(unstr.GetAnnotations()[internal.HookDeletePolicyAnnotation], ",")
+	for _, policy := range policies {
+		policy = strings.TrimSpace(policy)
+		if (status == tmplv1.HookSucceeded && policy == internal.HookDeleteSucceeded) || (status == tmplv1.HookFailed && policy == internal.HookDeleteFailed) {
+			if err := r.Client.Delete(context.TODO(), live, client.PropagationPolicy(v1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+				return "", "", err
+			}
+			r.Log.Info(name + " is deleted by the delete policy")
+		}
+	}
+	return status, hookMessage(name, findHookStatus(instance.Status.Hooks, phase, ref)), nil
+}
+
+// hookResult decides whether the hook has succeeded. Jobs and pods must be completed, and the other objects must be healthy.
+func (r *TemplateInstanceReconciler) hookResult(obj *unstructured.Unstructured) (tmplv1.HookStatusType, string, error) {
+	if obj.GroupVersionKind().GroupKind().String() == "Pod" {
+		switch phase, _, _ := unstructured.NestedString(obj.Object, "status", "phase"); phase {
+		case "Succeeded":
+			return tmplv1.HookSucceeded, "", nil
+		case "Failed":
+			return tmplv1.HookFailed, "pod is failed", nil
+		}
+		return tmplv1.HookRunning, "pod is not completed", nil
+	}
+
+	health, err := r.assessHealth(obj)
+	if err != nil {
+		return "", "", err
+	}
+	switch health.Status {
+	case tmplv1.HealthHealthy:
+		return tmplv1.HookSucceeded, "", nil
+	case tmplv1.HealthDegraded:
+		return tmplv1.HookFailed, health.Message, nil
+	}
+	return tmplv1.HookRunning, health.Message, nil
+}
+
+func hookMessage(name string, record *tmplv1.HookStatusSpec) string {
+	msg := fmt.Sprintf("%s is %s", name, strings.ToLower(string(record.Status)))
+	if len(record.Message) != 0 {
+		msg += ": " + record.Message
+	}
+	return msg
+}
+
+func findHookStatus(hooks []tmplv1.HookStatusSpec, phase tmplv1.HookPhaseType, ref tmplv1.RefSpec) *tmplv1.HookStatusSpec {
+	for idx, hook := range hooks {
+		if hook.Phase == phase && hook.Ref.Kind == ref.Kind && hook.Ref.Namespace == ref.Namespace && hook.Ref.Name == ref.Name {
+			return &hooks[idx]
+		}
+	}
+	return nil
+}
+
+// setHookStatus records the result of the hook, replacing the result of the previous run
+func setHookStatus(instance *tmplv1.TemplateInstance, hook tmplv1.HookStatusSpec) {
+	now := v1.Now()
+	hook.LastTransitionTime = &now
+	if record := findHookStatus(instance.Status.Hooks, hook.Phase, hook.Ref); record != nil {
+		if record.Status == hook.Status && record.Generation == hook.Generation {
+			hook.LastTransitionTime = record.LastTransitionTime
+		}
+		*record = hook
+		return
+	}
+	instance.Status.Hooks = append(instance.Status.Hooks, hook)
+}
+
+// ensureHookFinalizer keeps the instance until its pre-delete hooks are done if the template has pre-delete hooks
+func (r *TemplateInstanceReconciler) ensureHookFinalizer(instance *tmplv1.TemplateInstance, hooks []runtime.RawExtension) error {
+	preDelete, err := hooksOf(hooks, tmplv1.HookPreDelete)
+	if err != nil {
+		return err
+	}
+	if len(preDelete) == 0 {
+		return r.removeInstanceFinalizer(instance, internal.HookFinalizer)
+	}
+	return r.addInstanceFinalizer(instance, internal.HookFinalizer)
+}
+
+// runPreDeleteHooks renders the pre-delete hooks from the snapshot of the deleted instance and runs them.
+// Hooks are skipped if the namespace is being deleted, because no object can be created in the namespace.
+func (r *TemplateInstanceReconciler) runPreDeleteHooks(instance *tmplv1.TemplateInstance) (tmplv1.HookStatusType, string, error) {
+	snapshot, specInfo := instance.Status.Template, instance.Spec.Template
+	if instance.Status.ClusterTemplate != nil {
+		snapshot, specInfo = instance.Status.ClusterTemplate, instance.Spec.ClusterTemplate
+	}
+	if snapshot == nil || specInfo == nil {
+		return tmplv1.HookSucceeded, "", nil
+	}
+
+	ns := &unstructured.Unstructured{}
+	ns.SetAPIVersion("v1")
+	ns.SetKind("Namespace")
+	if err := r.Client.Get(context.TODO(), types.NamespacedName{Name: instance.Namespace}, ns); err != nil && !errors.IsNotFound(err) {
+		return "", "", err
+	} else if err != nil || ns.GetDeletionTimestamp() != nil {
+		r.Log.Info("pre-delete hooks are skipped because namespace " + instance.Namespace + " is being deleted")
+		return tmplv1.HookSucceeded, "", nil
+	}
+
+	instanceParams, err := internal.ResolveValueFrom(r.Client, instance.Namespace, specInfo.Parameters)
+	if err != nil {
+		return "", "", err
+	}
+	generated, err := internal.GetGeneratedValues(r.Client, instance)
+	if err != nil {
+		return "", "", err
+	}
+	instanceParams = internal.WithGeneratedValues(snapshot.Parameters, instanceParams, generated)
+	params, err := ResolveParameters(snapshot, instanceParams)
+	if err != nil {
+		return "", "", err
+	}
+	redactor := internal.NewRedactor(snapshot.Parameters, instanceParams)
+
+	objs := snapshot.DeepCopy().Objects
+	if len(snapshot.Object) != 0 {
+		rendered, err := TemplateExec(snapshot.Object, params, instance)
+		if err != nil {
+			return "", "", redactor.Error(err)
+		}
+		objs = append(objs, rendered...)
+	}
+	for idx := range objs {
+		if err := replaceParamsWithValue(&objs[idx], params, redactor); err != nil {
+			return "", "", redactor.Error(err)
+		}
+	}
+	hooks, _, err := splitHooks(objs)
+	if err != nil {
+		return "", "", redactor.Error(err)
+	}
+
+	status, msg, err := r.runHooks(instance, hooks, tmplv1.HookPreDelete)
+	return status, redactor.Redact(msg), redactor.Error(err)
+}
+
+func (r *TemplateInstanceReconciler) addInstanceFinalizer(instance *tmplv1.TemplateInstance, finalizer string) error {
+	if controllerutil.ContainsFinalizer(instance, finalizer) {
+		return nil
+	}
+	instanceWithFinalizer := instance.DeepCopy()
+	controllerutil.AddFinalizer(instanceWithFinalizer, finalizer)
+	if err := r.Client.Patch(context.TODO(), instanceWithFinalizer, client.MergeFrom(instance)); err != nil {
+		return err
+	}
+	instance.SetFinalizers(instanceWithFinalizer.GetFinalizers())
+	return nil
+}
+
+// waitHooks runs the hooks of the phase before the objects are applied.
+// Only the results of the hooks are recorded in the status until they succeed, so the objects are not applied meanwhile.
+func (r *TemplateInstanceReconciler) waitHooks(instance, updateInstance *tmplv1.TemplateInstance, hooks []runtime.RawExtension, phase tmplv1.HookPhaseType, redactor *internal.Redactor) (ctrl.Result, bool, error) {
+	status, msg, err := r.runHooks(updateInstance, hooks, phase)
+	if err != nil {
+		r.Log.Error(redactor.Error(err), "error occurs while run hooks")
+		res, err := r.updateTemplateInstanceStatus(instance, redactor.Error(err))
+		return res, false, err
+	}
+	if status == tmplv1.HookSucceeded {
+		return ctrl.Result{}, true, nil
+	}
+
+	hookInstance := instance.DeepCopy()
+	hookInstance.Status.Hooks = updateInstance.Status.Hooks
+	hookInstance.Status.Conditions = updateInstance.Status.Conditions
+	if err := r.Client.Status().Patch(context.TODO(), hookInstance, client.MergeFrom(instance)); err != nil {
+		r.Log.Error(err, "could not update template instance status")
+		return ctrl.Result{}, false, err
+	}
+	if status == tmplv1.HookFailed {
+		res, err := r.updateTemplateInstanceStatus(hookInstance, redactor.Error(fmt.Errorf(msg)))
+		return res, false, err
+	}
+	r.Log.Info(redactor.Redact(msg))
+	return ctrl.Result{RequeueAfter: healthCheckInterval}, false, nil
+}
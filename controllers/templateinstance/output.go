@@ -0,0 +1,61 @@
+package templateinstance
+
+import (
+	"fmt"
+	"strings"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/internal"
+)
+
+// updateOutputs resolves outputs of the template from the created objects and records them in the status of the instance.
+// Outputs are resolved only after every object is ready, and the values resolved before are kept until then.
+// Values of sensitive parameters and Secrets are not exposed in the outputs. It returns whether every output is resolved.
+func (r *TemplateInstanceReconciler) updateOutputs(instance *tmplv1.TemplateInstance, outputs []tmplv1.OutputSpec, params map[string]tmplv1.ParamValue, ready bool, redactor *internal.Redactor) bool {
+	if len(outputs) == 0 {
+		instance.Status.Outputs = nil
+		return true
+	}
+
+	cond := tmplv1.ConditionSpec{
+		Type:    tmplv1.ConditionTypeOutputsResolved,
+		Status:  "False",
+		Reason:  "ObjectsNotReady",
+		Message: "outputs are resolved after all objects are ready",
+	}
+	if !ready {
+		instance.Status.Conditions = setCondition(instance.Status.Conditions, cond)
+		return false
+	}
+
+	resolved := map[string]string{}
+	failed := []string{}
+	for _, output := range outputs {
+		// templates stored before validation may still take outputs from Secrets
+		if internal.IsSecretRef(output.ObjectRef) {
+			failed = append(failed, fmt.Sprintf("%s: %s", output.Name, internal.ErrSecretOutput.Error()))
+			continue
+		}
+		// sensitive values are not substituted into the value of the output, and values taken from objects are redacted
+		outputParams := params
+		if output.ObjectRef == nil {
+			outputParams = redactor.Params(params)
+		}
+		val, err := internal.ResolveOutput(r.Client, instance, output, outputParams)
+		if err != nil {
+			err = redactor.Error(err)
+			r.Log.Info("cannot resolve output", "output", output.Name, "reason", err.Error())
+			failed = append(failed, fmt.Sprintf("%s: %s", output.Name, err.Error()))
+			continue
+		}
+		resolved[output.Name] = redactor.Redact(val)
+	}
+
+	cond.Status, cond.Reason, cond.Message = "True", "OutputsResolved", "all outputs are resolved"
+	if len(failed) != 0 {
+		cond.Status, cond.Reason, cond.Message = "False", "OutputsNotResolved", strings.Join(failed, ", ")
+	}
+	instance.Status.Outputs = resolved
+	instance.Status.Conditions = setCondition(instance.Status.Conditions, cond)
+	return len(failed) == 0
+}
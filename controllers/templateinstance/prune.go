@@ -0,0 +1,133 @@
+package templateinstance
+
+import (
+	"context"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/internal"
+)
+
+// pruneObjects deletes objects in the inventory (status.objects) of the instance which are not rendered anymore.
+// Objects annotated with keep resource policy are released from the instance instead of being deleted.
+func (r *TemplateInstanceReconciler) pruneObjects(instance *tmplv1.TemplateInstance, objs []runtime.RawExtension) error {
+	reqLogger := r.Log.WithName("prune objects")
+
+	rendered := make(map[string]bool)
+	for idx := range objs {
+		unstr, err := BytesToUnstructuredObject(&objs[idx])
+		if err != nil {
+			return err
+		}
+		if len(unstr.GetNamespace()) == 0 {
+			unstr.SetNamespace(instance.Namespace)
+		}
+		rendered[refKey(objectRef(unstr))] = true
+	}
+
+	for _, statusObject := range instance.Status.Objects {
+		ref := statusObject.Ref
+		if rendered[refKey(ref)] {
+			continue
+		}
+		signature := finalizerSignature(ref.ApiVersion, ref.Kind, ref.Namespace, ref.Name)
+
+		live := &unstructured.Unstructured{}
+		live.SetAPIVersion(ref.ApiVersion)
+		live.SetKind(ref.Kind)
+		if err := r.Client.Get(context.TODO(), types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, live); err != nil {
+			if !errors.IsNotFound(err) {
+				return err
+			}
+			if err := r.removeInstanceFinalizer(instance, signature); err != nil {
+				return err
+			}
+			continue
+		}
+
+		// object with the same name may be replaced by someone else
+		if !isOwnedBy(live, instance) {
+			reqLogger.Info(fmt.Sprintf("%s %s/%s is not owned by the instance, skip pruning", ref.Kind, ref.Namespace, ref.Name))
+			continue
+		}
+
+		if live.GetAnnotations()[internal.ResourcePolicyAnnotation] == internal.ResourcePolicyKeep {
+			if err := r.releaseObject(live, instance); err != nil {
+				return err
+			}
+			reqLogger.Info(fmt.Sprintf("%s %s/%s is kept by resource policy", ref.Kind, ref.Namespace, ref.Name))
+		} else {
+			if err := r.Client.Delete(context.TODO(), live); err != nil && !errors.IsNotFound(err) {
+				return err
+			}
+			reqLogger.Info(fmt.Sprintf("%s %s/%s is pruned", ref.Kind, ref.Namespace, ref.Name))
+		}
+
+		if err := r.removeInstanceFinalizer(instance, signature); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// releaseObject removes owner reference, owner labels and annotation, so the object is not deleted along with the instance
+func (r *TemplateInstanceReconciler) releaseObject(obj *unstructured.Unstructured, instance *tmplv1.TemplateInstance) error {
+	ownerRefs := []v1.OwnerReference{}
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.UID != instance.UID || ref.Name != instance.Name {
+			ownerRefs = append(ownerRefs, ref)
+		}
+	}
+	obj.SetOwnerReferences(ownerRefs)
+
+	labels := obj.GetLabels()
+	delete(labels, internal.InstanceOwnerLabel)
+	delete(labels, internal.InstanceNamespaceLabel)
+	obj.SetLabels(labels)
+	annotations := obj.GetAnnotations()
+	delete(annotations, internal.InstanceOwnerAnnotation)
+	obj.SetAnnotations(annotations)
+
+	return r.Client.Update(context.TODO(), obj)
+}
+
+func (r *TemplateInstanceReconciler) removeInstanceFinalizer(instance *tmplv1.TemplateInstance, finalizer string) error {
+	if !controllerutil.ContainsFinalizer(instance, finalizer) {
+		return nil
+	}
+	instanceWithoutFinalizer := instance.DeepCopy()
+	controllerutil.RemoveFinalizer(instanceWithoutFinalizer, finalizer)
+	if err := r.Client.Patch(context.TODO(), instanceWithoutFinalizer, client.MergeFrom(instance)); err != nil {
+		return err
+	}
+	instance.SetFinalizers(instanceWithoutFinalizer.GetFinalizers())
+	return nil
+}
+
+// isOwnedBy checks owner reference or owner labels of the object
+func isOwnedBy(obj *unstructured.Unstructured, instance *tmplv1.TemplateInstance) bool {
+	for _, req := range ownerInstanceRequests(handler.MapObject{Meta: obj, Object: obj}) {
+		if req.Namespace == instance.Namespace && req.Name == instance.Name {
+			return true
+		}
+	}
+	return false
+}
+
+func refKey(ref tmplv1.RefSpec) string {
+	return finalizerSignature(ref.ApiVersion, ref.Kind, ref.Namespace, ref.Name)
+}
+
+// finalizerSignature is used as a finalizer of the instance for objects in other namespace
+func finalizerSignature(apiVersion, kind, ns, name string) string {
+	return apiVersion + ".-." + kind + ".-." + ns + ".-." + name
+}
@@ -0,0 +1,93 @@
+package templateinstance
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/types"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/internal"
+)
+
+// getTemplate returns the spec of the template which the instance is instantiated with and the name of its revision.
+// When the instance is pinned to a version, the spec is taken from the revision of the version instead of the current template.
+// Revisions of ClusterTemplate are used when the namespace is empty.
+func (r *TemplateInstanceReconciler) getTemplate(namespace string, info *tmplv1.ObjectInfo) (*tmplv1.TemplateSpec, string, error) {
+	name := info.Metadata.Name
+	if len(info.Version) != 0 {
+		revision, revisionName, err := internal.GetTemplateRevision(r.Client, namespace, name, info.Version)
+		if err != nil {
+			return nil, "", err
+		}
+		return &revision.Template, revisionName, nil
+	}
+
+	key := types.NamespacedName{Namespace: namespace, Name: name}
+	if len(namespace) == 0 {
+		template := &tmplv1.ClusterTemplate{}
+		if err := r.Client.Get(context.TODO(), key, template); err != nil {
+			return nil, "", err
+		}
+		return &template.TemplateSpec, template.Status.LatestRevision, nil
+	}
+	template := &tmplv1.Template{}
+	if err := r.Client.Get(context.TODO(), key, template); err != nil {
+		return nil, "", err
+	}
+	return &template.TemplateSpec, template.Status.LatestRevision, nil
+}
+
+// getTemplateRevision returns the spec of the template recorded in the revision of the given name.
+// ClusterTemplateRevision is used when the namespace is empty.
+func (r *TemplateInstanceReconciler) getTemplateRevision(namespace, name string) (*tmplv1.TemplateSpec, error) {
+	key := types.NamespacedName{Namespace: namespace, Name: name}
+	if len(namespace) == 0 {
+		revision := &tmplv1.ClusterTemplateRevision{}
+		if err := r.Client.Get(context.TODO(), key, revision); err != nil {
+			return nil, err
+		}
+		return &revision.Spec.Template, nil
+	}
+	revision := &tmplv1.TemplateRevision{}
+	if err := r.Client.Get(context.TODO(), key, revision); err != nil {
+		return nil, err
+	}
+	return &revision.Spec.Template, nil
+}
+
+// templateSnapshot returns the snapshot of the template kept in status of the instance
+func templateSnapshot(name string, template *tmplv1.TemplateSpec) *tmplv1.ObjectInfo {
+	objectInfo := &tmplv1.ObjectInfo{}
+	objectInfo.Metadata.Name = name
+	objectInfo.Version = template.Version
+	objectInfo.Objects = template.Objects
+	objectInfo.Object = template.Object
+	objectInfo.Parameters = template.Parameters
+	objectInfo.Plans = template.Plans
+	objectInfo.Credentials = template.Credentials
+	objectInfo.Outputs = template.Outputs
+	return objectInfo
+}
+
+// logUpgrade logs the version change of the instance and parameters which are not declared in the new version.
+// Values of parameters declared in both versions are carried over, and new parameters take their default values.
+func (r *TemplateInstanceReconciler) logUpgrade(from, to *tmplv1.ObjectInfo, instanceParams []tmplv1.ParamSpec) {
+	declared := map[string]bool{}
+	for _, param := range to.Parameters {
+		declared[param.Name] = true
+	}
+	dropped := []string{}
+	for _, param := range instanceParams {
+		if !declared[param.Name] {
+			dropped = append(dropped, param.Name)
+		}
+	}
+
+	reqLogger := r.Log.WithName("upgrade template")
+	reqLogger.Info(fmt.Sprintf("upgrade %s from version %q to %q", to.Metadata.Name, from.Version, to.Version))
+	if len(dropped) != 0 {
+		reqLogger.Info("parameters are not declared in the new version and ignored: " + strings.Join(dropped, ", "))
+	}
+}
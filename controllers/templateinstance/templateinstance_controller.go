@@ -18,12 +18,12 @@ package templateinstance
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 
-	jsonpatch "github.com/evanphx/json-patch"
 	"github.com/go-logr/logr"
 	"k8s.io/apimachinery/pkg/api/errors"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -31,30 +31,48 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 
 	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/internal"
 )
 
+const healthCheckInterval = 10 * time.Second
+
 // TemplateInstanceReconciler reconciles a TemplateInstance object
 type TemplateInstanceReconciler struct {
 	client.Client
 	Log    logr.Logger
 	Scheme *runtime.Scheme
+
+	// AllowApplicationOverrides allows instances to set the namespace, project and destination of Argo CD Applications.
+	// Argo CD deploys the objects with its own permission, so only the namespace of the instance in the cluster is allowed by default.
+	AllowApplicationOverrides bool
+
+	// watches for the kinds of objects created by template instances
+	controller   controller.Controller
+	watchedKinds map[schema.GroupVersionKind]struct{}
+	watchLock    sync.Mutex
 }
 
 // +kubebuilder:rbac:groups=tmax.io,resources=templateinstances,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups=tmax.io,resources=templateinstances/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups=tmax.io,resources=templaterevisions;clustertemplaterevisions,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups=argoproj.io,resources=applications,verbs=get;list;watch;create;update;patch;delete
 
 func (r *TemplateInstanceReconciler) Reconcile(req ctrl.Request) (ctrl.Result, error) {
 	reqLogger := r.Log.WithValues("Request.Namespace", req.Namespace, "Request.Name", req.Name)
 	reqLogger.Info("Reconciling TemplateInstance")
 
-	globalTemplate := &tmplv1.ClusterTemplate{}
 	// Fetch the TemplateInstance instance
 	instance := &tmplv1.TemplateInstance{}
 	err := r.Client.Get(context.TODO(), req.NamespacedName, instance)
@@ -67,6 +85,47 @@ func (r *TemplateInstanceReconciler) Reconcile(req ctrl.Request) (ctrl.Result, e
 
 	// 다른 namespace에 생성된 resource는 finalizer 통해서 삭제
 	if instance.GetDeletionTimestamp() != nil {
+		// files committed in gitops mode are removed from the repo
+		if controllerutil.ContainsFinalizer(instance, internal.GitopsFinalizer) {
+			gitops := instance.Spec.Gitops
+			if instance.Status.Gitops != nil {
+				gitops = instance.Status.Gitops.GitopsSpec
+			}
+			if err := r.deleteApplication(instance, gitops); err != nil {
+				reqLogger.Error(err, "failed to delete application")
+				return ctrl.Result{}, err
+			}
+			if err := r.removeCommittedFiles(instance, gitops); err != nil {
+				reqLogger.Error(err, "failed to remove files from "+gitops.SourceGitRepo)
+				return ctrl.Result{}, err
+			}
+			if err := r.removeInstanceFinalizer(instance, internal.GitopsFinalizer); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+		// objects are deleted after the pre-delete hooks are done
+		if controllerutil.ContainsFinalizer(instance, internal.HookFinalizer) {
+			deletingInstance := instance.DeepCopy()
+			status, msg, err := r.runPreDeleteHooks(deletingInstance)
+			if err == nil && status == tmplv1.HookFailed {
+				err = fmt.Errorf(msg)
+			}
+			if errUp := r.Client.Status().Patch(context.TODO(), deletingInstance, client.MergeFrom(instance)); errUp != nil {
+				reqLogger.Error(errUp, "could not update template instance status")
+				return ctrl.Result{}, errUp
+			}
+			if err != nil {
+				reqLogger.Error(err, "failed to run pre-delete hooks")
+				return ctrl.Result{}, err
+			}
+			if status == tmplv1.HookRunning {
+				reqLogger.Info(msg)
+				return ctrl.Result{RequeueAfter: healthCheckInterval}, nil
+			}
+			if err := r.removeInstanceFinalizer(instance, internal.HookFinalizer); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
 		if err := r.removeDependents(instance); err != nil {
 			reqLogger.Error(err, "failed to remove dependents")
 		}
@@ -80,6 +139,11 @@ func (r *TemplateInstanceReconciler) Reconcile(req ctrl.Request) (ctrl.Result, e
 		return r.updateTemplateInstanceStatus(instance, err)
 	}
 
+	// spec is restored from the revision history, and applied by the next reconcile
+	if instance.Spec.RollbackTo != 0 {
+		return r.rollbackTo(instance)
+	}
+
 	objectInfo := &tmplv1.ObjectInfo{}
 	instanceParameters := []tmplv1.ParamSpec{}
 	updateInstance := instance.DeepCopy()
@@ -87,23 +151,22 @@ func (r *TemplateInstanceReconciler) Reconcile(req ctrl.Request) (ctrl.Result, e
 	if instance.Spec.ClusterTemplate != nil { // instance with clustertemplate
 		instanceParameters = instance.Spec.ClusterTemplate.Parameters
 
-		if updateInstance.Status.ClusterTemplate == nil { // initial apply of instance
-			updateInstance.Status.ClusterTemplate = objectInfo
+		// initial apply of instance or upgrade to another version
+		if updateInstance.Status.ClusterTemplate == nil || internal.UpgradeRequested(instance.Spec.ClusterTemplate, updateInstance.Status.ClusterTemplate) {
 			// Get the clustertemplate info
-			template := &tmplv1.ClusterTemplate{}
-			if err = r.Client.Get(context.TODO(), types.NamespacedName{
-				Name: instance.Spec.ClusterTemplate.Metadata.Name,
-			}, template); err != nil {
+			template, revision, err := r.getTemplate("", instance.Spec.ClusterTemplate)
+			if err != nil {
 				reqLogger.Error(err, "Error occurs while get clustertemplate")
 				return r.updateTemplateInstanceStatus(instance, err)
 			}
 
-			globalTemplate = template
-			objectInfo.Metadata.Name = instance.Spec.ClusterTemplate.Metadata.Name
-			objectInfo.Objects = template.Objects
-			objectInfo.Object = template.Object
-			objectInfo.Parameters = template.Parameters
+			objectInfo = templateSnapshot(instance.Spec.ClusterTemplate.Metadata.Name, template)
 
+			if updateInstance.Status.ClusterTemplate != nil {
+				r.logUpgrade(updateInstance.Status.ClusterTemplate, objectInfo, instanceParameters)
+			}
+			updateInstance.Status.ClusterTemplate = objectInfo
+			updateInstance.Status.TemplateRevision = revision
 		} else {
 			objectInfo = updateInstance.Status.ClusterTemplate
 		}
@@ -111,152 +174,302 @@ func (r *TemplateInstanceReconciler) Reconcile(req ctrl.Request) (ctrl.Result, e
 	if instance.Spec.Template != nil { // instance with template
 		instanceParameters = instance.Spec.Template.Parameters
 
-		if updateInstance.Status.Template == nil { // initial apply of instance
-			updateInstance.Status.Template = objectInfo
+		// initial apply of instance or upgrade to another version
+		if updateInstance.Status.Template == nil || internal.UpgradeRequested(instance.Spec.Template, updateInstance.Status.Template) {
 			// Get the template info
-			template := &tmplv1.Template{}
-			if err = r.Client.Get(context.TODO(), types.NamespacedName{
-				Namespace: instance.Namespace,
-				Name:      instance.Spec.Template.Metadata.Name,
-			}, template); err != nil {
+			template, revision, err := r.getTemplate(instance.Namespace, instance.Spec.Template)
+			if err != nil {
 				reqLogger.Error(err, "Error occurs while get template")
 				return r.updateTemplateInstanceStatus(instance, err)
 			}
 
-			objectInfo.Metadata.Name = instance.Spec.Template.Metadata.Name
-			objectInfo.Objects = template.Objects
-			objectInfo.Parameters = template.Parameters
+			objectInfo = templateSnapshot(instance.Spec.Template.Metadata.Name, template)
 
+			if updateInstance.Status.Template != nil {
+				r.logUpgrade(updateInstance.Status.Template, objectInfo, instanceParameters)
+			}
+			updateInstance.Status.Template = objectInfo
+			updateInstance.Status.TemplateRevision = revision
 		} else {
 			objectInfo = updateInstance.Status.Template
 		}
 	}
 
+	// values of the parameters are read from secrets and config maps of the namespace
+	if instanceParameters, err = internal.ResolveValueFrom(r.Client, instance.Namespace, instanceParameters); err != nil {
+		reqLogger.Error(err, "error occurs while read parameter value")
+		return r.updateTemplateInstanceStatus(instance, err)
+	}
+
+	// generated values are used unless the instance gives values
+	generated, err := r.generateParameters(updateInstance, objectInfo.Parameters)
+	if err != nil {
+		reqLogger.Error(err, "error occurs while generate parameter value")
+		return r.updateTemplateInstanceStatus(instance, err)
+	}
+	instanceParameters = internal.WithGeneratedValues(objectInfo.Parameters, instanceParameters, generated)
+
+	// values of the selected plan are used as defaults of the parameters
+	specInfo, activeInfo := instance.Spec.Template, instance.Status.Template
+	if instance.Spec.ClusterTemplate != nil {
+		specInfo, activeInfo = instance.Spec.ClusterTemplate, instance.Status.ClusterTemplate
+	}
+	activePlan := ""
+	if activeInfo != nil {
+		activePlan = activeInfo.Plan
+	}
+	plan, err := internal.SelectPlan(objectInfo.Plans, specInfo.Plan, activePlan)
+	if err != nil {
+		reqLogger.Error(err, "error occurs while select plan")
+		return r.updateTemplateInstanceStatus(instance, err)
+	}
+	objectInfo.Plan = specInfo.Plan
+
 	tempObjectInfo := objectInfo.DeepCopy()
-	paramHandler := NewParamHandler(tempObjectInfo.Parameters, instanceParameters)
+	templateParameters := internal.ApplyPlanParameters(tempObjectInfo.Parameters, plan)
+	// values of sensitive parameters are hidden in logs and status
+	redactor := internal.NewRedactor(templateParameters, instanceParameters)
+	paramHandler := NewParamHandler(templateParameters, instanceParameters)
 
 	if err := paramHandler.ReviseParam(); err != nil {
-		reqLogger.Error(err, "Required parameter has no value")
-		return r.updateTemplateInstanceStatus(instance, err)
+		reqLogger.Error(redactor.Error(err), "Required parameter has no value")
+		return r.updateTemplateInstanceStatus(instance, redactor.Error(err))
 	}
 
 	totalParam := GetParamAsMap(paramHandler.templateParameters)
 	// Regex validating parameter values
-	if matched, m := RegexValidate(totalParam, objectInfo.Parameters); !matched {
+	if matched, m := RegexValidate(totalParam, objectInfo.Parameters, redactor); !matched {
+		err := fmt.Errorf(m)
 		reqLogger.Error(err, "error occurs while checking parameter matches regex")
-		return r.updateTemplateInstanceStatus(instance, fmt.Errorf(m))
+		return r.updateTemplateInstanceStatus(instance, err)
+	}
+	if err := r.checkSecretRefs(instance.Namespace, paramHandler.templateParameters); err != nil {
+		reqLogger.Error(redactor.Error(err), "error occurs while checking secret reference")
+		return r.updateTemplateInstanceStatus(instance, redactor.Error(err))
 	}
 
-	//////////////////////////test//////////////////////////
+	// objects written in go template are rendered from the snapshot, and created together with objects
 	if len(objectInfo.Object) != 0 {
-		tempObjectInfo.Objects, err = TemplateExec(globalTemplate, totalParam)
+		rendered, err := TemplateExec(objectInfo.Object, totalParam, instance)
 		if err != nil {
-			reqLogger.Error(err, "error occurs while executing go template")
-			return r.updateTemplateInstanceStatus(instance, err)
+			reqLogger.Error(redactor.Error(err), "error occurs while executing go template")
+			return r.updateTemplateInstanceStatus(instance, redactor.Error(err))
 		}
+		tempObjectInfo.Objects = append(tempObjectInfo.Objects, rendered...)
 	}
-	//////////////////////////test//////////////////////////
 
 	for key, val := range totalParam {
 		reqLogger := r.Log.WithName("replace k8s object")
-		reqLogger.Info("key: " + key + " value: " + val.String())
-	}
-
-	// gitops options
-	//if instance.Annotations["gitops"] == "enable" {
-	//	// Push template obejcts to given repo
-	//	for idx := range tempObjectInfo.Objects {
-	//		if err = r.replaceParamsWithValue(&(tempObjectInfo.Objects[idx]), totalParam); err != nil {
-	//			reqLogger.Error(err, "error occurs while replace parameters")
-	//			return r.updateTemplateInstanceStatus(instance, err)
-	//		}
-	//
-	//		if err = internal.SetNamespace(&(tempObjectInfo.Objects[idx]), instance); err != nil {
-	//			reqLogger.Error(err, "error occurs while update namespace")
-	//			return r.updateTemplateInstanceStatus(instance, err)
-	//		}
-	//
-	//		if err = internal.PushToGivenRepo(instance, tempObjectInfo.Objects[idx], r.Client); err != nil {
-	//			reqLogger.Error(err, "error occurs while push objects")
-	//			return r.updateTemplateInstanceStatus(instance, err)
-	//		}
-	//	}
-	//
-	//	// set template instance status
-	//	if res, err := r.updateTemplateInstanceStatus(updateInstance, nil); err != nil {
-	//		return res, err
-	//	}
-	//
-	//	if err := r.Client.Status().Patch(context.TODO(), updateInstance, client.MergeFrom(instance)); err != nil {
-	//		reqLogger.Error(err, "could not update template instance status")
-	//		return ctrl.Result{}, err
-	//	}
-	//
-	//	return ctrl.Result{}, nil
-	//}
+		reqLogger.Info("key: " + key + " value: " + redactor.Value(key, val))
+	}
+
+	for idx := range tempObjectInfo.Objects {
+		if err = replaceParamsWithValue(&(tempObjectInfo.Objects[idx]), totalParam, redactor); err != nil {
+			reqLogger.Error(redactor.Error(err), "error occurs while replace parameters")
+			return r.updateTemplateInstanceStatus(instance, redactor.Error(err))
+		}
+	}
+	if err = checkDuplicateObjects(tempObjectInfo.Objects); err != nil {
+		reqLogger.Error(redactor.Error(err), "error occurs while render objects")
+		return r.updateTemplateInstanceStatus(instance, redactor.Error(err))
+	}
+	// hook objects are not created with the other objects, but run at the phases of the instance lifecycle
+	hooks, objects, err := splitHooks(tempObjectInfo.Objects)
+	if err != nil {
+		reqLogger.Error(redactor.Error(err), "error occurs while render objects")
+		return r.updateTemplateInstanceStatus(instance, redactor.Error(err))
+	}
+	tempObjectInfo.Objects = objects
+
+	// objects are committed to the git repo and not created in the cluster in gitops mode
+	if err = checkGitopsMode(instance); err != nil {
+		reqLogger.Error(err, "error occurs while check gitops mode")
+		return r.updateTemplateInstanceStatus(instance, err)
+	}
+	if gitopsEnabled(instance) {
+		return r.commitObjects(instance, updateInstance, specInfo, objectInfo, tempObjectInfo.Objects, redactor)
+	}
+
+	if err = r.ensureHookFinalizer(updateInstance, hooks); err != nil {
+		reqLogger.Error(err, "error occurs while update finalizer")
+		return r.updateTemplateInstanceStatus(instance, err)
+	}
+
+	// the instance is installed until the objects are applied and the post-install hooks succeed.
+	// Objects and history of the status are also checked for instances which observed no generation, e.g. installed by older versions
+	installing := instance.Status.ObservedGeneration == 0 && len(instance.Status.Objects) == 0 && len(instance.Status.History) == 0
+	if (instance.Status.ClusterTemplate == nil && instance.Status.Template == nil) || instance.Generation != instance.Status.ObservedGeneration {
+		phase := tmplv1.HookPreUpgrade
+		if installing {
+			phase = tmplv1.HookPreInstall
+		}
+		if res, done, err := r.waitHooks(instance, updateInstance, hooks, phase, redactor); !done {
+			return res, err
+		}
+	}
+
+	// objects are applied in waves, and each wave waits for the previous waves to be ready
+	waves, err := orderWaves(tempObjectInfo.Objects)
+	if err != nil {
+		reqLogger.Error(redactor.Error(err), "error occurs while order objects")
+		return r.updateTemplateInstanceStatus(instance, redactor.Error(err))
+	}
+	waiting := ""
+	applied := false
 
 	// normal case (do not use gitops option)
 	if instance.Status.ClusterTemplate == nil && instance.Status.Template == nil {
 		for idx := range tempObjectInfo.Objects {
-			if err = replaceParamsWithValue(&(tempObjectInfo.Objects[idx]), totalParam); err != nil {
-				reqLogger.Error(err, "error occurs while replace parameters")
-				return r.updateTemplateInstanceStatus(instance, err)
-			}
 			if err = r.checkObjectExist(&(tempObjectInfo.Objects[idx])); err != nil {
-				reqLogger.Error(err, "exist resource")
-				return r.updateTemplateInstanceStatus(instance, err)
+				reqLogger.Error(redactor.Error(err), "exist resource")
+				return r.updateTemplateInstanceStatus(instance, redactor.Error(err))
 			}
 		}
 
-		cacheUnstr := []*unstructured.Unstructured{} // cache for case of error
-		finalizers := instance.GetFinalizers()
-
-		//create k8s object
-		for idx := range tempObjectInfo.Objects {
-			cache := &unstructured.Unstructured{}
-
-			var finalizer string
+		// created objects are deleted and finalizers are restored when error occurs during create objects
+		tx, err := r.beginTransaction(updateInstance, tempObjectInfo.Objects)
+		if err != nil {
+			reqLogger.Error(redactor.Error(err), "error occurs while store snapshot of k8s object")
+			return r.updateTemplateInstanceStatus(instance, redactor.Error(err))
+		}
+		finalizers := updateInstance.GetFinalizers()
 
-			if cache, finalizer, err = r.createObject(&(tempObjectInfo.Objects[idx]), updateInstance, finalizers); err != nil {
-				reqLogger.Error(err, "error occurs while create k8s object")
-				for _, cacheObj := range cacheUnstr {
-					r.Client.Delete(context.TODO(), cacheObj) // when error occurs during create objects, delete already created objects
-					reqLogger.Info("Object: " + cacheObj.GetKind() + " is deleted")
-				}
-				return r.updateTemplateInstanceStatus(instance, err)
+		//create k8s object wave by wave
+		waiting, err = r.applyWaves(updateInstance, waves, func(obj *runtime.RawExtension) error {
+			_, finalizer, err := r.createObject(obj, updateInstance, finalizers)
+			if err != nil {
+				return err
 			}
-
 			finalizers = append(finalizers, finalizer)
-			cacheUnstr = append(cacheUnstr, cache)
+			return nil
+		})
+		if err != nil {
+			reqLogger.Error(redactor.Error(err), "error occurs while create k8s object")
+			return r.failTransaction(instance, tx, err, redactor)
 		}
 
 		if res, err := r.updateTemplateInstanceStatus(updateInstance, nil); err != nil {
 			return res, err
 		}
+		// the rest of waves are created in the update path after the created objects are ready
+		if len(waiting) == 0 {
+			if err = r.endTransaction(updateInstance); err != nil {
+				reqLogger.Error(err, "error occurs while remove snapshot of k8s object")
+				return r.updateTemplateInstanceStatus(instance, err)
+			}
+			updateInstance.Status.ObservedGeneration = instance.Generation
+			setConflictCondition(updateInstance, nil, redactor)
+			applied = true
+		}
 	}
 
 	if instance.Status.ClusterTemplate != nil || instance.Status.Template != nil {
-		for idx := range tempObjectInfo.Objects {
-			if err = replaceParamsWithValue(&(tempObjectInfo.Objects[idx]), totalParam); err != nil {
-				reqLogger.Error(err, "error occurs while replace parameters")
-				return r.updateTemplateInstanceStatus(instance, err)
+		if instance.Generation != instance.Status.ObservedGeneration { // spec of instance is changed
+			// previous versions of the objects are restored when error occurs during update objects
+			tx, err := r.beginTransaction(updateInstance, tempObjectInfo.Objects)
+			if err != nil {
+				reqLogger.Error(redactor.Error(err), "error occurs while store snapshot of k8s object")
+				return r.updateTemplateInstanceStatus(instance, redactor.Error(err))
+			}
+
+			//update k8s object wave by wave
+			waiting, err = r.applyWaves(updateInstance, waves, func(obj *runtime.RawExtension) error {
+				return r.updateObject(obj, updateInstance)
+			})
+			if err != nil {
+				reqLogger.Error(redactor.Error(err), "error occurs while update k8s object")
+				return r.failTransaction(instance, tx, err, redactor)
+			}
+			// the update is finished after every wave is applied
+			if len(waiting) == 0 {
+				// delete objects which are not rendered anymore
+				if err = r.pruneObjects(updateInstance, tempObjectInfo.Objects); err != nil {
+					reqLogger.Error(redactor.Error(err), "error occurs while prune k8s object")
+					return r.failTransaction(instance, tx, err, redactor)
+				}
+				if err = r.endTransaction(updateInstance); err != nil {
+					reqLogger.Error(err, "error occurs while remove snapshot of k8s object")
+					return r.updateTemplateInstanceStatus(instance, err)
+				}
+				updateInstance.Status.ObservedGeneration = instance.Generation
+				setConflictCondition(updateInstance, nil, redactor)
+				applied = true
+			}
+		} else { // created objects are changed
+			if err = r.syncObjects(updateInstance, tempObjectInfo.Objects, redactor); err != nil {
+				reqLogger.Error(redactor.Error(err), "error occurs while sync k8s object")
+				return r.updateTemplateInstanceStatus(instance, redactor.Error(err))
 			}
 		}
+	}
 
-		//update k8s object
-		for idx := range tempObjectInfo.Objects {
-			if err = r.updateObject(&(tempObjectInfo.Objects[idx]), instance.Namespace); err != nil {
-				reqLogger.Error(err, "error occurs while update k8s object")
-				return r.updateTemplateInstanceStatus(instance, err)
+	ready, err := r.updateObjectStatus(updateInstance, tempObjectInfo.Objects)
+	if err != nil {
+		reqLogger.Error(redactor.Error(err), "error occurs while check health of k8s object")
+		return r.updateTemplateInstanceStatus(instance, redactor.Error(err))
+	}
+	if len(waiting) != 0 {
+		reqLogger.Info(waiting)
+		ready = false
+		updateInstance.Status.Conditions = setCondition(updateInstance.Status.Conditions, tmplv1.ConditionSpec{
+			Type:    tmplv1.ConditionTypeReady,
+			Status:  "False",
+			Reason:  "WaitingForDependencies",
+			Message: waiting,
+		})
+	}
+
+	// post-install hooks run after the objects are ready
+	hooksDone := true
+	if installing && len(waiting) == 0 {
+		postInstall, err := hooksOf(hooks, tmplv1.HookPostInstall)
+		if err != nil {
+			reqLogger.Error(redactor.Error(err), "error occurs while render objects")
+			return r.updateTemplateInstanceStatus(instance, redactor.Error(err))
+		}
+		if len(postInstall) != 0 {
+			status := tmplv1.HookRunning
+			if ready {
+				msg := ""
+				if status, msg, err = r.runHooks(updateInstance, hooks, tmplv1.HookPostInstall); err != nil {
+					reqLogger.Error(redactor.Error(err), "error occurs while run hooks")
+					return r.updateTemplateInstanceStatus(instance, redactor.Error(err))
+				}
+				if status == tmplv1.HookFailed {
+					updateInstance.Status.ObservedGeneration = instance.Status.ObservedGeneration
+					if err := r.Client.Status().Patch(context.TODO(), updateInstance, client.MergeFrom(instance)); err != nil {
+						reqLogger.Error(redactor.Error(err), "could not update template instance status")
+						return ctrl.Result{}, err
+					}
+					return r.updateTemplateInstanceStatus(updateInstance, redactor.Error(fmt.Errorf(msg)))
+				}
+			}
+			if status != tmplv1.HookSucceeded {
+				hooksDone = false
+				updateInstance.Status.ObservedGeneration = instance.Status.ObservedGeneration
 			}
 		}
 	}
 
+	// renders are recorded in the revision history after the objects are applied and the post-install hooks succeed
+	if applied && hooksDone {
+		recordRevision(updateInstance, specInfo, objectInfo, tempObjectInfo.Objects)
+	}
+
+	// outputs are resolved from the objects after they are ready
+	resolved := r.updateOutputs(updateInstance, objectInfo.Outputs, totalParam, ready, redactor)
+
+	// conditions are replaced by the patch, so the previous error is cleared here
+	updateInstance.Status.Conditions = setCondition(updateInstance.Status.Conditions, instanceCondition(nil))
 	if err := r.Client.Status().Patch(context.TODO(), updateInstance, client.MergeFrom(instance)); err != nil {
-		reqLogger.Error(err, "could not update template instance status")
+		reqLogger.Error(redactor.Error(err), "could not update template instance status")
 		return ctrl.Result{}, err
 	}
 
+	// status changes of created objects are not watched, so check the health again later
+	if !ready || !resolved || !hooksDone {
+		return ctrl.Result{RequeueAfter: healthCheckInterval}, nil
+	}
 	return ctrl.Result{}, nil
 }
 
@@ -271,6 +484,9 @@ func (r *TemplateInstanceReconciler) removeDependents(instance *tmplv1.TemplateI
 	// finalizer 분리해서 kind / ns / name 추출
 	for _, finalizer := range instance.GetFinalizers() {
 		dependentSignature := strings.Split(finalizer, ".-.")
+		if len(dependentSignature) != 4 { // not a finalizer of dependent object
+			continue
+		}
 		APIVersion = dependentSignature[0]
 		kind = dependentSignature[1]
 		ns = dependentSignature[2]
@@ -314,30 +530,8 @@ func (r *TemplateInstanceReconciler) createObject(obj *runtime.RawExtension, own
 		return nil, "", err
 	}
 
-	// namespace 설정을 안해주면 owner의 네임스페이스 설정 및 onwerRef 추가
-	if len(unstr.GetNamespace()) == 0 {
-		unstr.SetNamespace(owner.Namespace)
-
-		// set owner reference
-		isController := false
-		blockOwnerDeletion := true
-
-		//Get 하고 추가
-		ownerRefs := unstr.GetOwnerReferences()
-		//reqLogger.Info("before: " + fmt.Sprintf("%+v\n", unstr.GetOwnerReferences()))
-		ownerRef := v1.OwnerReference{
-			APIVersion:         owner.APIVersion,
-			Kind:               owner.Kind,
-			Name:               owner.Name,
-			UID:                owner.UID,
-			Controller:         &isController,
-			BlockOwnerDeletion: &blockOwnerDeletion,
-		}
-		ownerRefs = append(ownerRefs, ownerRef)
-		unstr.SetOwnerReferences(ownerRefs)
-	} else { // namespace 설정이 있을 시, 해당 APIversion, kind, ns, name으로 finalizer 설정. 이 정보 가지고 추후 gc 진행
-		finalizer = unstr.GetAPIVersion() + ".-." + unstr.GetKind() + ".-." + unstr.GetNamespace() + ".-." + unstr.GetName()
-
+	// namespace 설정이 있을 시, 해당 APIversion, kind, ns, name으로 finalizer 설정. 이 정보 가지고 추후 gc 진행
+	if finalizer = prepareObject(unstr, owner); len(finalizer) != 0 {
 		var filtered []string // 빈 element가 하나 생겨서 일단 한번 필터링 해줌
 		for _, str := range finalizers {
 			if str != "" {
@@ -354,54 +548,94 @@ func (r *TemplateInstanceReconciler) createObject(obj *runtime.RawExtension, own
 			r.Log.Error(errUp, "could not create template instance")
 			return nil, "", errUp
 		}
-
-		label := make(map[string]string)
-		label["owner"] = owner.Kind + "-" + owner.Name
-		unstr.SetLabels(label)
 	}
 
 	//reqLogger.Info("after: " + fmt.Sprintf("%+v\n", unstr.GetOwnerReferences()))
 	// create object
-	if err = r.Client.Create(context.TODO(), unstr); err != nil {
+	if err = r.applyObject(unstr, owner.Spec.ForceConflicts); err != nil {
 		return nil, "", err
 	}
 	r.Log.Info(unstr.GetKind() + " is created")
 	return unstr, finalizer, nil
 }
 
-// Apply changed parameters on existing k8s objects which are populated by templateinstance.
-// Get k8s obejcts as unstructured type and transform to []byte for applying parameters.
-func (r *TemplateInstanceReconciler) updateObject(obj *runtime.RawExtension, ns string) error {
-	updateUnstr, err := BytesToUnstructuredObject(obj)
-	if err != nil {
-		return err
+// prepareObject sets namespace, owner reference and owner labels on the object to be created.
+// Objects with their own namespace get a finalizer signature for the owner instead of owner reference.
+func prepareObject(unstr *unstructured.Unstructured, owner *tmplv1.TemplateInstance) (finalizer string) {
+	// namespace 설정을 안해주면 owner의 네임스페이스 설정 및 onwerRef 추가
+	if len(unstr.GetNamespace()) == 0 {
+		unstr.SetNamespace(owner.Namespace)
+
+		// set owner reference
+		isController := false
+		blockOwnerDeletion := true
+
+		//Get 하고 추가
+		ownerRefs := unstr.GetOwnerReferences()
+		//reqLogger.Info("before: " + fmt.Sprintf("%+v\n", unstr.GetOwnerReferences()))
+		ownerRef := v1.OwnerReference{
+			APIVersion:         owner.APIVersion,
+			Kind:               owner.Kind,
+			Name:               owner.Name,
+			UID:                owner.UID,
+			Controller:         &isController,
+			BlockOwnerDeletion: &blockOwnerDeletion,
+		}
+		ownerRefs = append(ownerRefs, ownerRef)
+		unstr.SetOwnerReferences(ownerRefs)
+	} else {
+		finalizer = finalizerSignature(unstr.GetAPIVersion(), unstr.GetKind(), unstr.GetNamespace(), unstr.GetName())
 	}
-	updateUnstr.SetNamespace(ns)
-	unstr := updateUnstr.DeepCopy()
 
-	// get already existing k8s object as unstructured type
-	if err = r.Client.Get(context.TODO(), types.NamespacedName{
-		Namespace: updateUnstr.GetNamespace(),
-		Name:      updateUnstr.GetName(),
-	}, unstr); err != nil {
-		return err
+	// owner labels and annotation are used to find the instance when the object is changed
+	labels := unstr.GetLabels()
+	if labels == nil {
+		labels = make(map[string]string)
 	}
+	for key, val := range ownerLabels(owner) {
+		labels[key] = val
+	}
+	unstr.SetLabels(labels)
+	annotations := unstr.GetAnnotations()
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations[internal.InstanceOwnerAnnotation] = owner.Name
+	unstr.SetAnnotations(annotations)
 
-	bytedUnstr, _ := unstr.MarshalJSON()
-	bytedUpdateUnstr, _ := updateUnstr.MarshalJSON()
-	patchedByte, _ := jsonpatch.MergePatch(bytedUnstr, bytedUpdateUnstr)
+	return finalizer
+}
 
-	finalPatch := make(map[string]interface{})
-	if err := json.Unmarshal(patchedByte, &finalPatch); err != nil {
-		return err
+// ownerLabels returns the labels of the objects created by the instance.
+// Names of instances may be longer than label values, so the owner label is left out for them.
+func ownerLabels(owner *tmplv1.TemplateInstance) map[string]string {
+	labels := map[string]string{internal.InstanceNamespaceLabel: owner.Namespace}
+	if val := owner.Kind + "-" + owner.Name; len(validation.IsValidLabelValue(val)) == 0 {
+		labels[internal.InstanceOwnerLabel] = val
 	}
-	unstr.SetUnstructuredContent(finalPatch)
+	return labels
+}
 
-	if err = r.Client.Update(context.TODO(), unstr); err != nil {
+// Apply changed parameters on existing k8s objects which are populated by templateinstance.
+// The rendered object is applied with server-side apply, so fields removed from the template are removed from the object
+// and fields managed by others are kept. Objects which don't exist yet are created.
+func (r *TemplateInstanceReconciler) updateObject(obj *runtime.RawExtension, owner *tmplv1.TemplateInstance) error {
+	unstr, err := BytesToUnstructuredObject(obj)
+	if err != nil {
 		return err
 	}
 
-	return nil
+	// owner reference and labels must be applied every time, or they are removed from the object
+	if finalizer := prepareObject(unstr, owner); len(finalizer) != 0 && !controllerutil.ContainsFinalizer(owner, finalizer) {
+		instanceWithFinalizer := owner.DeepCopy()
+		controllerutil.AddFinalizer(instanceWithFinalizer, finalizer)
+		if err := r.Client.Patch(context.TODO(), instanceWithFinalizer, client.MergeFrom(owner)); err != nil {
+			return err
+		}
+		owner.SetFinalizers(instanceWithFinalizer.GetFinalizers())
+	}
+
+	return r.applyObject(unstr, owner.Spec.ForceConflicts)
 }
 
 func (r *TemplateInstanceReconciler) checkObjectExist(obj *runtime.RawExtension) error {
@@ -424,30 +658,41 @@ func (r *TemplateInstanceReconciler) checkObjectExist(obj *runtime.RawExtension)
 	return nil
 }
 
+// checkSecretRefs checks that the secrets referenced by secretRef parameters exist in the namespace of the instance
+func (r *TemplateInstanceReconciler) checkSecretRefs(namespace string, params []tmplv1.ParamSpec) error {
+	for _, param := range params {
+		if param.ValueType != internal.SecretRefType {
+			continue
+		}
+		ref, ok := param.Value.Interface().(map[string]interface{})
+		if !ok {
+			continue
+		}
+		name, _ := ref["name"].(string)
+		key, _ := ref["key"].(string)
+
+		secret := &unstructured.Unstructured{}
+		secret.SetAPIVersion("v1")
+		secret.SetKind("Secret")
+		if err := r.Client.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: name}, secret); err != nil {
+			return fmt.Errorf("parameter %s: %s", param.Name, err.Error())
+		}
+		if len(key) != 0 {
+			if _, exist, _ := unstructured.NestedFieldNoCopy(secret.Object, "data", key); !exist {
+				return fmt.Errorf("parameter %s: secret %s has no key %s", param.Name, name, key)
+			}
+		}
+	}
+	return nil
+}
+
 func (r *TemplateInstanceReconciler) updateTemplateInstanceStatus(instance *tmplv1.TemplateInstance, err error) (ctrl.Result, error) {
 	reqLogger := r.Log.WithName("update template instance status")
 	// set condition depending on the error
 	instanceWithStatus := instance.DeepCopy()
 
-	var cond tmplv1.ConditionSpec
-	if err == nil {
-		cond.Message = "succeed to create instances"
-		cond.Status = "Succeeded"
-	} else {
-		cond.Message = err.Error()
-		cond.Reason = "error occurs while create instance"
-		cond.Status = "Error"
-	}
-
 	// set status
-	instanceWithStatus.Status = tmplv1.TemplateInstanceStatus{
-		Conditions: []tmplv1.ConditionSpec{
-			cond,
-		},
-		Objects:         nil,
-		ClusterTemplate: instance.Status.ClusterTemplate,
-		Template:        instance.Status.Template,
-	}
+	instanceWithStatus.Status.Conditions = setCondition(instance.Status.Conditions, instanceCondition(err))
 
 	if errUp := r.Client.Status().Patch(context.TODO(), instanceWithStatus, client.MergeFrom(instance)); errUp != nil {
 		reqLogger.Error(errUp, "could not create template instance")
@@ -458,6 +703,20 @@ func (r *TemplateInstanceReconciler) updateTemplateInstanceStatus(instance *tmpl
 	return ctrl.Result{}, err
 }
 
+// instanceCondition returns the condition without type, which reports whether the instance is created without error
+func instanceCondition(err error) tmplv1.ConditionSpec {
+	var cond tmplv1.ConditionSpec
+	if err == nil {
+		cond.Message = "succeed to create instances"
+		cond.Status = "Succeeded"
+	} else {
+		cond.Message = err.Error()
+		cond.Reason = "error occurs while create instance"
+		cond.Status = "Error"
+	}
+	return cond
+}
+
 func ignoreStatusUpdate() predicate.Predicate {
 	return predicate.Funcs{
 		UpdateFunc: func(e event.UpdateEvent) bool {
@@ -483,8 +742,16 @@ func ignoreStatusUpdate() predicate.Predicate {
 // }
 
 func (r *TemplateInstanceReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	return ctrl.NewControllerManagedBy(mgr).
+	c, err := ctrl.NewControllerManagedBy(mgr).
 		For(&tmplv1.TemplateInstance{}).
 		WithEventFilter(ignoreStatusUpdate()).
-		Complete(r)
+		Build(r)
+	if err != nil {
+		return err
+	}
+
+	// kinds of created objects are watched dynamically (see watchObject)
+	r.controller = c
+	r.watchedKinds = make(map[schema.GroupVersionKind]struct{})
+	return nil
 }
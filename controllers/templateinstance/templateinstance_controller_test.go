@@ -2,24 +2,295 @@ package templateinstance
 
 import (
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
+	memfs "github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	memory "github.com/go-git/go-git/v5/storage/memory"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/internal"
+	"github.com/tmax-cloud/template-operator/schemas"
 
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
 )
 
+// applyClient emulates server-side apply, because fake client doesn't support apply patch.
+// Fields applied by each field manager are tracked in managedFields: fields of other managers with different values
+// conflict unless the apply is forced, and fields which are not applied anymore by the manager are removed.
+// Lists are treated as atomic fields.
+type applyClient struct {
+	client.Client
+}
+
+func (c *applyClient) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch.Type() != types.ApplyPatchType {
+		return c.Client.Patch(ctx, obj, patch, opts...)
+	}
+
+	patchOpts := &client.PatchOptions{}
+	patchOpts.ApplyOptions(opts)
+	manager := patchOpts.FieldManager
+	if len(manager) == 0 {
+		return fmt.Errorf("apply must have a field manager")
+	}
+	force := patchOpts.Force != nil && *patchOpts.Force
+
+	applied := obj.(*unstructured.Unstructured)
+	appliedFields := map[string]interface{}{}
+	collectFields(applied.Object, nil, appliedFields)
+
+	live := &unstructured.Unstructured{}
+	live.SetGroupVersionKind(applied.GroupVersionKind())
+	if err := c.Client.Get(ctx, types.NamespacedName{Namespace: applied.GetNamespace(), Name: applied.GetName()}, live); err != nil {
+		if errors.IsNotFound(err) {
+			applied.SetManagedFields(managedFields(map[string]map[string]bool{manager: fieldSet(appliedFields)}))
+			return c.Client.Create(ctx, applied)
+		}
+		return err
+	}
+
+	owned := map[string]map[string]bool{}
+	for _, entry := range live.GetManagedFields() {
+		fields := map[string]bool{}
+		if entry.FieldsV1 != nil {
+			var tree map[string]interface{}
+			if err := json.Unmarshal(entry.FieldsV1.Raw, &tree); err != nil {
+				return err
+			}
+			decodeFields(tree, nil, fields)
+		}
+		owned[entry.Manager] = fields
+	}
+
+	causes := []metav1.StatusCause{}
+	for path, val := range appliedFields {
+		liveVal, exist := fieldValue(live.Object, path)
+		if !exist || jsonEqual(liveVal, val) {
+			continue
+		}
+		for other, fields := range owned {
+			if other == manager || !fields[path] {
+				continue
+			}
+			if force {
+				delete(fields, path)
+				continue
+			}
+			causes = append(causes, metav1.StatusCause{
+				Type:    metav1.CauseTypeFieldManagerConflict,
+				Message: fmt.Sprintf("conflict with %q", other),
+				Field:   "." + strings.Join(splitField(path), "."),
+			})
+		}
+	}
+	if len(causes) != 0 {
+		messages := []string{}
+		for _, cause := range causes {
+			messages = append(messages, cause.Message+": "+cause.Field)
+		}
+		return &errors.StatusError{ErrStatus: metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusConflict,
+			Reason:  metav1.StatusReasonConflict,
+			Message: fmt.Sprintf("Apply failed with %d conflicts: %s", len(causes), strings.Join(messages, ", ")),
+			Details: &metav1.StatusDetails{Causes: causes},
+		}}
+	}
+
+	// fields which are not applied anymore are removed unless others manage them
+	for path := range owned[manager] {
+		if _, exist := appliedFields[path]; exist {
+			continue
+		}
+		shared := false
+		for other, fields := range owned {
+			shared = shared || (other != manager && fields[path])
+		}
+		if !shared {
+			removeField(live.Object, splitField(path))
+		}
+	}
+	for path, val := range appliedFields {
+		setField(live.Object, splitField(path), val)
+	}
+	owned[manager] = fieldSet(appliedFields)
+	live.SetManagedFields(managedFields(owned))
+
+	if err := c.Client.Update(ctx, live); err != nil {
+		return err
+	}
+	// the applied object is filled with the response like apply of the server
+	applied.SetUnstructuredContent(live.UnstructuredContent())
+	return nil
+}
+
+// Update keeps managedFields of the object if they are not given, like the api server
+func (c *applyClient) Update(ctx context.Context, obj runtime.Object, opts ...client.UpdateOption) error {
+	if unstr, ok := obj.(*unstructured.Unstructured); ok && unstr.GetManagedFields() == nil {
+		live := &unstructured.Unstructured{}
+		live.SetGroupVersionKind(unstr.GroupVersionKind())
+		if err := c.Client.Get(ctx, types.NamespacedName{Namespace: unstr.GetNamespace(), Name: unstr.GetName()}, live); err == nil {
+			unstr.SetManagedFields(live.GetManagedFields())
+		}
+	}
+	return c.Client.Update(ctx, obj, opts...)
+}
+
+// fieldSeparator joins the keys of a field path, since keys may contain dots and slashes
+const fieldSeparator = "\x00"
+
+func splitField(path string) []string {
+	return strings.Split(path, fieldSeparator)
+}
+
+// collectFields collects the leaf fields of the object, except the identity, metadata managed by the server and status
+func collectFields(obj map[string]interface{}, prefix []string, fields map[string]interface{}) {
+	for key, val := range obj {
+		path := append(append([]string{}, prefix...), key)
+		switch strings.Join(path, ".") {
+		case "apiVersion", "kind", "status", "metadata.name", "metadata.namespace", "metadata.resourceVersion",
+			"metadata.managedFields", "metadata.creationTimestamp", "metadata.uid", "metadata.generation":
+			continue
+		}
+		if child, ok := val.(map[string]interface{}); ok && len(child) != 0 {
+			collectFields(child, path, fields)
+			continue
+		}
+		fields[strings.Join(path, fieldSeparator)] = val
+	}
+}
+
+func fieldSet(fields map[string]interface{}) map[string]bool {
+	set := map[string]bool{}
+	for path := range fields {
+		set[path] = true
+	}
+	return set
+}
+
+// managedFields encodes the fields of the managers in the format of fieldsV1. ex) {"f:spec": {"f:replicas": {}}}
+func managedFields(owned map[string]map[string]bool) []metav1.ManagedFieldsEntry {
+	managers := []string{}
+	for manager := range owned {
+		managers = append(managers, manager)
+	}
+	sort.Strings(managers)
+	entries := []metav1.ManagedFieldsEntry{}
+	for _, manager := range managers {
+		tree := map[string]interface{}{}
+		for path := range owned[manager] {
+			node := tree
+			for _, key := range splitField(path) {
+				child, ok := node["f:"+key].(map[string]interface{})
+				if !ok {
+					child = map[string]interface{}{}
+					node["f:"+key] = child
+				}
+				node = child
+			}
+		}
+		raw, _ := json.Marshal(tree)
+		entries = append(entries, metav1.ManagedFieldsEntry{
+			Manager:    manager,
+			Operation:  metav1.ManagedFieldsOperationApply,
+			FieldsType: "FieldsV1",
+			FieldsV1:   &metav1.FieldsV1{Raw: raw},
+		})
+	}
+	return entries
+}
+
+func decodeFields(tree map[string]interface{}, prefix []string, fields map[string]bool) {
+	for key, val := range tree {
+		path := append(append([]string{}, prefix...), strings.TrimPrefix(key, "f:"))
+		if child, ok := val.(map[string]interface{}); ok && len(child) != 0 {
+			decodeFields(child, path, fields)
+			continue
+		}
+		fields[strings.Join(path, fieldSeparator)] = true
+	}
+}
+
+func fieldValue(obj map[string]interface{}, path string) (interface{}, bool) {
+	return unstructuredField(obj, splitField(path))
+}
+
+func unstructuredField(obj map[string]interface{}, keys []string) (interface{}, bool) {
+	val, exist := obj[keys[0]]
+	if !exist || len(keys) == 1 {
+		return val, exist
+	}
+	child, ok := val.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	return unstructuredField(child, keys[1:])
+}
+
+func setField(obj map[string]interface{}, keys []string, val interface{}) {
+	if len(keys) == 1 {
+		obj[keys[0]] = val
+		return
+	}
+	child, ok := obj[keys[0]].(map[string]interface{})
+	if !ok {
+		child = map[string]interface{}{}
+		obj[keys[0]] = child
+	}
+	setField(child, keys[1:], val)
+}
+
+func removeField(obj map[string]interface{}, keys []string) {
+	if len(keys) == 1 {
+		delete(obj, keys[0])
+		return
+	}
+	if child, ok := obj[keys[0]].(map[string]interface{}); ok {
+		removeField(child, keys[1:])
+		if len(child) == 0 {
+			delete(obj, keys[0])
+		}
+	}
+}
+
+func jsonEqual(a, b interface{}) bool {
+	rawA, _ := json.Marshal(a)
+	rawB, _ := json.Marshal(b)
+	return string(rawA) == string(rawB)
+}
+
 func TestTemplateInstanceController(t *testing.T) {
 	var (
 		templateName = "test-template"
@@ -57,9 +328,9 @@ func TestTemplateInstanceController(t *testing.T) {
 					Name: templateName,
 				},
 				Parameters: []tmplv1.ParamSpec{
-					{Name: "NAME", Value: intstr.IntOrString{Type: intstr.String, StrVal: objectName}},
-					{Name: "REPLICAS", Value: intstr.IntOrString{Type: intstr.String, StrVal: "2"}},
-					// {Name: "REPLICAS", Value: intstr.IntOrString{Type: intstr.Int, IntVal: 2}},
+					{Name: "NAME", Value: tmplv1.FromString(objectName)},
+					{Name: "REPLICAS", Value: tmplv1.FromString("2")},
+					// {Name: "REPLICAS", Value: tmplv1.FromInt(2)},
 				},
 			},
 		},
@@ -71,7 +342,7 @@ func TestTemplateInstanceController(t *testing.T) {
 	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template)
 	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, instance)
 
-	cl := fake.NewFakeClient(objs...)
+	cl := &applyClient{fake.NewFakeClient(objs...)}
 
 	r := &TemplateInstanceReconciler{
 		Client: cl,
@@ -97,4 +368,2763 @@ func TestTemplateInstanceController(t *testing.T) {
 	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: objectName, Namespace: namespace}, &corev1.Service{})
 	require.NoError(t, err)
 
+	// created objects are recorded with their health
+	ti := &tmplv1.TemplateInstance{}
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	require.Len(t, ti.Status.Objects, 2)
+	assert.Equal(t, "Deployment", ti.Status.Objects[0].Ref.Kind)
+	assert.Equal(t, objectName, ti.Status.Objects[0].Ref.Name)
+	assert.Equal(t, namespace, ti.Status.Objects[0].Ref.Namespace)
+	assert.NotEmpty(t, ti.Status.Objects[0].Ref.ResourceVersion)
+	assert.Equal(t, tmplv1.HealthProgressing, ti.Status.Objects[0].Health.Status)
+	assert.Equal(t, tmplv1.HealthHealthy, ti.Status.Objects[1].Health.Status)
+	assert.Equal(t, "False", getCondition(ti, tmplv1.ConditionTypeReady).Status)
+
+	// deployment becomes available
+	TestDeploy.Status.AvailableReplicas = 2
+	require.NoError(t, r.Client.Status().Update(context.TODO(), TestDeploy))
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	assert.Equal(t, tmplv1.HealthHealthy, ti.Status.Objects[0].Health.Status)
+	assert.Equal(t, "True", getCondition(ti, tmplv1.ConditionTypeReady).Status)
+}
+
+func getCondition(instance *tmplv1.TemplateInstance, condType string) tmplv1.ConditionSpec {
+	for _, cond := range instance.Status.Conditions {
+		if cond.Type == condType {
+			return cond
+		}
+	}
+	return tmplv1.ConditionSpec{}
+}
+
+func TestTemplateInstanceDrift(t *testing.T) {
+	var (
+		templateName = "drift-template"
+		instanceName = "drift-instance"
+		objectName   = "drift-object"
+		namespace    = "test-ns"
+	)
+
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"kind": "Deployment", "apiVersion": "apps/v1", "metadata": { "name": "${NAME}"},
+				"spec": { "replicas": "${REPLICAS}"}}`)},
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": { "name": "${NAME}"}, "data": {"key": "value"}}`)},
+			},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "NAME", ValueType: "string"},
+				{Name: "REPLICAS", ValueType: "number"},
+			},
+		},
+	}
+
+	instance := &tmplv1.TemplateInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+		Spec: tmplv1.TemplateInstanceSpec{
+			Template: &tmplv1.ObjectInfo{
+				Metadata: tmplv1.MetadataSpec{
+					Name: templateName,
+				},
+				Parameters: []tmplv1.ParamSpec{
+					{Name: "NAME", Value: tmplv1.FromString(objectName)},
+					{Name: "REPLICAS", Value: tmplv1.FromInt(2)},
+				},
+			},
+		},
+	}
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template)
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, instance)
+
+	r := &TemplateInstanceReconciler{
+		Client: &applyClient{fake.NewFakeClient(template, instance)},
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+
+	req := reconcile.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+	}
+	objKey := types.NamespacedName{Name: objectName, Namespace: namespace}
+
+	_, err := r.Reconcile(req)
+	require.NoError(t, err)
+
+	// no drift right after creation
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+	ti := &tmplv1.TemplateInstance{}
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	assert.Empty(t, ti.Status.DriftedObjects)
+
+	// someone scales the deployment and deletes the configmap
+	deploy := &appsv1.Deployment{}
+	require.NoError(t, r.Client.Get(context.TODO(), objKey, deploy))
+	replicas := int32(5)
+	deploy.Spec.Replicas = &replicas
+	require.NoError(t, r.Client.Update(context.TODO(), deploy))
+	require.NoError(t, r.Client.Delete(context.TODO(), &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: objectName, Namespace: namespace}}))
+
+	// manual policy only reports the drift
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	assert.Len(t, ti.Status.DriftedObjects, 2)
+	require.NoError(t, r.Client.Get(context.TODO(), objKey, deploy))
+	assert.Equal(t, int32(5), *deploy.Spec.Replicas)
+
+	// auto heal policy re-applies the rendered objects
+	ti.Spec.SyncPolicy = tmplv1.SyncPolicyAutoHeal
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	assert.Equal(t, "Healed", getCondition(ti, tmplv1.ConditionTypeSynced).Reason)
+	require.NoError(t, r.Client.Get(context.TODO(), objKey, deploy))
+	assert.Equal(t, int32(2), *deploy.Spec.Replicas)
+	require.NoError(t, r.Client.Get(context.TODO(), objKey, &corev1.ConfigMap{}))
+}
+
+func TestIsSubset(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		desired string
+		live    string
+		inSync  bool
+	}{
+		{name: "defaulted fields",
+			desired: `{"spec": {"replicas": 2}}`, live: `{"spec": {"replicas": 2, "revisionHistoryLimit": 10}}`, inSync: true},
+		{name: "changed field",
+			desired: `{"spec": {"replicas": 2}}`, live: `{"spec": {"replicas": 5}}`, inSync: false},
+		{name: "secret string data",
+			desired: `{"kind": "Secret", "apiVersion": "v1", "stringData": {"password": "s3cr3t"}}`,
+			live:    `{"kind": "Secret", "apiVersion": "v1", "data": {"password": "czNjcjN0"}}`, inSync: true},
+		{name: "changed secret string data",
+			desired: `{"kind": "Secret", "apiVersion": "v1", "stringData": {"password": "s3cr3t"}}`,
+			live:    `{"kind": "Secret", "apiVersion": "v1", "data": {"password": "b3RoZXI="}}`, inSync: false},
+		{name: "normalized quantities",
+			desired: `{"resources": {"limits": {"cpu": "1000m", "memory": "1024Mi"}, "requests": {"cpu": 1}}}`,
+			live:    `{"resources": {"limits": {"cpu": "1", "memory": "1Gi"}, "requests": {"cpu": "1"}}}`, inSync: true},
+		{name: "changed quantity",
+			desired: `{"resources": {"limits": {"cpu": "500m"}}}`, live: `{"resources": {"limits": {"cpu": "1"}}}`, inSync: false},
+		{name: "strings which are not canonical quantities",
+			desired: `{"metadata": {"labels": {"version": "1.10"}}}`, live: `{"metadata": {"labels": {"version": "1.1"}}}`, inSync: false},
+		{name: "int or string",
+			desired: `{"spec": {"targetPort": "8080"}}`, live: `{"spec": {"targetPort": 8080}}`, inSync: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			desired, live := map[string]interface{}{}, map[string]interface{}{}
+			require.NoError(t, json.Unmarshal([]byte(tc.desired), &desired))
+			require.NoError(t, json.Unmarshal([]byte(tc.live), &live))
+			inSync, err := isSubset(desired, live)
+			require.NoError(t, err)
+			assert.Equal(t, tc.inSync, inSync)
+		})
+	}
+}
+
+func TestTemplateInstanceApplyConflicts(t *testing.T) {
+	var (
+		templateName = "conflict-template"
+		instanceName = "conflict-instance"
+		namespace    = "test-ns"
+	)
+
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "settings"}, "data": {"size": "${SIZE}", "mode": "debug"}}`)},
+			},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "SIZE", ValueType: "string"},
+			},
+		},
+	}
+	instance := &tmplv1.TemplateInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       instanceName,
+			Namespace:  namespace,
+			Generation: 1,
+		},
+		Spec: tmplv1.TemplateInstanceSpec{
+			Template: &tmplv1.ObjectInfo{
+				Metadata:   tmplv1.MetadataSpec{Name: templateName},
+				Parameters: []tmplv1.ParamSpec{{Name: "SIZE", Value: tmplv1.FromString("1")}},
+			},
+		},
+	}
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template, instance)
+
+	r := &TemplateInstanceReconciler{
+		Client: &applyClient{fake.NewFakeClient(template, instance)},
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+	req := reconcile.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+	}
+	getConfigMap := func() *corev1.ConfigMap {
+		cm := &corev1.ConfigMap{}
+		require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "settings", Namespace: namespace}, cm))
+		return cm
+	}
+	getInstance := func() *tmplv1.TemplateInstance {
+		ti := &tmplv1.TemplateInstance{}
+		require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+		return ti
+	}
+
+	_, err := r.Reconcile(req)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"size": "1", "mode": "debug"}, getConfigMap().Data)
+
+	// another manager takes the size
+	tuned := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "ConfigMap",
+		"metadata":   map[string]interface{}{"name": "settings", "namespace": namespace},
+		"data":       map[string]interface{}{"size": "5"},
+	}}
+	require.NoError(t, r.Client.Patch(context.TODO(), tuned, client.Apply, client.FieldOwner("tuner"), client.ForceOwnership))
+
+	// fields managed by others are not taken, and the conflict is reported
+	ti := getInstance()
+	ti.Spec.Template.Parameters[0].Value = tmplv1.FromString("3")
+	ti.Generation = 2
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+	_, err = r.Reconcile(req)
+	require.Error(t, err)
+
+	assert.Equal(t, "5", getConfigMap().Data["size"])
+	cond := getCondition(getInstance(), tmplv1.ConditionTypeConflicted)
+	assert.Equal(t, "True", cond.Status)
+	assert.Equal(t, "FieldManagerConflict", cond.Reason)
+	assert.Contains(t, cond.Message, `conflict with "tuner": .data.size`)
+
+	// fields are taken when the instance forces conflicts, and fields removed from the template are removed
+	ti = getInstance()
+	ti.Status.Template.Objects[0] = runtime.RawExtension{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "settings"}, "data": {"size": "${SIZE}"}}`)}
+	require.NoError(t, r.Client.Status().Update(context.TODO(), ti))
+	ti = getInstance()
+	ti.Spec.ForceConflicts = true
+	ti.Generation = 3
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]string{"size": "3"}, getConfigMap().Data)
+	cond = getCondition(getInstance(), tmplv1.ConditionTypeConflicted)
+	assert.Equal(t, "False", cond.Status)
+	assert.Equal(t, "Applied", cond.Reason)
+}
+
+func TestTemplateInstanceLongName(t *testing.T) {
+	var (
+		templateName = "long-name-template"
+		instanceName = "long-name-instance-" + strings.Repeat("x", 40)
+		namespace    = "test-ns"
+		otherNs      = "other-ns"
+	)
+
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": { "name": "long-name", "namespace": "other-ns"}}`)},
+			},
+		},
+	}
+
+	instance := &tmplv1.TemplateInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+		Spec: tmplv1.TemplateInstanceSpec{
+			Template: &tmplv1.ObjectInfo{
+				Metadata: tmplv1.MetadataSpec{
+					Name: templateName,
+				},
+			},
+		},
+	}
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template)
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, instance)
+
+	r := &TemplateInstanceReconciler{
+		Client: &applyClient{fake.NewFakeClient(template, instance)},
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+
+	req := reconcile.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+	}
+
+	_, err := r.Reconcile(req)
+	require.NoError(t, err)
+
+	// owner label doesn't fit in a label value, so the owner is found by the annotation
+	cm := &corev1.ConfigMap{}
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "long-name", Namespace: otherNs}, cm))
+	assert.NotContains(t, cm.Labels, internal.InstanceOwnerLabel)
+	assert.Equal(t, namespace, cm.Labels[internal.InstanceNamespaceLabel])
+	assert.Equal(t, instanceName, cm.Annotations[internal.InstanceOwnerAnnotation])
+	assert.Equal(t, []reconcile.Request{req}, ownerInstanceRequests(handler.MapObject{Meta: cm, Object: cm}))
+}
+
+func TestTemplateInstancePrune(t *testing.T) {
+	var (
+		templateName = "prune-template"
+		instanceName = "prune-instance"
+		namespace    = "test-ns"
+	)
+
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": { "name": "${NAME}"}}`)},
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": { "name": "${NAME}-keep"}}`)},
+			},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "NAME", ValueType: "string"},
+			},
+		},
+	}
+
+	instance := &tmplv1.TemplateInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+		Spec: tmplv1.TemplateInstanceSpec{
+			Template: &tmplv1.ObjectInfo{
+				Metadata: tmplv1.MetadataSpec{
+					Name: templateName,
+				},
+				Parameters: []tmplv1.ParamSpec{
+					{Name: "NAME", Value: tmplv1.FromString("old")},
+				},
+			},
+		},
+	}
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template)
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, instance)
+
+	r := &TemplateInstanceReconciler{
+		Client: &applyClient{fake.NewFakeClient(template, instance)},
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+
+	req := reconcile.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+	}
+
+	_, err := r.Reconcile(req)
+	require.NoError(t, err)
+
+	// user wants to keep one of the objects
+	kept := &corev1.ConfigMap{}
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "old-keep", Namespace: namespace}, kept))
+	kept.Annotations = map[string]string{"templateinstances.tmax.io/resource-policy": "keep"}
+	require.NoError(t, r.Client.Update(context.TODO(), kept))
+
+	// objects are renamed by parameter change
+	ti := &tmplv1.TemplateInstance{}
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	ti.Spec.Template.Parameters[0].Value = tmplv1.FromString("new")
+	ti.Generation = ti.Status.ObservedGeneration + 1
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "new", Namespace: namespace}, &corev1.ConfigMap{}))
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "new-keep", Namespace: namespace}, &corev1.ConfigMap{}))
+
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: "old", Namespace: namespace}, &corev1.ConfigMap{})
+	assert.True(t, errors.IsNotFound(err), "removed object is not pruned")
+
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "old-keep", Namespace: namespace}, kept))
+	assert.Empty(t, kept.OwnerReferences, "kept object is not released")
+
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	require.Len(t, ti.Status.Objects, 2)
+	assert.Equal(t, "new", ti.Status.Objects[0].Ref.Name)
+	assert.Equal(t, "new-keep", ti.Status.Objects[1].Ref.Name)
+}
+
+func TestTemplateInstanceUpgrade(t *testing.T) {
+	var (
+		templateName = "upgrade-template"
+		instanceName = "upgrade-instance"
+		namespace    = "test-ns"
+	)
+
+	newRevision := func(version string, objects ...string) *tmplv1.TemplateRevision {
+		rev := &tmplv1.TemplateRevision{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      templateName + "-" + version,
+				Namespace: namespace,
+				Labels:    map[string]string{internal.RevisionTemplateLabel: templateName},
+			},
+			Spec: tmplv1.TemplateRevisionSpec{
+				TemplateName: templateName,
+				Version:      version,
+				Hash:         version,
+				Template: tmplv1.TemplateSpec{
+					Version: version,
+					Parameters: []tmplv1.ParamSpec{
+						{Name: "NAME", ValueType: "string"},
+					},
+				},
+			},
+		}
+		for _, obj := range objects {
+			rev.Spec.Template.Objects = append(rev.Spec.Template.Objects, runtime.RawExtension{Raw: []byte(obj)})
+		}
+		return rev
+	}
+
+	// the current template is already changed to another version
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Version: "2.0",
+		},
+	}
+	rev10 := newRevision("1.0",
+		`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": { "name": "${NAME}"}}`)
+	rev11 := newRevision("1.1",
+		`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": { "name": "${NAME}"}, "data": {"version": "1.1"}}`,
+		`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": { "name": "${NAME}-extra"}}`)
+
+	instance := &tmplv1.TemplateInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+		Spec: tmplv1.TemplateInstanceSpec{
+			Template: &tmplv1.ObjectInfo{
+				Metadata: tmplv1.MetadataSpec{
+					Name: templateName,
+				},
+				Version: "1.0",
+				Parameters: []tmplv1.ParamSpec{
+					{Name: "NAME", Value: tmplv1.FromString("app")},
+				},
+			},
+		},
+	}
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template, instance, &tmplv1.TemplateRevision{}, &tmplv1.TemplateRevisionList{})
+
+	r := &TemplateInstanceReconciler{
+		Client: &applyClient{fake.NewFakeClient(template, rev10, rev11, instance)},
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+
+	req := reconcile.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+	}
+
+	// instance pinned to a version is instantiated with the revision instead of the current template
+	_, err := r.Reconcile(req)
+	require.NoError(t, err)
+
+	ti := &tmplv1.TemplateInstance{}
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	require.NotNil(t, ti.Status.Template)
+	assert.Equal(t, "1.0", ti.Status.Template.Version)
+	assert.Equal(t, "upgrade-template-1.0", ti.Status.TemplateRevision)
+	require.Len(t, ti.Status.Objects, 1)
+
+	// upgrade to the next version
+	ti.Spec.Template.Version = "1.1"
+	ti.Generation = ti.Status.ObservedGeneration + 1
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	assert.Equal(t, "1.1", ti.Status.Template.Version)
+	assert.Equal(t, "upgrade-template-1.1", ti.Status.TemplateRevision)
+	assert.Len(t, ti.Status.Objects, 2)
+
+	cm := &corev1.ConfigMap{}
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "app", Namespace: namespace}, cm))
+	assert.Equal(t, "1.1", cm.Data["version"])
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "app-extra", Namespace: namespace}, cm))
+
+	// unknown version is reported
+	ti.Spec.Template.Version = "9.9"
+	ti.Generation = ti.Status.ObservedGeneration + 1
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+
+	_, err = r.Reconcile(req)
+	require.Error(t, err)
+
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	assert.Equal(t, "1.1", ti.Status.Template.Version)
+	assert.Contains(t, getCondition(ti, "").Message, "version 9.9")
+}
+
+func TestTemplateInstanceGoTemplate(t *testing.T) {
+	var (
+		templateName = "gotemplate-template"
+		namespace    = "test-ns"
+	)
+
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": { "name": "${NAME}-plain"}}`)},
+			},
+			Object: []string{`
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .NAME }}
+data:
+  message: "hello {{ .NAME }}"
+`},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "NAME", ValueType: "string"},
+			},
+		},
+	}
+
+	// go template renders the same object as objects
+	dupTemplate := template.DeepCopy()
+	dupTemplate.Name = "duplicated-template"
+	dupTemplate.Objects[0].Raw = []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": { "name": "${NAME}"}}`)
+
+	newInstance := func(name, templateName string) *tmplv1.TemplateInstance {
+		return &tmplv1.TemplateInstance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+			},
+			Spec: tmplv1.TemplateInstanceSpec{
+				Template: &tmplv1.ObjectInfo{
+					Metadata: tmplv1.MetadataSpec{
+						Name: templateName,
+					},
+					Parameters: []tmplv1.ParamSpec{
+						{Name: "NAME", Value: tmplv1.FromString("app")},
+					},
+				},
+			},
+		}
+	}
+	instance := newInstance("gotemplate-instance", templateName)
+	duplicated := newInstance("duplicated-instance", dupTemplate.Name)
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template, instance)
+
+	r := &TemplateInstanceReconciler{
+		Client: &applyClient{fake.NewFakeClient(template, dupTemplate, instance, duplicated)},
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+
+	req := reconcile.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      instance.Name,
+			Namespace: namespace,
+		},
+	}
+
+	_, err := r.Reconcile(req)
+	require.NoError(t, err)
+
+	cm := &corev1.ConfigMap{}
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "app-plain", Namespace: namespace}, cm))
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "app", Namespace: namespace}, cm))
+	assert.Equal(t, "hello app", cm.Data["message"])
+
+	ti := &tmplv1.TemplateInstance{}
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	require.NotNil(t, ti.Status.Template)
+	assert.Len(t, ti.Status.Template.Object, 1)
+	assert.Len(t, ti.Status.Objects, 2)
+
+	// update of the instance re-renders go template from the snapshot
+	ti.Spec.Template.Parameters[0].Value = tmplv1.FromString("web")
+	ti.Generation = ti.Status.ObservedGeneration + 1
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "web", Namespace: namespace}, cm))
+	assert.Equal(t, "hello web", cm.Data["message"])
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: "app", Namespace: namespace}, cm)
+	assert.True(t, errors.IsNotFound(err), "object rendered with old parameters is not pruned")
+
+	// the same object in objects and object is rejected
+	_, err = r.Reconcile(reconcile.Request{NamespacedName: types.NamespacedName{Name: duplicated.Name, Namespace: namespace}})
+	require.Error(t, err)
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: duplicated.Name, Namespace: namespace}, ti))
+	assert.Contains(t, getCondition(ti, "").Message, "defined more than once")
+}
+
+func TestTemplateExec(t *testing.T) {
+	instance := &tmplv1.TemplateInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "exec-instance",
+			Namespace: "test-ns",
+			UID:       "uid-1",
+			Labels:    map[string]string{"team": "a"},
+		},
+	}
+	objects := []string{`
+apiVersion: v1
+kind: Secret
+metadata:
+  name: {{ .Instance.Name }}-secret
+  namespace: {{ .Instance.Namespace }}
+  labels:{{ .Instance.Labels | toYaml | nindent 4 }}
+data:
+  user: {{ .USER | default "admin" | b64enc }}
+  password: {{ randAlphaNum 16 | b64enc }}
+stringData:
+  port: {{ .PORT | quote }}
+  hosts: {{ list "a" "b" | join "," | upper }}
+`}
+	params := map[string]tmplv1.ParamValue{"PORT": tmplv1.FromInt(8080)}
+
+	rendered, err := TemplateExec(objects, params, instance)
+	require.NoError(t, err)
+	require.Len(t, rendered, 1)
+
+	secret := &corev1.Secret{}
+	require.NoError(t, json.Unmarshal(rendered[0].Raw, secret))
+	assert.Equal(t, "exec-instance-secret", secret.Name)
+	assert.Equal(t, "test-ns", secret.Namespace)
+	assert.Equal(t, "a", secret.Labels["team"])
+	assert.Equal(t, "admin", string(secret.Data["user"]))
+	assert.Len(t, secret.Data["password"], 16)
+	assert.Equal(t, "8080", secret.StringData["port"])
+	assert.Equal(t, "A,B", secret.StringData["hosts"])
+
+	// random values are stable for the same instance
+	again, err := TemplateExec(objects, params, instance)
+	require.NoError(t, err)
+	assert.Equal(t, string(rendered[0].Raw), string(again[0].Raw))
+
+	other := instance.DeepCopy()
+	other.UID = "uid-2"
+	otherRendered, err := TemplateExec(objects, params, other)
+	require.NoError(t, err)
+	assert.NotEqual(t, string(rendered[0].Raw), string(otherRendered[0].Raw))
+
+	// required value is missing
+	_, err = TemplateExec([]string{`{"kind": "ConfigMap", "metadata": {"name": "{{ required "NAME is required" .NAME }}"}}`}, params, instance)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "NAME is required")
+
+	// sizes are limited not to exhaust the memory of the operator
+	for _, object := range []string{
+		`{"kind": "ConfigMap", "metadata": {"name": "{{ randAlphaNum 2000000000 }}"}}`,
+		`{"kind": "ConfigMap", "metadata": {"name": "{{ randNumeric -1 }}"}}`,
+		`{"kind": "ConfigMap", "metadata": {"name": "{{ repeat 1000000000 "x" }}"}}`,
+		`{"kind": "ConfigMap", "metadata": {"name": "{{ repeat -1 "x" }}"}}`,
+		`{"kind": "ConfigMap", "metadata": {"name": "{{ indent -1 "x" }}"}}`,
+	} {
+		_, err = TemplateExec([]string{object}, params, instance)
+		assert.Error(t, err, object)
+	}
+}
+
+func TestTemplateInstanceTypedParams(t *testing.T) {
+	var (
+		templateName = "typed-template"
+		namespace    = "test-ns"
+	)
+
+	rawValue := func(raw string) tmplv1.ParamValue {
+		v := tmplv1.ParamValue{}
+		require.NoError(t, json.Unmarshal([]byte(raw), &v))
+		return v
+	}
+
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"kind": "Deployment", "apiVersion": "apps/v1",
+					"metadata": {"name": "typed", "labels": "${LABELS}", "annotations": {"args": "args are ${ARGS}"}},
+					"spec": {"replicas": "${REPLICAS}", "paused": "${PAUSED}",
+						"template": {"spec": {"containers": [{"name": "app", "image": "nginx", "args": "${ARGS}",
+							"env": [{"name": "PASSWORD", "valueFrom": {"secretKeyRef": "${DB_SECRET}"}}]}]}}}}`)},
+			},
+			Object: []string{`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "typed-config"},
+				"data": {"first": "{{ first .ARGS }}", "paused": "{{ if .PAUSED }}yes{{ end }}", "team": "{{ .LABELS.team }}"}}`},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "REPLICAS", ValueType: "integer", Schema: &runtime.RawExtension{Raw: []byte(`{"minimum": 1, "maximum": 5}`)}},
+				{Name: "PAUSED", ValueType: "boolean"},
+				{Name: "LABELS", ValueType: "object", Value: rawValue(`{"team": "default"}`)},
+				{Name: "ARGS", ValueType: "array", Schema: &runtime.RawExtension{Raw: []byte(`{"items": {"type": "string"}, "minItems": 1}`)}},
+				{Name: "DB_SECRET", ValueType: "secretRef"},
+			},
+		},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "db", Namespace: namespace},
+		Data:       map[string][]byte{"password": []byte("secret")},
+	}
+
+	newInstance := func(name string, params ...tmplv1.ParamSpec) *tmplv1.TemplateInstance {
+		return &tmplv1.TemplateInstance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+			},
+			Spec: tmplv1.TemplateInstanceSpec{
+				Template: &tmplv1.ObjectInfo{
+					Metadata:   tmplv1.MetadataSpec{Name: templateName},
+					Parameters: params,
+				},
+			},
+		}
+	}
+	// values given as strings are converted to the value types
+	instance := newInstance("typed-instance",
+		tmplv1.ParamSpec{Name: "REPLICAS", Value: tmplv1.FromString("3")},
+		tmplv1.ParamSpec{Name: "PAUSED", Value: tmplv1.FromString("true")},
+		tmplv1.ParamSpec{Name: "LABELS", Value: rawValue(`{"team": "a"}`)},
+		tmplv1.ParamSpec{Name: "ARGS", Value: rawValue(`["--port", "8080"]`)},
+		tmplv1.ParamSpec{Name: "DB_SECRET", Value: rawValue(`{"name": "db", "key": "password"}`)},
+	)
+	tooMany := newInstance("too-many-instance",
+		tmplv1.ParamSpec{Name: "REPLICAS", Value: tmplv1.FromInt(9)},
+		tmplv1.ParamSpec{Name: "ARGS", Value: rawValue(`["--port"]`)},
+	)
+	noSecret := newInstance("no-secret-instance",
+		tmplv1.ParamSpec{Name: "REPLICAS", Value: tmplv1.FromInt(1)},
+		tmplv1.ParamSpec{Name: "ARGS", Value: rawValue(`["--port"]`)},
+		tmplv1.ParamSpec{Name: "DB_SECRET", Value: rawValue(`{"name": "db", "key": "user"}`)},
+	)
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template, instance)
+
+	r := &TemplateInstanceReconciler{
+		Client: &applyClient{fake.NewFakeClient(template, secret, instance, tooMany, noSecret)},
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+	reconcileInstance := func(name string) error {
+		_, err := r.Reconcile(reconcile.Request{NamespacedName: types.NamespacedName{Name: name, Namespace: namespace}})
+		return err
+	}
+
+	require.NoError(t, reconcileInstance(instance.Name))
+
+	deploy := &appsv1.Deployment{}
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "typed", Namespace: namespace}, deploy))
+	assert.Equal(t, int32(3), *deploy.Spec.Replicas)
+	assert.True(t, deploy.Spec.Paused)
+	assert.Equal(t, "a", deploy.Labels["team"])
+	assert.Equal(t, `args are ["--port","8080"]`, deploy.Annotations["args"])
+	container := deploy.Spec.Template.Spec.Containers[0]
+	assert.Equal(t, []string{"--port", "8080"}, container.Args)
+	require.NotNil(t, container.Env[0].ValueFrom.SecretKeyRef)
+	assert.Equal(t, "db", container.Env[0].ValueFrom.SecretKeyRef.Name)
+	assert.Equal(t, "password", container.Env[0].ValueFrom.SecretKeyRef.Key)
+
+	cm := &corev1.ConfigMap{}
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "typed-config", Namespace: namespace}, cm))
+	assert.Equal(t, map[string]string{"first": "--port", "paused": "yes", "team": "a"}, cm.Data)
+
+	ti := &tmplv1.TemplateInstance{}
+
+	// schema violation
+	require.Error(t, reconcileInstance(tooMany.Name))
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: tooMany.Name, Namespace: namespace}, ti))
+	assert.Contains(t, getCondition(ti, "").Message, "parameter REPLICAS: value must be less than 5")
+
+	// referenced key does not exist
+	require.Error(t, reconcileInstance(noSecret.Name))
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: noSecret.Name, Namespace: namespace}, ti))
+	assert.Contains(t, getCondition(ti, "").Message, "secret db has no key user")
+}
+
+func TestTemplateInstancePlan(t *testing.T) {
+	var (
+		templateName = "plan-template"
+		instanceName = "plan-instance"
+		namespace    = "test-ns"
+	)
+
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": { "name": "${NAME}"}, "data": {"size": "${SIZE}", "owner": "${OWNER}"}}`)},
+			},
+			Plans: []tmplv1.PlanSpec{
+				{
+					Name:           "small",
+					PlanUpdateable: true,
+					Schemas: tmplv1.Schemas{ServiceInstance: tmplv1.ServiceInstanceSchema{
+						Create: tmplv1.SchemaParameters{Parameters: map[string]intstr.IntOrString{
+							"SIZE":  intstr.FromString("1"),
+							"OWNER": intstr.FromString("team-a"),
+						}},
+					}},
+				},
+				{
+					Name: "large",
+					Schemas: tmplv1.Schemas{ServiceInstance: tmplv1.ServiceInstanceSchema{
+						Create: tmplv1.SchemaParameters{Parameters: map[string]intstr.IntOrString{"SIZE": intstr.FromString("3")}},
+					}},
+				},
+			},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "NAME", ValueType: "string"},
+				{Name: "SIZE", ValueType: "string", Value: tmplv1.FromString("0")},
+				{Name: "OWNER", ValueType: "string", Value: tmplv1.FromString("nobody")},
+			},
+		},
+	}
+	instance := &tmplv1.TemplateInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+		Spec: tmplv1.TemplateInstanceSpec{
+			Template: &tmplv1.ObjectInfo{
+				Metadata: tmplv1.MetadataSpec{Name: templateName},
+				Plan:     "small",
+				Parameters: []tmplv1.ParamSpec{
+					{Name: "NAME", Value: tmplv1.FromString("sized")},
+					{Name: "OWNER", Value: tmplv1.FromString("me")},
+				},
+			},
+		},
+	}
+	unknownPlan := instance.DeepCopy()
+	unknownPlan.Name = "unknown-plan-instance"
+	unknownPlan.Spec.Template.Plan = "huge"
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template, instance)
+
+	r := &TemplateInstanceReconciler{
+		Client: &applyClient{fake.NewFakeClient(template, instance, unknownPlan)},
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+	req := reconcile.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+	}
+	getConfigMap := func() *corev1.ConfigMap {
+		cm := &corev1.ConfigMap{}
+		require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "sized", Namespace: namespace}, cm))
+		return cm
+	}
+
+	// values of the plan override defaults of the template, and parameters of the instance override the plan
+	_, err := r.Reconcile(req)
+	require.NoError(t, err)
+
+	ti := &tmplv1.TemplateInstance{}
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	assert.Equal(t, "small", ti.Status.Template.Plan)
+	assert.Len(t, ti.Status.Template.Plans, 2)
+	assert.Equal(t, map[string]string{"size": "1", "owner": "me"}, getConfigMap().Data)
+
+	// small plan is updateable
+	ti.Spec.Template.Plan = "large"
+	ti.Generation = ti.Status.ObservedGeneration + 1
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	assert.Equal(t, "large", ti.Status.Template.Plan)
+	assert.Equal(t, map[string]string{"size": "3", "owner": "me"}, getConfigMap().Data)
+
+	// large plan is not updateable
+	ti.Spec.Template.Plan = "small"
+	ti.Generation = ti.Status.ObservedGeneration + 1
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+
+	_, err = r.Reconcile(req)
+	require.Error(t, err)
+
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	assert.Equal(t, "large", ti.Status.Template.Plan)
+	assert.Contains(t, getCondition(ti, "").Message, "plan large is not updateable")
+	assert.Equal(t, "3", getConfigMap().Data["size"])
+
+	// unknown plan is reported
+	_, err = r.Reconcile(reconcile.Request{NamespacedName: types.NamespacedName{Name: unknownPlan.Name, Namespace: namespace}})
+	require.Error(t, err)
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: unknownPlan.Name, Namespace: namespace}, ti))
+	assert.Contains(t, getCondition(ti, "").Message, "plan huge is not found")
+}
+
+func TestTemplateInstanceOutputs(t *testing.T) {
+	var (
+		templateName = "output-template"
+		instanceName = "output-instance"
+		namespace    = "test-ns"
+	)
+
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"kind": "Deployment", "apiVersion": "apps/v1", "metadata": {"name": "${NAME}"}, "spec": {"replicas": 1}}`)},
+				{Raw: []byte(`{"kind": "Service", "apiVersion": "v1", "metadata": {"name": "${NAME}"}, "spec": {"clusterIP": "10.0.0.10", "ports": [{"port": 80}]}}`)},
+				{Raw: []byte(`{"kind": "Secret", "apiVersion": "v1", "metadata": {"name": "${NAME}"}, "data": {"password": "czNjcjN0"}}`)},
+			},
+			Outputs: []tmplv1.OutputSpec{
+				{Name: "url", Value: "http://${NAME}.${NAMESPACE}"},
+				{Name: "clusterIP", ObjectRef: &tmplv1.OutputObjectRef{Kind: "Service", Name: "${NAME}"}, JSONPath: ".spec.clusterIP"},
+				{Name: "ports", ObjectRef: &tmplv1.OutputObjectRef{Kind: "Service", Name: "${NAME}"}, JSONPath: "{.spec.ports[*].port}"},
+			},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "NAME", ValueType: "string"},
+				{Name: "NAMESPACE", ValueType: "string", Value: tmplv1.FromString(namespace)},
+			},
+		},
+	}
+	instance := &tmplv1.TemplateInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+		Spec: tmplv1.TemplateInstanceSpec{
+			Template: &tmplv1.ObjectInfo{
+				Metadata: tmplv1.MetadataSpec{Name: templateName},
+				Parameters: []tmplv1.ParamSpec{
+					{Name: "NAME", Value: tmplv1.FromString("web")},
+				},
+			},
+		},
+	}
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template, instance)
+
+	r := &TemplateInstanceReconciler{
+		Client: &applyClient{fake.NewFakeClient(template, instance)},
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+	req := reconcile.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+	}
+
+	// outputs wait for the objects to be ready
+	res, err := r.Reconcile(req)
+	require.NoError(t, err)
+	assert.NotZero(t, res.RequeueAfter)
+
+	ti := &tmplv1.TemplateInstance{}
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	assert.Len(t, ti.Status.Template.Outputs, 3)
+	assert.Empty(t, ti.Status.Outputs)
+	assert.Equal(t, "False", getCondition(ti, tmplv1.ConditionTypeOutputsResolved).Status)
+
+	deploy := &appsv1.Deployment{}
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "web", Namespace: namespace}, deploy))
+	deploy.Status.AvailableReplicas = 1
+	require.NoError(t, r.Client.Status().Update(context.TODO(), deploy))
+
+	res, err = r.Reconcile(req)
+	require.NoError(t, err)
+	assert.Zero(t, res.RequeueAfter)
+
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	assert.Equal(t, map[string]string{
+		"url":       "http://web." + namespace,
+		"clusterIP": "10.0.0.10",
+		"ports":     "80",
+	}, ti.Status.Outputs)
+	assert.Equal(t, "True", getCondition(ti, tmplv1.ConditionTypeOutputsResolved).Status)
+
+	// outputs which cannot be resolved are reported, and resolved again later
+	ti.Status.Template.Outputs[1].JSONPath = ".status.loadBalancer.ingress[0].ip"
+	require.NoError(t, r.Client.Status().Update(context.TODO(), ti))
+
+	res, err = r.Reconcile(req)
+	require.NoError(t, err)
+	assert.NotZero(t, res.RequeueAfter)
+
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	assert.Equal(t, "80", ti.Status.Outputs["ports"])
+	cond := getCondition(ti, tmplv1.ConditionTypeOutputsResolved)
+	assert.Equal(t, "False", cond.Status)
+	assert.Contains(t, cond.Message, "clusterIP:")
+
+	// values of secrets are not published in the status
+	ti.Status.Template.Outputs = append(ti.Status.Template.Outputs,
+		tmplv1.OutputSpec{Name: "password", ObjectRef: &tmplv1.OutputObjectRef{Kind: "Secret", Name: "${NAME}"}, JSONPath: ".data.password"})
+	require.NoError(t, r.Client.Status().Update(context.TODO(), ti))
+
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	assert.NotContains(t, ti.Status.Outputs, "password")
+	assert.Contains(t, getCondition(ti, tmplv1.ConditionTypeOutputsResolved).Message, "password: outputs are published in the status")
+}
+
+func TestTemplateInstanceValueFrom(t *testing.T) {
+	var (
+		templateName = "secret-template"
+		namespace    = "test-ns"
+		password     = "p4ssw0rd"
+	)
+
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "${NAME}"}, "data": {"password": "${PASSWORD}", "mode": "${MODE}", "replicas": "x${REPLICAS}", "ip": "10.0.0.10", "pin": "${PIN}"}}`)},
+			},
+			Outputs: []tmplv1.OutputSpec{
+				{Name: "dsn", Value: "admin:${PASSWORD}@${NAME}"},
+				{Name: "address", Value: "10.0.0.10:${PIN}"},
+				{Name: "ip", ObjectRef: &tmplv1.OutputObjectRef{Kind: "ConfigMap", Name: "${NAME}"}, JSONPath: ".data.ip"},
+			},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "NAME", ValueType: "string"},
+				{Name: "PIN", ValueType: "string", Sensitive: true, Value: tmplv1.FromString("1")},
+				{Name: "PASSWORD", ValueType: "string", Regex: "^[a-z0-9]+$"},
+				{Name: "MODE", ValueType: "string", Value: tmplv1.FromString("debug")},
+				{Name: "REPLICAS", ValueType: "integer", Value: tmplv1.FromInt(1)},
+			},
+		},
+	}
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: namespace},
+		Data:       map[string][]byte{"password": []byte(password), "invalid": []byte("P@ss")},
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "settings", Namespace: namespace},
+		// quotes and backslashes of the value cannot add fields to the object
+		Data: map[string]string{"mode": `release\", "injected": "yes`, "replicas": "3"},
+	}
+	newInstance := func(name string, secretKey string) *tmplv1.TemplateInstance {
+		optional := true
+		return &tmplv1.TemplateInstance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+			},
+			Spec: tmplv1.TemplateInstanceSpec{
+				Template: &tmplv1.ObjectInfo{
+					Metadata: tmplv1.MetadataSpec{Name: templateName},
+					Parameters: []tmplv1.ParamSpec{
+						{Name: "NAME", Value: tmplv1.FromString(name)},
+						{Name: "PASSWORD", ValueFrom: &tmplv1.ParamValueSource{SecretKeyRef: &corev1.SecretKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{Name: "credentials"}, Key: secretKey,
+						}}},
+						{Name: "MODE", ValueFrom: &tmplv1.ParamValueSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{Name: "settings"}, Key: "mode",
+						}}},
+						{Name: "REPLICAS", ValueFrom: &tmplv1.ParamValueSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+							LocalObjectReference: corev1.LocalObjectReference{Name: "missing"}, Key: "replicas", Optional: &optional,
+						}}},
+					},
+				},
+			},
+		}
+	}
+	instance := newInstance("valid", "password")
+	invalid := newInstance("invalid", "invalid")
+	missing := newInstance("missing", "unknown")
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template, instance)
+
+	r := &TemplateInstanceReconciler{
+		Client: &applyClient{fake.NewFakeClient(template, secret, configMap, instance, invalid, missing)},
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+	reconcileInstance := func(name string) (*tmplv1.TemplateInstance, error) {
+		req := reconcile.Request{NamespacedName: types.NamespacedName{Name: name, Namespace: namespace}}
+		_, err := r.Reconcile(req)
+		ti := &tmplv1.TemplateInstance{}
+		require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+		return ti, err
+	}
+
+	// values are read from the secret and the config map, and defaults are used for missing optional keys
+	ti, err := reconcileInstance("valid")
+	require.NoError(t, err)
+
+	cm := &corev1.ConfigMap{}
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "valid", Namespace: namespace}, cm))
+	assert.Equal(t, map[string]string{"password": password, "mode": `release\", "injected": "yes`, "replicas": "x1", "ip": "10.0.0.10", "pin": "1"}, cm.Data)
+
+	// values taken from secrets are not exposed in the status
+	assert.Equal(t, "admin:"+internal.RedactedValue+"@valid", ti.Status.Outputs["dsn"])
+	// short sensitive values are hidden by parameter, and don't mangle other text containing them
+	assert.Equal(t, "10.0.0.10:"+internal.RedactedValue, ti.Status.Outputs["address"])
+	assert.Equal(t, "10.0.0.10", ti.Status.Outputs["ip"])
+	raw, err := json.Marshal(ti)
+	require.NoError(t, err)
+	assert.NotContains(t, string(raw), password)
+
+	// values are redacted from the error message
+	ti, err = reconcileInstance("invalid")
+	require.Error(t, err)
+	assert.NotContains(t, err.Error(), "P@ss")
+	assert.Contains(t, getCondition(ti, "").Message, "value:"+internal.RedactedValue)
+
+	// missing keys are reported
+	ti, err = reconcileInstance("missing")
+	require.Error(t, err)
+	assert.Contains(t, getCondition(ti, "").Message, "secret credentials has no key unknown")
+}
+
+func TestTemplateInstanceGenerate(t *testing.T) {
+	var (
+		templateName = "generate-template"
+		instanceName = "generate-instance"
+		namespace    = "test-ns"
+	)
+
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "${NAME}"}, "data": {"password": "${PASSWORD}", "id": "${ID}", "user": "${USER}"}}`)},
+			},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "NAME", ValueType: "string"},
+				{Name: "PASSWORD", ValueType: "string", Required: true, Generate: &tmplv1.GenerateSpec{Type: "random", Length: 24, Charset: `abc123"\`}},
+				{Name: "ID", Generate: &tmplv1.GenerateSpec{Type: "uuid"}},
+				{Name: "USER", Generate: &tmplv1.GenerateSpec{Type: "random"}},
+			},
+		},
+	}
+	instance := &tmplv1.TemplateInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+		Spec: tmplv1.TemplateInstanceSpec{
+			Template: &tmplv1.ObjectInfo{
+				Metadata: tmplv1.MetadataSpec{Name: templateName},
+				Parameters: []tmplv1.ParamSpec{
+					{Name: "NAME", Value: tmplv1.FromString("generated")},
+					{Name: "USER", Value: tmplv1.FromString("admin")},
+				},
+			},
+		},
+	}
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template, instance)
+
+	r := &TemplateInstanceReconciler{
+		Client: &applyClient{fake.NewFakeClient(template, instance)},
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+	req := reconcile.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+	}
+	getConfigMap := func() *corev1.ConfigMap {
+		cm := &corev1.ConfigMap{}
+		require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "generated", Namespace: namespace}, cm))
+		return cm
+	}
+
+	// values are generated once and stored in a secret owned by the instance
+	_, err := r.Reconcile(req)
+	require.NoError(t, err)
+
+	secret := &corev1.Secret{}
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: instanceName + "-generated", Namespace: namespace}, secret))
+	assert.Equal(t, instanceName, secret.Labels[internal.GeneratedLabel])
+	require.Len(t, secret.OwnerReferences, 1)
+	assert.Equal(t, "TemplateInstance", secret.OwnerReferences[0].Kind)
+
+	password := string(secret.Data["PASSWORD"])
+	assert.Regexp(t, `^[abc123"\\]{24}$`, password)
+	assert.Regexp(t, "^[0-9a-f-]{36}$", string(secret.Data["ID"]))
+	assert.Len(t, secret.Data["USER"], 16)
+
+	data := getConfigMap().Data
+	assert.Equal(t, password, data["password"])
+	assert.Equal(t, string(secret.Data["ID"]), data["id"])
+	// values of the instance take precedence over generated values
+	assert.Equal(t, "admin", data["user"])
+
+	// generated values are kept on update
+	ti := &tmplv1.TemplateInstance{}
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	ti.Spec.Template.Parameters = ti.Spec.Template.Parameters[:1]
+	ti.Generation = ti.Status.ObservedGeneration + 1
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+
+	data = getConfigMap().Data
+	assert.Equal(t, password, data["password"])
+	assert.Equal(t, string(secret.Data["USER"]), data["user"])
+}
+
+func TestTemplateInstanceWaves(t *testing.T) {
+	var (
+		templateName = "wave-template"
+		instanceName = "wave-instance"
+		namespace    = "test-ns"
+	)
+
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "${NAME}-app", "annotations": {"templateinstances.tmax.io/depends-on": "Deployment/${NAME}-db"}}}`)},
+				{Raw: []byte(`{"kind": "Deployment", "apiVersion": "apps/v1", "metadata": {"name": "${NAME}-db"}, "spec": {"replicas": 1}}`)},
+			},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "NAME", ValueType: "string"},
+			},
+		},
+	}
+	instance := &tmplv1.TemplateInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       instanceName,
+			Namespace:  namespace,
+			Generation: 1,
+		},
+		Spec: tmplv1.TemplateInstanceSpec{
+			Template: &tmplv1.ObjectInfo{
+				Metadata: tmplv1.MetadataSpec{Name: templateName},
+				Parameters: []tmplv1.ParamSpec{
+					{Name: "NAME", Value: tmplv1.FromString("web")},
+				},
+			},
+		},
+	}
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template, instance)
+
+	r := &TemplateInstanceReconciler{
+		Client: &applyClient{fake.NewFakeClient(template, instance)},
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+	req := reconcile.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+	}
+
+	// the config map waits for the deployment to be ready
+	res, err := r.Reconcile(req)
+	require.NoError(t, err)
+	assert.NotZero(t, res.RequeueAfter)
+
+	deploy := &appsv1.Deployment{}
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "web-db", Namespace: namespace}, deploy))
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: "web-app", Namespace: namespace}, &corev1.ConfigMap{})
+	assert.True(t, errors.IsNotFound(err), "config map is created before the deployment is ready")
+
+	ti := &tmplv1.TemplateInstance{}
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	cond := getCondition(ti, tmplv1.ConditionTypeReady)
+	assert.Equal(t, "False", cond.Status)
+	assert.Equal(t, "WaitingForDependencies", cond.Reason)
+	assert.Contains(t, cond.Message, "Deployment "+namespace+"/web-db")
+	assert.Zero(t, ti.Status.ObservedGeneration)
+
+	// the next wave is created after the deployment is ready
+	deploy.Status.AvailableReplicas = 1
+	require.NoError(t, r.Client.Status().Update(context.TODO(), deploy))
+
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "web-app", Namespace: namespace}, &corev1.ConfigMap{}))
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	assert.Equal(t, int64(1), ti.Status.ObservedGeneration)
+	assert.Equal(t, "ObjectsHealthy", getCondition(ti, tmplv1.ConditionTypeReady).Reason)
+}
+
+func TestOrderWaves(t *testing.T) {
+	raw := func(objs ...string) []runtime.RawExtension {
+		result := []runtime.RawExtension{}
+		for _, obj := range objs {
+			result = append(result, runtime.RawExtension{Raw: []byte(obj)})
+		}
+		return result
+	}
+	names := func(waves [][]runtime.RawExtension) [][]string {
+		result := [][]string{}
+		for _, wave := range waves {
+			wnames := []string{}
+			for idx := range wave {
+				unstr, err := BytesToUnstructuredObject(&wave[idx])
+				require.NoError(t, err)
+				wnames = append(wnames, unstr.GetName())
+			}
+			result = append(result, wnames)
+		}
+		return result
+	}
+
+	waves, err := orderWaves(raw(
+		`{"kind": "Service", "apiVersion": "v1", "metadata": {"name": "svc", "annotations": {"templateinstances.tmax.io/depends-on": "StatefulSet/db"}}}`,
+		`{"kind": "StatefulSet", "apiVersion": "apps/v1", "metadata": {"name": "db", "annotations": {"templateinstances.tmax.io/wave": "1"}}}`,
+		`{"kind": "CustomResourceDefinition", "apiVersion": "apiextensions.k8s.io/v1", "metadata": {"name": "crd", "annotations": {"templateinstances.tmax.io/wave": "3"}}}`,
+		`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "cm"}}`,
+		`{"kind": "Namespace", "apiVersion": "v1", "metadata": {"name": "ns"}}`,
+		`{"kind": "Secret", "apiVersion": "v1", "metadata": {"name": "early", "annotations": {"templateinstances.tmax.io/wave": "-1"}}}`,
+	))
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"ns"}, {"crd"}, {"early"}, {"cm"}, {"db"}, {"svc"}}, names(waves))
+
+	_, err = orderWaves(raw(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "cm", "annotations": {"templateinstances.tmax.io/wave": "first"}}}`))
+	assert.Error(t, err)
+
+	_, err = orderWaves(raw(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "cm", "annotations": {"templateinstances.tmax.io/depends-on": "Secret/unknown"}}}`))
+	assert.Error(t, err)
+
+	_, err = orderWaves(raw(
+		`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "a", "annotations": {"templateinstances.tmax.io/depends-on": "ConfigMap/b"}}}`,
+		`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "b", "annotations": {"templateinstances.tmax.io/depends-on": "ConfigMap/a"}}}`,
+	))
+	assert.Error(t, err)
+}
+
+func TestTemplateInstanceHooks(t *testing.T) {
+	var (
+		templateName = "hook-template"
+		instanceName = "hook-instance"
+		namespace    = "test-ns"
+	)
+
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "${NAME}"}}`)},
+				{Raw: []byte(`{"kind": "Job", "apiVersion": "batch/v1", "metadata": {"name": "${NAME}-migrate", "annotations": {"templateinstances.tmax.io/hook": "pre-install", "templateinstances.tmax.io/hook-delete-policy": "hook-succeeded"}}}`)},
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "${NAME}-seed", "annotations": {"templateinstances.tmax.io/hook": "post-install"}}}`)},
+				{Raw: []byte(`{"kind": "Job", "apiVersion": "batch/v1", "metadata": {"name": "${NAME}-cleanup", "annotations": {"templateinstances.tmax.io/hook": "pre-delete"}}}`)},
+			},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "NAME", ValueType: "string"},
+			},
+		},
+	}
+	instance := &tmplv1.TemplateInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       instanceName,
+			Namespace:  namespace,
+			Generation: 1,
+		},
+		Spec: tmplv1.TemplateInstanceSpec{
+			Template: &tmplv1.ObjectInfo{
+				Metadata: tmplv1.MetadataSpec{Name: templateName},
+				Parameters: []tmplv1.ParamSpec{
+					{Name: "NAME", Value: tmplv1.FromString("app")},
+				},
+			},
+		},
+	}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template, instance)
+
+	r := &TemplateInstanceReconciler{
+		Client: &applyClient{fake.NewFakeClient(template, instance, ns)},
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+	req := reconcile.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+	}
+	completeJob := func(name, condType string) {
+		job := &batchv1.Job{}
+		require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: namespace}, job))
+		job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobConditionType(condType), Status: corev1.ConditionTrue, Message: "job " + condType}}
+		require.NoError(t, r.Client.Status().Update(context.TODO(), job))
+	}
+
+	// objects are not created until the pre-install hook succeeds
+	res, err := r.Reconcile(req)
+	require.NoError(t, err)
+	assert.NotZero(t, res.RequeueAfter)
+
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "app-migrate", Namespace: namespace}, &batchv1.Job{}))
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: "app", Namespace: namespace}, &corev1.ConfigMap{})
+	assert.True(t, errors.IsNotFound(err), "object is created before the pre-install hook succeeds")
+
+	ti := &tmplv1.TemplateInstance{}
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	assert.Equal(t, "HookRunning", getCondition(ti, tmplv1.ConditionTypeHooksSucceeded).Reason)
+	assert.Contains(t, ti.Finalizers, internal.HookFinalizer)
+	require.Len(t, ti.Status.Hooks, 1)
+	assert.Equal(t, tmplv1.HookRunning, ti.Status.Hooks[0].Status)
+
+	// objects are created after the pre-install hook, and the post-install hook runs after they are ready
+	completeJob("app-migrate", "Complete")
+
+	res, err = r.Reconcile(req)
+	require.NoError(t, err)
+	assert.Zero(t, res.RequeueAfter)
+
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "app", Namespace: namespace}, &corev1.ConfigMap{}))
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "app-seed", Namespace: namespace}, &corev1.ConfigMap{}))
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: "app-migrate", Namespace: namespace}, &batchv1.Job{})
+	assert.True(t, errors.IsNotFound(err), "succeeded hook is not deleted by the delete policy")
+
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	assert.Equal(t, int64(1), ti.Status.ObservedGeneration)
+	assert.Equal(t, "True", getCondition(ti, tmplv1.ConditionTypeHooksSucceeded).Status)
+	require.Len(t, ti.Status.Hooks, 2)
+	for _, hook := range ti.Status.Hooks {
+		assert.Equal(t, tmplv1.HookSucceeded, hook.Status)
+	}
+	assert.Len(t, ti.Status.Objects, 1, "hooks are listed as objects")
+
+	// hooks run once for a generation
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: "app-migrate", Namespace: namespace}, &batchv1.Job{})
+	assert.True(t, errors.IsNotFound(err), "pre-install hook runs again")
+
+	// instances with objects are installed even if no generation is observed, e.g. installed by older versions
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	ti.Generation = 2
+	ti.Status.ObservedGeneration = 0
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: "app-migrate", Namespace: namespace}, &batchv1.Job{})
+	assert.True(t, errors.IsNotFound(err), "pre-install hook runs for the installed instance")
+
+	// the instance is kept until the pre-delete hook is done, and failure of the hook is reported
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	now := metav1.Now()
+	ti.DeletionTimestamp = &now
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+
+	res, err = r.Reconcile(req)
+	require.NoError(t, err)
+	assert.NotZero(t, res.RequeueAfter)
+	require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "app-cleanup", Namespace: namespace}, &batchv1.Job{}))
+
+	completeJob("app-cleanup", "Failed")
+	_, err = r.Reconcile(req)
+	require.Error(t, err)
+
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	assert.Contains(t, ti.Finalizers, internal.HookFinalizer)
+	cond := getCondition(ti, tmplv1.ConditionTypeHooksSucceeded)
+	assert.Equal(t, "HookFailed", cond.Reason)
+	assert.Contains(t, cond.Message, "job Failed")
+}
+
+// failingClient fails to apply the object with the name
+type failingClient struct {
+	applyClient
+	name string
+}
+
+func (c *failingClient) Patch(ctx context.Context, obj runtime.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if unstr, ok := obj.(*unstructured.Unstructured); ok && patch.Type() == types.ApplyPatchType && unstr.GetName() == c.name {
+		return fmt.Errorf("%s is rejected", c.name)
+	}
+	return c.applyClient.Patch(ctx, obj, patch, opts...)
+}
+
+func TestTemplateInstanceRollback(t *testing.T) {
+	var (
+		templateName = "rollback-template"
+		instanceName = "rollback-instance"
+		namespace    = "test-ns"
+	)
+
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "first"}, "data": {"mode": "${MODE}"}}`)},
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "shared", "namespace": "other-ns"}, "data": {"mode": "${MODE}"}}`)},
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "last"}, "data": {"mode": "${MODE}"}}`)},
+			},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "MODE", ValueType: "string"},
+			},
+		},
+	}
+	instance := &tmplv1.TemplateInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       instanceName,
+			Namespace:  namespace,
+			Generation: 1,
+		},
+		Spec: tmplv1.TemplateInstanceSpec{
+			Template: &tmplv1.ObjectInfo{
+				Metadata: tmplv1.MetadataSpec{Name: templateName},
+				Parameters: []tmplv1.ParamSpec{
+					{Name: "MODE", Value: tmplv1.FromString("blue")},
+				},
+			},
+		},
+	}
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template, instance)
+
+	cl := &failingClient{applyClient: applyClient{fake.NewFakeClient(template, instance)}, name: "last"}
+	r := &TemplateInstanceReconciler{
+		Client: cl,
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+	req := reconcile.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+	}
+	getMode := func(ns, name string) (string, error) {
+		cm := &corev1.ConfigMap{}
+		if err := r.Client.Get(context.TODO(), types.NamespacedName{Name: name, Namespace: ns}, cm); err != nil {
+			return "", err
+		}
+		return cm.Data["mode"], nil
+	}
+
+	// created objects and finalizers are removed when creating an object fails
+	_, err := r.Reconcile(req)
+	require.Error(t, err)
+
+	_, err = getMode(namespace, "first")
+	assert.True(t, errors.IsNotFound(err), "created object is not deleted")
+	_, err = getMode("other-ns", "shared")
+	assert.True(t, errors.IsNotFound(err), "created object in other namespace is not deleted")
+
+	ti := &tmplv1.TemplateInstance{}
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	assert.Empty(t, ti.Finalizers)
+	cond := getCondition(ti, tmplv1.ConditionTypeRolledBack)
+	assert.Equal(t, "True", cond.Status)
+	assert.Contains(t, cond.Message, "ConfigMap "+namespace+"/last")
+	assert.Equal(t, "Error", getCondition(ti, "").Status)
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: instanceName + "-snapshot", Namespace: namespace}, &corev1.Secret{})
+	assert.True(t, errors.IsNotFound(err), "snapshot is not removed after rollback")
+
+	// objects are created when the error is resolved
+	cl.name = ""
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	assert.Equal(t, int64(1), ti.Status.ObservedGeneration)
+	assert.Len(t, ti.Finalizers, 1)
+	assert.Equal(t, "False", getCondition(ti, tmplv1.ConditionTypeRolledBack).Status)
+
+	// previous versions of the objects are restored when updating an object fails
+	ti.Spec.Template.Parameters[0].Value = tmplv1.FromString("green")
+	ti.Generation = 2
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+	cl.name = "last"
+
+	_, err = r.Reconcile(req)
+	require.Error(t, err)
+
+	mode, err := getMode(namespace, "first")
+	require.NoError(t, err)
+	assert.Equal(t, "blue", mode)
+	mode, err = getMode("other-ns", "shared")
+	require.NoError(t, err)
+	assert.Equal(t, "blue", mode)
+
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	assert.Equal(t, int64(1), ti.Status.ObservedGeneration)
+	assert.Len(t, ti.Finalizers, 1)
+	assert.Equal(t, "ApplyFailed", getCondition(ti, tmplv1.ConditionTypeRolledBack).Reason)
+}
+
+func TestTemplateInstanceHistory(t *testing.T) {
+	var (
+		templateName = "history-template"
+		instanceName = "history-instance"
+		namespace    = "test-ns"
+	)
+
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "history"}, "data": {"mode": "${MODE}"}}`)},
+			},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "MODE", ValueType: "string"},
+			},
+		},
+	}
+	limit := int32(2)
+	instance := &tmplv1.TemplateInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       instanceName,
+			Namespace:  namespace,
+			Generation: 1,
+		},
+		Spec: tmplv1.TemplateInstanceSpec{
+			Template: &tmplv1.ObjectInfo{
+				Metadata: tmplv1.MetadataSpec{Name: templateName},
+				Parameters: []tmplv1.ParamSpec{
+					{Name: "MODE", Value: tmplv1.FromString("blue")},
+				},
+			},
+			RevisionHistoryLimit: &limit,
+		},
+	}
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template, instance)
+
+	r := &TemplateInstanceReconciler{
+		Client: &applyClient{fake.NewFakeClient(template, instance)},
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+	req := reconcile.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+	}
+	getMode := func() string {
+		cm := &corev1.ConfigMap{}
+		require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "history", Namespace: namespace}, cm))
+		return cm.Data["mode"]
+	}
+	update := func(mutate func(ti *tmplv1.TemplateInstance)) *tmplv1.TemplateInstance {
+		ti := &tmplv1.TemplateInstance{}
+		require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+		mutate(ti)
+		require.NoError(t, r.Client.Update(context.TODO(), ti))
+		_, err := r.Reconcile(req)
+		require.NoError(t, err)
+		updated := &tmplv1.TemplateInstance{}
+		require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, updated))
+		return updated
+	}
+
+	// every successful render is recorded as a revision
+	_, err := r.Reconcile(req)
+	require.NoError(t, err)
+
+	ti := update(func(ti *tmplv1.TemplateInstance) {
+		ti.Spec.Template.Parameters[0].Value = tmplv1.FromString("green")
+		ti.Generation = 2
+	})
+	assert.Equal(t, "green", getMode())
+	require.Len(t, ti.Status.History, 2)
+	first, second := ti.Status.History[0], ti.Status.History[1]
+	assert.Equal(t, int64(1), first.Revision)
+	assert.Equal(t, int64(1), first.Generation)
+	assert.Equal(t, "blue", first.Parameters[0].Value.String())
+	assert.Equal(t, int64(2), second.Revision)
+	assert.Equal(t, "green", second.Parameters[0].Value.String())
+	assert.NotEqual(t, first.Digest, second.Digest)
+	assert.NotNil(t, second.DeployedTime)
+
+	// spec is restored from the revision and applied as a new revision
+	ti = update(func(ti *tmplv1.TemplateInstance) {
+		ti.Spec.RollbackTo = 1
+	})
+	assert.Zero(t, ti.Spec.RollbackTo)
+	assert.Equal(t, "blue", ti.Spec.Template.Parameters[0].Value.String())
+	assert.Equal(t, "green", getMode())
+
+	ti = update(func(ti *tmplv1.TemplateInstance) {
+		ti.Generation = 3
+	})
+	assert.Equal(t, "blue", getMode())
+	// old revisions are removed over the limit
+	require.Len(t, ti.Status.History, 2)
+	assert.Equal(t, int64(2), ti.Status.History[0].Revision)
+	assert.Equal(t, int64(3), ti.Status.History[1].Revision)
+	assert.Equal(t, first.Digest, ti.Status.History[1].Digest)
+
+	// unknown revisions cannot be rolled back to
+	ti.Spec.RollbackTo = 1
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+	_, err = r.Reconcile(req)
+	require.Error(t, err)
+}
+
+func TestTemplateInstanceRollbackVersion(t *testing.T) {
+	var (
+		templateName = "rollback-version-template"
+		instanceName = "rollback-version-instance"
+		namespace    = "test-ns"
+	)
+
+	newRevision := func(name, version, release string) *tmplv1.TemplateRevision {
+		return &tmplv1.TemplateRevision{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: namespace,
+				Labels:    map[string]string{internal.RevisionTemplateLabel: templateName},
+			},
+			Spec: tmplv1.TemplateRevisionSpec{
+				TemplateName: templateName,
+				Version:      version,
+				Hash:         release,
+				Template: tmplv1.TemplateSpec{
+					Version: version,
+					Objects: []runtime.RawExtension{
+						{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "rollback-version"}, "data": {"release": "` + release + `"}}`)},
+					},
+				},
+			},
+		}
+	}
+	// template without version was deployed first, and has been changed since then
+	unversioned := newRevision(templateName+"-0123456789", "", "unversioned")
+	rev10 := newRevision(templateName+"-1.0", "1.0", "1.0")
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: unversioned.Spec.Template,
+		Status:       tmplv1.TemplateStatus{LatestRevision: unversioned.Name},
+	}
+
+	instance := &tmplv1.TemplateInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       instanceName,
+			Namespace:  namespace,
+			Generation: 1,
+		},
+		Spec: tmplv1.TemplateInstanceSpec{
+			Template: &tmplv1.ObjectInfo{
+				Metadata: tmplv1.MetadataSpec{Name: templateName},
+			},
+		},
+	}
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template, instance, &tmplv1.TemplateRevision{}, &tmplv1.TemplateRevisionList{})
+
+	r := &TemplateInstanceReconciler{
+		Client: &applyClient{fake.NewFakeClient(template, unversioned, rev10, instance)},
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+	req := reconcile.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+	}
+	getRelease := func() string {
+		cm := &corev1.ConfigMap{}
+		require.NoError(t, r.Client.Get(context.TODO(), types.NamespacedName{Name: "rollback-version", Namespace: namespace}, cm))
+		return cm.Data["release"]
+	}
+	update := func(mutate func(ti *tmplv1.TemplateInstance)) *tmplv1.TemplateInstance {
+		ti := &tmplv1.TemplateInstance{}
+		require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+		mutate(ti)
+		require.NoError(t, r.Client.Update(context.TODO(), ti))
+		_, err := r.Reconcile(req)
+		require.NoError(t, err)
+		updated := &tmplv1.TemplateInstance{}
+		require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, updated))
+		return updated
+	}
+
+	_, err := r.Reconcile(req)
+	require.NoError(t, err)
+	assert.Equal(t, "unversioned", getRelease())
+
+	// the current template is replaced by a version
+	template.TemplateSpec = rev10.Spec.Template
+	template.Status.LatestRevision = rev10.Name
+	require.NoError(t, r.Client.Update(context.TODO(), template))
+	ti := update(func(ti *tmplv1.TemplateInstance) {
+		ti.Spec.Template.Version = "1.0"
+		ti.Generation = 2
+	})
+	assert.Equal(t, "1.0", getRelease())
+	require.Len(t, ti.Status.History, 2)
+	assert.Empty(t, ti.Status.History[0].Version)
+	assert.Equal(t, unversioned.Name, ti.Status.History[0].TemplateRevision)
+
+	// version is cleared and the snapshot is restored from the template revision
+	ti = update(func(ti *tmplv1.TemplateInstance) {
+		ti.Spec.RollbackTo = 1
+	})
+	assert.Empty(t, ti.Spec.Template.Version)
+	assert.Empty(t, ti.Status.Template.Version)
+	assert.Equal(t, unversioned.Name, ti.Status.TemplateRevision)
+
+	ti = update(func(ti *tmplv1.TemplateInstance) {
+		ti.Generation = 3
+	})
+	assert.Equal(t, "unversioned", getRelease())
+	require.Len(t, ti.Status.History, 3)
+	assert.Equal(t, ti.Status.History[0].Digest, ti.Status.History[2].Digest)
+}
+
+// newGitopsRepo creates a bare repo whose branch has an initial commit
+func newGitopsRepo(t *testing.T, branch string) string {
+	dir, err := ioutil.TempDir("", "gitops")
+	require.NoError(t, err)
+	_, err = git.PlainInit(dir, true)
+	require.NoError(t, err)
+
+	seed, err := git.Init(memory.NewStorage(), memfs.New())
+	require.NoError(t, err)
+	require.NoError(t, seed.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.NewBranchReferenceName(branch))))
+	w, err := seed.Worktree()
+	require.NoError(t, err)
+	require.NoError(t, util.WriteFile(w.Filesystem, "README.md", []byte("gitops"), 0644))
+	_, err = w.Add("README.md")
+	require.NoError(t, err)
+	_, err = w.Commit("init", &git.CommitOptions{Author: &object.Signature{Name: "test", When: time.Now()}})
+	require.NoError(t, err)
+	_, err = seed.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{"file://" + dir}})
+	require.NoError(t, err)
+	refSpec := config.RefSpec(fmt.Sprintf("refs/heads/%s:refs/heads/%s", branch, branch))
+	require.NoError(t, seed.Push(&git.PushOptions{RemoteName: "origin", RefSpecs: []config.RefSpec{refSpec}}))
+	return dir
+}
+
+func TestTemplateInstanceGitops(t *testing.T) {
+	var (
+		templateName = "gitops-template"
+		instanceName = "gitops-instance"
+		namespace    = "test-ns"
+	)
+
+	dir := newGitopsRepo(t, "main")
+	defer os.RemoveAll(dir)
+
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "gitops"}, "data": {"mode": "${MODE}"}}`)},
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "${MODE}-extra"}}`)},
+				{Raw: []byte(`{"kind": "Namespace", "apiVersion": "v1", "metadata": {"name": "gitops-apps"}}`)},
+			},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "MODE", ValueType: "string"},
+			},
+		},
+	}
+	instance := &tmplv1.TemplateInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       instanceName,
+			Namespace:  namespace,
+			Generation: 1,
+		},
+		Spec: tmplv1.TemplateInstanceSpec{
+			Template: &tmplv1.ObjectInfo{
+				Metadata: tmplv1.MetadataSpec{Name: templateName},
+				Parameters: []tmplv1.ParamSpec{
+					{Name: "MODE", Value: tmplv1.FromString("blue")},
+				},
+			},
+			Gitops: tmplv1.GitopsSpec{
+				SourceGitRepo: "file://" + dir,
+				Path:          "/deploy/",
+			},
+		},
+	}
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template, instance)
+
+	r := &TemplateInstanceReconciler{
+		Client: &applyClient{fake.NewFakeClient(template, instance)},
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+	req := reconcile.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+	}
+	repo, err := git.PlainOpen(dir)
+	require.NoError(t, err)
+	head := func() *object.Commit {
+		ref, err := repo.Reference("refs/heads/main", true)
+		require.NoError(t, err)
+		commit, err := repo.CommitObject(ref.Hash())
+		require.NoError(t, err)
+		return commit
+	}
+	files := func() map[string]string {
+		tree, err := head().Tree()
+		require.NoError(t, err)
+		result := map[string]string{}
+		require.NoError(t, tree.Files().ForEach(func(f *object.File) error {
+			result[f.Name], err = f.Contents()
+			return err
+		}))
+		return result
+	}
+	getInstance := func() *tmplv1.TemplateInstance {
+		ti := &tmplv1.TemplateInstance{}
+		require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+		return ti
+	}
+
+	// all objects are committed in a single commit, and not created in the cluster
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+	err = r.Client.Get(context.TODO(), types.NamespacedName{Name: "gitops", Namespace: namespace}, &corev1.ConfigMap{})
+	assert.True(t, errors.IsNotFound(err))
+
+	first := head()
+	parent, err := first.Parent(0)
+	require.NoError(t, err)
+	assert.Equal(t, "init", parent.Message)
+	committed := files()
+	assert.Len(t, committed, 4)
+	assert.Contains(t, committed["deploy/test-ns/gitops-instance/test-ns_configmap_gitops.yaml"], "mode: blue")
+	assert.Contains(t, committed["deploy/test-ns/gitops-instance/test-ns_configmap_gitops.yaml"], "namespace: test-ns")
+	assert.Contains(t, committed, "deploy/test-ns/gitops-instance/test-ns_configmap_blue-extra.yaml")
+	assert.NotContains(t, committed["deploy/test-ns/gitops-instance/namespace_gitops-apps.yaml"], "namespace:")
+
+	ti := getInstance()
+	require.NotNil(t, ti.Status.Gitops)
+	assert.Equal(t, first.Hash.String(), ti.Status.Gitops.Commit)
+	assert.Equal(t, int64(1), ti.Status.ObservedGeneration)
+	assert.Contains(t, ti.Finalizers, internal.GitopsFinalizer)
+	assert.Empty(t, ti.Status.Objects)
+	assert.Len(t, ti.Status.History, 1)
+
+	// nothing is committed until the spec is changed
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+	assert.Equal(t, first.Hash, head().Hash)
+
+	// files of objects which are not rendered anymore are removed in the same commit
+	ti = getInstance()
+	ti.Spec.Template.Parameters[0].Value = tmplv1.FromString("green")
+	ti.Generation = 2
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+
+	second := head()
+	assert.Equal(t, []plumbing.Hash{first.Hash}, second.ParentHashes)
+	committed = files()
+	assert.Len(t, committed, 4)
+	assert.Contains(t, committed["deploy/test-ns/gitops-instance/test-ns_configmap_gitops.yaml"], "mode: green")
+	assert.Contains(t, committed, "deploy/test-ns/gitops-instance/test-ns_configmap_green-extra.yaml")
+	assert.NotContains(t, committed, "deploy/test-ns/gitops-instance/test-ns_configmap_blue-extra.yaml")
+	ti = getInstance()
+	assert.Equal(t, second.Hash.String(), ti.Status.Gitops.Commit)
+	assert.Equal(t, int64(2), ti.Status.ObservedGeneration)
+
+	// gitops cannot be disabled, or the committed objects would be left behind
+	ti.Spec.Gitops = tmplv1.GitopsSpec{}
+	ti.Generation = 3
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+	_, err = r.Reconcile(req)
+	require.Error(t, err)
+	ti = getInstance()
+	ti.Spec.Gitops = instance.Spec.Gitops
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+
+	// removal of the files is committed when the instance is deleted
+	ti = getInstance()
+	now := metav1.Now()
+	ti.DeletionTimestamp = &now
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+
+	assert.Equal(t, []plumbing.Hash{second.Hash}, head().ParentHashes)
+	assert.Equal(t, map[string]string{"README.md": "gitops"}, files())
+	assert.NotContains(t, getInstance().Finalizers, internal.GitopsFinalizer)
+}
+
+func TestTemplateInstanceGitopsSecrets(t *testing.T) {
+	var (
+		templateName = "gitops-secret-template"
+		instanceName = "gitops-secret-instance"
+		namespace    = "test-ns"
+	)
+
+	dir := newGitopsRepo(t, "main")
+	defer os.RemoveAll(dir)
+
+	configMap := runtime.RawExtension{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "gitops"}, "data": {"password": "${PASSWORD}"}}`)}
+	secret := runtime.RawExtension{Raw: []byte(`{"kind": "Secret", "apiVersion": "v1", "metadata": {"name": "gitops"}, "stringData": {"password": "${PASSWORD}"}}`)}
+
+	// secret values are not committed to the repo in plain text
+	for _, tc := range []struct {
+		name    string
+		objects []runtime.RawExtension
+		param   tmplv1.ParamSpec
+		message string
+	}{
+		{name: "sensitive", objects: []runtime.RawExtension{configMap},
+			param: tmplv1.ParamSpec{Name: "PASSWORD", ValueType: "string", Sensitive: true}, message: "sensitive parameters PASSWORD"},
+		{name: "generated", objects: []runtime.RawExtension{configMap},
+			param: tmplv1.ParamSpec{Name: "PASSWORD", ValueType: "string", Generate: &tmplv1.GenerateSpec{Type: "random"}}, message: "sensitive parameters PASSWORD"},
+		{name: "secret object", objects: []runtime.RawExtension{secret},
+			param: tmplv1.ParamSpec{Name: "PASSWORD", ValueType: "string"}, message: "secret gitops"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			template := &tmplv1.Template{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:      templateName,
+					Namespace: namespace,
+				},
+				TemplateSpec: tmplv1.TemplateSpec{
+					Objects:    tc.objects,
+					Parameters: []tmplv1.ParamSpec{tc.param},
+				},
+			}
+			instance := &tmplv1.TemplateInstance{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:       instanceName,
+					Namespace:  namespace,
+					Generation: 1,
+				},
+				Spec: tmplv1.TemplateInstanceSpec{
+					Template: &tmplv1.ObjectInfo{
+						Metadata: tmplv1.MetadataSpec{Name: templateName},
+						Parameters: []tmplv1.ParamSpec{
+							{Name: "PASSWORD", Value: tmplv1.FromString("s3cr3t-password")},
+						},
+					},
+					Gitops: tmplv1.GitopsSpec{SourceGitRepo: "file://" + dir},
+				},
+			}
+
+			s := scheme.Scheme
+			s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template, instance)
+
+			r := &TemplateInstanceReconciler{
+				Client: &applyClient{fake.NewFakeClient(template, instance)},
+				Log:    logf.Log.WithName("test-logger"),
+				Scheme: s,
+			}
+			req := reconcile.Request{
+				NamespacedName: types.NamespacedName{
+					Name:      instanceName,
+					Namespace: namespace,
+				},
+			}
+
+			_, err := r.Reconcile(req)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tc.message)
+			assert.NotContains(t, err.Error(), "s3cr3t-password")
+
+			ti := &tmplv1.TemplateInstance{}
+			require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+			assert.Nil(t, ti.Status.Gitops)
+
+			repo, err := git.PlainOpen(dir)
+			require.NoError(t, err)
+			head, err := repo.Reference(plumbing.NewBranchReferenceName("main"), true)
+			require.NoError(t, err)
+			commit, err := repo.CommitObject(head.Hash())
+			require.NoError(t, err)
+			assert.Equal(t, "init", commit.Message, "objects are committed")
+		})
+	}
+}
+
+func TestTemplateInstanceGitopsSameName(t *testing.T) {
+	var (
+		templateName = "gitops-template"
+		instanceName = "gitops-instance"
+		namespaces   = []string{"team-a", "team-b"}
+	)
+
+	dir := newGitopsRepo(t, "main")
+	defer os.RemoveAll(dir)
+
+	var objs []runtime.Object
+	for _, namespace := range namespaces {
+		objs = append(objs, &tmplv1.Template{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      templateName,
+				Namespace: namespace,
+			},
+			TemplateSpec: tmplv1.TemplateSpec{
+				Objects: []runtime.RawExtension{
+					{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "gitops"}}`)},
+				},
+			},
+		}, &tmplv1.TemplateInstance{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:       instanceName,
+				Namespace:  namespace,
+				Generation: 1,
+			},
+			Spec: tmplv1.TemplateInstanceSpec{
+				Template: &tmplv1.ObjectInfo{
+					Metadata: tmplv1.MetadataSpec{Name: templateName},
+				},
+				Gitops: tmplv1.GitopsSpec{
+					SourceGitRepo: "file://" + dir,
+					Path:          "apps",
+				},
+			},
+		})
+	}
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, objs...)
+
+	r := &TemplateInstanceReconciler{
+		Client: &applyClient{fake.NewFakeClient(objs...)},
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+	repo, err := git.PlainOpen(dir)
+	require.NoError(t, err)
+	files := func() []string {
+		ref, err := repo.Reference("refs/heads/main", true)
+		require.NoError(t, err)
+		commit, err := repo.CommitObject(ref.Hash())
+		require.NoError(t, err)
+		tree, err := commit.Tree()
+		require.NoError(t, err)
+		var result []string
+		require.NoError(t, tree.Files().ForEach(func(f *object.File) error {
+			result = append(result, f.Name)
+			return nil
+		}))
+		return result
+	}
+
+	// instances of the same name in different namespaces are committed to their own directories
+	for _, namespace := range namespaces {
+		_, err = r.Reconcile(reconcile.Request{NamespacedName: types.NamespacedName{Name: instanceName, Namespace: namespace}})
+		require.NoError(t, err)
+	}
+	assert.ElementsMatch(t, []string{
+		"README.md",
+		"apps/team-a/gitops-instance/team-a_configmap_gitops.yaml",
+		"apps/team-b/gitops-instance/team-b_configmap_gitops.yaml",
+	}, files())
+
+	// deleting one of them doesn't remove the files of the other
+	key := types.NamespacedName{Name: instanceName, Namespace: namespaces[0]}
+	ti := &tmplv1.TemplateInstance{}
+	require.NoError(t, r.Client.Get(context.TODO(), key, ti))
+	now := metav1.Now()
+	ti.DeletionTimestamp = &now
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+	_, err = r.Reconcile(reconcile.Request{NamespacedName: key})
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"README.md",
+		"apps/team-b/gitops-instance/team-b_configmap_gitops.yaml",
+	}, files())
+}
+
+func TestTemplateInstanceGitopsBranchPerChange(t *testing.T) {
+	var (
+		templateName = "gitops-template"
+		instanceName = "gitops-instance"
+		namespace    = "test-ns"
+	)
+
+	dir := newGitopsRepo(t, "release")
+	defer os.RemoveAll(dir)
+
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "gitops"}, "data": {"mode": "blue"}}`)},
+			},
+		},
+	}
+	instance := &tmplv1.TemplateInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       instanceName,
+			Namespace:  namespace,
+			Generation: 1,
+		},
+		Spec: tmplv1.TemplateInstanceSpec{
+			Template: &tmplv1.ObjectInfo{
+				Metadata: tmplv1.MetadataSpec{Name: templateName},
+			},
+			Gitops: tmplv1.GitopsSpec{
+				SourceGitRepo:      "file://" + dir,
+				Branch:             "release",
+				Author:             tmplv1.GitopsAuthorSpec{Name: "deployer", Email: "deployer@example.com"},
+				CommitMessage:      "deploy {{ .Name }} #{{ .Generation }}",
+				Strategy:           tmplv1.GitopsStrategyBranchPerChange,
+				ChangeBranchPrefix: "review/",
+			},
+		},
+	}
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template, instance)
+
+	r := &TemplateInstanceReconciler{
+		Client: &applyClient{fake.NewFakeClient(template, instance)},
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+	req := reconcile.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+	}
+	repo, err := git.PlainOpen(dir)
+	require.NoError(t, err)
+	base, err := repo.Reference("refs/heads/release", true)
+	require.NoError(t, err)
+
+	// the commit is pushed to a new branch created from the branch, and the branch is not changed
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+
+	ref, err := repo.Reference("refs/heads/review/test-ns/gitops-instance-1", true)
+	require.NoError(t, err)
+	commit, err := repo.CommitObject(ref.Hash())
+	require.NoError(t, err)
+	assert.Equal(t, "deploy gitops-instance #1", commit.Message)
+	assert.Equal(t, "deployer", commit.Author.Name)
+	assert.Equal(t, "deployer@example.com", commit.Author.Email)
+	assert.Equal(t, []plumbing.Hash{base.Hash()}, commit.ParentHashes)
+	_, err = commit.File("test-ns/gitops-instance/test-ns_configmap_gitops.yaml")
+	assert.NoError(t, err)
+
+	latest, err := repo.Reference("refs/heads/release", true)
+	require.NoError(t, err)
+	assert.Equal(t, base.Hash(), latest.Hash())
+
+	ti := &tmplv1.TemplateInstance{}
+	require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+	require.NotNil(t, ti.Status.Gitops)
+	assert.Equal(t, "review/test-ns/gitops-instance-1", ti.Status.Gitops.PushedBranch)
+	assert.Equal(t, commit.Hash.String(), ti.Status.Gitops.Commit)
+
+	// removal of the files is a change of the branch, so nothing is pushed until the change is merged
+	now := metav1.Now()
+	ti.DeletionTimestamp = &now
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+	_, err = repo.Reference("refs/heads/review/test-ns/gitops-instance-removed", true)
+	assert.Equal(t, plumbing.ErrReferenceNotFound, err)
+}
+
+func TestTemplateInstanceGitopsCredentials(t *testing.T) {
+	var (
+		templateName = "gitops-template"
+		instanceName = "gitops-instance"
+		namespace    = "test-ns"
+	)
+
+	dir := newGitopsRepo(t, "main")
+	defer os.RemoveAll(dir)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	privateKey := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "gitops"}}`)},
+			},
+		},
+	}
+	secrets := []runtime.Object{
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "basic", Namespace: namespace},
+			Type:       corev1.SecretTypeBasicAuth,
+			Data:       map[string][]byte{"username": []byte("deployer@example.com"), "password": []byte("token")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "ssh", Namespace: namespace},
+			Type:       corev1.SecretTypeSSHAuth,
+			Data:       map[string][]byte{"ssh-privatekey": privateKey, "known_hosts": []byte("invalid known hosts")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "opaque", Namespace: namespace},
+			Data:       map[string][]byte{"username": []byte("user"), "token": []byte("token")},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "tls", Namespace: namespace},
+			Type:       corev1.SecretTypeTLS,
+		},
+	}
+
+	for _, tc := range []struct {
+		name   string
+		repo   string
+		secret string
+		errMsg string
+	}{
+		{name: "basic auth", repo: "file://" + dir, secret: "basic"},
+		{name: "ssh auth for file repo", repo: "file://" + dir, secret: "ssh", errMsg: "cannot be used for file repo"},
+		{name: "basic auth for ssh repo", repo: "git@localhost:org/repo.git", secret: "basic", errMsg: "cannot be used for ssh repo"},
+		{name: "ssh without private key", repo: "git@localhost:org/repo.git", secret: "opaque", errMsg: "has no key ssh-privatekey"},
+		{name: "invalid known hosts", repo: "ssh://git@localhost/org/repo.git", secret: "ssh", errMsg: "secret ssh: knownhosts"},
+		{name: "unsupported secret type", repo: "file://" + dir, secret: "tls", errMsg: "cannot be used for gitops credentials"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			instance := &tmplv1.TemplateInstance{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:       instanceName,
+					Namespace:  namespace,
+					Generation: 1,
+				},
+				Spec: tmplv1.TemplateInstanceSpec{
+					Template: &tmplv1.ObjectInfo{
+						Metadata: tmplv1.MetadataSpec{Name: templateName},
+					},
+					Gitops: tmplv1.GitopsSpec{SourceGitRepo: tc.repo, Secret: tc.secret},
+				},
+			}
+
+			s := scheme.Scheme
+			s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template, instance)
+
+			r := &TemplateInstanceReconciler{
+				Client: &applyClient{fake.NewFakeClient(append([]runtime.Object{template, instance}, secrets...)...)},
+				Log:    logf.Log.WithName("test-logger"),
+				Scheme: s,
+			}
+			req := reconcile.Request{
+				NamespacedName: types.NamespacedName{
+					Name:      instanceName,
+					Namespace: namespace,
+				},
+			}
+
+			_, err := r.Reconcile(req)
+			if len(tc.errMsg) != 0 {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tc.errMsg)
+				return
+			}
+			require.NoError(t, err)
+
+			// username of the credentials is the email of the author
+			repo, err := git.PlainOpen(dir)
+			require.NoError(t, err)
+			ref, err := repo.Reference("refs/heads/main", true)
+			require.NoError(t, err)
+			commit, err := repo.CommitObject(ref.Hash())
+			require.NoError(t, err)
+			assert.Equal(t, "deployer@example.com", commit.Author.Email)
+		})
+	}
+}
+
+func TestTemplateInstanceGitopsApplication(t *testing.T) {
+	var (
+		templateName = "gitops-template"
+		instanceName = "gitops-instance"
+		namespace    = "test-ns"
+	)
+
+	dir := newGitopsRepo(t, "main")
+	defer os.RemoveAll(dir)
+
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "gitops"}}`)},
+			},
+		},
+	}
+	instance := &tmplv1.TemplateInstance{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: tmplv1.GroupVersion.String(),
+			Kind:       "TemplateInstance",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       instanceName,
+			Namespace:  namespace,
+			Generation: 1,
+		},
+		Spec: tmplv1.TemplateInstanceSpec{
+			Template: &tmplv1.ObjectInfo{
+				Metadata: tmplv1.MetadataSpec{Name: templateName},
+			},
+			Gitops: tmplv1.GitopsSpec{
+				SourceGitRepo: "file://" + dir,
+				Path:          "apps",
+				Application: &tmplv1.GitopsApplicationSpec{
+					Project:   "team",
+					Automated: &tmplv1.GitopsAutomatedSyncSpec{Prune: true},
+				},
+			},
+		},
+	}
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template, instance)
+
+	r := &TemplateInstanceReconciler{
+		Client: &applyClient{fake.NewFakeClient(template, instance)},
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+	req := reconcile.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+	}
+	appKey := types.NamespacedName{Name: "test-ns-gitops-instance", Namespace: "argocd"}
+	getApp := func() *unstructured.Unstructured {
+		app := &unstructured.Unstructured{}
+		app.SetGroupVersionKind(schemas.ApplicationGroupVersionKind)
+		require.NoError(t, r.Client.Get(context.TODO(), appKey, app))
+		return app
+	}
+	getInstance := func() *tmplv1.TemplateInstance {
+		ti := &tmplv1.TemplateInstance{}
+		require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+		return ti
+	}
+
+	// project of the Application is changed only if the operator allows it
+	_, err := r.Reconcile(req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "project of the application")
+	assert.Nil(t, getInstance().Status.Gitops)
+	r.AllowApplicationOverrides = true
+
+	// the Application deploys the directory of the instance, and the instance waits for it to be synced
+	res, err := r.Reconcile(req)
+	require.NoError(t, err)
+	assert.NotZero(t, res.RequeueAfter)
+
+	app := getApp()
+	source, _, _ := unstructured.NestedStringMap(app.Object, "spec", "source")
+	assert.Equal(t, map[string]string{"repoURL": "file://" + dir, "path": "apps/test-ns/gitops-instance", "targetRevision": "main"}, source)
+	destination, _, _ := unstructured.NestedStringMap(app.Object, "spec", "destination")
+	assert.Equal(t, map[string]string{"server": "https://kubernetes.default.svc", "namespace": namespace}, destination)
+	project, _, _ := unstructured.NestedString(app.Object, "spec", "project")
+	assert.Equal(t, "team", project)
+	prune, _, _ := unstructured.NestedBool(app.Object, "spec", "syncPolicy", "automated", "prune")
+	assert.True(t, prune)
+	assert.Contains(t, app.GetFinalizers(), "resources-finalizer.argocd.argoproj.io")
+
+	ti := getInstance()
+	assert.Equal(t, "False", getCondition(ti, tmplv1.ConditionTypeSynced).Status)
+	assert.Equal(t, "ApplicationUnknown", getCondition(ti, tmplv1.ConditionTypeSynced).Reason)
+	assert.Equal(t, "False", getCondition(ti, tmplv1.ConditionTypeReady).Status)
+
+	// sync and health status of the Application are reflected in the conditions
+	require.NoError(t, unstructured.SetNestedMap(app.Object, map[string]interface{}{
+		"sync":   map[string]interface{}{"status": "Synced", "revision": ti.Status.Gitops.Commit},
+		"health": map[string]interface{}{"status": "Degraded", "message": "pod is crashing"},
+	}, "status"))
+	require.NoError(t, r.Client.Update(context.TODO(), app))
+	res, err = r.Reconcile(req)
+	require.NoError(t, err)
+	assert.NotZero(t, res.RequeueAfter)
+
+	ti = getInstance()
+	assert.Equal(t, "True", getCondition(ti, tmplv1.ConditionTypeSynced).Status)
+	assert.Contains(t, getCondition(ti, tmplv1.ConditionTypeSynced).Message, ti.Status.Gitops.Commit)
+	assert.Equal(t, "ApplicationDegraded", getCondition(ti, tmplv1.ConditionTypeReady).Reason)
+	assert.Contains(t, getCondition(ti, tmplv1.ConditionTypeReady).Message, "pod is crashing")
+
+	app = getApp()
+	require.NoError(t, unstructured.SetNestedField(app.Object, "Healthy", "status", "health", "status"))
+	require.NoError(t, r.Client.Update(context.TODO(), app))
+	res, err = r.Reconcile(req)
+	require.NoError(t, err)
+	assert.Zero(t, res.RequeueAfter)
+	assert.Equal(t, "True", getCondition(getInstance(), tmplv1.ConditionTypeReady).Status)
+
+	// the Application is deleted with the instance
+	ti = getInstance()
+	now := metav1.Now()
+	ti.DeletionTimestamp = &now
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+	app = &unstructured.Unstructured{}
+	app.SetGroupVersionKind(schemas.ApplicationGroupVersionKind)
+	err = r.Client.Get(context.TODO(), appKey, app)
+	assert.True(t, errors.IsNotFound(err))
+}
+
+// raceGitopsRepo installs a hook which pushes a commit of another client to the branch of the repo
+// while the next n pushes are received, so they are rejected as non-fast-forward
+func raceGitopsRepo(t *testing.T, dir, branch string, n int) {
+	require.NoError(t, ioutil.WriteFile(dir+"/races", []byte(fmt.Sprint(n)), 0644))
+	hook := fmt.Sprintf(`#!/bin/sh
+[ -n "$OTHER_PUSH" ] && exit 0
+n=$(cat %[1]s/races)
+[ "$n" -gt 0 ] || exit 0
+echo $((n-1)) > %[1]s/races
+for v in $(env | grep -o '^GIT_[A-Z_]*'); do unset $v; done
+tmp=$(mktemp -d)
+git clone -q -b %[2]s %[1]s $tmp && cd $tmp &&
+echo $n > other-$n.txt && git add . && git -c user.name=other -c user.email=other@example.com commit -q -m other &&
+OTHER_PUSH=1 git push -q origin %[2]s
+rm -rf $tmp
+`, dir, branch)
+	require.NoError(t, os.MkdirAll(dir+"/hooks", 0755))
+	require.NoError(t, ioutil.WriteFile(dir+"/hooks/pre-receive", []byte(hook), 0755))
+}
+
+func TestTemplateInstanceGitopsPushConflict(t *testing.T) {
+	var (
+		templateName = "gitops-template"
+		instanceName = "gitops-instance"
+		namespace    = "test-ns"
+	)
+
+	dir := newGitopsRepo(t, "main")
+	defer os.RemoveAll(dir)
+
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"kind": "ConfigMap", "apiVersion": "v1", "metadata": {"name": "gitops"}, "data": {"mode": "${MODE}"}}`)},
+			},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "MODE", ValueType: "string"},
+			},
+		},
+	}
+	instance := &tmplv1.TemplateInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:       instanceName,
+			Namespace:  namespace,
+			Generation: 1,
+		},
+		Spec: tmplv1.TemplateInstanceSpec{
+			Template: &tmplv1.ObjectInfo{
+				Metadata: tmplv1.MetadataSpec{Name: templateName},
+				Parameters: []tmplv1.ParamSpec{
+					{Name: "MODE", Value: tmplv1.FromString("blue")},
+				},
+			},
+			Gitops: tmplv1.GitopsSpec{
+				SourceGitRepo: "file://" + dir,
+			},
+		},
+	}
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, template, instance)
+
+	r := &TemplateInstanceReconciler{
+		Client: &applyClient{fake.NewFakeClient(template, instance)},
+		Log:    logf.Log.WithName("test-logger"),
+		Scheme: s,
+	}
+	req := reconcile.Request{
+		NamespacedName: types.NamespacedName{
+			Name:      instanceName,
+			Namespace: namespace,
+		},
+	}
+	repo, err := git.PlainOpen(dir)
+	require.NoError(t, err)
+	head := func() *object.Commit {
+		ref, err := repo.Reference("refs/heads/main", true)
+		require.NoError(t, err)
+		commit, err := repo.CommitObject(ref.Hash())
+		require.NoError(t, err)
+		return commit
+	}
+	getInstance := func() *tmplv1.TemplateInstance {
+		ti := &tmplv1.TemplateInstance{}
+		require.NoError(t, r.Client.Get(context.TODO(), req.NamespacedName, ti))
+		return ti
+	}
+
+	// the change is committed again on the commits of the other client, without merge commits
+	raceGitopsRepo(t, dir, "main", 2)
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+
+	commit := head()
+	assert.Len(t, commit.ParentHashes, 1)
+	_, err = commit.File("test-ns/gitops-instance/test-ns_configmap_gitops.yaml")
+	assert.NoError(t, err)
+	_, err = commit.File("other-1.txt")
+	assert.NoError(t, err)
+	_, err = commit.File("other-2.txt")
+	assert.NoError(t, err)
+	parent, err := commit.Parent(0)
+	require.NoError(t, err)
+	assert.Equal(t, "other\n", parent.Message)
+
+	ti := getInstance()
+	assert.Equal(t, commit.Hash.String(), ti.Status.Gitops.Commit)
+	assert.Equal(t, "True", getCondition(ti, tmplv1.ConditionTypePushed).Status)
+
+	// the push fails with a specific condition when the branch keeps being updated
+	raceGitopsRepo(t, dir, "main", 100)
+	ti.Spec.Template.Parameters[0].Value = tmplv1.FromString("green")
+	ti.Generation = 2
+	require.NoError(t, r.Client.Update(context.TODO(), ti))
+	_, err = r.Reconcile(req)
+	require.Error(t, err)
+
+	ti = getInstance()
+	cond := getCondition(ti, tmplv1.ConditionTypePushed)
+	assert.Equal(t, "False", cond.Status)
+	assert.Equal(t, "RetriesExhausted", cond.Reason)
+	assert.Equal(t, int64(1), ti.Status.ObservedGeneration)
+	assert.Equal(t, "Error", getCondition(ti, "").Status)
+	contents, err := head().File("test-ns/gitops-instance/test-ns_configmap_gitops.yaml")
+	require.NoError(t, err)
+	data, err := contents.Contents()
+	require.NoError(t, err)
+	assert.Contains(t, data, "mode: blue")
+
+	// the push is tried again in the next reconcile
+	raceGitopsRepo(t, dir, "main", 0)
+	_, err = r.Reconcile(req)
+	require.NoError(t, err)
+	ti = getInstance()
+	assert.Equal(t, "True", getCondition(ti, tmplv1.ConditionTypePushed).Status)
+	assert.Equal(t, int64(2), ti.Status.ObservedGeneration)
 }
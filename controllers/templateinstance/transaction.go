@@ -0,0 +1,236 @@
+package templateinstance
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/internal"
+)
+
+const snapshotKey = "snapshot.json"
+
+// transaction is the state of the objects and finalizers before the objects are applied for a generation of the instance
+type transaction struct {
+	Generation int64            `json:"generation"`
+	Finalizers []string         `json:"finalizers,omitempty"`
+	Objects    []snapshotObject `json:"objects,omitempty"`
+}
+
+type snapshotObject struct {
+	Ref tmplv1.RefSpec `json:"ref"`
+	// Object is the previous version of the object, or empty if the object did not exist
+	Object map[string]interface{} `json:"object,omitempty"`
+}
+
+// objectError tells which object failed to be applied
+type objectError struct {
+	ref tmplv1.RefSpec
+	err error
+}
+
+func (e *objectError) Error() string {
+	return fmt.Sprintf("%s %s/%s: %s", e.ref.Kind, e.ref.Namespace, e.ref.Name, e.err.Error())
+}
+
+func (e *objectError) Unwrap() error {
+	return e.err
+}
+
+// snapshotSecretName returns the name of the secret which the snapshot of the transaction is stored in
+func snapshotSecretName(instance *tmplv1.TemplateInstance) string {
+	return instance.Name + "-snapshot"
+}
+
+// beginTransaction stores the live state of the objects to be applied and the objects created before in a secret owned by the instance.
+// The snapshot is kept until every object of the generation is applied, so objects applied over several reconciles are restored together.
+func (r *TemplateInstanceReconciler) beginTransaction(instance *tmplv1.TemplateInstance, objs []runtime.RawExtension) (*transaction, error) {
+	name := snapshotSecretName(instance)
+	secret := &corev1.Secret{}
+	if err := r.Client.Get(context.TODO(), types.NamespacedName{Namespace: instance.Namespace, Name: name}, secret); err == nil {
+		if !metav1.IsControlledBy(secret, instance) {
+			return nil, fmt.Errorf("secret %s already exists and is not owned by the instance", name)
+		}
+		tx := &transaction{}
+		if err := json.Unmarshal(secret.Data[snapshotKey], tx); err == nil && tx.Generation == instance.Generation {
+			return tx, nil
+		}
+	} else if !errors.IsNotFound(err) {
+		return nil, err
+	}
+
+	tx := &transaction{Generation: instance.Generation, Finalizers: instance.GetFinalizers()}
+	refs := []tmplv1.RefSpec{}
+	for idx := range objs {
+		unstr, err := BytesToUnstructuredObject(&objs[idx])
+		if err != nil {
+			return nil, err
+		}
+		if len(unstr.GetNamespace()) == 0 {
+			unstr.SetNamespace(instance.Namespace)
+		}
+		refs = append(refs, objectRef(unstr))
+	}
+	// objects created before may be pruned by the transaction
+	for _, obj := range instance.Status.Objects {
+		refs = append(refs, tmplv1.RefSpec{ApiVersion: obj.Ref.ApiVersion, Kind: obj.Ref.Kind, Namespace: obj.Ref.Namespace, Name: obj.Ref.Name})
+	}
+
+	stored := map[tmplv1.RefSpec]bool{}
+	for _, ref := range refs {
+		if stored[ref] {
+			continue
+		}
+		stored[ref] = true
+
+		live := &unstructured.Unstructured{}
+		live.SetAPIVersion(ref.ApiVersion)
+		live.SetKind(ref.Kind)
+		if err := r.Client.Get(context.TODO(), types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, live); err != nil {
+			if !errors.IsNotFound(err) {
+				return nil, err
+			}
+			tx.Objects = append(tx.Objects, snapshotObject{Ref: ref})
+			continue
+		}
+		// fields set by the server are not restored
+		for _, field := range []string{"uid", "resourceVersion", "generation", "creationTimestamp", "selfLink", "managedFields"} {
+			unstructured.RemoveNestedField(live.Object, "metadata", field)
+		}
+		tx.Objects = append(tx.Objects, snapshotObject{Ref: ref, Object: live.Object})
+	}
+
+	data, err := json.Marshal(tx)
+	if err != nil {
+		return nil, err
+	}
+	secret = &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: instance.Namespace}}
+	if _, err := controllerutil.CreateOrUpdate(context.TODO(), r.Client, secret, func() error {
+		if secret.Labels == nil {
+			secret.Labels = map[string]string{}
+		}
+		secret.Labels[internal.SnapshotLabel] = instance.Name
+		secret.Data = map[string][]byte{snapshotKey: data}
+		return controllerutil.SetControllerReference(instance, secret, r.Scheme)
+	}); err != nil {
+		return nil, err
+	}
+	r.Log.Info("snapshot of " + strconv.Itoa(len(tx.Objects)) + " objects is stored in secret " + name)
+	return tx, nil
+}
+
+// endTransaction removes the snapshot after every object of the generation is applied
+func (r *TemplateInstanceReconciler) endTransaction(instance *tmplv1.TemplateInstance) error {
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: snapshotSecretName(instance), Namespace: instance.Namespace}}
+	if err := r.Client.Delete(context.TODO(), secret); client.IgnoreNotFound(err) != nil {
+		return err
+	}
+	for _, cond := range instance.Status.Conditions {
+		if cond.Type == tmplv1.ConditionTypeRolledBack && cond.Status == "True" {
+			instance.Status.Conditions = setCondition(instance.Status.Conditions, tmplv1.ConditionSpec{
+				Type:    tmplv1.ConditionTypeRolledBack,
+				Status:  "False",
+				Reason:  "Applied",
+				Message: fmt.Sprintf("objects of generation %d are applied", instance.Generation),
+			})
+		}
+	}
+	return nil
+}
+
+// rollback restores the objects and finalizers of the instance to the snapshot of the transaction.
+// Objects which did not exist are deleted, and the others are restored to their previous versions.
+// The RolledBack condition is set with the error which caused the rollback.
+func (r *TemplateInstanceReconciler) rollback(instance *tmplv1.TemplateInstance, tx *transaction, cause error, redactor *internal.Redactor) error {
+	failed := []string{}
+	for idx := len(tx.Objects) - 1; idx >= 0; idx-- {
+		obj := tx.Objects[idx]
+		if err := r.restoreObject(obj); err != nil {
+			err = redactor.Error(err)
+			r.Log.Error(err, "cannot restore "+obj.Ref.Kind+" "+obj.Ref.Namespace+"/"+obj.Ref.Name)
+			failed = append(failed, fmt.Sprintf("%s %s/%s: %s", obj.Ref.Kind, obj.Ref.Namespace, obj.Ref.Name, err.Error()))
+		}
+	}
+
+	// finalizers added for the objects in other namespaces are removed
+	latest := &tmplv1.TemplateInstance{}
+	if err := r.Client.Get(context.TODO(), types.NamespacedName{Namespace: instance.Namespace, Name: instance.Name}, latest); err != nil {
+		return err
+	}
+	restored := latest.DeepCopy()
+	restored.SetFinalizers(tx.Finalizers)
+	if err := r.Client.Patch(context.TODO(), restored, client.MergeFrom(latest)); err != nil {
+		return err
+	}
+	instance.SetFinalizers(tx.Finalizers)
+
+	cond := tmplv1.ConditionSpec{
+		Type:    tmplv1.ConditionTypeRolledBack,
+		Status:  "True",
+		Reason:  "ApplyFailed",
+		Message: redactor.Redact(cause.Error()),
+	}
+	// the snapshot is kept if any object is not restored, so the next rollback restores the same state
+	if len(failed) != 0 {
+		cond.Reason = "RollbackFailed"
+		cond.Message += ", cannot restore " + strings.Join(failed, ", ")
+	} else if err := r.endTransaction(instance); err != nil {
+		return err
+	}
+	instance.Status.Conditions = setCondition(instance.Status.Conditions, cond)
+	return nil
+}
+
+func (r *TemplateInstanceReconciler) restoreObject(obj snapshotObject) error {
+	live := &unstructured.Unstructured{}
+	live.SetAPIVersion(obj.Ref.ApiVersion)
+	live.SetKind(obj.Ref.Kind)
+	err := r.Client.Get(context.TODO(), types.NamespacedName{Namespace: obj.Ref.Namespace, Name: obj.Ref.Name}, live)
+	if err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	exist := err == nil
+
+	if obj.Object == nil {
+		if !exist {
+			return nil
+		}
+		return client.IgnoreNotFound(r.Client.Delete(context.TODO(), live, client.PropagationPolicy(metav1.DeletePropagationBackground)))
+	}
+
+	prev := &unstructured.Unstructured{Object: obj.Object}
+	if !exist {
+		return r.Client.Create(context.TODO(), prev)
+	}
+	prev.SetResourceVersion(live.GetResourceVersion())
+	return r.Client.Update(context.TODO(), prev)
+}
+
+// failTransaction rolls back the transaction and records the error which caused the rollback in the status of the instance
+func (r *TemplateInstanceReconciler) failTransaction(instance *tmplv1.TemplateInstance, tx *transaction, cause error, redactor *internal.Redactor) (ctrl.Result, error) {
+	failedInstance := instance.DeepCopy()
+	setConflictCondition(failedInstance, cause, redactor)
+	cause = redactor.Error(cause)
+	if err := r.rollback(failedInstance, tx, cause, redactor); err != nil {
+		r.Log.Error(err, "error occurs while roll back k8s object")
+		return r.updateTemplateInstanceStatus(instance, fmt.Errorf("%s, cannot roll back: %s", cause.Error(), err.Error()))
+	}
+	if err := r.Client.Status().Patch(context.TODO(), failedInstance, client.MergeFrom(instance)); err != nil {
+		r.Log.Error(err, "could not update template instance status")
+		return ctrl.Result{}, err
+	}
+	return r.updateTemplateInstanceStatus(failedInstance, cause)
+}
@@ -2,6 +2,7 @@ package templateinstance
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/conversion"
@@ -9,21 +10,16 @@ import (
 	"regexp"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/yaml"
-	"strconv"
 	"strings"
 	"text/template"
 
 	"k8s.io/apimachinery/pkg/api/errors"
 
 	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/internal"
 	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
-const (
-	stringType = "string"
-	numberType = "number"
-)
-
 type ParamHandler struct {
 	templateParameters []tmplv1.ParamSpec
 	instanceParameters []tmplv1.ParamSpec
@@ -40,64 +36,61 @@ func (p *ParamHandler) ReviseParam() error {
 	instanceParams := GetParamAsMap(p.instanceParameters)
 
 	for idx, param := range p.templateParameters {
-		if val, exist := instanceParams[param.Name]; exist {
-			convertedVal := val
-			if param.ValueType == numberType && val.Type == intstr.String {
-				convertedVal = intstr.IntOrString{Type: intstr.Int, IntVal: int32(val.IntValue())}
-			}
-			if param.ValueType == stringType && val.Type == intstr.Int {
-				convertedVal = intstr.IntOrString{Type: intstr.String, StrVal: val.String()}
-			}
-			// in case of Service Instance has no value
-			if param.ValueType == stringType && val.Type == intstr.String && len(val.StrVal) == 0 {
-				convertedVal = param.Value
-			}
-			param.Value = convertedVal
+		// in case of Service Instance has no value
+		if val, exist := instanceParams[param.Name]; exist && !internal.IsEmptyParamValue(val) {
+			param.Value = val
 		}
 		// [TODO]: UI 변경되면 확인해야함 (tsb create Template Instance 부분)
 		// If the required field has no value
-		if param.Required && param.Value.Type == 1 && len(param.Value.StrVal) == 0 {
-			err := errors.NewBadRequest(param.Name + "must have a value")
+		if param.Required && internal.IsEmptyParamValue(param.Value) {
+			err := errors.NewBadRequest(param.Name + " must have a value")
 			return err
 		}
 
-		// // Set default value for not required parameter
-		// if param.Value.Size() == 0 {
-		// 	if len(param.ValueType) == 0 || param.ValueType == stringType {
-		// 		param.Value = intstr.IntOrString{Type: intstr.String, StrVal: ""}
-		// 	}
-		// 	if param.ValueType == numberType {
-		// 		param.Value = intstr.IntOrString{Type: intstr.Int, IntVal: 0}
-		// 	}
-		// }
+		// convert the value to the value type and validate it with the schema
+		if !internal.IsEmptyParamValue(param.Value) {
+			converted, err := internal.ConvertParamValue(param, param.Value)
+			if err != nil {
+				return errors.NewBadRequest(fmt.Sprintf("parameter %s: %s", param.Name, err.Error()))
+			}
+			param.Value = converted
+		}
 
 		p.templateParameters[idx] = param
 	}
 	return nil
 }
 
-func GetParamAsMap(parameters []tmplv1.ParamSpec) (resultParam map[string]intstr.IntOrString) {
-	resultParam = make(map[string]intstr.IntOrString)
+// ResolveParameters returns values of the parameters of the instance deployed with the template snapshot in status.
+// Values of the active plan and the instance override the defaults of the template.
+func ResolveParameters(snapshot *tmplv1.ObjectInfo, instanceParameters []tmplv1.ParamSpec) (map[string]tmplv1.ParamValue, error) {
+	plan, err := internal.SelectPlan(snapshot.Plans, snapshot.Plan, "")
+	if err != nil {
+		return nil, err
+	}
+	paramHandler := NewParamHandler(internal.ApplyPlanParameters(snapshot.DeepCopy().Parameters, plan), instanceParameters)
+	if err := paramHandler.ReviseParam(); err != nil {
+		return nil, err
+	}
+	return GetParamAsMap(paramHandler.templateParameters), nil
+}
+
+func GetParamAsMap(parameters []tmplv1.ParamSpec) (resultParam map[string]tmplv1.ParamValue) {
+	resultParam = make(map[string]tmplv1.ParamValue)
 	for _, param := range parameters {
 		resultParam[param.Name] = param.Value
 	}
 	return resultParam
 }
 
-func RegexValidate(checkParamAsMap map[string]intstr.IntOrString, paramSpec []tmplv1.ParamSpec) (matched bool, msg string) {
+func RegexValidate(checkParamAsMap map[string]tmplv1.ParamValue, paramSpec []tmplv1.ParamSpec, redactor *internal.Redactor) (matched bool, msg string) {
 
 	m := "Regex Validation succeeded"
 
 	for _, param := range paramSpec {
-		intOrStrVal := checkParamAsMap[param.Name]
-		var stringVal string
-		if intOrStrVal.Type == intstr.Int {
-			stringVal = strconv.Itoa(int(intOrStrVal.IntVal))
-		} else {
-			stringVal = intOrStrVal.StrVal
-		}
+		stringVal := checkParamAsMap[param.Name].String()
 		if matched, _ := regexp.MatchString(param.Regex, stringVal); !matched {
-			m = fmt.Sprintf("parameter:%s value:%s doesn't match with given regex", param.Name, stringVal)
+			m = fmt.Sprintf("parameter:%s value:%s doesn't match with given regex", param.Name, redactor.Value(param.Name, checkParamAsMap[param.Name]))
 			return matched, m
 		}
 	}
@@ -105,40 +98,62 @@ func RegexValidate(checkParamAsMap map[string]intstr.IntOrString, paramSpec []tm
 	return true, m
 }
 
-func replaceParamsWithValue(obj *runtime.RawExtension, params map[string]intstr.IntOrString) error {
+func replaceParamsWithValue(obj *runtime.RawExtension, params map[string]tmplv1.ParamValue, redactor *internal.Redactor) error {
 	reqLogger := ctrl.Log.WithName("replace k8s object")
 	objStr := string(obj.Raw)
 	reqLogger.Info("original object: " + objStr)
+	// the object is logged with the sensitive values hidden
+	reqLogger.Info("replaced object: " + substituteParams(objStr, redactor.Params(params)))
+
+	obj.Raw = []byte(substituteParams(objStr, params))
+	return nil
+}
+
+// substituteParams replaces parameter references in the JSON of the object with the values
+func substituteParams(objStr string, params map[string]tmplv1.ParamValue) string {
 	for key, value := range params {
 		// reqLogger.Info("key: " + key + " value: " + value.String())
-		if value.Type == intstr.Int {
+		if value.Type == intstr.Int || value.IsRaw() {
+			// "${KEY}" is replaced with the value itself, e.g. number, boolean, array or object
 			objStr = strings.Replace(objStr, "\"${"+key+"}\"", value.String(), -1)
-			objStr = strings.Replace(objStr, "${"+key+"}", value.String(), -1)
-		} else {
-			objStr = strings.Replace(objStr, "${"+key+"}", value.String(), -1)
 		}
+		// ${KEY} inside of a string is replaced with the escaped JSON of the value,
+		// so quotes and backslashes in the value cannot break the object or add fields to it
+		objStr = strings.Replace(objStr, "${"+key+"}", escapeJSONString(value.String()), -1)
 	}
-	reqLogger.Info("replaced object: " + objStr)
+	return objStr
+}
 
-	obj.Raw = []byte(objStr)
-	return nil
+// escapeJSONString escapes the string to be put in a JSON string
+func escapeJSONString(str string) string {
+	quoted, _ := json.Marshal(str)
+	return string(quoted[1 : len(quoted)-1])
 }
 
-func TemplateExec(tmpl *tmplv1.ClusterTemplate, param map[string]intstr.IntOrString) (result []runtime.RawExtension, err error) {
+// TemplateExec renders go templates of the object field with the parameters and metadata of the instance.
+// Random functions are seeded with the instance, so the instance is rendered to the same objects every time.
+func TemplateExec(objects []string, param map[string]tmplv1.ParamValue, instance *tmplv1.TemplateInstance) (result []runtime.RawExtension, err error) {
 	log := ctrl.Log.WithName("Go template")
 	tmplParam := make(map[string]interface{})
 	for k, v := range param {
-		if v.Type == 0 { // valueType : integer
-			tmplParam[k] = v.IntVal
-		} else {
-			tmplParam[k] = v.StrVal
-		}
+		tmplParam[k] = v.Interface()
+	}
+	tmplParam[internal.InstanceKey] = map[string]interface{}{
+		"Name":        instance.Name,
+		"Namespace":   instance.Namespace,
+		"UID":         string(instance.UID),
+		"Labels":      instance.Labels,
+		"Annotations": instance.Annotations,
 	}
 
-	t := template.New("object template")
-	cache := runtime.RawExtension{}
-	for _, tp := range tmpl.Object {
-		t, err = t.Parse(tp)
+	seed := string(instance.UID)
+	if len(seed) == 0 {
+		seed = instance.Namespace + "/" + instance.Name
+	}
+	funcs := internal.TemplateFuncMap(seed)
+
+	for idx, tp := range objects {
+		t, err := template.New(fmt.Sprintf("object[%d]", idx)).Funcs(funcs).Parse(tp)
 		if err != nil {
 			log.Error(err, "parsing error")
 			return nil, err
@@ -151,12 +166,36 @@ func TemplateExec(tmpl *tmplv1.ClusterTemplate, param map[string]intstr.IntOrStr
 			return nil, err
 		}
 
-		cache.Raw, _ = yaml.YAMLToJSON(buf.Bytes())
-		result = append(result, cache)
+		raw, err := yaml.YAMLToJSON(buf.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("object[%d] is not rendered to a valid object: %v", idx, err)
+		}
+		if len(bytes.TrimSpace(raw)) == 0 || string(raw) == "null" {
+			return nil, fmt.Errorf("object[%d] is rendered to an empty object", idx)
+		}
+		result = append(result, runtime.RawExtension{Raw: raw})
 	}
 	return result, nil
 }
 
+// checkDuplicateObjects fails when the same object is rendered more than once,
+// for example defined in both objects and object fields of the template
+func checkDuplicateObjects(objs []runtime.RawExtension) error {
+	rendered := make(map[string]bool)
+	for idx := range objs {
+		unstr, err := BytesToUnstructuredObject(&objs[idx])
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s %s/%s", unstr.GroupVersionKind().GroupKind(), unstr.GetNamespace(), unstr.GetName())
+		if rendered[key] {
+			return fmt.Errorf("%s is defined more than once in objects and object of the template", key)
+		}
+		rendered[key] = true
+	}
+	return nil
+}
+
 func BytesToUnstructuredObject(obj *runtime.RawExtension) (*unstructured.Unstructured, error) {
 	var in runtime.Object
 	var scope conversion.Scope // While not actually used within the function, need to pass in
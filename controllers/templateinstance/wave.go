@@ -0,0 +1,166 @@
+package templateinstance
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/internal"
+)
+
+// orderWaves groups the objects into waves to be applied in order.
+// CustomResourceDefinitions and Namespaces are applied before the other objects, which are ordered by the wave annotation.
+// Objects with the depends-on annotation are put in a wave after the objects they depend on.
+// Objects in the same wave keep the order of the template.
+func orderWaves(objs []runtime.RawExtension) ([][]runtime.RawExtension, error) {
+	unstrs := make([]*unstructured.Unstructured, len(objs))
+	index := make(map[string]int)
+	for idx := range objs {
+		unstr, err := BytesToUnstructuredObject(&objs[idx])
+		if err != nil {
+			return nil, err
+		}
+		unstrs[idx] = unstr
+		index[strings.ToLower(unstr.GetKind()+"/"+unstr.GetName())] = idx
+	}
+
+	waves := make([]int, len(objs))
+	deps := make([][]int, len(objs))
+	for idx, unstr := range unstrs {
+		annotations := unstr.GetAnnotations()
+		if wave, exist := annotations[internal.WaveAnnotation]; exist {
+			val, err := strconv.Atoi(strings.TrimSpace(wave))
+			if err != nil {
+				return nil, fmt.Errorf("%s %s has invalid wave %q", unstr.GetKind(), unstr.GetName(), wave)
+			}
+			waves[idx] = val
+		}
+		for _, dep := range strings.Split(annotations[internal.DependsOnAnnotation], ",") {
+			if dep = strings.TrimSpace(dep); len(dep) == 0 {
+				continue
+			}
+			depIdx, exist := index[strings.ToLower(dep)]
+			if !exist {
+				return nil, fmt.Errorf("%s %s depends on %s which is not in the template", unstr.GetKind(), unstr.GetName(), dep)
+			}
+			deps[idx] = append(deps[idx], depIdx)
+		}
+	}
+
+	// waves of dependents are pushed after their dependencies until nothing changes
+	for round := 0; ; round++ {
+		changed := false
+		for idx := range deps {
+			for _, dep := range deps[idx] {
+				if waves[idx] <= waves[dep] {
+					waves[idx] = waves[dep] + 1
+					changed = true
+				}
+			}
+		}
+		if !changed {
+			break
+		}
+		if round > len(objs) {
+			return nil, fmt.Errorf("dependencies of the objects have a cycle")
+		}
+	}
+
+	type waveKey struct{ rank, wave int }
+	keys := []waveKey{}
+	grouped := make(map[waveKey][]runtime.RawExtension)
+	for idx, unstr := range unstrs {
+		key := waveKey{rank: 1, wave: waves[idx]}
+		if isClusterSetup(unstr) {
+			key.rank = 0
+		}
+		if _, exist := grouped[key]; !exist {
+			keys = append(keys, key)
+		}
+		grouped[key] = append(grouped[key], objs[idx])
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].rank != keys[j].rank {
+			return keys[i].rank < keys[j].rank
+		}
+		return keys[i].wave < keys[j].wave
+	})
+
+	result := make([][]runtime.RawExtension, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, grouped[key])
+	}
+	return result, nil
+}
+
+// isClusterSetup reports whether the object is needed by the other objects to be created
+func isClusterSetup(unstr *unstructured.Unstructured) bool {
+	gk := unstr.GroupVersionKind().GroupKind()
+	return (gk.Group == "apiextensions.k8s.io" && gk.Kind == "CustomResourceDefinition") || (gk.Group == "" && gk.Kind == "Namespace")
+}
+
+// applyWaves applies the waves in order. A wave is applied only after every object of the previous waves is ready.
+// It returns the reason why the waves are not applied yet, or empty string if every wave is applied.
+func (r *TemplateInstanceReconciler) applyWaves(instance *tmplv1.TemplateInstance, waves [][]runtime.RawExtension, apply func(obj *runtime.RawExtension) error) (string, error) {
+	for idx := range waves {
+		if idx > 0 {
+			notReady, err := r.notReadyObjects(instance, waves[idx-1])
+			if err != nil {
+				return "", err
+			}
+			if len(notReady) != 0 {
+				return fmt.Sprintf("wave %d of %d is waiting for %s", idx+1, len(waves), strings.Join(notReady, ", ")), nil
+			}
+		}
+		for objIdx := range waves[idx] {
+			if err := apply(&waves[idx][objIdx]); err != nil {
+				unstr, errDecode := BytesToUnstructuredObject(&waves[idx][objIdx])
+				if errDecode != nil {
+					return "", err
+				}
+				if len(unstr.GetNamespace()) == 0 {
+					unstr.SetNamespace(instance.Namespace)
+				}
+				return "", &objectError{ref: objectRef(unstr), err: err}
+			}
+		}
+	}
+	return "", nil
+}
+
+// notReadyObjects returns the objects which are not healthy
+func (r *TemplateInstanceReconciler) notReadyObjects(instance *tmplv1.TemplateInstance, objs []runtime.RawExtension) ([]string, error) {
+	notReady := []string{}
+	for idx := range objs {
+		desired, err := BytesToUnstructuredObject(&objs[idx])
+		if err != nil {
+			return nil, err
+		}
+		if len(desired.GetNamespace()) == 0 {
+			desired.SetNamespace(instance.Namespace)
+		}
+
+		health := tmplv1.HealthSpec{Status: tmplv1.HealthMissing}
+		live := &unstructured.Unstructured{}
+		live.SetGroupVersionKind(desired.GroupVersionKind())
+		if err := r.Client.Get(context.TODO(), types.NamespacedName{Namespace: desired.GetNamespace(), Name: desired.GetName()}, live); err == nil {
+			if health, err = r.assessHealth(live); err != nil {
+				return nil, err
+			}
+		} else if !errors.IsNotFound(err) {
+			return nil, err
+		}
+		if health.Status != tmplv1.HealthHealthy {
+			notReady = append(notReady, fmt.Sprintf("%s %s/%s", desired.GetKind(), desired.GetNamespace(), desired.GetName()))
+		}
+	}
+	return notReady, nil
+}
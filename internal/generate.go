@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"math/big"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+)
+
+const (
+	// Types of generated values
+	GenerateRandom = "random"
+	GenerateUUID   = "uuid"
+
+	defaultGenerateLength  = 16
+	maxGenerateLength      = 256
+	defaultGenerateCharset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+)
+
+// GeneratedSecretName returns the name of the secret which generated values of the instance are stored in
+func GeneratedSecretName(instance *tmplv1.TemplateInstance) string {
+	return instance.Name + "-generated"
+}
+
+// GenerateValue generates a new value with the generate option of the parameter
+func GenerateValue(spec *tmplv1.GenerateSpec) (string, error) {
+	switch spec.Type {
+	case GenerateUUID:
+		return string(uuid.NewUUID()), nil
+	case GenerateRandom:
+		length, charset := spec.Length, []rune(spec.Charset)
+		if length <= 0 {
+			length = defaultGenerateLength
+		}
+		if length > maxGenerateLength {
+			return "", fmt.Errorf("length of generated value cannot be longer than %d", maxGenerateLength)
+		}
+		if len(charset) == 0 {
+			charset = []rune(defaultGenerateCharset)
+		}
+		result := make([]rune, length)
+		for idx := range result {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
+			if err != nil {
+				return "", err
+			}
+			result[idx] = charset[n.Int64()]
+		}
+		return string(result), nil
+	}
+	return "", fmt.Errorf("generate type %q is not supported", spec.Type)
+}
+
+// GetGeneratedValues returns the values generated for the instance, or nil if none has been generated yet
+func GetGeneratedValues(c client.Client, instance *tmplv1.TemplateInstance) (map[string][]byte, error) {
+	secret := &corev1.Secret{}
+	if err := c.Get(context.TODO(), types.NamespacedName{Namespace: instance.Namespace, Name: GeneratedSecretName(instance)}, secret); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	return secret.Data, nil
+}
+
+// WithGeneratedValues returns the parameters of the instance with the generated values of the parameters which the instance gives no value
+func WithGeneratedValues(templateParams, instanceParams []tmplv1.ParamSpec, generated map[string][]byte) []tmplv1.ParamSpec {
+	result := append([]tmplv1.ParamSpec{}, instanceParams...)
+	for _, param := range templateParams {
+		val, exist := generated[param.Name]
+		if param.Generate == nil || !exist {
+			continue
+		}
+		given := false
+		for _, instanceParam := range instanceParams {
+			if instanceParam.Name == param.Name && !IsEmptyParamValue(instanceParam.Value) {
+				given = true
+			}
+		}
+		if !given {
+			result = append(result, tmplv1.ParamSpec{Name: param.Name, Value: tmplv1.FromString(string(val))})
+		}
+	}
+	return result
+}
@@ -1,134 +1,373 @@
 package internal
 
 import (
+	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
-	"github.com/ghodss/yaml"
+	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
-	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
-	billy "github.com/go-git/go-billy/v5"
 	memfs "github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-billy/v5/util"
 	git "github.com/go-git/go-git/v5"
 
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
 	http "github.com/go-git/go-git/v5/plumbing/transport/http"
+	ssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
 	memory "github.com/go-git/go-git/v5/storage/memory"
 	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
 	corev1 "k8s.io/api/core/v1"
 )
 
-// [TODO] : err 처리 log로 바꾸기
+const (
+	DefaultGitopsBranch        = "main"
+	DefaultChangeBranchPrefix  = "template-operator"
+	DefaultCommitAuthor        = "template-operator"
+	DefaultCommitMessage       = "{{ .Action }} {{ .Namespace }}/{{ .Name }} (generation {{ .Generation }})"
+	GitopsActionUpdate         = "Update"
+	GitopsActionRemove         = "Remove"
+	removedChangeBranchPostfix = "removed"
+
+	// keys of the secret of ssh credentials in addition to ssh-privatekey
+	knownHostsKey    = "known_hosts"
+	sshPassphraseKey = "passphrase"
+)
+
 var (
-	defaultRemoteName = "main"
-	storer            *memory.Storage
-	fs                billy.Filesystem
+	scpLikeURL        = regexp.MustCompile(`^[^/@:]+@[^/:]+:`)
+	defaultRemoteName = "origin"
+
+	// pushes are serialized per repo url
+	repoLocks sync.Map
+	// the change is committed again on the latest branch with the backoff while the push is rejected as non-fast-forward
+	pushBackoff = wait.Backoff{
+		Duration: 100 * time.Millisecond,
+		Factor:   2,
+		Jitter:   0.1,
+		Steps:    5,
+	}
 )
 
-func PushToGivenRepo(instance *tmplv1.TemplateInstance, obj runtime.RawExtension, c client.Client) error {
-	storer = memory.NewStorage()
-	fs = memfs.New()
+// GitopsChange is a change of the files of a template instance to be committed
+type GitopsChange struct {
+	// Action is Update or Remove
+	Action     string
+	Namespace  string
+	Name       string
+	Generation int64
+	// Files are written in the directory of the instance, and the directory is removed if there are no files
+	Files map[string][]byte
+}
 
-	credential := &corev1.Secret{}
-	if err := c.Get(context.TODO(), types.NamespacedName{
-		Namespace: instance.Namespace,
-		Name:      instance.Spec.Gitops.Secret,
-	}, credential); err != nil {
-		fmt.Printf("%v", err)
-		return err
+// GitopsBranch returns the branch which the commits of the gitops spec are pushed to, or created from
+func GitopsBranch(gitops tmplv1.GitopsSpec) string {
+	if len(gitops.Branch) == 0 {
+		return DefaultGitopsBranch
 	}
+	return gitops.Branch
+}
 
-	// Authentication
-	auth := &http.BasicAuth{
-		Username: string(credential.Data["username"]),
-		Password: string(credential.Data["token"]), // personal access token
+// InstanceDir returns the directory of the files of the instance in the repo.
+// The directory is keyed by the namespace too, so instances of the same name in different namespaces don't share it.
+func InstanceDir(gitops tmplv1.GitopsSpec, namespace, name string) string {
+	return path.Join(MutateRepoPath(gitops.Path), namespace, name)
+}
+
+// ChangeBranch returns the name of the branch which the change is pushed to by BranchPerChange strategy
+func ChangeBranch(gitops tmplv1.GitopsSpec, change *GitopsChange) string {
+	prefix := strings.TrimSuffix(gitops.ChangeBranchPrefix, "/")
+	if len(prefix) == 0 {
+		prefix = DefaultChangeBranchPrefix
+	}
+	postfix := fmt.Sprintf("%d", change.Generation)
+	if change.Action == GitopsActionRemove {
+		postfix = removedChangeBranchPostfix
 	}
+	return fmt.Sprintf("%s/%s/%s-%s", prefix, change.Namespace, change.Name, postfix)
+}
+
+// ParseCommitMessage parses the commit message template of the gitops spec
+func ParseCommitMessage(gitops tmplv1.GitopsSpec) (*template.Template, error) {
+	message := gitops.CommitMessage
+	if len(message) == 0 {
+		message = DefaultCommitMessage
+	}
+	return template.New("commitMessage").Option("missingkey=error").Parse(message)
+}
+
+// CommitMessage renders the commit message template of the gitops spec with the change
+func CommitMessage(gitops tmplv1.GitopsSpec, change *GitopsChange) (string, error) {
+	tmpl, err := ParseCommitMessage(gitops)
+	if err != nil {
+		return "", err
+	}
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, change); err != nil {
+		return "", fmt.Errorf("commit message: %s", err.Error())
+	}
+	return buf.String(), nil
+}
+
+// PushConflictError is returned when the commit is not pushed because the branch keeps being updated by others
+type PushConflictError struct {
+	Attempts int
+	Err      error
+}
 
-	repository := MutateRepoURL(instance.Spec.Gitops.SourceGitRepo)
-	repo, err := git.Clone(storer, fs, &git.CloneOptions{
-		URL:             repository,
+func (e *PushConflictError) Error() string {
+	return fmt.Sprintf("cannot push to the branch updated by others after %d attempts: %s", e.Attempts, e.Err.Error())
+}
+
+// CommitFiles replaces the files in the directory of the instance under the path of the gitops repo with the files of the change
+// in a single commit, and pushes the commit to the branch of the gitops spec, or a new branch by BranchPerChange strategy.
+// Nothing is committed if the files are not changed. It returns the branch and the SHA of the commit which the branch points to.
+// Pushes to the same repo are serialized, and the change is committed again on the latest branch when the branch was updated by others.
+// PushConflictError is returned if the branch is still updated after the retries.
+func CommitFiles(c client.Client, gitops tmplv1.GitopsSpec, change *GitopsChange) (string, string, error) {
+	message, err := CommitMessage(gitops, change)
+	if err != nil {
+		return "", "", err
+	}
+
+	url := MutateRepoURL(gitops.SourceGitRepo)
+	auth, username, err := gitopsAuth(c, change.Namespace, gitops.Secret, url)
+	if err != nil {
+		return "", "", err
+	}
+
+	lock := repoLock(url)
+	lock.Lock()
+	defer lock.Unlock()
+
+	var branch, commit string
+	var pushErr error
+	attempts := 0
+	if err := wait.ExponentialBackoff(pushBackoff, func() (bool, error) {
+		attempts++
+		branch, commit, pushErr = commitOnce(url, auth, username, message, gitops, change)
+		if pushErr != nil && isNonFastForward(pushErr) {
+			return false, nil
+		}
+		return true, pushErr
+	}); err != nil {
+		if err == wait.ErrWaitTimeout {
+			return "", "", &PushConflictError{Attempts: attempts, Err: pushErr}
+		}
+		return "", "", err
+	}
+	return branch, commit, nil
+}
+
+// repoLock returns the lock which serializes pushes to the repo
+func repoLock(url string) *sync.Mutex {
+	lock, _ := repoLocks.LoadOrStore(url, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+// isNonFastForward reports whether the push was rejected because the branch was updated after it was cloned
+func isNonFastForward(err error) bool {
+	if err == git.ErrForceNeeded || err == git.ErrNonFastForwardUpdate {
+		return true
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "non-fast-forward") || strings.Contains(msg, "fetch first") || strings.Contains(msg, "failed to update ref")
+}
+
+// commitOnce clones the latest branch into memory, commits the change on it and pushes the commit
+func commitOnce(url string, auth transport.AuthMethod, username, message string, gitops tmplv1.GitopsSpec, change *GitopsChange) (string, string, error) {
+	// storage is not shared between calls, which may run concurrently for different repos
+	fs := memfs.New()
+	branch := GitopsBranch(gitops)
+	repo, err := git.Clone(memory.NewStorage(), fs, &git.CloneOptions{
+		URL:             url,
 		Auth:            auth,
-		InsecureSkipTLS: true,
+		InsecureSkipTLS: gitops.InsecureSkipTLSVerify,
+		CABundle:        gitops.CABundle,
 		RemoteName:      defaultRemoteName,
-		ReferenceName:   plumbing.ReferenceName("refs/heads/main"),
+		ReferenceName:   plumbing.NewBranchReferenceName(branch),
 		SingleBranch:    true,
 		Tags:            git.NoTags,
 	})
 	if err != nil {
-		fmt.Printf("%v", err)
-		return err
+		return "", "", err
 	}
 
-	fmt.Println("Repository cloned")
-
 	w, err := repo.Worktree()
 	if err != nil {
-		fmt.Printf("%v", err)
-		return err
+		return "", "", err
 	}
 
-	getKind := make(map[string]interface{})
-	if err := json.Unmarshal(obj.Raw, &getKind); err != nil {
-		fmt.Println(err, "error occurs while unmarshal")
+	// files which are not given anymore are removed with the directory
+	dirPath := InstanceDir(gitops, change.Namespace, change.Name)
+	if _, err := fs.Lstat(dirPath); err == nil {
+		if _, err := w.Remove(dirPath); err != nil {
+			return "", "", err
+		}
+	}
+	for name, data := range change.Files {
+		filePath := path.Join(dirPath, name)
+		if err := util.WriteFile(fs, filePath, data, 0644); err != nil {
+			return "", "", err
+		}
+		// git add $filePath
+		if _, err := w.Add(filePath); err != nil {
+			return "", "", err
+		}
 	}
-	objKind := getKind["kind"].(string)
 
-	// Create new file
-	path := MutateRepoPath(instance.Spec.Gitops.Path)
-	filePath := path + "/" + instance.Name + "_" + objKind + ".yaml"
-	newFile, err := fs.Create(filePath)
+	status, err := w.Status()
 	if err != nil {
-		return err
+		return "", "", err
+	}
+	if status.IsClean() {
+		head, err := repo.Head()
+		if err != nil {
+			return "", "", err
+		}
+		return branch, head.Hash().String(), nil
 	}
 
-	yamlRaw, err := yaml.JSONToYAML(obj.Raw)
+	// git commit -m $message
+	author := &object.Signature{
+		Name:  gitops.Author.Name,
+		Email: gitops.Author.Email,
+		When:  time.Now(),
+	}
+	if len(author.Name) == 0 {
+		author.Name = DefaultCommitAuthor
+	}
+	if len(author.Email) == 0 {
+		author.Email = username
+	}
+	hash, err := w.Commit(message, &git.CommitOptions{Author: author})
 	if err != nil {
-		return err
+		return "", "", err
+	}
+
+	// change branches are owned by the operator, so they are overwritten when the change is pushed again
+	refSpec := config.RefSpec(fmt.Sprintf("refs/heads/%s:refs/heads/%s", branch, branch))
+	if gitops.Strategy == tmplv1.GitopsStrategyBranchPerChange {
+		branch = ChangeBranch(gitops, change)
+		refSpec = config.RefSpec(fmt.Sprintf("+refs/heads/%s:refs/heads/%s", GitopsBranch(gitops), branch))
+	}
+
+	//Push the code to the remote
+	if err = repo.Push(&git.PushOptions{
+		RemoteName:      defaultRemoteName,
+		RefSpecs:        []config.RefSpec{refSpec},
+		Auth:            auth,
+		InsecureSkipTLS: gitops.InsecureSkipTLSVerify,
+		CABundle:        gitops.CABundle,
+	}); err != nil {
+		return "", "", err
 	}
-	newFile.Write(yamlRaw)
-	newFile.Close()
+	return branch, hash.String(), nil
+}
 
-	// git add $filePath
-	_, err = w.Add(filePath)
+// gitopsAuth builds the authentication for the url of the repo from the secret of the credentials.
+// Secrets of kubernetes.io/basic-auth type are used for http(s) repos and kubernetes.io/ssh-auth type for ssh repos.
+// Opaque secrets may have username and token (personal access token) keys, or ssh-privatekey and known_hosts keys.
+// It returns the username of the credentials as well.
+func gitopsAuth(c client.Client, namespace, secret, url string) (transport.AuthMethod, string, error) {
+	if len(secret) == 0 {
+		return nil, "", nil
+	}
+	credential := &corev1.Secret{}
+	if err := c.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: secret}, credential); err != nil {
+		return nil, "", err
+	}
+
+	endpoint, err := transport.NewEndpoint(url)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
+	useSSH := endpoint.Protocol == "ssh"
+	username := string(credential.Data[corev1.BasicAuthUsernameKey])
 
-	// git commit -m $message
-	commitTime := time.Now()
-	_, err = w.Commit("Update"+" "+instance.Name+"_"+objKind+".yaml", &git.CommitOptions{
-		Author: &object.Signature{
-			Email: auth.Username,
-			When:  commitTime,
-		},
-	})
+	switch credential.Type {
+	case corev1.SecretTypeBasicAuth:
+		if useSSH {
+			return nil, "", fmt.Errorf("secret %s of type %s cannot be used for ssh repo %s", secret, credential.Type, url)
+		}
+		return &http.BasicAuth{
+			Username: username,
+			Password: string(credential.Data[corev1.BasicAuthPasswordKey]),
+		}, username, nil
+	case corev1.SecretTypeSSHAuth:
+		if !useSSH {
+			return nil, "", fmt.Errorf("secret %s of type %s cannot be used for %s repo %s", secret, credential.Type, endpoint.Protocol, url)
+		}
+	case corev1.SecretTypeOpaque, "":
+		if !useSSH {
+			return &http.BasicAuth{
+				Username: username,
+				Password: string(credential.Data["token"]), // personal access token
+			}, username, nil
+		}
+	default:
+		return nil, "", fmt.Errorf("secret %s of type %s cannot be used for gitops credentials", secret, credential.Type)
+	}
+
+	key, exist := credential.Data[corev1.SSHAuthPrivateKey]
+	if !exist {
+		return nil, "", fmt.Errorf("secret %s has no key %s", secret, corev1.SSHAuthPrivateKey)
+	}
+	// user of the url (git@host:org/repo.git) is used unless the secret has username
+	if len(username) == 0 {
+		username = endpoint.User
+	}
+	publicKeys, err := ssh.NewPublicKeys(username, key, string(credential.Data[sshPassphraseKey]))
 	if err != nil {
-		return err
+		return nil, "", fmt.Errorf("secret %s: %s", secret, err.Error())
+	}
+	// host keys are verified with known_hosts of the secret, or known_hosts files of the operator otherwise
+	if hosts, exist := credential.Data[knownHostsKey]; exist {
+		if err := setKnownHosts(publicKeys, hosts); err != nil {
+			return nil, "", fmt.Errorf("secret %s: %s", secret, err.Error())
+		}
 	}
+	return publicKeys, username, nil
+}
 
-	//Push the code to the remote
-	err = repo.Push(&git.PushOptions{
-		RemoteName: defaultRemoteName,
-		Auth:       auth,
-		Prune:      true,
-	})
+// setKnownHosts makes the host keys verified with the known_hosts data
+func setKnownHosts(publicKeys *ssh.PublicKeys, hosts []byte) error {
+	file, err := ioutil.TempFile("", "known_hosts")
 	if err != nil {
 		return err
 	}
-
-	fmt.Println("Remote updated.", filePath)
-
+	defer os.Remove(file.Name())
+	if _, err := file.Write(hosts); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	// known_hosts files are read when the callback is created
+	callback, err := ssh.NewKnownHostsCallback(file.Name())
+	if err != nil {
+		return err
+	}
+	publicKeys.HostKeyCallback = callback
 	return nil
 }
 
+// MutateRepoURL uses https unless the url of the repo has a scheme or is an scp-like ssh url (git@host:org/repo.git)
 func MutateRepoURL(Repo string) (result string) {
-	if ok := strings.HasPrefix(Repo, "https://"); ok {
+	if ok := strings.Contains(Repo, "://") || scpLikeURL.MatchString(Repo); ok {
 		return Repo
 	}
 
@@ -138,14 +377,5 @@ func MutateRepoURL(Repo string) (result string) {
 }
 
 func MutateRepoPath(Path string) (result string) {
-	result = Path
-	if ok := strings.HasPrefix(Path, "/"); ok {
-		result = Path[1:]
-	}
-
-	if ok := strings.HasSuffix(Path, "/"); ok {
-		result = result[0 : len(result)-1]
-	}
-
-	return result
+	return strings.Trim(Path, "/")
 }
@@ -0,0 +1,126 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/jsonpath"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+)
+
+// ErrSecretOutput is returned for outputs taken from Secrets, which would be published in plain text
+var ErrSecretOutput = errors.New("outputs are published in the status of the instance and cannot be taken from Secret, use credentials of TemplateBinding instead")
+
+// IsSecretRef reports whether the output is taken from a Secret
+func IsSecretRef(ref *tmplv1.OutputObjectRef) bool {
+	return ref != nil && ref.Kind == "Secret" && (len(ref.APIVersion) == 0 || ref.APIVersion == "v1")
+}
+
+// ReplaceParamRefs replaces parameter references (e.g. ${NAME}) in the string with the values
+func ReplaceParamRefs(str string, params map[string]tmplv1.ParamValue) string {
+	return paramRefRegex.ReplaceAllStringFunc(str, func(ref string) string {
+		if val, exist := params[ref[2:len(ref)-1]]; exist {
+			return val.String()
+		}
+		return ref
+	})
+}
+
+// ResolveOutput returns the value of the output taken from the objects created by the template instance
+func ResolveOutput(c client.Client, instance *tmplv1.TemplateInstance, output tmplv1.OutputSpec, params map[string]tmplv1.ParamValue) (string, error) {
+	if output.ObjectRef == nil {
+		return ReplaceParamRefs(output.Value, params), nil
+	}
+
+	name := ReplaceParamRefs(output.ObjectRef.Name, params)
+	var ref *tmplv1.RefSpec
+	for idx, obj := range instance.Status.Objects {
+		if obj.Ref.Kind == output.ObjectRef.Kind && obj.Ref.Name == name &&
+			(len(output.ObjectRef.APIVersion) == 0 || obj.Ref.ApiVersion == output.ObjectRef.APIVersion) {
+			ref = &instance.Status.Objects[idx].Ref
+			break
+		}
+	}
+	if ref == nil {
+		return "", fmt.Errorf("%s %s is not created by the template instance", output.ObjectRef.Kind, name)
+	}
+
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(ref.ApiVersion)
+	obj.SetKind(ref.Kind)
+	if err := c.Get(context.TODO(), types.NamespacedName{Namespace: ref.Namespace, Name: ref.Name}, obj); err != nil {
+		return "", err
+	}
+	return EvaluateJSONPath(obj, output.JSONPath)
+}
+
+// EvaluateJSONPath returns the value at the JSONPath of the object.
+// Strings are returned as they are, and the other values are encoded to JSON.
+func EvaluateJSONPath(obj *unstructured.Unstructured, path string) (string, error) {
+	jp, err := parseJSONPath(path)
+	if err != nil {
+		return "", err
+	}
+
+	content := obj.UnstructuredContent()
+	// data of secret is given in plain text
+	if obj.GetKind() == "Secret" && obj.GroupVersionKind().Group == "" {
+		content = obj.DeepCopy().UnstructuredContent()
+		if data, ok := content["data"].(map[string]interface{}); ok {
+			for key, val := range data {
+				if encoded, ok := val.(string); ok {
+					if decoded, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+						data[key] = string(decoded)
+					}
+				}
+			}
+		}
+	}
+
+	results, err := jp.FindResults(content)
+	if err != nil {
+		return "", fmt.Errorf("cannot find %s in %s %s: %s", path, obj.GetKind(), obj.GetName(), err.Error())
+	}
+	values := []interface{}{}
+	for _, result := range results {
+		for _, val := range result {
+			values = append(values, val.Interface())
+		}
+	}
+	if len(values) == 0 {
+		return "", fmt.Errorf("%s %s has no value at %s", obj.GetKind(), obj.GetName(), path)
+	}
+
+	var value interface{} = values
+	if len(values) == 1 {
+		value = values[0]
+	}
+	if str, ok := value.(string); ok {
+		return str, nil
+	}
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
+
+// parseJSONPath parses the JSONPath expression. Braces can be omitted. ex) .spec.clusterIP
+func parseJSONPath(path string) (*jsonpath.JSONPath, error) {
+	if !strings.HasPrefix(path, "{") {
+		path = "{" + path + "}"
+	}
+	jp := jsonpath.New("output")
+	if err := jp.Parse(path); err != nil {
+		return nil, fmt.Errorf("invalid JSONPath %s: %s", path, err.Error())
+	}
+	return jp, nil
+}
@@ -0,0 +1,170 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+)
+
+// RedactedValue is shown instead of values of sensitive parameters
+const RedactedValue = "******"
+
+// ResolveValueFrom returns a copy of the parameters whose values are read from the secrets and config maps selected by valueFrom.
+// Values of missing keys of optional selectors are left empty, so the default values of the template are used.
+func ResolveValueFrom(c client.Client, namespace string, params []tmplv1.ParamSpec) ([]tmplv1.ParamSpec, error) {
+	result := make([]tmplv1.ParamSpec, 0, len(params))
+	for _, param := range params {
+		if param.ValueFrom != nil {
+			val, err := readValueFrom(c, namespace, param.ValueFrom)
+			if err != nil {
+				return nil, fmt.Errorf("parameter %s: %s", param.Name, err.Error())
+			}
+			param.Value = tmplv1.FromString(val)
+		}
+		result = append(result, param)
+	}
+	return result, nil
+}
+
+func readValueFrom(c client.Client, namespace string, source *tmplv1.ParamValueSource) (string, error) {
+	switch {
+	case source.SecretKeyRef != nil:
+		ref := source.SecretKeyRef
+		optional := ref.Optional != nil && *ref.Optional
+		secret := &corev1.Secret{}
+		if err := c.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: ref.Name}, secret); err != nil {
+			if optional && client.IgnoreNotFound(err) == nil {
+				return "", nil
+			}
+			return "", err
+		}
+		if val, exist := secret.Data[ref.Key]; exist {
+			return string(val), nil
+		}
+		if optional {
+			return "", nil
+		}
+		return "", fmt.Errorf("secret %s has no key %s", ref.Name, ref.Key)
+	case source.ConfigMapKeyRef != nil:
+		ref := source.ConfigMapKeyRef
+		optional := ref.Optional != nil && *ref.Optional
+		cm := &corev1.ConfigMap{}
+		if err := c.Get(context.TODO(), types.NamespacedName{Namespace: namespace, Name: ref.Name}, cm); err != nil {
+			if optional && client.IgnoreNotFound(err) == nil {
+				return "", nil
+			}
+			return "", err
+		}
+		if val, exist := cm.Data[ref.Key]; exist {
+			return val, nil
+		}
+		if val, exist := cm.BinaryData[ref.Key]; exist {
+			return string(val), nil
+		}
+		if optional {
+			return "", nil
+		}
+		return "", fmt.Errorf("config map %s has no key %s", ref.Name, ref.Key)
+	}
+	return "", fmt.Errorf("valueFrom must select a key of a secret or a config map")
+}
+
+// minRedactedValueLength is the length of the shortest value redacted from arbitrary text.
+// Shorter values such as 1 or true would mangle unrelated text, so they are only hidden by parameter.
+const minRedactedValueLength = 6
+
+// Redactor hides values of sensitive parameters in logs and messages.
+// Values are hidden by parameter where they are substituted, and the text from other sources is redacted by value.
+type Redactor struct {
+	sensitive map[string]bool
+	replacer  *strings.Replacer
+}
+
+// NewRedactor collects values of the sensitive parameters from the parameters of the template and the instance.
+// A parameter is sensitive if it is marked sensitive in either of them, or its value is generated or taken from a secret.
+func NewRedactor(templateParams, instanceParams []tmplv1.ParamSpec) *Redactor {
+	sensitive := make(map[string]bool)
+	for _, param := range append(append([]tmplv1.ParamSpec{}, templateParams...), instanceParams...) {
+		if param.Sensitive || param.Generate != nil || (param.ValueFrom != nil && param.ValueFrom.SecretKeyRef != nil) {
+			sensitive[param.Name] = true
+		}
+	}
+
+	values := []string{}
+	for _, param := range append(append([]tmplv1.ParamSpec{}, templateParams...), instanceParams...) {
+		if !sensitive[param.Name] || IsEmptyParamValue(param.Value) {
+			continue
+		}
+		values = append(values, param.Value.String())
+	}
+	// longer values are replaced first not to leave a part of them
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+
+	oldnew := []string{}
+	for _, val := range values {
+		if len(val) >= minRedactedValueLength {
+			oldnew = append(oldnew, val, RedactedValue)
+		}
+	}
+	return &Redactor{sensitive: sensitive, replacer: strings.NewReplacer(oldnew...)}
+}
+
+// IsSensitive reports whether the parameter is sensitive
+func (r *Redactor) IsSensitive(name string) bool {
+	return r.sensitive[name]
+}
+
+// SensitiveParams returns the sorted names of the sensitive parameters
+func (r *Redactor) SensitiveParams() []string {
+	names := []string{}
+	for name := range r.sensitive {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Value returns the value of the parameter to be shown
+func (r *Redactor) Value(name string, value tmplv1.ParamValue) string {
+	if r.IsSensitive(name) {
+		return RedactedValue
+	}
+	return value.String()
+}
+
+// Params returns the parameters whose sensitive values are hidden, to be substituted into the text to be shown
+func (r *Redactor) Params(params map[string]tmplv1.ParamValue) map[string]tmplv1.ParamValue {
+	result := make(map[string]tmplv1.ParamValue, len(params))
+	for name, value := range params {
+		if r.IsSensitive(name) {
+			value = tmplv1.FromString(RedactedValue)
+		}
+		result[name] = value
+	}
+	return result
+}
+
+// Redact hides values of the sensitive parameters in the string.
+// Values shorter than minRedactedValueLength are left as they are.
+func (r *Redactor) Redact(str string) string {
+	return r.replacer.Replace(str)
+}
+
+// Error hides values of the sensitive parameters in the message of the error
+func (r *Redactor) Error(err error) error {
+	if err == nil {
+		return nil
+	}
+	if msg := r.Redact(err.Error()); msg != err.Error() {
+		return errors.New(msg)
+	}
+	return err
+}
@@ -0,0 +1,364 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	IntegerType   = "integer"
+	BooleanType   = "boolean"
+	ArrayType     = "array"
+	ObjectType    = "object"
+	SecretRefType = "secretRef"
+)
+
+// ParamSchema is the subset of JSON schema which parameter values are validated with
+type ParamSchema struct {
+	Type                 string                  `json:"type,omitempty"`
+	Enum                 []interface{}           `json:"enum,omitempty"`
+	Minimum              *float64                `json:"minimum,omitempty"`
+	Maximum              *float64                `json:"maximum,omitempty"`
+	ExclusiveMinimum     bool                    `json:"exclusiveMinimum,omitempty"`
+	ExclusiveMaximum     bool                    `json:"exclusiveMaximum,omitempty"`
+	MinLength            *int                    `json:"minLength,omitempty"`
+	MaxLength            *int                    `json:"maxLength,omitempty"`
+	Pattern              string                  `json:"pattern,omitempty"`
+	Items                *ParamSchema            `json:"items,omitempty"`
+	MinItems             *int                    `json:"minItems,omitempty"`
+	MaxItems             *int                    `json:"maxItems,omitempty"`
+	UniqueItems          bool                    `json:"uniqueItems,omitempty"`
+	Properties           map[string]*ParamSchema `json:"properties,omitempty"`
+	Required             []string                `json:"required,omitempty"`
+	AdditionalProperties *bool                   `json:"additionalProperties,omitempty"`
+}
+
+// secretRefSchema is the schema of the value of secretRef parameters
+var secretRefSchema = &ParamSchema{
+	Type: ObjectType,
+	Properties: map[string]*ParamSchema{
+		"name": {Type: StringType, MinLength: intPtr(1)},
+		"key":  {Type: StringType},
+	},
+	Required:             []string{"name"},
+	AdditionalProperties: boolPtr(false),
+}
+
+// ParseParamSchema parses the JSON schema of the parameter
+func ParseParamSchema(raw *runtime.RawExtension) (*ParamSchema, error) {
+	if raw == nil || len(raw.Raw) == 0 {
+		return nil, nil
+	}
+	schema := &ParamSchema{}
+	if err := json.Unmarshal(raw.Raw, schema); err != nil {
+		return nil, fmt.Errorf("invalid schema: %v", err)
+	}
+	if err := schema.check(); err != nil {
+		return nil, fmt.Errorf("invalid schema: %v", err)
+	}
+	return schema, nil
+}
+
+// check validates patterns of the schema
+func (s *ParamSchema) check() error {
+	if len(s.Pattern) != 0 {
+		if _, err := regexp.Compile(s.Pattern); err != nil {
+			return err
+		}
+	}
+	if s.Items != nil {
+		if err := s.Items.check(); err != nil {
+			return err
+		}
+	}
+	for _, prop := range s.Properties {
+		if prop == nil {
+			continue
+		}
+		if err := prop.check(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ConvertParamValue converts the value to the value type of the parameter and validates it with the schema.
+// Values given as strings (e.g. by web forms) are parsed to the value type, so "true" is a boolean and "[1, 2]" is an array.
+func ConvertParamValue(param tmplv1.ParamSpec, value tmplv1.ParamValue) (tmplv1.ParamValue, error) {
+	val := value.Interface()
+	// zero value of IntOrString means that the value is not given for types other than numbers
+	if !value.IsRaw() && value.Type == intstr.Int && value.IntVal == 0 {
+		switch param.ValueType {
+		case BooleanType:
+			val = false
+		case ArrayType:
+			val = []interface{}{}
+		case ObjectType:
+			val = map[string]interface{}{}
+		case SecretRefType:
+			if param.Required {
+				return value, fmt.Errorf("value must be given")
+			}
+			return tmplv1.ParamValue{Raw: []byte("null")}, nil
+		}
+	}
+	if str, ok := val.(string); ok && len(param.ValueType) != 0 && param.ValueType != StringType {
+		parsed, err := parseString(param.ValueType, str)
+		if err != nil {
+			return value, err
+		}
+		val = parsed
+	}
+
+	switch param.ValueType {
+	case "", StringType:
+		if value.IsRaw() {
+			return value, fmt.Errorf("value must be a string")
+		}
+		// integers are used as strings as before
+		return tmplv1.FromString(value.String()), validateWithSchema(param, value.String())
+	case NumberType:
+		if _, ok := toFloat(val); !ok {
+			return value, fmt.Errorf("value must be a number")
+		}
+	case IntegerType:
+		f, ok := toFloat(val)
+		if !ok || f != math.Trunc(f) {
+			return value, fmt.Errorf("value must be an integer")
+		}
+	case BooleanType:
+		if _, ok := val.(bool); !ok {
+			return value, fmt.Errorf("value must be a boolean")
+		}
+	case ArrayType:
+		if _, ok := val.([]interface{}); !ok {
+			return value, fmt.Errorf("value must be an array")
+		}
+	case ObjectType:
+		if _, ok := val.(map[string]interface{}); !ok {
+			return value, fmt.Errorf("value must be an object")
+		}
+	case SecretRefType:
+		if err := secretRefSchema.validate(val, ""); err != nil {
+			return value, err
+		}
+	default:
+		return value, fmt.Errorf("value type %s is not supported", param.ValueType)
+	}
+
+	if err := validateWithSchema(param, val); err != nil {
+		return value, err
+	}
+	return tmplv1.FromValue(val)
+}
+
+// IsEmptyParamValue reports whether the value is not given
+func IsEmptyParamValue(value tmplv1.ParamValue) bool {
+	if !value.IsSet() {
+		return true
+	}
+	if value.IsRaw() {
+		return false
+	}
+	return value.Type == intstr.String && len(value.StrVal) == 0
+}
+
+func validateWithSchema(param tmplv1.ParamSpec, val interface{}) error {
+	schema, err := ParseParamSchema(param.Schema)
+	if err != nil || schema == nil {
+		return err
+	}
+	return schema.validate(val, "")
+}
+
+func parseString(valueType, str string) (interface{}, error) {
+	switch valueType {
+	case NumberType, IntegerType:
+		f, err := strconv.ParseFloat(strings.TrimSpace(str), 64)
+		if err != nil {
+			return nil, fmt.Errorf("value must be a number")
+		}
+		if i, err := strconv.ParseInt(strings.TrimSpace(str), 10, 64); err == nil {
+			return i, nil
+		}
+		return f, nil
+	case BooleanType:
+		b, err := strconv.ParseBool(strings.TrimSpace(str))
+		if err != nil {
+			return nil, fmt.Errorf("value must be a boolean")
+		}
+		return b, nil
+	case ArrayType, ObjectType, SecretRefType:
+		v, err := tmplv1.FromValue(json.RawMessage(str))
+		if err != nil {
+			return nil, fmt.Errorf("value must be a JSON %s", valueType)
+		}
+		return v.Interface(), nil
+	}
+	return str, nil
+}
+
+// validate checks the value with the schema. path is the location of the value in the parameter value for error messages.
+func (s *ParamSchema) validate(val interface{}, path string) error {
+	errorf := func(format string, args ...interface{}) error {
+		msg := fmt.Sprintf(format, args...)
+		if len(path) != 0 {
+			return fmt.Errorf("%s: %s", path, msg)
+		}
+		return fmt.Errorf("%s", msg)
+	}
+
+	if len(s.Type) != 0 && !matchesType(s.Type, val) {
+		return errorf("value must be %s", s.Type)
+	}
+	if len(s.Enum) != 0 {
+		found := false
+		for _, e := range s.Enum {
+			if equalJSON(e, val) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errorf("value must be one of %v", s.Enum)
+		}
+	}
+
+	switch typed := val.(type) {
+	case string:
+		if s.MinLength != nil && len(typed) < *s.MinLength {
+			return errorf("value must be at least %d characters", *s.MinLength)
+		}
+		if s.MaxLength != nil && len(typed) > *s.MaxLength {
+			return errorf("value must be at most %d characters", *s.MaxLength)
+		}
+		if len(s.Pattern) != 0 {
+			if matched, _ := regexp.MatchString(s.Pattern, typed); !matched {
+				return errorf("value doesn't match with pattern %s", s.Pattern)
+			}
+		}
+	case []interface{}:
+		if s.MinItems != nil && len(typed) < *s.MinItems {
+			return errorf("value must have at least %d items", *s.MinItems)
+		}
+		if s.MaxItems != nil && len(typed) > *s.MaxItems {
+			return errorf("value must have at most %d items", *s.MaxItems)
+		}
+		for idx := range typed {
+			if s.UniqueItems {
+				for prev := 0; prev < idx; prev++ {
+					if equalJSON(typed[prev], typed[idx]) {
+						return errorf("items must be unique")
+					}
+				}
+			}
+			if s.Items != nil {
+				if err := s.Items.validate(typed[idx], fmt.Sprintf("%s[%d]", path, idx)); err != nil {
+					return err
+				}
+			}
+		}
+	case map[string]interface{}:
+		for _, key := range s.Required {
+			if _, exist := typed[key]; !exist {
+				return errorf("%s is required", key)
+			}
+		}
+		keys := make([]string, 0, len(typed))
+		for key := range typed {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			prop, exist := s.Properties[key]
+			if !exist {
+				if s.AdditionalProperties != nil && !*s.AdditionalProperties {
+					return errorf("%s is not allowed", key)
+				}
+				continue
+			}
+			if prop != nil {
+				if err := prop.validate(typed[key], strings.TrimPrefix(path+"."+key, ".")); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		if f, ok := toFloat(val); ok {
+			if s.Minimum != nil && (f < *s.Minimum || (s.ExclusiveMinimum && f == *s.Minimum)) {
+				return errorf("value must be greater than %v", *s.Minimum)
+			}
+			if s.Maximum != nil && (f > *s.Maximum || (s.ExclusiveMaximum && f == *s.Maximum)) {
+				return errorf("value must be less than %v", *s.Maximum)
+			}
+		}
+	}
+	return nil
+}
+
+func matchesType(schemaType string, val interface{}) bool {
+	switch schemaType {
+	case StringType:
+		_, ok := val.(string)
+		return ok
+	case NumberType:
+		_, ok := toFloat(val)
+		return ok
+	case IntegerType:
+		f, ok := toFloat(val)
+		return ok && f == math.Trunc(f)
+	case BooleanType:
+		_, ok := val.(bool)
+		return ok
+	case ArrayType:
+		_, ok := val.([]interface{})
+		return ok
+	case ObjectType:
+		_, ok := val.(map[string]interface{})
+		return ok
+	case "null":
+		return val == nil
+	}
+	return false
+}
+
+func toFloat(val interface{}) (float64, bool) {
+	switch n := val.(type) {
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case int:
+		return float64(n), true
+	case float64:
+		return n, true
+	}
+	return 0, false
+}
+
+// equalJSON compares values regardless of the type of numbers
+func equalJSON(a, b interface{}) bool {
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		return ok && fa == fb
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func intPtr(i int) *int {
+	return &i
+}
+
+func boolPtr(b bool) *bool {
+	return &b
+}
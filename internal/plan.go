@@ -0,0 +1,51 @@
+package internal
+
+import (
+	"fmt"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+)
+
+// SelectPlan finds the plan requested by the template instance.
+// Changing the plan from the active one is only allowed when the active plan is updateable.
+// It returns nil if no plan is requested.
+func SelectPlan(plans []tmplv1.PlanSpec, requested, active string) (*tmplv1.PlanSpec, error) {
+	if len(active) != 0 && requested != active {
+		if current := findPlan(plans, active); current != nil && !current.PlanUpdateable {
+			return nil, fmt.Errorf("plan %s is not updateable, cannot change the plan to %q", active, requested)
+		}
+	}
+	if len(requested) == 0 {
+		return nil, nil
+	}
+	plan := findPlan(plans, requested)
+	if plan == nil {
+		return nil, fmt.Errorf("plan %s is not found in the template", requested)
+	}
+	return plan, nil
+}
+
+// ApplyPlanParameters returns parameters of the template whose default values are replaced with the values of the plan.
+// Values given by the template instance still take precedence over them.
+func ApplyPlanParameters(params []tmplv1.ParamSpec, plan *tmplv1.PlanSpec) []tmplv1.ParamSpec {
+	if plan == nil {
+		return params
+	}
+	result := make([]tmplv1.ParamSpec, 0, len(params))
+	for _, param := range params {
+		if val, exist := plan.Schemas.ServiceInstance.Create.Parameters[param.Name]; exist {
+			param.Value = tmplv1.FromIntOrString(val)
+		}
+		result = append(result, param)
+	}
+	return result
+}
+
+func findPlan(plans []tmplv1.PlanSpec, name string) *tmplv1.PlanSpec {
+	for idx := range plans {
+		if plans[idx].Name == name {
+			return &plans[idx]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+)
+
+// RevisionTemplateLabel is set on every revision with the name of the template it is created from
+const RevisionTemplateLabel = "templaterevisions.tmax.io/template"
+
+var invalidNameChars = regexp.MustCompile(`[^a-z0-9.-]+`)
+
+// TemplateHash returns the hash of the fields which decide the objects created by the template
+func TemplateHash(spec *tmplv1.TemplateSpec) (string, error) {
+	raw, err := json.Marshal(struct {
+		Objects     interface{}         `json:"objects,omitempty"`
+		Object      []string            `json:"object,omitempty"`
+		Plans       interface{}         `json:"plans,omitempty"`
+		Parameters  interface{}         `json:"parameters,omitempty"`
+		Credentials []tmplv1.OutputSpec `json:"credentials,omitempty"`
+		Outputs     []tmplv1.OutputSpec `json:"outputs,omitempty"`
+	}{spec.Objects, spec.Object, spec.Plans, spec.Parameters, spec.Credentials, spec.Outputs})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(raw)), nil
+}
+
+// RevisionName returns the name of the revision of the template.
+// Versioned templates are named after the version, and the others after the hash.
+// Versions are followed by a short hash of the version, because different versions (e.g. 1.0 and 1-0) can be sanitized to the same name.
+func RevisionName(templateName, version, hash string) string {
+	if len(version) == 0 {
+		return templateName + "-" + hash[:10]
+	}
+	versionHash := fmt.Sprintf("%x", sha256.Sum256([]byte(version)))[:6]
+	suffix := strings.Trim(invalidNameChars.ReplaceAllString(strings.ToLower(version), "-"), "-.")
+	if len(suffix) == 0 {
+		return templateName + "-" + versionHash
+	}
+	return templateName + "-" + suffix + "-" + versionHash
+}
+
+// DeployedRevisions returns the names of the template revisions deployed by the instances or recorded in their history.
+// Revisions of ClusterTemplate are returned if cluster is true, and revisions of Template otherwise.
+func DeployedRevisions(instances []tmplv1.TemplateInstance, cluster bool) map[string]bool {
+	deployed := map[string]bool{}
+	for _, instance := range instances {
+		if (instance.Spec.ClusterTemplate != nil) != cluster {
+			continue
+		}
+		if len(instance.Status.TemplateRevision) != 0 {
+			deployed[instance.Status.TemplateRevision] = true
+		}
+		for _, rev := range instance.Status.History {
+			if len(rev.TemplateRevision) != 0 {
+				deployed[rev.TemplateRevision] = true
+			}
+		}
+	}
+	return deployed
+}
+
+// UpgradeRequested reports whether the template instance asks for another version than the deployed one
+func UpgradeRequested(spec, status *tmplv1.ObjectInfo) bool {
+	return len(spec.Version) != 0 && spec.Version != status.Version
+}
+
+// GetTemplateRevision finds the revision of the given version of the template, and returns it with its name.
+// Revisions of ClusterTemplate are looked up when the namespace is empty.
+func GetTemplateRevision(c client.Client, namespace, templateName, version string) (*tmplv1.TemplateRevisionSpec, string, error) {
+	labels := client.MatchingLabels{RevisionTemplateLabel: templateName}
+	names := []string{}
+	specs := []tmplv1.TemplateRevisionSpec{}
+	if len(namespace) == 0 {
+		revisions := &tmplv1.ClusterTemplateRevisionList{}
+		if err := c.List(context.TODO(), revisions, labels); err != nil {
+			return nil, "", err
+		}
+		for _, rev := range revisions.Items {
+			names = append(names, rev.Name)
+			specs = append(specs, rev.Spec)
+		}
+	} else {
+		revisions := &tmplv1.TemplateRevisionList{}
+		if err := c.List(context.TODO(), revisions, client.InNamespace(namespace), labels); err != nil {
+			return nil, "", err
+		}
+		for _, rev := range revisions.Items {
+			names = append(names, rev.Name)
+			specs = append(specs, rev.Spec)
+		}
+	}
+
+	for idx := range specs {
+		if specs[idx].Version == version {
+			return &specs[idx], names[idx], nil
+		}
+	}
+	return nil, "", fmt.Errorf("version %s of template %s is not found", version, templateName)
+}
@@ -0,0 +1,327 @@
+package internal
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"sigs.k8s.io/yaml"
+)
+
+// InstanceKey is the key of template instance metadata in the data of go templates.
+// Parameters must not use the name.
+const InstanceKey = "Instance"
+
+const (
+	alphaNum = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+	alpha    = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	numeric  = "0123456789"
+
+	// limits of the functions not to exhaust the memory of the operator
+	maxRandLength   = 1024
+	maxRepeatLength = 1 << 20
+)
+
+// TemplateFuncMap returns functions available in go templates of the object field.
+// Functions have no access to files, environment or network.
+// Random functions are seeded with the given seed, so rendering the same template with the same seed gives the same result.
+// The seed is not secret and all random functions share one stream, so their values are predictable.
+// They must not be used for passwords or keys, which are generated by the generate field of parameters instead.
+func TemplateFuncMap(seed string) template.FuncMap {
+	h := fnv.New64a()
+	h.Write([]byte(seed))
+	rnd := rand.New(rand.NewSource(int64(h.Sum64())))
+	randString := func(letters string) func(int) (string, error) {
+		return func(n int) (string, error) {
+			if n < 0 || n > maxRandLength {
+				return "", fmt.Errorf("length of random string must be between 0 and %d", maxRandLength)
+			}
+			b := make([]byte, n)
+			for i := range b {
+				b[i] = letters[rnd.Intn(len(letters))]
+			}
+			return string(b), nil
+		}
+	}
+
+	return template.FuncMap{
+		// strings
+		"upper":      strings.ToUpper,
+		"lower":      strings.ToLower,
+		"title":      strings.Title,
+		"trim":       strings.TrimSpace,
+		"trimAll":    func(cutset, s string) string { return strings.Trim(s, cutset) },
+		"trimPrefix": func(prefix, s string) string { return strings.TrimPrefix(s, prefix) },
+		"trimSuffix": func(suffix, s string) string { return strings.TrimSuffix(s, suffix) },
+		"contains":   func(substr, s string) bool { return strings.Contains(s, substr) },
+		"hasPrefix":  func(prefix, s string) bool { return strings.HasPrefix(s, prefix) },
+		"hasSuffix":  func(suffix, s string) bool { return strings.HasSuffix(s, suffix) },
+		"replace":    func(old, new, s string) string { return strings.Replace(s, old, new, -1) },
+		"repeat":     repeat,
+		"trunc":      trunc,
+		"split":      func(sep, s string) []string { return strings.Split(s, sep) },
+		"join":       join,
+		"quote":      func(v interface{}) string { return strconv.Quote(toString(v)) },
+		"squote":     func(v interface{}) string { return "'" + toString(v) + "'" },
+		"indent":     indent,
+		"nindent": func(spaces int, s string) (string, error) {
+			indented, err := indent(spaces, s)
+			return "\n" + indented, err
+		},
+		"toString": toString,
+		"atoi":     func(s string) (int, error) { return strconv.Atoi(s) },
+
+		// defaults and conditionals
+		"default":  defaultValue,
+		"empty":    isEmpty,
+		"required": required,
+		"coalesce": coalesce,
+		"ternary": func(trueVal, falseVal interface{}, cond bool) interface{} {
+			if cond {
+				return trueVal
+			}
+			return falseVal
+		},
+
+		// lists and dictionaries
+		"list":  func(v ...interface{}) []interface{} { return v },
+		"first": func(list interface{}) interface{} { l := toList(list); return index(l, 0) },
+		"last":  func(list interface{}) interface{} { l := toList(list); return index(l, len(l)-1) },
+		"has":   func(needle, list interface{}) bool { return has(needle, toList(list)) },
+		"uniq":  func(list interface{}) []interface{} { return uniq(toList(list)) },
+		"dict":  dict,
+		"get":   func(d interface{}, key string) interface{} { return toDict(d)[key] },
+		"set": func(d map[string]interface{}, key string, val interface{}) map[string]interface{} {
+			d[key] = val
+			return d
+		},
+		"hasKey": func(d interface{}, key string) bool { _, ok := toDict(d)[key]; return ok },
+		"keys":   func(d interface{}) []string { return keys(toDict(d)) },
+
+		// encoding
+		"b64enc":   func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+		"b64dec":   b64dec,
+		"toJson":   toJSON,
+		"fromJson": fromJSON,
+		"toYaml":   toYAML,
+		"fromYaml": fromYAML,
+
+		// crypto and random (random values are predictable, not for secrets)
+		"sha1sum":      func(s string) string { sum := sha1.Sum([]byte(s)); return hex.EncodeToString(sum[:]) },
+		"sha256sum":    func(s string) string { sum := sha256.Sum256([]byte(s)); return hex.EncodeToString(sum[:]) },
+		"randAlphaNum": randString(alphaNum),
+		"randAlpha":    randString(alpha),
+		"randNumeric":  randString(numeric),
+	}
+}
+
+func toString(v interface{}) string {
+	switch s := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return s
+	case []byte:
+		return string(s)
+	case fmt.Stringer:
+		return s.String()
+	}
+	return fmt.Sprintf("%v", v)
+}
+
+func trunc(length int, s string) string {
+	if length < 0 || len(s) <= length {
+		return s
+	}
+	return s[:length]
+}
+
+func join(sep string, v interface{}) string {
+	list := toList(v)
+	if list == nil {
+		return toString(v)
+	}
+	items := make([]string, len(list))
+	for i := range list {
+		items[i] = toString(list[i])
+	}
+	return strings.Join(items, sep)
+}
+
+// repeat returns the string repeated count times, up to the limit of the output size
+func repeat(count int, s string) (string, error) {
+	if count < 0 || (len(s) != 0 && count > maxRepeatLength/len(s)) {
+		return "", fmt.Errorf("repeated string must be shorter than %d bytes", maxRepeatLength)
+	}
+	return strings.Repeat(s, count), nil
+}
+
+// indent pads every line of the string, up to the limit of the padding added
+func indent(spaces int, s string) (string, error) {
+	if lines := strings.Count(s, "\n") + 1; spaces < 0 || spaces > maxRepeatLength/lines {
+		return "", fmt.Errorf("indented string must be padded with less than %d bytes", maxRepeatLength)
+	}
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.Replace(s, "\n", "\n"+pad, -1), nil
+}
+
+// isEmpty reports whether the value is nil or the zero value of its type
+func isEmpty(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	val := reflect.ValueOf(v)
+	switch val.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return val.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return val.IsNil()
+	}
+	return val.IsZero()
+}
+
+func defaultValue(d interface{}, given ...interface{}) interface{} {
+	if len(given) == 0 || isEmpty(given[0]) {
+		return d
+	}
+	return given[0]
+}
+
+func required(msg string, v interface{}) (interface{}, error) {
+	if isEmpty(v) {
+		return nil, errors.New(msg)
+	}
+	return v, nil
+}
+
+func coalesce(v ...interface{}) interface{} {
+	for _, val := range v {
+		if !isEmpty(val) {
+			return val
+		}
+	}
+	return nil
+}
+
+// toList converts any slice or array to a list. Other values make an empty list.
+func toList(v interface{}) []interface{} {
+	val := reflect.ValueOf(v)
+	if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+		return nil
+	}
+	list := make([]interface{}, val.Len())
+	for i := range list {
+		list[i] = val.Index(i).Interface()
+	}
+	return list
+}
+
+// toDict converts any map with string keys to a dictionary. Other values make an empty dictionary.
+func toDict(v interface{}) map[string]interface{} {
+	val := reflect.ValueOf(v)
+	if val.Kind() != reflect.Map || val.Type().Key().Kind() != reflect.String {
+		return nil
+	}
+	d := make(map[string]interface{}, val.Len())
+	for _, key := range val.MapKeys() {
+		d[key.String()] = val.MapIndex(key).Interface()
+	}
+	return d
+}
+
+func index(list []interface{}, idx int) interface{} {
+	if idx < 0 || idx >= len(list) {
+		return nil
+	}
+	return list[idx]
+}
+
+func has(needle interface{}, list []interface{}) bool {
+	for _, item := range list {
+		if reflect.DeepEqual(item, needle) {
+			return true
+		}
+	}
+	return false
+}
+
+func uniq(list []interface{}) []interface{} {
+	result := []interface{}{}
+	for _, item := range list {
+		if !has(item, result) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func dict(v ...interface{}) (map[string]interface{}, error) {
+	if len(v)%2 != 0 {
+		return nil, errors.New("dict requires even number of arguments")
+	}
+	d := make(map[string]interface{}, len(v)/2)
+	for i := 0; i < len(v); i += 2 {
+		d[toString(v[i])] = v[i+1]
+	}
+	return d, nil
+}
+
+func keys(d map[string]interface{}) []string {
+	result := make([]string, 0, len(d))
+	for key := range d {
+		result = append(result, key)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func b64dec(s string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+func toJSON(v interface{}) (string, error) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+func fromJSON(s string) (interface{}, error) {
+	var out interface{}
+	if err := json.Unmarshal([]byte(s), &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func toYAML(v interface{}) (string, error) {
+	out, err := yaml.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(out), "\n"), nil
+}
+
+func fromYAML(s string) (interface{}, error) {
+	var out interface{}
+	if err := yaml.Unmarshal([]byte(s), &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
@@ -5,7 +5,6 @@ import (
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/conversion"
 	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/util/intstr"
 )
 
 type TemplateResolver struct {
@@ -51,8 +50,8 @@ func (r *TemplateResolver) SetParameterDefaultFields() {
 		}
 
 		// IntOrString default value{0 0 }    for util.go:44
-		if param.ValueType == "string" && len(param.Value.StrVal) == 0 {
-			param.Value = intstr.IntOrString{Type: intstr.String, StrVal: ""}
+		if param.ValueType == "string" && len(param.Value.StrVal) == 0 && !param.Value.IsRaw() {
+			param.Value = tmplv1.FromString("")
 		}
 
 		newParams = append(newParams, param)
@@ -0,0 +1,397 @@
+package internal
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/conversion"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+)
+
+const (
+	StringType = "string"
+	NumberType = "number"
+)
+
+// parameter reference in objects. ex) ${NAME}
+var paramRefRegex = regexp.MustCompile(`\$\{([^{}]+)\}`)
+
+var supportedValueTypes = []string{StringType, NumberType, IntegerType, BooleanType, ArrayType, ObjectType, SecretRefType}
+
+// ValidateTemplateSpec checks objects, go-template objects and parameters of the template
+// and returns every violation with its field path.
+func ValidateTemplateSpec(spec *tmplv1.TemplateSpec) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	declared, paramErrs := validateParameters(spec.Parameters, field.NewPath("parameters"))
+	allErrs = append(allErrs, paramErrs...)
+	allErrs = append(allErrs, validatePlans(spec.Plans, spec.Parameters, field.NewPath("plans"))...)
+	allErrs = append(allErrs, validateOutputs(spec.Credentials, declared, field.NewPath("credentials"))...)
+	allErrs = append(allErrs, validateOutputs(spec.Outputs, declared, field.NewPath("outputs"))...)
+	for idx, output := range spec.Outputs {
+		if IsSecretRef(output.ObjectRef) {
+			allErrs = append(allErrs, field.Forbidden(field.NewPath("outputs").Index(idx).Child("objectRef"), ErrSecretOutput.Error()))
+		}
+	}
+
+	objectsPath := field.NewPath("objects")
+	for idx := range spec.Objects {
+		objPath := objectsPath.Index(idx)
+		if err := decodeObject(&spec.Objects[idx]); err != nil {
+			allErrs = append(allErrs, field.Invalid(objPath, string(spec.Objects[idx].Raw), "cannot decode object: "+err.Error()))
+			continue
+		}
+		allErrs = append(allErrs, validateParamRefs(string(spec.Objects[idx].Raw), declared, objPath)...)
+		allErrs = append(allErrs, validateHookAnnotations(&spec.Objects[idx], objPath)...)
+	}
+
+	objectPath := field.NewPath("object")
+	for idx, tp := range spec.Object {
+		if _, err := template.New("object template").Funcs(TemplateFuncMap("")).Parse(tp); err != nil {
+			allErrs = append(allErrs, field.Invalid(objectPath.Index(idx), tp, "cannot parse go template: "+err.Error()))
+			continue
+		}
+		allErrs = append(allErrs, validateParamRefs(tp, declared, objectPath.Index(idx))...)
+	}
+	// instance metadata is given to go templates with the reserved name
+	if len(spec.Object) != 0 && declared[InstanceKey] {
+		allErrs = append(allErrs, field.Invalid(field.NewPath("parameters"), InstanceKey, "parameter name is reserved for instance metadata in object"))
+	}
+
+	return allErrs
+}
+
+func validateParameters(params []tmplv1.ParamSpec, fldPath *field.Path) (map[string]bool, field.ErrorList) {
+	allErrs := field.ErrorList{}
+	declared := make(map[string]bool)
+
+	for idx, param := range params {
+		paramPath := fldPath.Index(idx)
+		if len(param.Name) == 0 {
+			allErrs = append(allErrs, field.Required(paramPath.Child("name"), "parameter must have a name"))
+		} else if declared[param.Name] {
+			allErrs = append(allErrs, field.Duplicate(paramPath.Child("name"), param.Name))
+		}
+		declared[param.Name] = true
+
+		if len(param.ValueType) != 0 && !isSupportedValueType(param.ValueType) {
+			allErrs = append(allErrs, field.NotSupported(paramPath.Child("valueType"), param.ValueType, supportedValueTypes))
+		} else if _, err := ParseParamSchema(param.Schema); err != nil {
+			allErrs = append(allErrs, field.Invalid(paramPath.Child("schema"), string(param.Schema.Raw), err.Error()))
+		} else if !IsEmptyParamValue(param.Value) && (param.Value.IsRaw() || param.Value.Type == intstr.String) {
+			// default value
+			if _, err := ConvertParamValue(param, param.Value); err != nil {
+				shown := param.Value.String()
+				if param.Sensitive {
+					shown = RedactedValue
+				}
+				allErrs = append(allErrs, field.Invalid(paramPath.Child("value"), shown, err.Error()))
+			}
+		}
+
+		if len(param.Regex) != 0 {
+			if _, err := regexp.Compile(param.Regex); err != nil {
+				allErrs = append(allErrs, field.Invalid(paramPath.Child("regex"), param.Regex, err.Error()))
+			}
+		}
+		if param.ValueFrom != nil {
+			allErrs = append(allErrs, field.Forbidden(paramPath.Child("valueFrom"), "valueFrom can be used only in parameters of the template instance"))
+		}
+		if param.Generate != nil {
+			allErrs = append(allErrs, validateGenerate(param, paramPath)...)
+		}
+	}
+	return declared, allErrs
+}
+
+// validateGenerate checks generated values are strings and the parameter has no default value
+func validateGenerate(param tmplv1.ParamSpec, paramPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	generatePath := paramPath.Child("generate")
+
+	if len(param.ValueType) != 0 && param.ValueType != StringType {
+		allErrs = append(allErrs, field.Invalid(paramPath.Child("valueType"), param.ValueType, "only string values can be generated"))
+	}
+	if !IsEmptyParamValue(param.Value) && (param.Value.IsRaw() || param.Value.Type == intstr.String) {
+		allErrs = append(allErrs, field.Forbidden(paramPath.Child("value"), "value cannot be given with generate"))
+	}
+	switch param.Generate.Type {
+	case GenerateRandom:
+		if param.Generate.Length < 0 {
+			allErrs = append(allErrs, field.Invalid(generatePath.Child("length"), param.Generate.Length, "length must be positive"))
+		}
+		if param.Generate.Length > maxGenerateLength {
+			allErrs = append(allErrs, field.Invalid(generatePath.Child("length"), param.Generate.Length, fmt.Sprintf("length must be at most %d", maxGenerateLength)))
+		}
+	case GenerateUUID:
+		if param.Generate.Length != 0 || len(param.Generate.Charset) != 0 {
+			allErrs = append(allErrs, field.Forbidden(generatePath, "length and charset can be given only for random"))
+		}
+	default:
+		allErrs = append(allErrs, field.NotSupported(generatePath.Child("type"), param.Generate.Type, []string{GenerateRandom, GenerateUUID}))
+	}
+	return allErrs
+}
+
+// validatePlans checks plans have unique names and their values are valid for the declared parameters
+func validatePlans(plans []tmplv1.PlanSpec, params []tmplv1.ParamSpec, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	declared := make(map[string]tmplv1.ParamSpec)
+	for _, param := range params {
+		declared[param.Name] = param
+	}
+
+	names := make(map[string]bool)
+	for idx, plan := range plans {
+		planPath := fldPath.Index(idx)
+		if len(plan.Name) == 0 {
+			allErrs = append(allErrs, field.Required(planPath.Child("name"), "plan must have a name"))
+		} else if names[plan.Name] {
+			allErrs = append(allErrs, field.Duplicate(planPath.Child("name"), plan.Name))
+		}
+		names[plan.Name] = true
+
+		valuesPath := planPath.Child("schemas", "service_instance", "create", "parameters")
+		values := plan.Schemas.ServiceInstance.Create.Parameters
+		valueNames := make([]string, 0, len(values))
+		for name := range values {
+			valueNames = append(valueNames, name)
+		}
+		sort.Strings(valueNames)
+		for _, name := range valueNames {
+			val := values[name]
+			param, exist := declared[name]
+			if !exist {
+				allErrs = append(allErrs, field.NotFound(valuesPath.Key(name), name))
+				continue
+			}
+			if _, err := ConvertParamValue(param, tmplv1.FromIntOrString(val)); err != nil {
+				allErrs = append(allErrs, field.Invalid(valuesPath.Key(name), val.String(), err.Error()))
+			}
+		}
+	}
+	return allErrs
+}
+
+// validateOutputs checks every output is taken from either an object or a value
+func validateOutputs(outputs []tmplv1.OutputSpec, declared map[string]bool, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	names := make(map[string]bool)
+	for idx, output := range outputs {
+		outputPath := fldPath.Index(idx)
+		if len(output.Name) == 0 {
+			allErrs = append(allErrs, field.Required(outputPath.Child("name"), "output must have a name"))
+		} else if names[output.Name] {
+			allErrs = append(allErrs, field.Duplicate(outputPath.Child("name"), output.Name))
+		}
+		names[output.Name] = true
+
+		if output.ObjectRef == nil {
+			if len(output.Value) == 0 {
+				allErrs = append(allErrs, field.Required(outputPath, "either objectRef and jsonPath or value must be given"))
+			}
+			if len(output.JSONPath) != 0 {
+				allErrs = append(allErrs, field.Forbidden(outputPath.Child("jsonPath"), "jsonPath must be given with objectRef"))
+			}
+			allErrs = append(allErrs, validateParamRefs(output.Value, declared, outputPath.Child("value"))...)
+			continue
+		}
+
+		refPath := outputPath.Child("objectRef")
+		if len(output.ObjectRef.Kind) == 0 {
+			allErrs = append(allErrs, field.Required(refPath.Child("kind"), "object must have a kind"))
+		}
+		if len(output.ObjectRef.Name) == 0 {
+			allErrs = append(allErrs, field.Required(refPath.Child("name"), "object must have a name"))
+		}
+		allErrs = append(allErrs, validateParamRefs(output.ObjectRef.Name, declared, refPath.Child("name"))...)
+		if len(output.Value) != 0 {
+			allErrs = append(allErrs, field.Forbidden(outputPath.Child("value"), "value cannot be given with objectRef"))
+		}
+		if len(output.JSONPath) == 0 {
+			allErrs = append(allErrs, field.Required(outputPath.Child("jsonPath"), "jsonPath must be given with objectRef"))
+		} else if _, err := parseJSONPath(output.JSONPath); err != nil {
+			allErrs = append(allErrs, field.Invalid(outputPath.Child("jsonPath"), output.JSONPath, err.Error()))
+		}
+	}
+	return allErrs
+}
+
+func validateParamRefs(raw string, declared map[string]bool, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	reported := make(map[string]bool)
+	for _, match := range paramRefRegex.FindAllStringSubmatch(raw, -1) {
+		name := match[1]
+		if declared[name] || reported[name] {
+			continue
+		}
+		reported[name] = true
+		allErrs = append(allErrs, field.Invalid(fldPath, match[0], fmt.Sprintf("parameter %s is not declared in parameters", name)))
+	}
+	return allErrs
+}
+
+var supportedHookPhases = []string{string(tmplv1.HookPreInstall), string(tmplv1.HookPostInstall), string(tmplv1.HookPreUpgrade), string(tmplv1.HookPreDelete)}
+var supportedHookDeletePolicies = []string{HookDeleteSucceeded, HookDeleteFailed}
+
+// validateHookAnnotations checks phases and delete policies of hook objects
+func validateHookAnnotations(obj *runtime.RawExtension, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	unstr := &unstructured.Unstructured{}
+	if err := unstr.UnmarshalJSON(obj.Raw); err != nil {
+		return allErrs
+	}
+	annotations := unstr.GetAnnotations()
+	annoPath := fldPath.Child("metadata", "annotations")
+	for _, check := range []struct {
+		key       string
+		supported []string
+	}{
+		{key: HookAnnotation, supported: supportedHookPhases},
+		{key: HookDeletePolicyAnnotation, supported: supportedHookDeletePolicies},
+	} {
+		val, exist := annotations[check.key]
+		if !exist {
+			continue
+		}
+		for _, item := range strings.Split(val, ",") {
+			if !sets.NewString(check.supported...).Has(strings.TrimSpace(item)) {
+				allErrs = append(allErrs, field.NotSupported(annoPath.Key(check.key), item, check.supported))
+			}
+		}
+	}
+	if _, exist := annotations[HookDeletePolicyAnnotation]; exist {
+		if _, isHook := annotations[HookAnnotation]; !isHook {
+			allErrs = append(allErrs, field.Invalid(annoPath.Key(HookDeletePolicyAnnotation), annotations[HookDeletePolicyAnnotation], "delete policy is only for hook objects"))
+		}
+	}
+	return allErrs
+}
+
+func decodeObject(obj *runtime.RawExtension) error {
+	var in runtime.Object
+	var scope conversion.Scope
+	if err := runtime.Convert_runtime_RawExtension_To_runtime_Object(obj, &in, scope); err != nil {
+		return err
+	}
+	unstrObj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(in)
+	if err != nil {
+		return err
+	}
+	unstr := unstructured.Unstructured{Object: unstrObj}
+	if len(unstr.GetKind()) == 0 {
+		return fmt.Errorf("object has no kind")
+	}
+	return nil
+}
+
+func isSupportedValueType(valueType string) bool {
+	for _, t := range supportedValueTypes {
+		if t == valueType {
+			return true
+		}
+	}
+	return false
+}
+
+// validateValueFrom checks the parameter selects a key of either a secret or a config map
+func validateValueFrom(param tmplv1.ParamSpec, paramPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	fromPath := paramPath.Child("valueFrom")
+
+	if value := param.Value; value.IsRaw() || (value.Type == intstr.String && len(value.StrVal) != 0) || value.IntVal != 0 {
+		allErrs = append(allErrs, field.Forbidden(paramPath.Child("value"), "value cannot be given with valueFrom"))
+	}
+	source := param.ValueFrom
+	switch {
+	case source.SecretKeyRef != nil && source.ConfigMapKeyRef != nil:
+		allErrs = append(allErrs, field.Forbidden(fromPath, "only one of secretKeyRef and configMapKeyRef can be given"))
+	case source.SecretKeyRef != nil:
+		allErrs = append(allErrs, validateKeySelector(source.SecretKeyRef.Name, source.SecretKeyRef.Key, fromPath.Child("secretKeyRef"))...)
+	case source.ConfigMapKeyRef != nil:
+		allErrs = append(allErrs, validateKeySelector(source.ConfigMapKeyRef.Name, source.ConfigMapKeyRef.Key, fromPath.Child("configMapKeyRef"))...)
+	default:
+		allErrs = append(allErrs, field.Required(fromPath, "either secretKeyRef or configMapKeyRef must be given"))
+	}
+	return allErrs
+}
+
+func validateKeySelector(name, key string, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if len(name) == 0 {
+		allErrs = append(allErrs, field.Required(fldPath.Child("name"), "name must be given"))
+	}
+	if len(key) == 0 {
+		allErrs = append(allErrs, field.Required(fldPath.Child("key"), "key must be given"))
+	}
+	return allErrs
+}
+
+// ValidateInstanceParameters checks instance parameters against the parameters declared in the template.
+// Unknown names, missing required values, regex and type mismatches are all reported.
+func ValidateInstanceParameters(templateParams, instanceParams []tmplv1.ParamSpec, fldPath *field.Path) field.ErrorList {
+	allErrs := field.ErrorList{}
+
+	declared := make(map[string]tmplv1.ParamSpec)
+	for _, param := range templateParams {
+		declared[param.Name] = param
+	}
+
+	given := make(map[string]tmplv1.ParamValue)
+	for idx, param := range instanceParams {
+		paramPath := fldPath.Index(idx)
+		if _, exist := declared[param.Name]; !exist {
+			allErrs = append(allErrs, field.NotFound(paramPath.Child("name"), param.Name))
+			continue
+		}
+		given[param.Name] = param.Value
+
+		// values taken from secrets and config maps are validated when they are read
+		if param.ValueFrom != nil {
+			allErrs = append(allErrs, validateValueFrom(param, paramPath)...)
+			given[param.Name] = tmplv1.FromString(RedactedValue)
+			continue
+		}
+
+		spec := declared[param.Name]
+		shown := param.Value.String()
+		if spec.Sensitive || param.Sensitive {
+			shown = RedactedValue
+		}
+		if !IsEmptyParamValue(param.Value) {
+			if _, err := ConvertParamValue(spec, param.Value); err != nil {
+				allErrs = append(allErrs, field.Invalid(paramPath.Child("value"), shown, err.Error()))
+				continue
+			}
+		}
+		if len(spec.Regex) != 0 {
+			if matched, _ := regexp.MatchString(spec.Regex, param.Value.String()); !matched {
+				allErrs = append(allErrs, field.Invalid(paramPath.Child("value"), shown, fmt.Sprintf("value doesn't match with regex %s", spec.Regex)))
+			}
+		}
+	}
+
+	for _, param := range templateParams {
+		// generated values are given by the controller
+		if !param.Required || param.Generate != nil {
+			continue
+		}
+		val, exist := given[param.Name]
+		if !exist || IsEmptyParamValue(val) {
+			val = param.Value
+		}
+		if IsEmptyParamValue(val) {
+			allErrs = append(allErrs, field.Required(fldPath, fmt.Sprintf("parameter %s must have a value", param.Name)))
+		}
+	}
+
+	return allErrs
+}
@@ -3,4 +3,47 @@ package internal
 const (
 	ClaimFinalizer = "clustertemplateclaims.tmax.io/finalizer"
 	ClaimLabel     = "clustertemplateclaims.tmax.io/claim"
+
+	// Labels set on every object created by a template instance.
+	// The owner label is only set if its value fits in a label value, and the owner annotation always has the instance name.
+	InstanceOwnerLabel      = "owner"
+	InstanceNamespaceLabel  = "templateinstances.tmax.io/namespace"
+	InstanceOwnerAnnotation = "templateinstances.tmax.io/owner"
+
+	// Objects annotated with keep policy are not deleted when they are removed from the template
+	ResourcePolicyAnnotation = "templateinstances.tmax.io/resource-policy"
+	ResourcePolicyKeep       = "keep"
+
+	// Objects are applied in ascending order of waves, and each wave is applied after the objects of the previous waves are ready
+	WaveAnnotation = "templateinstances.tmax.io/wave"
+	// Objects are applied after the objects they depend on (comma separated kind/name of objects in the template) are ready
+	DependsOnAnnotation = "templateinstances.tmax.io/depends-on"
+
+	// Hook objects are not created with the other objects, but run at the phases (comma separated) of the annotation
+	HookAnnotation = "templateinstances.tmax.io/hook"
+	// Hook objects are deleted before they run again (before-hook-creation), or after they succeed (hook-succeeded) or fail (hook-failed)
+	HookDeletePolicyAnnotation   = "templateinstances.tmax.io/hook-delete-policy"
+	HookDeleteBeforeHookCreation = "before-hook-creation"
+	HookDeleteSucceeded          = "hook-succeeded"
+	HookDeleteFailed             = "hook-failed"
+	// HookFinalizer keeps the template instance until its pre-delete hooks are done
+	HookFinalizer = "templateinstances.tmax.io/pre-delete-hook"
+	// GitopsFinalizer keeps the template instance until the files committed for it are removed from the git repo
+	GitopsFinalizer = "templateinstances.tmax.io/gitops"
+)
+
+const (
+	// Labels and annotations set on template instances provisioned by the service broker
+	BrokerInstanceLabel     = "servicebroker.tmax.io/instance-id"
+	BrokerServiceAnnotation = "servicebroker.tmax.io/service-id"
+	BrokerPlanAnnotation    = "servicebroker.tmax.io/plan-id"
 )
+
+// BindingLabel is set on secrets of template bindings with the name of the binding
+const BindingLabel = "templatebindings.tmax.io/binding"
+
+// GeneratedLabel is set on secrets of generated parameter values with the name of the template instance
+const GeneratedLabel = "templateinstances.tmax.io/generated"
+
+// SnapshotLabel is set on secrets of the snapshot of objects before they are applied with the name of the template instance
+const SnapshotLabel = "templateinstances.tmax.io/snapshot"
@@ -18,10 +18,13 @@ package main
 
 import (
 	"flag"
+	"github.com/tmax-cloud/template-operator/broker"
 	"github.com/tmax-cloud/template-operator/controllers/clustertemplate"
 	"github.com/tmax-cloud/template-operator/controllers/clustertemplateclaim"
 	"github.com/tmax-cloud/template-operator/controllers/template"
+	"github.com/tmax-cloud/template-operator/controllers/templatebinding"
 	"github.com/tmax-cloud/template-operator/controllers/templateinstance"
+	"github.com/tmax-cloud/template-operator/webhooks"
 	"os"
 
 	"k8s.io/apimachinery/pkg/runtime"
@@ -50,10 +53,26 @@ func init() {
 func main() {
 	var metricsAddr string
 	var enableLeaderElection bool
+	var enableWebhook bool
+	var brokerAddr string
+	var brokerInsecure bool
+	var allowApplicationOverrides bool
 	flag.StringVar(&metricsAddr, "metrics-addr", ":8080", "The address the metric endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "enable-leader-election", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.BoolVar(&enableWebhook, "enable-webhook", false,
+		"Enable validating admission webhooks. "+
+			"Serving certificates must be mounted on /tmp/k8s-webhook-server/serving-certs.")
+	flag.StringVar(&brokerAddr, "broker-addr", "",
+		"The address the Open Service Broker API server binds to. The broker is disabled if empty. "+
+			"Basic auth credentials are read from BROKER_USERNAME and BROKER_PASSWORD environment variables.")
+	flag.BoolVar(&brokerInsecure, "broker-insecure", false,
+		"Serve the Open Service Broker API without authentication if BROKER_USERNAME is not set. "+
+			"Anyone who can reach the broker can create template instances in any namespace.")
+	flag.BoolVar(&allowApplicationOverrides, "gitops-application-overrides", false,
+		"Allow template instances to set the namespace, project and destination of Argo CD Applications. "+
+			"Applications deploy the objects to the namespace of the instance in the cluster if not allowed.")
 	opts := zap.Options{
 		Development: false,
 	}
@@ -90,9 +109,10 @@ func main() {
 		os.Exit(1)
 	}
 	if err = (&templateinstance.TemplateInstanceReconciler{
-		Client: mgr.GetClient(),
-		Log:    ctrl.Log.WithName("controllers").WithName("TemplateInstance"),
-		Scheme: mgr.GetScheme(),
+		Client:                    mgr.GetClient(),
+		Log:                       ctrl.Log.WithName("controllers").WithName("TemplateInstance"),
+		Scheme:                    mgr.GetScheme(),
+		AllowApplicationOverrides: allowApplicationOverrides,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "TemplateInstance")
 		os.Exit(1)
@@ -105,6 +125,48 @@ func main() {
 		setupLog.Error(err, "unable to create controller", "controller", "ClusterTemplateClaim")
 		os.Exit(1)
 	}
+	if err = (&templatebinding.TemplateBindingReconciler{
+		Client: mgr.GetClient(),
+		Log:    ctrl.Log.WithName("controllers").WithName("TemplateBinding"),
+		Scheme: mgr.GetScheme(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "TemplateBinding")
+		os.Exit(1)
+	}
+	if enableWebhook {
+		if err = (&webhooks.TemplateValidator{
+			Log: ctrl.Log.WithName("webhooks").WithName("Template"),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Template")
+			os.Exit(1)
+		}
+		if err = (&webhooks.TemplateInstanceValidator{
+			Client: mgr.GetClient(),
+			Log:    ctrl.Log.WithName("webhooks").WithName("TemplateInstance"),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "TemplateInstance")
+			os.Exit(1)
+		}
+		if err = (&webhooks.TemplateRevisionValidator{
+			Log: ctrl.Log.WithName("webhooks").WithName("TemplateRevision"),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "TemplateRevision")
+			os.Exit(1)
+		}
+	}
+	if len(brokerAddr) != 0 {
+		if err = mgr.Add(&broker.Server{
+			Client:   mgr.GetClient(),
+			Log:      ctrl.Log.WithName("broker"),
+			Addr:     brokerAddr,
+			Username: os.Getenv("BROKER_USERNAME"),
+			Password: os.Getenv("BROKER_PASSWORD"),
+			Insecure: brokerInsecure,
+		}); err != nil {
+			setupLog.Error(err, "unable to create service broker")
+			os.Exit(1)
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	setupLog.Info("starting manager")
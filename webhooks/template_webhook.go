@@ -0,0 +1,93 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhooks
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/internal"
+)
+
+const templateValidatePath = "/validate-tmax-io-v1-template"
+
+// +kubebuilder:webhook:path=/validate-tmax-io-v1-template,mutating=false,failurePolicy=fail,groups=tmax.io,resources=templates;clustertemplates,verbs=create;update,versions=v1,name=vtemplate.tmax.io
+
+// TemplateValidator validates Template and ClusterTemplate objects
+type TemplateValidator struct {
+	Log     logr.Logger
+	decoder *admission.Decoder
+}
+
+func (v *TemplateValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	reqLogger := v.Log.WithValues("Request.Kind", req.Kind.Kind, "Request.Namespace", req.Namespace, "Request.Name", req.Name)
+
+	var spec *tmplv1.TemplateSpec
+	switch req.Kind.Kind {
+	case "Template":
+		template := &tmplv1.Template{}
+		if err := v.decoder.Decode(req, template); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		spec = &template.TemplateSpec
+	case "ClusterTemplate":
+		template := &tmplv1.ClusterTemplate{}
+		if err := v.decoder.Decode(req, template); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		spec = &template.TemplateSpec
+	default:
+		return admission.Allowed("")
+	}
+
+	if errs := internal.ValidateTemplateSpec(spec); len(errs) != 0 {
+		reqLogger.Info("invalid template", "errors", errs.ToAggregate().Error())
+		return invalidResponse(schema.GroupKind{Group: req.Kind.Group, Kind: req.Kind.Kind}, req.Name, errs)
+	}
+	return admission.Allowed("")
+}
+
+func (v *TemplateValidator) SetupWithManager(mgr ctrl.Manager) error {
+	decoder, err := admission.NewDecoder(mgr.GetScheme())
+	if err != nil {
+		return err
+	}
+	v.decoder = decoder
+	mgr.GetWebhookServer().Register(templateValidatePath, &webhook.Admission{Handler: v})
+	return nil
+}
+
+// invalidResponse denies the request with a StatusError so that kubectl shows every field path
+func invalidResponse(gk schema.GroupKind, name string, errs field.ErrorList) admission.Response {
+	statusErr := errors.NewInvalid(gk, name, errs)
+	return admission.Response{
+		AdmissionResponse: admissionv1beta1.AdmissionResponse{
+			Allowed: false,
+			Result:  &statusErr.ErrStatus,
+		},
+	}
+}
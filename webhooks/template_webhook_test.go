@@ -0,0 +1,200 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	runtime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/scheme"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func newAdmissionRequest(t *testing.T, kind string, obj runtime.Object) admission.Request {
+	raw, err := json.Marshal(obj)
+	require.NoError(t, err)
+	return admission.Request{
+		AdmissionRequest: admissionv1beta1.AdmissionRequest{
+			Kind:      metav1.GroupVersionKind{Group: "tmax.io", Version: "v1", Kind: kind},
+			Operation: admissionv1beta1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+}
+
+func TestTemplateValidator(t *testing.T) {
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, &tmplv1.Template{}, &tmplv1.ClusterTemplate{})
+	decoder, err := admission.NewDecoder(s)
+	require.NoError(t, err)
+
+	v := &TemplateValidator{
+		Log:     logf.Log.WithName("test-logger"),
+		decoder: decoder,
+	}
+
+	valid := &tmplv1.Template{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "tmax.io/v1", Kind: "Template"},
+		ObjectMeta: metav1.ObjectMeta{Name: "valid", Namespace: "test-ns"},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"kind": "Service", "apiVersion": "v1", "metadata": { "name": "${NAME}"}}`)},
+			},
+			Object: []string{`{"kind": "Deployment", "apiVersion": "apps/v1", "metadata": {"name": {{ .NAME | default .Instance.Name | quote }}}}`},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "NAME", ValueType: "string", Regex: "^[a-z]+$"},
+			},
+		},
+	}
+	res := v.Handle(context.TODO(), newAdmissionRequest(t, "Template", valid))
+	assert.True(t, res.Allowed, "valid template is denied")
+
+	invalid := &tmplv1.ClusterTemplate{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "tmax.io/v1", Kind: "ClusterTemplate"},
+		ObjectMeta: metav1.ObjectMeta{Name: "invalid"},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"apiVersion": "v1"}`)},
+				{Raw: []byte(`{"kind": "Service", "apiVersion": "v1", "metadata": { "name": "${UNKNOWN}"}}`)},
+			},
+			Object: []string{`{{ .NAME `},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "NAME", ValueType: "bool"},
+				{Name: "NAME", Regex: "[a-z"},
+			},
+		},
+	}
+	res = v.Handle(context.TODO(), newAdmissionRequest(t, "ClusterTemplate", invalid))
+	require.False(t, res.Allowed, "invalid template is allowed")
+
+	msg := res.Result.Message
+	assert.Contains(t, msg, "objects[0]")
+	assert.Contains(t, msg, "objects[1]")
+	assert.Contains(t, msg, "UNKNOWN")
+	assert.Contains(t, msg, "object[0]")
+	assert.Contains(t, msg, "parameters[0].valueType")
+	assert.Contains(t, msg, "parameters[1].name")
+	assert.Contains(t, msg, "parameters[1].regex")
+	assert.Len(t, res.Result.Details.Causes, 6)
+
+	// functions out of the library are not allowed
+	res = v.Handle(context.TODO(), newAdmissionRequest(t, "Template", &tmplv1.Template{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "tmax.io/v1", Kind: "Template"},
+		ObjectMeta: metav1.ObjectMeta{Name: "unknown-func", Namespace: "test-ns"},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Object: []string{`{"kind": "ConfigMap", "data": {"home": "{{ env "HOME" }}"}}`},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "Instance", ValueType: "string"},
+			},
+		},
+	}))
+	require.False(t, res.Allowed, "template with unknown function is allowed")
+	assert.Contains(t, res.Result.Message, `function "env" not defined`)
+	assert.Contains(t, res.Result.Message, "reserved for instance metadata")
+
+	// default values are checked against the value type and schema
+	res = v.Handle(context.TODO(), newAdmissionRequest(t, "Template", &tmplv1.Template{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "tmax.io/v1", Kind: "Template"},
+		ObjectMeta: metav1.ObjectMeta{Name: "typed", Namespace: "test-ns"},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "ENABLED", ValueType: "boolean", Value: tmplv1.FromString("yes")},
+				{Name: "PORTS", ValueType: "array", Value: tmplv1.FromString(`[80, 70000]`),
+					Schema: &runtime.RawExtension{Raw: []byte(`{"items": {"type": "integer", "maximum": 65535}}`)}},
+				{Name: "MODE", Schema: &runtime.RawExtension{Raw: []byte(`{"pattern": "[a-"}`)}},
+				{Name: "TOKEN", ValueFrom: &tmplv1.ParamValueSource{SecretKeyRef: &corev1.SecretKeySelector{Key: "token"}}},
+				{Name: "PASSWORD", ValueType: "integer", Value: tmplv1.FromString("1"), Generate: &tmplv1.GenerateSpec{Type: "random"}},
+				{Name: "ID", Generate: &tmplv1.GenerateSpec{Type: "uuid", Length: 8}},
+				{Name: "SUFFIX", Generate: &tmplv1.GenerateSpec{Type: "hex"}},
+				{Name: "KEY", Generate: &tmplv1.GenerateSpec{Type: "random", Length: 1 << 20}},
+			},
+		},
+	}))
+	require.False(t, res.Allowed, "template with invalid default values is allowed")
+	assert.Contains(t, res.Result.Message, "parameters[0].value")
+	assert.Contains(t, res.Result.Message, "parameters[1].value")
+	assert.Contains(t, res.Result.Message, "parameters[2].schema")
+	assert.Contains(t, res.Result.Message, "parameters[3].valueFrom")
+	assert.Contains(t, res.Result.Message, "parameters[4].valueType")
+	assert.Contains(t, res.Result.Message, "parameters[4].value")
+	assert.Contains(t, res.Result.Message, "parameters[5].generate")
+	assert.Contains(t, res.Result.Message, "parameters[6].generate.type")
+	assert.Contains(t, res.Result.Message, "parameters[7].generate.length")
+
+	// plans must have unique names and values of declared parameters
+	res = v.Handle(context.TODO(), newAdmissionRequest(t, "Template", &tmplv1.Template{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "tmax.io/v1", Kind: "Template"},
+		ObjectMeta: metav1.ObjectMeta{Name: "plans", Namespace: "test-ns"},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Plans: []tmplv1.PlanSpec{
+				{Name: "small", Schemas: tmplv1.Schemas{ServiceInstance: tmplv1.ServiceInstanceSchema{
+					Create: tmplv1.SchemaParameters{Parameters: map[string]intstr.IntOrString{
+						"REPLICAS": intstr.FromString("many"),
+						"UNKNOWN":  intstr.FromString("value"),
+					}},
+				}}},
+				{Name: "small"},
+			},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "REPLICAS", ValueType: "integer"},
+			},
+		},
+	}))
+	require.False(t, res.Allowed, "template with invalid plans is allowed")
+	assert.Contains(t, res.Result.Message, "plans[0].schemas.service_instance.create.parameters[REPLICAS]")
+	assert.Contains(t, res.Result.Message, "plans[0].schemas.service_instance.create.parameters[UNKNOWN]")
+	assert.Contains(t, res.Result.Message, "plans[1].name")
+
+	// credentials and outputs are taken from a value or a JSONPath of an object
+	res = v.Handle(context.TODO(), newAdmissionRequest(t, "Template", &tmplv1.Template{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "tmax.io/v1", Kind: "Template"},
+		ObjectMeta: metav1.ObjectMeta{Name: "credentials", Namespace: "test-ns"},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Credentials: []tmplv1.OutputSpec{
+				{Name: "host", Value: "${UNKNOWN}.svc"},
+				{Name: "port", ObjectRef: &tmplv1.OutputObjectRef{Kind: "Service", Name: "${NAME}"}, JSONPath: "{.spec.ports[0"},
+				{Name: "port", Value: "80", ObjectRef: &tmplv1.OutputObjectRef{Kind: "Service", Name: "${NAME}"}},
+			},
+			Outputs: []tmplv1.OutputSpec{
+				{Name: "clusterIP", ObjectRef: &tmplv1.OutputObjectRef{Kind: "Service", Name: "${NAME}"}},
+				{Name: "password", ObjectRef: &tmplv1.OutputObjectRef{Kind: "Secret", Name: "${NAME}"}, JSONPath: ".data.password"},
+			},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "NAME", ValueType: "string"},
+			},
+		},
+	}))
+	require.False(t, res.Allowed, "template with invalid credentials is allowed")
+	assert.Contains(t, res.Result.Message, "credentials[0].value")
+	assert.Contains(t, res.Result.Message, "credentials[1].jsonPath")
+	assert.Contains(t, res.Result.Message, "credentials[2].name")
+	assert.Contains(t, res.Result.Message, "credentials[2].value")
+	assert.Contains(t, res.Result.Message, "outputs[0].jsonPath")
+	assert.Contains(t, res.Result.Message, "outputs[1].objectRef")
+
+	// hook objects must have supported phases and delete policies
+	res = v.Handle(context.TODO(), newAdmissionRequest(t, "Template", &tmplv1.Template{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "tmax.io/v1", Kind: "Template"},
+		ObjectMeta: metav1.ObjectMeta{Name: "hooks", Namespace: "test-ns"},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Objects: []runtime.RawExtension{
+				{Raw: []byte(`{"kind": "Job", "apiVersion": "batch/v1", "metadata": {"name": "migrate", "annotations": {"templateinstances.tmax.io/hook": "pre-install, pre-upgrade"}}}`)},
+				{Raw: []byte(`{"kind": "Job", "apiVersion": "batch/v1", "metadata": {"name": "seed", "annotations": {"templateinstances.tmax.io/hook": "post-upgrade", "templateinstances.tmax.io/hook-delete-policy": "always"}}}`)},
+				{Raw: []byte(`{"kind": "Service", "apiVersion": "v1", "metadata": {"name": "svc", "annotations": {"templateinstances.tmax.io/hook-delete-policy": "hook-succeeded"}}}`)},
+			},
+		},
+	}))
+	require.False(t, res.Allowed, "template with invalid hooks is allowed")
+	assert.NotContains(t, res.Result.Message, "objects[0]")
+	assert.Contains(t, res.Result.Message, "post-upgrade")
+	assert.Contains(t, res.Result.Message, "always")
+	assert.Contains(t, res.Result.Message, "objects[2].metadata.annotations[templateinstances.tmax.io/hook-delete-policy]")
+}
@@ -0,0 +1,180 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhooks
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/go-logr/logr"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	"github.com/tmax-cloud/template-operator/internal"
+)
+
+const templateInstanceValidatePath = "/validate-tmax-io-v1-templateinstance"
+
+// +kubebuilder:webhook:path=/validate-tmax-io-v1-templateinstance,mutating=false,failurePolicy=fail,groups=tmax.io,resources=templateinstances,verbs=create;update,versions=v1,name=vtemplateinstance.tmax.io
+
+// TemplateInstanceValidator validates parameters of TemplateInstance against the referenced template
+type TemplateInstanceValidator struct {
+	Client  client.Client
+	Log     logr.Logger
+	decoder *admission.Decoder
+}
+
+func (v *TemplateInstanceValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	reqLogger := v.Log.WithValues("Request.Namespace", req.Namespace, "Request.Name", req.Name)
+
+	instance := &tmplv1.TemplateInstance{}
+	if err := v.decoder.Decode(req, instance); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	// 삭제 중인 instance는 finalizer 정리를 위해 항상 허용
+	if instance.GetDeletionTimestamp() != nil {
+		return admission.Allowed("")
+	}
+
+	if errs := v.validate(ctx, instance); len(errs) != 0 {
+		reqLogger.Info("invalid template instance", "errors", errs.ToAggregate().Error())
+		return invalidResponse(schema.GroupKind{Group: req.Kind.Group, Kind: req.Kind.Kind}, req.Name, errs)
+	}
+	return admission.Allowed("")
+}
+
+func (v *TemplateInstanceValidator) validate(ctx context.Context, instance *tmplv1.TemplateInstance) field.ErrorList {
+	specPath := field.NewPath("spec")
+
+	// template/clustertemplate both empty or inserted
+	if (instance.Spec.ClusterTemplate == nil) == (instance.Spec.Template == nil) {
+		return field.ErrorList{
+			field.Invalid(specPath, "", "you should insert either template or clustertemplate"),
+		}
+	}
+
+	// rollback is allowed only to the revisions in history
+	if rollbackTo := instance.Spec.RollbackTo; rollbackTo != 0 {
+		found := false
+		for _, rev := range instance.Status.History {
+			found = found || rev.Revision == rollbackTo
+		}
+		if !found {
+			return field.ErrorList{field.NotFound(specPath.Child("rollbackTo"), rollbackTo)}
+		}
+	}
+
+	// objects created in the cluster or committed to the git repo would be left behind when the mode is changed
+	gitops := len(instance.Spec.Gitops.SourceGitRepo) != 0
+	if (gitops && len(instance.Status.Objects) != 0) || (!gitops && instance.Status.Gitops != nil) {
+		return field.ErrorList{field.Forbidden(specPath.Child("gitops", "sourcegitrepo"), "gitops cannot be enabled or disabled after objects are deployed")}
+	}
+	if _, err := internal.ParseCommitMessage(instance.Spec.Gitops); gitops && err != nil {
+		return field.ErrorList{field.Invalid(specPath.Child("gitops", "commitMessage"), instance.Spec.Gitops.CommitMessage, err.Error())}
+	}
+
+	var objectInfo *tmplv1.ObjectInfo
+	var fldPath *field.Path
+	var templateParams []tmplv1.ParamSpec
+	var templatePlans []tmplv1.PlanSpec
+	var activeInfo *tmplv1.ObjectInfo
+
+	if instance.Spec.ClusterTemplate != nil {
+		objectInfo = instance.Spec.ClusterTemplate
+		fldPath = specPath.Child("clustertemplate")
+		activeInfo = instance.Status.ClusterTemplate
+		if instance.Status.ClusterTemplate != nil && !internal.UpgradeRequested(objectInfo, instance.Status.ClusterTemplate) { // already instantiated with snapshot
+			templateParams = instance.Status.ClusterTemplate.Parameters
+			templatePlans = instance.Status.ClusterTemplate.Plans
+		} else if len(objectInfo.Version) != 0 {
+			revision, _, err := internal.GetTemplateRevision(v.Client, "", objectInfo.Metadata.Name, objectInfo.Version)
+			if err != nil {
+				return field.ErrorList{field.Invalid(fldPath.Child("version"), objectInfo.Version, err.Error())}
+			}
+			templateParams = revision.Template.Parameters
+			templatePlans = revision.Template.Plans
+		} else {
+			template := &tmplv1.ClusterTemplate{}
+			if err := v.Client.Get(ctx, types.NamespacedName{Name: objectInfo.Metadata.Name}, template); err != nil {
+				return templateGetError(fldPath, objectInfo.Metadata.Name, err)
+			}
+			templateParams = template.Parameters
+			templatePlans = template.Plans
+		}
+	} else {
+		objectInfo = instance.Spec.Template
+		fldPath = specPath.Child("template")
+		activeInfo = instance.Status.Template
+		if instance.Status.Template != nil && !internal.UpgradeRequested(objectInfo, instance.Status.Template) {
+			templateParams = instance.Status.Template.Parameters
+			templatePlans = instance.Status.Template.Plans
+		} else if len(objectInfo.Version) != 0 {
+			revision, _, err := internal.GetTemplateRevision(v.Client, instance.Namespace, objectInfo.Metadata.Name, objectInfo.Version)
+			if err != nil {
+				return field.ErrorList{field.Invalid(fldPath.Child("version"), objectInfo.Version, err.Error())}
+			}
+			templateParams = revision.Template.Parameters
+			templatePlans = revision.Template.Plans
+		} else {
+			template := &tmplv1.Template{}
+			if err := v.Client.Get(ctx, types.NamespacedName{
+				Namespace: instance.Namespace,
+				Name:      objectInfo.Metadata.Name,
+			}, template); err != nil {
+				return templateGetError(fldPath, objectInfo.Metadata.Name, err)
+			}
+			templateParams = template.Parameters
+			templatePlans = template.Plans
+		}
+	}
+
+	activePlan := ""
+	if activeInfo != nil {
+		activePlan = activeInfo.Plan
+	}
+	plan, err := internal.SelectPlan(templatePlans, objectInfo.Plan, activePlan)
+	if err != nil {
+		return field.ErrorList{field.Invalid(fldPath.Child("plan"), objectInfo.Plan, err.Error())}
+	}
+
+	return internal.ValidateInstanceParameters(internal.ApplyPlanParameters(templateParams, plan), objectInfo.Parameters, fldPath.Child("parameters"))
+}
+
+func templateGetError(fldPath *field.Path, name string, err error) field.ErrorList {
+	namePath := fldPath.Child("metadata", "name")
+	if errors.IsNotFound(err) {
+		return field.ErrorList{field.NotFound(namePath, name)}
+	}
+	return field.ErrorList{field.InternalError(namePath, err)}
+}
+
+func (v *TemplateInstanceValidator) SetupWithManager(mgr ctrl.Manager) error {
+	decoder, err := admission.NewDecoder(mgr.GetScheme())
+	if err != nil {
+		return err
+	}
+	v.decoder = decoder
+	mgr.GetWebhookServer().Register(templateInstanceValidatePath, &webhook.Admission{Handler: v})
+	return nil
+}
@@ -0,0 +1,236 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	runtime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestTemplateInstanceValidator(t *testing.T) {
+	var (
+		templateName = "test-template"
+		namespace    = "test-ns"
+	)
+
+	template := &tmplv1.Template{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      templateName,
+			Namespace: namespace,
+		},
+		TemplateSpec: tmplv1.TemplateSpec{
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "NAME", ValueType: "string", Required: true, Value: tmplv1.FromString(""), Regex: "^[a-z-]+$"},
+				{Name: "REPLICAS", ValueType: "number", Value: tmplv1.FromInt(1)},
+				{Name: "PORT", ValueType: "number", Required: true, Value: tmplv1.FromString("")},
+				{Name: "PASSWORD", Required: true, Generate: &tmplv1.GenerateSpec{Type: "random"}},
+			},
+			Plans: []tmplv1.PlanSpec{
+				{
+					Name: "web",
+					Schemas: tmplv1.Schemas{ServiceInstance: tmplv1.ServiceInstanceSchema{
+						Create: tmplv1.SchemaParameters{Parameters: map[string]intstr.IntOrString{"PORT": intstr.FromInt(80)}},
+					}},
+				},
+			},
+		},
+	}
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, &tmplv1.Template{}, &tmplv1.TemplateInstance{})
+	decoder, err := admission.NewDecoder(s)
+	require.NoError(t, err)
+
+	v := &TemplateInstanceValidator{
+		Client:  fake.NewFakeClientWithScheme(s, []runtime.Object{template}...),
+		Log:     logf.Log.WithName("test-logger"),
+		decoder: decoder,
+	}
+
+	newInstance := func(spec tmplv1.TemplateInstanceSpec) *tmplv1.TemplateInstance {
+		return &tmplv1.TemplateInstance{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "tmax.io/v1", Kind: "TemplateInstance"},
+			ObjectMeta: metav1.ObjectMeta{Name: "test-instance", Namespace: namespace},
+			Spec:       spec,
+		}
+	}
+
+	// valid parameters
+	valid := newInstance(tmplv1.TemplateInstanceSpec{
+		Template: &tmplv1.ObjectInfo{
+			Metadata: tmplv1.MetadataSpec{Name: templateName},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "NAME", Value: tmplv1.FromString("nginx")},
+				{Name: "PORT", Value: tmplv1.FromString("8080")},
+			},
+		},
+	})
+	// required parameters with generate option need no value
+	res := v.Handle(context.TODO(), newAdmissionRequest(t, "TemplateInstance", valid))
+	assert.True(t, res.Allowed, "valid instance is denied")
+
+	// neither template nor clustertemplate
+	res = v.Handle(context.TODO(), newAdmissionRequest(t, "TemplateInstance", newInstance(tmplv1.TemplateInstanceSpec{})))
+	assert.False(t, res.Allowed, "instance without template is allowed")
+
+	// template does not exist
+	res = v.Handle(context.TODO(), newAdmissionRequest(t, "TemplateInstance", newInstance(tmplv1.TemplateInstanceSpec{
+		Template: &tmplv1.ObjectInfo{Metadata: tmplv1.MetadataSpec{Name: "no-template"}},
+	})))
+	require.False(t, res.Allowed, "instance with unknown template is allowed")
+	assert.Contains(t, res.Result.Message, "spec.template.metadata.name")
+
+	// every violation is returned at once
+	invalid := newInstance(tmplv1.TemplateInstanceSpec{
+		Template: &tmplv1.ObjectInfo{
+			Metadata: tmplv1.MetadataSpec{Name: templateName},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "NAME", Value: tmplv1.FromString("Nginx")},
+				{Name: "REPLICAS", Value: tmplv1.FromString("two")},
+				{Name: "UNKNOWN", Value: tmplv1.FromString("value")},
+			},
+		},
+	})
+	res = v.Handle(context.TODO(), newAdmissionRequest(t, "TemplateInstance", invalid))
+	require.False(t, res.Allowed, "invalid instance is allowed")
+
+	msg := res.Result.Message
+	assert.Contains(t, msg, "spec.template.parameters[0].value")
+	assert.Contains(t, msg, "spec.template.parameters[1].value")
+	assert.Contains(t, msg, "spec.template.parameters[2].name")
+	assert.Contains(t, msg, "parameter PORT must have a value")
+	assert.Len(t, res.Result.Details.Causes, 4)
+
+	// values of the plan are used for required parameters
+	res = v.Handle(context.TODO(), newAdmissionRequest(t, "TemplateInstance", newInstance(tmplv1.TemplateInstanceSpec{
+		Template: &tmplv1.ObjectInfo{
+			Metadata:   tmplv1.MetadataSpec{Name: templateName},
+			Plan:       "web",
+			Parameters: []tmplv1.ParamSpec{{Name: "NAME", Value: tmplv1.FromString("nginx")}},
+		},
+	})))
+	assert.True(t, res.Allowed, "instance with plan is denied")
+
+	res = v.Handle(context.TODO(), newAdmissionRequest(t, "TemplateInstance", newInstance(tmplv1.TemplateInstanceSpec{
+		Template: &tmplv1.ObjectInfo{
+			Metadata:   tmplv1.MetadataSpec{Name: templateName},
+			Plan:       "batch",
+			Parameters: []tmplv1.ParamSpec{{Name: "NAME", Value: tmplv1.FromString("nginx")}},
+		},
+	})))
+	require.False(t, res.Allowed, "instance with unknown plan is allowed")
+	assert.Contains(t, res.Result.Message, "spec.template.plan")
+
+	// values can be taken from secrets and config maps, and sensitive values are not shown
+	res = v.Handle(context.TODO(), newAdmissionRequest(t, "TemplateInstance", newInstance(tmplv1.TemplateInstanceSpec{
+		Template: &tmplv1.ObjectInfo{
+			Metadata: tmplv1.MetadataSpec{Name: templateName},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "NAME", ValueFrom: &tmplv1.ParamValueSource{SecretKeyRef: &corev1.SecretKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "app"}, Key: "name",
+				}}},
+				{Name: "PORT", ValueFrom: &tmplv1.ParamValueSource{ConfigMapKeyRef: &corev1.ConfigMapKeySelector{
+					LocalObjectReference: corev1.LocalObjectReference{Name: "app"}, Key: "port",
+				}}},
+			},
+		},
+	})))
+	assert.True(t, res.Allowed, "instance with valueFrom is denied")
+
+	res = v.Handle(context.TODO(), newAdmissionRequest(t, "TemplateInstance", newInstance(tmplv1.TemplateInstanceSpec{
+		Template: &tmplv1.ObjectInfo{
+			Metadata: tmplv1.MetadataSpec{Name: templateName},
+			Parameters: []tmplv1.ParamSpec{
+				{Name: "NAME", Value: tmplv1.FromString("Secret"), Sensitive: true},
+				{Name: "PORT", Value: tmplv1.FromString("80"), ValueFrom: &tmplv1.ParamValueSource{
+					SecretKeyRef:    &corev1.SecretKeySelector{Key: "port"},
+					ConfigMapKeyRef: &corev1.ConfigMapKeySelector{LocalObjectReference: corev1.LocalObjectReference{Name: "app"}},
+				}},
+			},
+		},
+	})))
+	require.False(t, res.Allowed, "instance with invalid valueFrom is allowed")
+	assert.Contains(t, res.Result.Message, "spec.template.parameters[0].value")
+	assert.NotContains(t, res.Result.Message, "Secret")
+	assert.Contains(t, res.Result.Message, "spec.template.parameters[1].value")
+	assert.Contains(t, res.Result.Message, "spec.template.parameters[1].valueFrom")
+
+	// rollback is allowed only to the revisions in history
+	rollback := valid.DeepCopy()
+	rollback.Spec.RollbackTo = 2
+	rollback.Status.History = []tmplv1.InstanceRevisionSpec{{Revision: 1}, {Revision: 2}}
+	res = v.Handle(context.TODO(), newAdmissionRequest(t, "TemplateInstance", rollback))
+	assert.True(t, res.Allowed, "rollback to revision in history is denied")
+
+	rollback.Spec.RollbackTo = 3
+	res = v.Handle(context.TODO(), newAdmissionRequest(t, "TemplateInstance", rollback))
+	require.False(t, res.Allowed, "rollback to unknown revision is allowed")
+	assert.Contains(t, res.Result.Message, "spec.rollbackTo")
+
+	// gitops mode cannot be changed after objects are deployed
+	gitops := valid.DeepCopy()
+	gitops.Status.Gitops = &tmplv1.GitopsStatusSpec{GitopsSpec: tmplv1.GitopsSpec{SourceGitRepo: "https://github.com/user/repo"}}
+	res = v.Handle(context.TODO(), newAdmissionRequest(t, "TemplateInstance", gitops))
+	require.False(t, res.Allowed, "disabling gitops is allowed")
+	assert.Contains(t, res.Result.Message, "spec.gitops.sourcegitrepo")
+
+	gitops.Spec.Gitops = gitops.Status.Gitops.GitopsSpec
+	res = v.Handle(context.TODO(), newAdmissionRequest(t, "TemplateInstance", gitops))
+	assert.True(t, res.Allowed, "gitops instance is denied")
+
+	gitops.Spec.Gitops.CommitMessage = "{{ .Name"
+	res = v.Handle(context.TODO(), newAdmissionRequest(t, "TemplateInstance", gitops))
+	require.False(t, res.Allowed, "invalid commit message template is allowed")
+	assert.Contains(t, res.Result.Message, "spec.gitops.commitMessage")
+}
+
+func TestTemplateInstanceValidatorMissingValue(t *testing.T) {
+	// the value key is left out in both the template and the instance
+	template := &tmplv1.Template{}
+	require.NoError(t, json.Unmarshal([]byte(`{"apiVersion": "tmax.io/v1", "kind": "Template",
+		"metadata": {"name": "test-template", "namespace": "test-ns"},
+		"parameters": [{"name": "NAME", "required": true}, {"name": "PORT", "valueType": "number", "required": true}]}`), template))
+
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, &tmplv1.Template{}, &tmplv1.TemplateInstance{})
+	decoder, err := admission.NewDecoder(s)
+	require.NoError(t, err)
+
+	v := &TemplateInstanceValidator{
+		Client:  fake.NewFakeClientWithScheme(s, template),
+		Log:     logf.Log.WithName("test-logger"),
+		decoder: decoder,
+	}
+	newRequest := func(params string) admission.Request {
+		return admission.Request{
+			AdmissionRequest: admissionv1beta1.AdmissionRequest{
+				Kind:      metav1.GroupVersionKind{Group: "tmax.io", Version: "v1", Kind: "TemplateInstance"},
+				Operation: admissionv1beta1.Create,
+				Object: runtime.RawExtension{Raw: []byte(`{"apiVersion": "tmax.io/v1", "kind": "TemplateInstance",
+					"metadata": {"name": "test-instance", "namespace": "test-ns"},
+					"spec": {"template": {"metadata": {"name": "test-template"}, "parameters": ` + params + `}}}`)},
+			},
+		}
+	}
+
+	res := v.Handle(context.TODO(), newRequest(`[{"name": "NAME"}]`))
+	require.False(t, res.Allowed, "instance without values of required parameters is allowed")
+	assert.Contains(t, res.Result.Message, "parameter NAME must have a value")
+	assert.Contains(t, res.Result.Message, "parameter PORT must have a value")
+
+	// an integer 0 is a value
+	res = v.Handle(context.TODO(), newRequest(`[{"name": "NAME", "value": "nginx"}, {"name": "PORT", "value": 0}]`))
+	assert.True(t, res.Allowed, res.Result.Message)
+}
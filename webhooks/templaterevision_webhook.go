@@ -0,0 +1,94 @@
+/*
+
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package webhooks
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+
+	"github.com/go-logr/logr"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+)
+
+const templateRevisionValidatePath = "/validate-tmax-io-v1-templaterevision"
+
+// +kubebuilder:webhook:path=/validate-tmax-io-v1-templaterevision,mutating=false,failurePolicy=fail,groups=tmax.io,resources=templaterevisions;clustertemplaterevisions,verbs=update,versions=v1,name=vtemplaterevision.tmax.io
+
+// TemplateRevisionValidator keeps TemplateRevision and ClusterTemplateRevision objects immutable
+type TemplateRevisionValidator struct {
+	Log     logr.Logger
+	decoder *admission.Decoder
+}
+
+func (v *TemplateRevisionValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	if req.Operation != admissionv1beta1.Update {
+		return admission.Allowed("")
+	}
+
+	var spec, oldSpec *tmplv1.TemplateRevisionSpec
+	switch req.Kind.Kind {
+	case "TemplateRevision":
+		revision, old := &tmplv1.TemplateRevision{}, &tmplv1.TemplateRevision{}
+		if err := v.decode(req, revision, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		spec, oldSpec = &revision.Spec, &old.Spec
+	case "ClusterTemplateRevision":
+		revision, old := &tmplv1.ClusterTemplateRevision{}, &tmplv1.ClusterTemplateRevision{}
+		if err := v.decode(req, revision, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+		spec, oldSpec = &revision.Spec, &old.Spec
+	default:
+		return admission.Allowed("")
+	}
+
+	if !reflect.DeepEqual(spec, oldSpec) {
+		v.Log.Info("denied to change revision", "Request.Kind", req.Kind.Kind, "Request.Namespace", req.Namespace, "Request.Name", req.Name)
+		return invalidResponse(schema.GroupKind{Group: req.Kind.Group, Kind: req.Kind.Kind}, req.Name, field.ErrorList{
+			field.Forbidden(field.NewPath("spec"), "revision is immutable, change the version of the template instead"),
+		})
+	}
+	return admission.Allowed("")
+}
+
+// decode decodes both the new and the old object of the update request
+func (v *TemplateRevisionValidator) decode(req admission.Request, obj, old runtime.Object) error {
+	if err := v.decoder.DecodeRaw(req.Object, obj); err != nil {
+		return err
+	}
+	return v.decoder.DecodeRaw(req.OldObject, old)
+}
+
+func (v *TemplateRevisionValidator) SetupWithManager(mgr ctrl.Manager) error {
+	decoder, err := admission.NewDecoder(mgr.GetScheme())
+	if err != nil {
+		return err
+	}
+	v.decoder = decoder
+	mgr.GetWebhookServer().Register(templateRevisionValidatePath, &webhook.Admission{Handler: v})
+	return nil
+}
@@ -0,0 +1,65 @@
+package webhooks
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tmplv1 "github.com/tmax-cloud/template-operator/api/v1"
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	runtime "k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	logf "sigs.k8s.io/controller-runtime/pkg/runtime/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+func TestTemplateRevisionValidator(t *testing.T) {
+	s := scheme.Scheme
+	s.AddKnownTypes(tmplv1.SchemeBuilder.GroupVersion, &tmplv1.TemplateRevision{}, &tmplv1.ClusterTemplateRevision{})
+	decoder, err := admission.NewDecoder(s)
+	require.NoError(t, err)
+
+	v := &TemplateRevisionValidator{
+		Log:     logf.Log.WithName("test-logger"),
+		decoder: decoder,
+	}
+
+	old := &tmplv1.ClusterTemplateRevision{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "tmax.io/v1", Kind: "ClusterTemplateRevision"},
+		ObjectMeta: metav1.ObjectMeta{Name: "test-1.0"},
+		Spec: tmplv1.TemplateRevisionSpec{
+			TemplateName: "test",
+			Version:      "1.0",
+			Revision:     1,
+			Template: tmplv1.TemplateSpec{
+				Objects: []runtime.RawExtension{
+					{Raw: []byte(`{"kind": "Service", "apiVersion": "v1", "metadata": {"name": "${NAME}"}}`)},
+				},
+			},
+		},
+	}
+	updateRequest := func(obj *tmplv1.ClusterTemplateRevision) admission.Request {
+		req := newAdmissionRequest(t, "ClusterTemplateRevision", obj)
+		req.Operation = admissionv1beta1.Update
+		raw, err := json.Marshal(old)
+		require.NoError(t, err)
+		req.OldObject = runtime.RawExtension{Raw: raw}
+		return req
+	}
+
+	// metadata can be changed
+	labeled := old.DeepCopy()
+	labeled.Labels = map[string]string{"app": "test"}
+	res := v.Handle(context.TODO(), updateRequest(labeled))
+	assert.True(t, res.Allowed, "metadata change is denied")
+
+	// spec cannot be changed
+	changed := old.DeepCopy()
+	changed.Spec.Template.Objects = nil
+	res = v.Handle(context.TODO(), updateRequest(changed))
+	require.False(t, res.Allowed, "spec change is allowed")
+	assert.Contains(t, res.Result.Message, "revision is immutable")
+}